@@ -0,0 +1,121 @@
+// Package api serves the http endpoints of rmsloader
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/metrics"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/report"
+	"github.com/sirupsen/logrus"
+)
+
+// the time allowed for requests in flight to finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// DefaultAddr is the address the server listens on when the settings name none, only the local host reaches it
+const DefaultAddr = "127.0.0.1:8080"
+
+// Server holds the routes and their dependencies
+type Server struct {
+	db  *sqlx.DB
+	mux *http.ServeMux
+	// the bearer token of the /api endpoints and /metrics, they are open when it is empty
+	token string
+}
+
+// NewServer creates the api server on top of the database, a request for the data must carry
+// "Authorization: Bearer <token>" when token is set. /healthz and /readyz stay open for the probes.
+func NewServer(db *sqlx.DB, token string) *Server {
+	s := &Server{db: db, mux: http.NewServeMux(), token: token}
+	s.routes()
+	return s
+}
+
+// routes registers the endpoints
+func (s *Server) routes() {
+	s.mux.HandleFunc("GET /api/cdrs/export", s.handleExport)
+	s.mux.HandleFunc("GET /api/reports/daily", s.handleReport(report.PeriodDay))
+	s.mux.HandleFunc("GET /api/reports/monthly", s.handleReport(report.PeriodMonth))
+	s.mux.HandleFunc("GET /api/runs", s.handleRuns)
+	s.mux.HandleFunc("GET /api/runs/{id}", s.handleRun)
+	s.mux.HandleFunc("GET /healthz", s.handleHealthz)
+	s.mux.HandleFunc("GET /readyz", s.handleReadyz)
+	if model.Settings.Metrics.Enabled {
+		s.mux.Handle("GET /metrics", metrics.Handler())
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rmsloader"`)
+		writeError(w, apperr.New(apperr.RequestDenied, "api.ServeHTTP", "the request needs the api token"))
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorized tells whether r may be served, the probes are always served
+func (s *Server) authorized(r *http.Request) bool {
+	if s.token == "" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+		return true
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) == 1
+}
+
+// ListenAndServe serves h on addr until the context is cancelled
+func ListenAndServe(ctx context.Context, addr string, h http.Handler) error {
+	CallFrom := "api.ListenAndServe "
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		li.Logger.L.WithFields(logrus.Fields{"CallFrom": CallFrom, "addr": addr}).Info("api listening")
+		errs <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := srv.Shutdown(shutdownCtx)
+		if serveErr := <-errs; !errors.Is(serveErr, http.ErrServerClosed) && err == nil {
+			err = serveErr
+		}
+		return err
+	}
+}
+
+// writeJSON writes v as a json response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		li.Logger.L.WithFields(logrus.Fields{"err": err}).Warn("writing json response failed")
+	}
+}
+
+// writeError writes an error as a json response, the status and code come from the error catalogue
+// eg. {"error": "REQUEST_INVALID: ...", "code": "REQUEST_INVALID"}
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, apperr.HTTPStatus(err), map[string]string{
+		"error": err.Error(),
+		"code":  string(apperr.CodeOf(err)),
+	})
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// emptyDB is a sqlite database without tables, every query of the calls fails on it
+func emptyDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	store, err := dbs.Open(context.Background(), dbs.DriverSQLite, filepath.Join(t.TempDir(), "api.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DB().Close() })
+	return store.DB()
+}
+
+func TestTokenRequired(t *testing.T) {
+	s := NewServer(emptyDB(t), "s3cret")
+	tests := []struct {
+		path   string
+		auth   string
+		status int
+	}{
+		{"/healthz", "", http.StatusOK},
+		{"/api/runs", "", http.StatusUnauthorized},
+		{"/api/runs", "Bearer wrong", http.StatusUnauthorized},
+		{"/api/cdrs/export", "Basic s3cret", http.StatusUnauthorized},
+		{"/api/cdrs/export?format=xml", "Bearer s3cret", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s with %q answered %d, want %d", tt.path, tt.auth, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestExportFailureIsJSON(t *testing.T) {
+	s := NewServer(emptyDB(t), "")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/cdrs/export?format=csv", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("a failed export answered %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("a failed export is %q", got)
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != "" {
+		t.Errorf("a failed export is a download %q", got)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["code"] != "DB_READ" {
+		t.Errorf("a failed export wrote %q", rec.Body.String())
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	saved := model.PathVars
+	t.Cleanup(func() { model.PathVars = saved })
+	model.PathVars.LogPath = t.TempDir()
+	model.PathVars.DbLogs = "/logs/db.log"
+	model.PathVars.AnalysisLogs = ""
+	model.PathVars.OddDates = ""
+	model.PathVars.CSVPath = t.TempDir()
+	s := NewServer(emptyDB(t), "s3cret")
+	probe := func(path string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s wrote %q", path, rec.Body.String())
+		}
+		return rec.Code, body
+	}
+	if code, body := probe("/healthz"); code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("/healthz answered %d %v", code, body)
+	}
+	if code, body := probe("/readyz"); code != http.StatusOK || body["ready"] != true {
+		t.Errorf("/readyz answered %d %v", code, body)
+	}
+	model.PathVars.CSVPath = ""
+	if code, body := probe("/readyz"); code != http.StatusServiceUnavailable || body["ready"] != false {
+		t.Errorf("/readyz without a csv_path answered %d %v", code, body)
+	}
+	// liveness does not depend on the checks
+	if code, _ := probe("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz answered %d when not ready", code)
+	}
+}
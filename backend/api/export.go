@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/export"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/sirupsen/logrus"
+)
+
+// handleExport streams the filtered CDRs as a download.
+// GET /api/cdrs/export?from=2024-01-01&to=2024-02-01&extension=2001&format=xlsx&columns=time,source&tz=UTC&gzip=true
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	CallFrom := "api.handleExport "
+	filter, opts, err := export.ParseValues(r.URL.Query())
+	if err != nil {
+		writeError(w, apperr.Wrap(apperr.RequestInvalid, "api.handleExport", err))
+		return
+	}
+	out := &download{ResponseWriter: w, contentType: opts.ContentType(), name: opts.FileName(time.Now())}
+	count, err := export.Write(r.Context(), s.db, out, filter, opts)
+	if err != nil {
+		err = apperr.Wrap(apperr.DBRead, "api.handleExport", err)
+		li.Logger.L.WithFields(apperr.Fields(err)).WithFields(logrus.Fields{
+			"CallFrom": CallFrom,
+			"rows":     count,
+			"err":      err,
+		}).Error("export failed")
+		// the headers are gone once rows were streamed, all that is left is to log it
+		if !out.started {
+			writeError(w, err)
+		}
+		return
+	}
+	li.Logger.L.WithFields(logrus.Fields{
+		"CallFrom": CallFrom,
+		"rows":     count,
+		"format":   opts.Format,
+	}).Info("export complete")
+}
+
+// download sets the headers of the file on its first write, an export that fails before it wrote anything
+// still answers with a json error
+type download struct {
+	http.ResponseWriter
+	contentType string
+	name        string
+	started     bool
+}
+
+// Write implements io.Writer
+func (d *download) Write(p []byte) (int, error) {
+	if !d.started {
+		d.started = true
+		d.Header().Set("Content-Type", d.contentType)
+		d.Header().Set("Content-Disposition", `attachment; filename="`+d.name+`"`)
+	}
+	return d.ResponseWriter.Write(p)
+}
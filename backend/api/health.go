@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/pienaahj/rmsloader/backend/health"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/sirupsen/logrus"
+)
+
+// handleHealthz reports that the process is up and serving.
+// GET /healthz
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz runs the readiness checks and answers 503 when any of them failed.
+// GET /readyz
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	CallFrom := "api.handleReadyz "
+	report := health.Ready(r.Context(), s.db)
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+		li.Logger.L.WithFields(logrus.Fields{
+			"CallFrom": CallFrom,
+			"checks":   report.Checks,
+		}).Warn("not ready")
+	}
+	writeJSON(w, status, report)
+}
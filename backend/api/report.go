@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/report"
+)
+
+// handleReport returns the call summaries of a period as json.
+// GET /api/reports/daily?from=2024-01-01&to=2024-02-01&extension=2001&by_extension=false
+func (s *Server) handleReport(period string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		values := url.Values{}
+		for k, v := range r.URL.Query() {
+			values[k] = v
+		}
+		values.Set("period", period)
+		q, err := report.ParseValues(values, time.Now())
+		if err != nil {
+			writeError(w, apperr.Wrap(apperr.RequestInvalid, "api.handleReport", err))
+			return
+		}
+		summaries, err := report.Run(r.Context(), s.db, q)
+		if err != nil {
+			writeError(w, apperr.Wrap(apperr.DBRead, "api.handleReport", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, summaries)
+	}
+}
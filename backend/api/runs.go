@@ -0,0 +1,52 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+)
+
+// the runs listed when no limit is given, and the most a request may ask for
+const (
+	defaultRunsLimit = 20
+	maxRunsLimit     = 1000
+)
+
+// handleRuns lists the latest import runs, newest first.
+// GET /api/runs?limit=20
+func (s *Server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	limit := defaultRunsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRunsLimit {
+			writeError(w, apperr.New(apperr.RequestInvalid, "api.handleRuns", fmt.Sprintf("limit must be between 1 and %d", maxRunsLimit)))
+			return
+		}
+		limit = n
+	}
+	runs, err := dbs.ListImportRuns(r.Context(), s.db, limit)
+	if err != nil {
+		writeError(w, apperr.Wrap(apperr.DBRead, "api.handleRuns", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// handleRun returns one import run.
+// GET /api/runs/{id}
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	run, err := dbs.GetImportRun(r.Context(), s.db, id)
+	if err != nil {
+		writeError(w, apperr.Wrap(apperr.DBRead, "api.handleRun", err))
+		return
+	}
+	if run == nil {
+		writeError(w, apperr.New(apperr.RequestNotFound, "api.handleRun", "no import run "+id))
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
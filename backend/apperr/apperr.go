@@ -0,0 +1,250 @@
+// Package apperr is the catalogue of the errors of rmsloader. Every error carries a stable code that is logged
+// as error_code and returned by the api, so operators can grep and alert on it and callers can test for it
+// with errors.Is and errors.As.
+package apperr
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Kind groups the codes by what failed
+type Kind string
+
+// the kinds of errors
+const (
+	KindParse   Kind = "parse"
+	KindDB      Kind = "db"
+	KindIO      Kind = "io"
+	KindConfig  Kind = "config"
+	KindRequest Kind = "request"
+	KindNotify  Kind = "notify"
+	KindOther   Kind = "other"
+)
+
+// Code identifies an error, codes are never renamed or reused once released
+type Code string
+
+// the error codes
+const (
+	ParseCSV       Code = "PARSE_CSV"
+	ParseShortLine Code = "PARSE_SHORT_LINE"
+	ParseTime      Code = "PARSE_TIME"
+	ParseDuration  Code = "PARSE_DURATION"
+	ParseSize      Code = "PARSE_SIZE"
+	ParseNumber    Code = "PARSE_NUMBER"
+
+	DBConnect  Code = "DB_CONNECT"
+	DBRead     Code = "DB_READ"
+	DBWrite    Code = "DB_WRITE"
+	DBCommit   Code = "DB_COMMIT"
+	DBLocked   Code = "DB_LOCKED"
+	DBLockLost Code = "DB_LOCK_LOST"
+
+	IOOpen     Code = "IO_OPEN"
+	IORead     Code = "IO_READ"
+	IOWrite    Code = "IO_WRITE"
+	IOCreate   Code = "IO_CREATE"
+	IOPath     Code = "IO_PATH"
+	IONotFound Code = "IO_NOT_FOUND"
+
+	ConfigInvalid Code = "CONFIG_INVALID"
+
+	RequestInvalid  Code = "REQUEST_INVALID"
+	RequestNotFound Code = "REQUEST_NOT_FOUND"
+	RequestDenied   Code = "REQUEST_DENIED"
+
+	NotifySend Code = "NOTIFY_SEND"
+
+	// Internal is the code of errors that were not given one
+	Internal Code = "INTERNAL"
+)
+
+// entry describes a code
+type entry struct {
+	kind    Kind
+	status  int
+	message string
+}
+
+var catalogue = map[Code]entry{
+	ParseCSV:        {KindParse, http.StatusUnprocessableEntity, "malformed csv"},
+	ParseShortLine:  {KindParse, http.StatusUnprocessableEntity, "too few fields"},
+	ParseTime:       {KindParse, http.StatusUnprocessableEntity, "cannot parse the time"},
+	ParseDuration:   {KindParse, http.StatusUnprocessableEntity, "cannot parse the duration"},
+	ParseSize:       {KindParse, http.StatusUnprocessableEntity, "cannot parse the size"},
+	ParseNumber:     {KindParse, http.StatusUnprocessableEntity, "cannot parse the number"},
+	DBConnect:       {KindDB, http.StatusServiceUnavailable, "cannot connect to the database"},
+	DBRead:          {KindDB, http.StatusInternalServerError, "cannot read from the database"},
+	DBWrite:         {KindDB, http.StatusInternalServerError, "cannot write to the database"},
+	DBCommit:        {KindDB, http.StatusInternalServerError, "cannot commit the transaction"},
+	DBLocked:        {KindDB, http.StatusConflict, "another import is running"},
+	DBLockLost:      {KindDB, http.StatusInternalServerError, "the import lock was lost"},
+	IOOpen:          {KindIO, http.StatusInternalServerError, "cannot open the file"},
+	IORead:          {KindIO, http.StatusInternalServerError, "cannot read the file"},
+	IOWrite:         {KindIO, http.StatusInternalServerError, "cannot write the file"},
+	IOCreate:        {KindIO, http.StatusInternalServerError, "cannot create the file"},
+	IOPath:          {KindIO, http.StatusInternalServerError, "cannot use the path"},
+	IONotFound:      {KindIO, http.StatusNotFound, "not found"},
+	ConfigInvalid:   {KindConfig, http.StatusInternalServerError, "invalid configuration"},
+	RequestInvalid:  {KindRequest, http.StatusBadRequest, "invalid request"},
+	RequestNotFound: {KindRequest, http.StatusNotFound, "not found"},
+	RequestDenied:   {KindRequest, http.StatusUnauthorized, "missing or wrong api token"},
+	NotifySend:      {KindNotify, http.StatusBadGateway, "cannot send the notification"},
+	Internal:        {KindOther, http.StatusInternalServerError, "internal error"},
+}
+
+// Kind returns the kind of the code
+func (c Code) Kind() Kind {
+	if e, ok := catalogue[c]; ok {
+		return e.kind
+	}
+	return KindOther
+}
+
+// Error is an error with a code. Op names the operation that failed, Err is the cause.
+type Error struct {
+	Code Code
+	Op   string
+	// Msg says what failed, the catalogue message of the code when empty
+	Msg string
+	Err error
+}
+
+// Error formats the error as CODE: op: message: cause
+func (e *Error) Error() string {
+	s := string(e.Code)
+	if e.Op != "" {
+		s += ": " + e.Op
+	}
+	msg := e.Msg
+	if msg == "" {
+		msg = catalogue[e.Code].message
+	}
+	if msg != "" {
+		s += ": " + msg
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Unwrap returns the cause
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the sentinels of the codes and kinds, so errors.Is(err, ErrParseTime) or errors.Is(err, ErrDB)
+// hold for any error of that code or kind
+func (e *Error) Is(target error) bool {
+	switch t := target.(type) {
+	case *Error:
+		return t.Op == "" && t.Msg == "" && t.Err == nil && t.Code == e.Code
+	case kindError:
+		return Kind(t) == e.Code.Kind()
+	}
+	return false
+}
+
+// kindError is the sentinel of a kind
+type kindError Kind
+
+func (k kindError) Error() string {
+	return string(k) + " error"
+}
+
+// the sentinels of the kinds
+var (
+	ErrParse   error = kindError(KindParse)
+	ErrDB      error = kindError(KindDB)
+	ErrIO      error = kindError(KindIO)
+	ErrConfig  error = kindError(KindConfig)
+	ErrRequest error = kindError(KindRequest)
+	ErrNotify  error = kindError(KindNotify)
+)
+
+// the sentinels of the codes
+var (
+	ErrParseCSV        = &Error{Code: ParseCSV}
+	ErrParseShortLine  = &Error{Code: ParseShortLine}
+	ErrParseTime       = &Error{Code: ParseTime}
+	ErrParseDuration   = &Error{Code: ParseDuration}
+	ErrParseSize       = &Error{Code: ParseSize}
+	ErrParseNumber     = &Error{Code: ParseNumber}
+	ErrDBConnect       = &Error{Code: DBConnect}
+	ErrDBRead          = &Error{Code: DBRead}
+	ErrDBWrite         = &Error{Code: DBWrite}
+	ErrDBCommit        = &Error{Code: DBCommit}
+	ErrDBLocked        = &Error{Code: DBLocked}
+	ErrDBLockLost      = &Error{Code: DBLockLost}
+	ErrIOOpen          = &Error{Code: IOOpen}
+	ErrIORead          = &Error{Code: IORead}
+	ErrIOWrite         = &Error{Code: IOWrite}
+	ErrIOCreate        = &Error{Code: IOCreate}
+	ErrIOPath          = &Error{Code: IOPath}
+	ErrIONotFound      = &Error{Code: IONotFound}
+	ErrConfigInvalid   = &Error{Code: ConfigInvalid}
+	ErrRequestInvalid  = &Error{Code: RequestInvalid}
+	ErrRequestNotFound = &Error{Code: RequestNotFound}
+	ErrRequestDenied   = &Error{Code: RequestDenied}
+	ErrNotifySend      = &Error{Code: NotifySend}
+)
+
+// New returns an error of code without a cause
+func New(code Code, op string, msg string) *Error {
+	return &Error{Code: code, Op: op, Msg: msg}
+}
+
+// Wrap gives err a code, it returns nil for a nil err and err itself when it already has the code
+func Wrap(code Code, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) && e.Code == code {
+		return err
+	}
+	return &Error{Code: code, Op: op, Err: err}
+}
+
+// CodeOf returns the code of the outermost coded error in the chain of err, Internal when there is none
+// and "" for a nil err
+func CodeOf(err error) Code {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return Internal
+}
+
+// KindOf returns the kind of the code of err
+func KindOf(err error) Kind {
+	return CodeOf(err).Kind()
+}
+
+// HTTPStatus returns the status an api response of err carries
+func HTTPStatus(err error) int {
+	if e, ok := catalogue[CodeOf(err)]; ok {
+		return e.status
+	}
+	return http.StatusInternalServerError
+}
+
+// Fields returns the log fields of err, its code, kind and the operation that failed
+func Fields(err error) logrus.Fields {
+	fields := logrus.Fields{
+		"error_code": CodeOf(err),
+		"error_kind": KindOf(err),
+	}
+	var e *Error
+	if errors.As(err, &e) && e.Op != "" {
+		fields["error_op"] = e.Op
+	}
+	return fields
+}
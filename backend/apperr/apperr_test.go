@@ -0,0 +1,133 @@
+package apperr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestCatalogue(t *testing.T) {
+	tests := []struct {
+		code     Code
+		sentinel error
+		kind     Kind
+		kindErr  error
+		status   int
+	}{
+		{ParseCSV, ErrParseCSV, KindParse, ErrParse, http.StatusUnprocessableEntity},
+		{ParseShortLine, ErrParseShortLine, KindParse, ErrParse, http.StatusUnprocessableEntity},
+		{ParseTime, ErrParseTime, KindParse, ErrParse, http.StatusUnprocessableEntity},
+		{ParseDuration, ErrParseDuration, KindParse, ErrParse, http.StatusUnprocessableEntity},
+		{ParseSize, ErrParseSize, KindParse, ErrParse, http.StatusUnprocessableEntity},
+		{ParseNumber, ErrParseNumber, KindParse, ErrParse, http.StatusUnprocessableEntity},
+		{DBConnect, ErrDBConnect, KindDB, ErrDB, http.StatusServiceUnavailable},
+		{DBRead, ErrDBRead, KindDB, ErrDB, http.StatusInternalServerError},
+		{DBWrite, ErrDBWrite, KindDB, ErrDB, http.StatusInternalServerError},
+		{DBCommit, ErrDBCommit, KindDB, ErrDB, http.StatusInternalServerError},
+		{DBLocked, ErrDBLocked, KindDB, ErrDB, http.StatusConflict},
+		{DBLockLost, ErrDBLockLost, KindDB, ErrDB, http.StatusInternalServerError},
+		{IOOpen, ErrIOOpen, KindIO, ErrIO, http.StatusInternalServerError},
+		{IORead, ErrIORead, KindIO, ErrIO, http.StatusInternalServerError},
+		{IOWrite, ErrIOWrite, KindIO, ErrIO, http.StatusInternalServerError},
+		{IOCreate, ErrIOCreate, KindIO, ErrIO, http.StatusInternalServerError},
+		{IOPath, ErrIOPath, KindIO, ErrIO, http.StatusInternalServerError},
+		{IONotFound, ErrIONotFound, KindIO, ErrIO, http.StatusNotFound},
+		{ConfigInvalid, ErrConfigInvalid, KindConfig, ErrConfig, http.StatusInternalServerError},
+		{RequestInvalid, ErrRequestInvalid, KindRequest, ErrRequest, http.StatusBadRequest},
+		{RequestNotFound, ErrRequestNotFound, KindRequest, ErrRequest, http.StatusNotFound},
+		{RequestDenied, ErrRequestDenied, KindRequest, ErrRequest, http.StatusUnauthorized},
+		{NotifySend, ErrNotifySend, KindNotify, ErrNotify, http.StatusBadGateway},
+	}
+	if len(tests) != len(catalogue)-1 {
+		t.Errorf("the table covers %d codes, the catalogue holds %d besides INTERNAL", len(tests), len(catalogue)-1)
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.code), func(t *testing.T) {
+			cause := errors.New("cause")
+			err := fmt.Errorf("outer: %w", Wrap(tt.code, "op", cause))
+			if got := tt.code.Kind(); got != tt.kind {
+				t.Errorf("kind %s, want %s", got, tt.kind)
+			}
+			if got := CodeOf(err); got != tt.code {
+				t.Errorf("CodeOf = %s", got)
+			}
+			if got := KindOf(err); got != tt.kind {
+				t.Errorf("KindOf = %s", got)
+			}
+			if got := HTTPStatus(err); got != tt.status {
+				t.Errorf("HTTPStatus = %d, want %d", got, tt.status)
+			}
+			if !errors.Is(err, tt.sentinel) || !errors.Is(err, tt.kindErr) || !errors.Is(err, cause) {
+				t.Errorf("%v is not its code, its kind and its cause", err)
+			}
+			if other := otherSentinel(tt.code); errors.Is(err, other) {
+				t.Errorf("%v is %v", err, other)
+			}
+		})
+	}
+}
+
+// otherSentinel returns the sentinel of a code of another kind
+func otherSentinel(code Code) error {
+	if code.Kind() == KindRequest {
+		return ErrDBRead
+	}
+	return ErrRequestInvalid
+}
+
+func TestUncoded(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		code   Code
+		kind   Kind
+		status int
+	}{
+		{"nil", nil, "", KindOther, http.StatusInternalServerError},
+		{"plain", errors.New("boom"), Internal, KindOther, http.StatusInternalServerError},
+		{"wrapped plain", fmt.Errorf("read: %w", os.ErrNotExist), Internal, KindOther, http.StatusInternalServerError},
+		{"unknown code", &Error{Code: "NOPE"}, "NOPE", KindOther, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := CodeOf(tt.err); got != tt.code {
+			t.Errorf("%s: CodeOf = %q, want %q", tt.name, got, tt.code)
+		}
+		if got := KindOf(tt.err); got != tt.kind {
+			t.Errorf("%s: KindOf = %q, want %q", tt.name, got, tt.kind)
+		}
+		if got := HTTPStatus(tt.err); got != tt.status {
+			t.Errorf("%s: HTTPStatus = %d, want %d", tt.name, got, tt.status)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	if Wrap(DBRead, "op", nil) != nil {
+		t.Error("a nil error was wrapped")
+	}
+	inner := New(DBLocked, "db.Lock", "held by b:2")
+	if got := Wrap(DBLocked, "process", inner); got != error(inner) {
+		t.Errorf("an error of the same code was wrapped again: %v", got)
+	}
+	// the outermost code wins
+	outer := Wrap(DBWrite, "retention", inner)
+	if CodeOf(outer) != DBWrite || !errors.Is(outer, ErrDBLocked) || !errors.Is(outer, ErrDBWrite) {
+		t.Errorf("%v lost a code", outer)
+	}
+	// a sentinel with an op or message is not a code sentinel
+	if errors.Is(inner, New(DBLocked, "db.Lock", "")) {
+		t.Error("an error matched a coded error with an op")
+	}
+	if got := inner.Error(); got != "DB_LOCKED: db.Lock: held by b:2" {
+		t.Errorf("Error() = %q", got)
+	}
+	if got := Wrap(IOOpen, "", os.ErrNotExist).Error(); got != "IO_OPEN: cannot open the file: file does not exist" {
+		t.Errorf("Error() = %q", got)
+	}
+	fields := Fields(fmt.Errorf("run: %w", inner))
+	if fields["error_code"] != DBLocked || fields["error_kind"] != KindDB || fields["error_op"] != "db.Lock" {
+		t.Errorf("Fields = %v", fields)
+	}
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+
+	"github.com/pienaahj/rmsloader/backend/api"
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/export"
+	"github.com/pienaahj/rmsloader/backend/fixtures"
+	"github.com/pienaahj/rmsloader/backend/integrity"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/notify"
+	"github.com/pienaahj/rmsloader/backend/privacy"
+	"github.com/pienaahj/rmsloader/backend/process"
+	"github.com/pienaahj/rmsloader/backend/report"
+	"github.com/pienaahj/rmsloader/backend/retention"
+	"github.com/pienaahj/rmsloader/backend/schedule"
+	"github.com/pienaahj/rmsloader/backend/secrets"
+)
+
+// command is a sub command of rmsloader, running without one imports the csv files
+type command struct {
+	usage string
+	run   func(ctx context.Context, db *sqlx.DB, args []string) error
+}
+
+// commands holds the sub commands by name
+var commands = map[string]command{
+	"verify":       {"re-hash the recordings and check the cdr hash chain for edits and deletions", runVerify},
+	"retention":    {"archive and delete the rows expired by the retention rules", runRetention},
+	"erase":        {"delete or anonymise every cdr of a phone number, for a data subject request", runErase},
+	"export":       {"write filtered cdrs as csv, rms csv, json lines or xlsx", runExport},
+	"serve":        {"serve the http api until interrupted", runServe},
+	"report":       {"print daily or monthly call summaries per extension", runReport},
+	"secrets":      {"generate a key, seal the encrypted secrets file or check where the secrets are read from", runSecrets},
+	"runs":         {"list the latest import runs with their counts and status", runRuns},
+	"schedule":     {"run the scheduled jobs until interrupted, list their next times or run one now", runSchedule},
+	"notify":       {"send the notification of an import run to the webhooks and mail of the notify settings", runNotify},
+	"gen-fixtures": {"write sample rms csv exports with injected defects", runGenFixtures},
+	"healthcheck":  {"probe the readiness of a running server, for docker HEALTHCHECK", runHealthcheck},
+}
+
+// offlineCommands run without a database connection
+var offlineCommands = map[string]bool{
+	"gen-fixtures": true,
+	"secrets":      true,
+}
+
+// commandFromArgs splits the sub command from its arguments, the name is empty for the default import
+func commandFromArgs(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "", args
+	}
+	return args[0], args[1:]
+}
+
+// runCommand runs the named sub command
+func runCommand(ctx context.Context, name string, db *sqlx.DB, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q, available commands:\n%s", name, commandUsage())
+	}
+	return cmd.run(ctx, db, args)
+}
+
+// commandUsage lists the sub commands
+func commandUsage() string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %-14s %s\n", name, commands[name].usage)
+	}
+	return b.String()
+}
+
+// runVerify checks the recordings and the hash chain and fails if anything was tampered with
+func runVerify(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	recordings := fs.Bool("recordings", true, "re-hash the recordings hashed at import")
+	chain := fs.Bool("chain", model.Settings.Integrity.HashChain, "verify the hash chain over the imported rows")
+	jsonOut := fs.Bool("json", false, "print the report as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var report integrity.Report
+	if *recordings {
+		if err := integrity.VerifyRecordings(ctx, db, process.RecordingPath, &report); err != nil {
+			return fmt.Errorf("verifying recordings: %w", err)
+		}
+	}
+	if *chain {
+		if err := integrity.VerifyChain(ctx, db, &report); err != nil {
+			return fmt.Errorf("verifying hash chain: %w", err)
+		}
+	}
+
+	if *jsonOut {
+		if err := process.ToJSON(report, os.Stdout); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Recordings checked: %d, changed: %d, missing: %d\n", report.RecordingsChecked, len(report.RecordingsChanged), len(report.RecordingsMissing))
+		fmt.Printf("Chain entries checked: %d, broken links: %d, rows edited: %d, rows deleted: %d, rows not chained: %d\n",
+			report.ChainChecked, len(report.ChainBroken), len(report.RowsEdited), len(report.RowsDeleted), report.Unchained)
+		for _, group := range [][]integrity.Finding{report.RecordingsChanged, report.RecordingsMissing, report.ChainBroken, report.RowsEdited, report.RowsDeleted} {
+			for _, f := range group {
+				fmt.Printf("  %s uid=%s file=%s seq=%d\n", f.Reason, f.UID, f.File, f.Seq)
+			}
+		}
+	}
+	if !report.OK() {
+		return errors.New("verify found tampered recordings or rows")
+	}
+	return nil
+}
+
+// runRetention applies the retention rules, with -dry-run it only reports what would expire
+func runRetention(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("retention", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only report the rows that would expire")
+	rule := fs.String("rule", "", "apply only the named rule")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// a purge does not run alongside an import
+	if !*dryRun {
+		locked, release, err := process.LockImport(ctx, dbs.NewSQLRepository(db))
+		if err != nil {
+			return err
+		}
+		defer release()
+		ctx = locked
+	}
+	archiveDir := filepath.Join(model.PathVars.DestinationPath, "retention")
+	results, err := retention.Run(ctx, db, model.Settings.Retention, archiveDir, retention.Options{DryRun: *dryRun, Rule: *rule})
+	for _, r := range results {
+		fmt.Printf("Rule %s: cutoff %s, expiring %d", r.Rule, r.Cutoff.Format("2006-01-02"), r.Matched)
+		if r.Matched > 0 {
+			fmt.Printf(" (%s to %s)", r.First.Format("2006-01-02"), r.Last.Format("2006-01-02"))
+		}
+		if !*dryRun {
+			fmt.Printf(", deleted %d", r.Deleted)
+			if r.Archive != "" {
+				fmt.Printf(", archived to %s", r.Archive)
+			}
+		}
+		fmt.Println()
+	}
+	return err
+}
+
+// runErase deletes or anonymises the cdrs of a number, with -dry-run it only counts them
+func runErase(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("erase", flag.ContinueOnError)
+	number := fs.String("number", "", "the phone number of the subject")
+	mode := fs.String("mode", retention.EraseDelete, "delete the rows or anonymise their numbers")
+	dryRun := fs.Bool("dry-run", false, "only count the rows of the subject")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *number == "" {
+		return fmt.Errorf("erase needs -number")
+	}
+	// an erasure does not run alongside an import, which could store the subject again meanwhile
+	if !*dryRun {
+		locked, release, err := process.LockImport(ctx, dbs.NewSQLRepository(db))
+		if err != nil {
+			return err
+		}
+		defer release()
+		ctx = locked
+	}
+	r, err := retention.Erase(ctx, db, *number, retention.EraseOptions{
+		Mode:       *mode,
+		DryRun:     *dryRun,
+		ChunkSize:  model.Settings.Retention.ChunkSize,
+		ArchiveDir: filepath.Join(model.PathVars.DestinationPath, "retention"),
+	})
+	fmt.Printf("Subject %s: matched %d", privacy.Mask(*number), r.Matched)
+	if r.Matched > 0 {
+		fmt.Printf(" (%s to %s)", r.First.Format("2006-01-02"), r.Last.Format("2006-01-02"))
+	}
+	fmt.Printf(", archived %d", r.Archived)
+	if !*dryRun {
+		fmt.Printf(", deleted %d, anonymised %d, history changes erased %d", r.Deleted, r.Anonymised, r.History)
+	}
+	fmt.Println()
+	return err
+}
+
+// runExport writes the filtered cdrs to a file or stdout
+func runExport(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	values := url.Values{}
+	for _, name := range []string{"from", "to", "direction", "extension", "flagged", "format", "columns", "tz"} {
+		name := name
+		fs.Func(name, "export "+name+" filter or option", func(v string) error {
+			values.Set(name, v)
+			return nil
+		})
+	}
+	gzipOut := fs.Bool("gzip", false, "gzip the output")
+	mask := fs.Bool("mask", false, "mask the source and destination numbers")
+	out := fs.String("o", "", "the file to write, stdout when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	values.Set("gzip", fmt.Sprint(*gzipOut))
+	values.Set("mask", fmt.Sprint(*mask))
+	filter, opts, err := export.ParseValues(values)
+	if err != nil {
+		return err
+	}
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	count, err := export.Write(ctx, db, w, filter, opts)
+	if err != nil {
+		return fmt.Errorf("export failed after %d rows: %w", count, err)
+	}
+	if *out != "" {
+		fmt.Printf("Exported %d rows to %s\n", count, *out)
+		return w.Sync()
+	}
+	return nil
+}
+
+// runServe serves the api until the context is cancelled
+func runServe(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", model.Settings.API.ListenAddr, "the address to listen on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *addr == "" {
+		*addr = api.DefaultAddr
+	}
+	var token string
+	if name := model.Settings.API.TokenSecret; name != "" {
+		var err error
+		if token, err = secrets.Get(name); err != nil {
+			return err
+		}
+	}
+	if token == "" && !loopback(*addr) {
+		li.Logger.L.WithFields(logrus.Fields{"addr": *addr}).Warn("the api listens beyond the local host without a token, anyone who reaches it can export the calls")
+	}
+	// the scheduled jobs run alongside the api and stop with it
+	if model.Settings.Schedule.Enabled {
+		scheduler, err := schedule.New(db, model.Settings.Schedule)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		done := make(chan struct{})
+		go func() {
+			scheduler.Start(ctx)
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+	return api.ListenAndServe(ctx, *addr, api.NewServer(db, token))
+}
+
+// runReport prints the call summaries, with -rebuild it first recomputes the summaries of the range
+func runReport(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	values := url.Values{}
+	for _, name := range []string{"from", "to", "period", "extension"} {
+		name := name
+		fs.Func(name, "report "+name, func(v string) error {
+			values.Set(name, v)
+			return nil
+		})
+	}
+	byExtension := fs.Bool("by-extension", true, "one row per extension, otherwise the extensions are summed")
+	rebuild := fs.Bool("rebuild", false, "recompute the summaries from rmscdr first, over all calls when no dates are given")
+	jsonOut := fs.Bool("json", false, "print the report as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	values.Set("by_extension", fmt.Sprint(*byExtension))
+	q, err := report.ParseValues(values, time.Now())
+	if err != nil {
+		return err
+	}
+	if *rebuild {
+		var from, to time.Time
+		if values.Get("from") != "" {
+			from = q.From
+		}
+		if values.Get("to") != "" {
+			to = q.To
+		}
+		days, err := report.Rebuild(ctx, db, from, to)
+		if err != nil {
+			return fmt.Errorf("rebuilding summaries: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Rebuilt the summaries of %d days\n", days)
+	}
+	summaries, err := report.Run(ctx, db, q)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return process.ToJSON(summaries, os.Stdout)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Period\tExtension\tCalls\tInbound\tOutbound\tFlagged\tTotal s\tAvg s\tMax s\t")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%.1f\t%d\t\n",
+			s.Period, s.Extension, s.Calls, s.Inbound, s.Outbound, s.Flagged, s.TotalDuration, s.AvgDuration, s.MaxDuration)
+	}
+	return tw.Flush()
+}
+
+// runRuns lists the latest import runs, or the run given by -id
+func runRuns(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("runs", flag.ContinueOnError)
+	limit := fs.Int("limit", 20, "the number of runs listed, newest first")
+	id := fs.String("id", "", "show only the run with this id")
+	jsonOut := fs.Bool("json", false, "print the runs as json")
+	jobs := fs.Bool("jobs", false, "list the scheduled job runs instead of the import runs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *jobs {
+		return printJobRuns(ctx, db, *limit, *jsonOut)
+	}
+	var runs []model.ImportRun
+	if *id != "" {
+		run, err := dbs.GetImportRun(ctx, db, *id)
+		if err != nil {
+			return err
+		}
+		if run == nil {
+			return fmt.Errorf("no import run %s", *id)
+		}
+		runs = append(runs, *run)
+	} else {
+		var err error
+		if runs, err = dbs.ListImportRuns(ctx, db, *limit); err != nil {
+			return err
+		}
+	}
+	if *jsonOut {
+		return process.ToJSON(runs, os.Stdout)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Run\tStarted\tSeconds\tStatus\tFiles\tImported\tSkipped\tFailed\tRows\tRejected\tInserted\tVersion\tHost\tError")
+	for _, r := range runs {
+		seconds := "-"
+		if r.FinishedAt != nil {
+			seconds = fmt.Sprintf("%.1f", r.FinishedAt.Sub(r.StartedAt).Seconds())
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n",
+			r.ID, r.StartedAt.Local().Format("2006-01-02 15:04:05"), seconds, r.Status, r.FilesFound, r.FilesImported,
+			r.FilesSkipped, r.FilesFailed, r.RowsParsed, r.RowsRejected, r.RowsInserted, r.Version, r.Host, r.Error)
+	}
+	return tw.Flush()
+}
+
+// printJobRuns lists the latest scheduled job runs, newest first
+func printJobRuns(ctx context.Context, db *sqlx.DB, limit int, jsonOut bool) error {
+	runs, err := dbs.ListJobRuns(ctx, db, limit)
+	if err != nil {
+		return err
+	}
+	if jsonOut {
+		return process.ToJSON(runs, os.Stdout)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Id\tJob\tKind\tScheduled\tStarted\tSeconds\tStatus\tHost\tError")
+	for _, r := range runs {
+		seconds := "-"
+		if r.FinishedAt != nil {
+			seconds = fmt.Sprintf("%.1f", r.FinishedAt.Sub(r.StartedAt).Seconds())
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.Job, r.Kind,
+			r.ScheduledAt.Local().Format("2006-01-02 15:04:05"), r.StartedAt.Local().Format("2006-01-02 15:04:05"),
+			seconds, r.Status, r.Host, r.Error)
+	}
+	return tw.Flush()
+}
+
+// runNotify sends the notification of a recorded import run, to check the notify settings
+func runNotify(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("notify", flag.ContinueOnError)
+	id := fs.String("id", "", "the run to notify, the latest when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var run *model.ImportRun
+	if *id != "" {
+		var err error
+		if run, err = dbs.GetImportRun(ctx, db, *id); err != nil {
+			return err
+		}
+	} else {
+		runs, err := dbs.ListImportRuns(ctx, db, 1)
+		if err != nil {
+			return err
+		}
+		if len(runs) == 0 {
+			return fmt.Errorf("no import runs recorded")
+		}
+		run = &runs[0]
+	}
+	if run == nil {
+		return fmt.Errorf("no import run %s", *id)
+	}
+	// the run is sent whatever its events, its rejected rows were not kept
+	events := notify.Events(model.Settings.Notify, *run)
+	if len(events) == 0 {
+		events = []string{run.Status}
+	}
+	n := notify.Notification{Run: *run, Events: events}
+	if err := notify.Send(ctx, model.Settings.Notify, n); err != nil {
+		return err
+	}
+	fmt.Printf("Sent the notification of run %s (%s) to %d webhooks", run.ID, strings.Join(events, ", "), len(model.Settings.Notify.Webhooks))
+	if model.Settings.Notify.Email.Enabled {
+		fmt.Printf(" and %s", strings.Join(model.Settings.Notify.Email.To, ", "))
+	}
+	fmt.Println()
+	return nil
+}
+
+// runSchedule runs the scheduled jobs until interrupted, with -list it prints their next times and with
+// -run it runs one job now, under its lock
+func runSchedule(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("schedule", flag.ContinueOnError)
+	list := fs.Bool("list", false, "print the next time of every job")
+	run := fs.String("run", "", "run the named job now")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	scheduler, err := schedule.New(db, model.Settings.Schedule)
+	if err != nil {
+		return err
+	}
+	switch {
+	case *list:
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "Job\tKind\tCron\tNext")
+		for _, p := range scheduler.Next(time.Now()) {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.Job.Name, p.Job.Kind, p.Job.Cron, p.Next.Format("2006-01-02 15:04:05 MST"))
+		}
+		return tw.Flush()
+	case *run != "":
+		job, ok := scheduler.Job(*run)
+		if !ok {
+			return fmt.Errorf("no scheduled job %s", *run)
+		}
+		r, err := scheduler.Execute(ctx, job, time.Now())
+		if r == nil {
+			return err
+		}
+		fmt.Printf("Job %s: %s\n", r.Job, r.Status)
+		if r.Status == model.JobFailed {
+			return err
+		}
+		return nil
+	}
+	if len(model.Settings.Schedule.Jobs) == 0 {
+		return fmt.Errorf("no jobs in schedule.jobs")
+	}
+	if err := scheduler.Start(ctx); !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// the secrets the loader reads, checked by the secrets command when no names are given
+var knownSecrets = []string{"DB_USER_GO", "DB_PASSWORD_GO", "DB_ADDR_GO_CDR", "DB_NAME_GO_CDR", "RMSLOADER_DB_DSN", "RMSLOADER_PSEUDONYM_KEY",
+	"SFTP_USERNAME", "SFTP_PASSWORD", "SFTP_KEY_PASSPHRASE", "SMB_USERNAME", "SMB_PASSWORD", "RMS_USERNAME", "RMS_PASSWORD", "RMS_TOKEN",
+	"NOTIFY_WEBHOOK_SECRET", "SMTP_USERNAME", "SMTP_PASSWORD"}
+
+// runSecrets manages the encrypted secrets file, the values of the secrets are never printed
+func runSecrets(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("secrets", flag.ContinueOnError)
+	keygen := fs.Bool("keygen", false, "print a new key for the secrets file")
+	seal := fs.String("seal", "", "encrypt this json file of secrets into the secrets file")
+	out := fs.String("o", model.Settings.Secrets.File, "the encrypted secrets file to write")
+	check := fs.String("check", strings.Join(knownSecrets, ","), "the comma separated secrets to look up")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch {
+	case *keygen:
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s=%s\n", secrets.KeyEnv(), key)
+		return nil
+	case *seal != "":
+		if *out == "" {
+			return fmt.Errorf("give the secrets file with -o or secrets.file")
+		}
+		names, err := secrets.SealFile(*seal, *out)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Sealed %d secrets into %s: %s\n", len(names), *out, strings.Join(names, ", "))
+		fmt.Printf("Delete %s once the secrets are safe\n", *seal)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SECRET\tSOURCE")
+	for _, name := range strings.Split(*check, ",") {
+		name = strings.TrimSpace(name)
+		_, source, err := secrets.Lookup(name)
+		if err != nil {
+			source = err.Error()
+		}
+		if source == "" {
+			source = "not set"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", name, source)
+	}
+	return tw.Flush()
+}
+
+// runGenFixtures writes sample RMS csv exports for tests and load benchmarks
+func runGenFixtures(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("gen-fixtures", flag.ContinueOnError)
+	opts := fixtures.Options{}
+	fs.StringVar(&opts.Dir, "o", model.PathVars.CSVPath, "the folder to write the files to")
+	fs.IntVar(&opts.Rows, "rows", 1000, "the calls per file")
+	fs.IntVar(&opts.Files, "files", 1, "the number of files, they split the date range")
+	from := fs.String("from", time.Now().UTC().AddDate(0, 0, -7).Format("2006-01-02"), "the first day of calls")
+	to := fs.String("to", time.Now().UTC().Format("2006-01-02"), "the day after the last calls")
+	extensions := fs.String("extensions", "2001-2020", "the extensions as a comma separated list of numbers and ranges")
+	fs.Float64Var(&opts.ShortLines, "short-lines", 0, "the share of rows cut short")
+	fs.Float64Var(&opts.BadTimes, "bad-dates", 0, "the share of rows with an unparseable time")
+	fs.Float64Var(&opts.NineDigits, "nine-digit", 0, "the share of rows with a number missing its leading zero")
+	fs.Float64Var(&opts.OddDurations, "odd-durations", 0, "the share of rows with an unusual duration")
+	fs.Int64Var(&opts.Seed, "seed", 0, "the random seed to reproduce a set of files, random when 0")
+	jsonOut := fs.Bool("json", false, "print the report as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var err error
+	if opts.From, err = time.Parse("2006-01-02", *from); err != nil {
+		return fmt.Errorf("invalid -from: %w", err)
+	}
+	if opts.To, err = time.Parse("2006-01-02", *to); err != nil {
+		return fmt.Errorf("invalid -to: %w", err)
+	}
+	if opts.Extensions, err = fixtures.ParseExtensions(*extensions); err != nil {
+		return err
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	r, err := fixtures.Generate(opts)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return process.ToJSON(r, os.Stdout)
+	}
+	fmt.Printf("Wrote %d rows to %d files in %s with seed %d\n", r.Rows, len(r.Files), opts.Dir, r.Seed)
+	for _, defect := range []string{fixtures.DefectShortLine, fixtures.DefectBadTime, fixtures.DefectNineDigit, fixtures.DefectOddDuration} {
+		if n := r.Defects[defect]; n > 0 {
+			fmt.Printf("  %-14s %d\n", defect, n)
+		}
+	}
+	return nil
+}
+
+// healthcheck runs the healthcheck command on its own, before the logs and the metrics are set up, and
+// returns the exit code
+func healthcheck(args []string) int {
+	// without the settings the default api address is probed
+	model.ReadSettings("./pathConfig.json")
+	if err := runHealthcheck(context.Background(), nil, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runHealthcheck fails unless the server answers its readiness endpoint with 200
+func runHealthcheck(ctx context.Context, db *sqlx.DB, args []string) error {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	target := fs.String("url", readyURL(model.Settings.API.ListenAddr), "the readiness endpoint to probe")
+	timeout := fs.Duration("timeout", 5*time.Second, "the time allowed for the answer")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, *target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("probing %s: %w", *target, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s: %s", *target, resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+	return nil
+}
+
+// readyURL returns the readiness endpoint of a server listening on addr, a server on all interfaces is probed on localhost
+func readyURL(addr string) string {
+	if addr == "" {
+		addr = api.DefaultAddr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr + "/readyz"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/readyz"
+}
+
+// loopback tells whether addr only accepts connections from the local host
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// importOptions parses the flags of the default import
+func importOptions(args []string) (process.Options, error) {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	var opts process.Options
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "parse and validate the csv files without writing to the database")
+	fs.StringVar(&opts.ReportPath, "report", "", "write the dry-run report as json to this file")
+	err := fs.Parse(args)
+	return opts, err
+}
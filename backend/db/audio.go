@@ -0,0 +1,67 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+const TableAudio = "rmscdr_audio"
+
+var audioSchema = `
+CREATE TABLE IF NOT EXISTS rmscdr_audio (
+	id BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	uid VARCHAR(50) NOT NULL,
+	file_name VARCHAR(100),
+	codec VARCHAR(30),
+	sample_rate INTEGER,
+	channels INTEGER,
+	bits_per_sample INTEGER,
+	audio_duration_ms BIGINT,
+	duration_delta DOUBLE,
+	duration_mismatch TINYINT(1),
+	INDEX (uid),
+	INDEX (duration_mismatch)
+);`
+
+// InsertAudioBatch stores the wav header details of the recordings linked to a batch of CDRs
+func InsertAudioBatch(ctx context.Context, db *sqlx.DB, batch []model.AudioInfo) (int64, error) {
+	CallFrom := "InsertAudioBatch in db "
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	if err := ensureTable(ctx, db, TableAudio); err != nil {
+		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+		return 0, err
+	}
+	return insertAudio(ctx, db, batch)
+}
+
+// InsertAudioBatchTx stores the audio details of a batch inside the transaction of an import unit
+func InsertAudioBatchTx(ctx context.Context, tx *sqlx.Tx, batch []model.AudioInfo) (int64, error) {
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	return insertAudio(ctx, tx, batch)
+}
+
+// insertAudio inserts the audio details of a batch in one statement
+func insertAudio(ctx context.Context, e sqlx.ExtContext, batch []model.AudioInfo) (int64, error) {
+	CallFrom := "insertAudio in db "
+	query := `INSERT INTO rmscdr_audio (uid, file_name, codec, sample_rate, channels, bits_per_sample, audio_duration_ms, duration_delta, duration_mismatch)
+		 VALUES (:uid, :file_name, :codec, :sample_rate, :channels, :bits_per_sample, :audio_duration_ms, :duration_delta, :duration_mismatch)`
+	res, err := sqlx.NamedExecContext(ctx, e, query, batch)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return 0, fmt.Errorf("inserting audio details: %w", err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return rowsAffected, nil
+}
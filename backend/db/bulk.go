@@ -0,0 +1,148 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/sirupsen/logrus"
+)
+
+const TableCDRStage = "rmscdr_stage"
+
+// the columns streamed into the staging table, in the order writeTSV writes them
+const bulkColumns = "uid, direction, time, unix_timestamp, flagged, source, destination, duration, size, exists_in_db, local_copy, authentic, file_name, sip_call_id, call_key"
+
+// stageDuplicate joins a staged row to the same call in rmscdr on its call_key, the way an upsert matches
+// calls, so the unique index of EnsureCallKey is used
+const stageDuplicate = "r.call_key = s.call_key"
+
+// BulkLoadCDRsTx streams a batch into a temporary staging table and merges the calls that are not in rmscdr
+// yet. It returns the rows that were inserted, calls already loaded and calls repeated in the batch are left
+// out. MySQL streams with LOAD DATA LOCAL INFILE and the server has to allow local_infile, PostgreSQL uses COPY.
+func BulkLoadCDRsTx(ctx context.Context, tx *sqlx.Tx, batch []model.RMSCDR) ([]model.RMSCDR, error) {
+	CallFrom := "BulkLoadCDRsTx in db "
+	rows := distinctCalls(batch)
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	store := storeFor(tx)
+	if err := store.StageCDRs(ctx, tx, rows); err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return nil, err
+	}
+	defer store.DropStage(context.WithoutCancel(ctx), tx)
+
+	var duplicates []string
+	if err := tx.SelectContext(ctx, &duplicates, "SELECT s.uid FROM rmscdr_stage s JOIN rmscdr r ON "+stageDuplicate); err != nil {
+		li.Logger.ErrMySQLRetrieveMessage(CallFrom, TableCDRStage, err)
+		return nil, err
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO rmscdr ("+bulkColumns+") SELECT "+bulkColumns+
+		" FROM rmscdr_stage s WHERE NOT EXISTS (SELECT 1 FROM rmscdr r WHERE "+stageDuplicate+")")
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return nil, fmt.Errorf("merging staging table: %w", err)
+	}
+	merged, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	skip := make(map[string]bool, len(duplicates))
+	for _, uid := range duplicates {
+		skip[uid] = true
+	}
+	inserted := make([]model.RMSCDR, 0, len(rows)-len(skip))
+	for _, cdr := range rows {
+		if !skip[cdr.UID] {
+			inserted = append(inserted, cdr)
+		}
+	}
+	li.Logger.L.WithFields(logrus.Fields{
+		"CallFrom":   CallFrom,
+		"rows":       len(batch),
+		"merged":     merged,
+		"duplicates": len(batch) - len(inserted),
+	}).Info("bulk load merged")
+	return inserted, nil
+}
+
+// writeTSV writes the rows in the tab separated layout LOAD DATA reads with its default escaping
+func writeTSV(w io.Writer, rows []model.RMSCDR) error {
+	bw := bufio.NewWriterSize(w, 64*1024)
+	for _, cdr := range rows {
+		fields := [...]string{
+			tsvEscape(cdr.UID),
+			tsvEscape(cdr.Direction),
+			cdr.Time.UTC().Format("2006-01-02 15:04:05"),
+			strconv.FormatInt(cdr.UnixTimestamp, 10),
+			tsvBool(cdr.Flagged),
+			tsvEscape(cdr.Source),
+			tsvEscape(cdr.Destination),
+			strconv.FormatInt(cdr.Duration, 10),
+			strconv.FormatFloat(cdr.Size, 'f', -1, 64),
+			tsvBool(cdr.ExistsINDB),
+			tsvBool(cdr.LocalCopy),
+			tsvEscape(cdr.Authentic),
+			tsvEscape(cdr.FileName),
+			tsvEscape(cdr.SipCallID),
+			cdr.CallKey(),
+		}
+		for i, field := range fields {
+			if i > 0 {
+				bw.WriteByte('\t')
+			}
+			bw.WriteString(field)
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// distinctCalls returns the first export of every call in a batch
+func distinctCalls(batch []model.RMSCDR) []model.RMSCDR {
+	rows := make([]model.RMSCDR, 0, len(batch))
+	seen := make(map[string]bool, len(batch))
+	for _, cdr := range batch {
+		key := cdr.NaturalKey()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		rows = append(rows, cdr)
+	}
+	return rows
+}
+
+// cdrValues returns the values of a row in the order of bulkColumns
+func cdrValues(cdr model.RMSCDR) []interface{} {
+	return []interface{}{
+		cdr.UID, cdr.Direction, cdr.Time.UTC(), cdr.UnixTimestamp, cdr.Flagged, cdr.Source, cdr.Destination,
+		cdr.Duration, cdr.Size, cdr.ExistsINDB, cdr.LocalCopy, cdr.Authentic, cdr.FileName, cdr.SipCallID, cdr.CallKey(),
+	}
+}
+
+// tsvEscaper escapes the characters LOAD DATA treats as separators or escapes
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`, "\x00", `\0`)
+
+func tsvEscape(s string) string {
+	return tsvEscaper.Replace(s)
+}
+
+func tsvBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// the rows written per benchmark iteration
+const benchRows = 10000
+
+// benchDB connects to the database in RMSLOADER_TEST_DSN, the server needs local_infile=ON and the dsn
+// parseTime=true. The rows written are deleted again.
+func benchDB(b *testing.B) *sqlx.DB {
+	dsn := os.Getenv("RMSLOADER_TEST_DSN")
+	if dsn == "" {
+		b.Skip("RMSLOADER_TEST_DSN not set")
+	}
+	db, err := sqlx.Connect("mysql", dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := PrepareImport(ctx, db); err != nil {
+		b.Fatal(err)
+	}
+	if err := EnsureCallKey(ctx, db); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		db.ExecContext(ctx, "DELETE FROM rmscdr WHERE file_name LIKE 'bench-%'")
+		db.Close()
+	})
+	return db
+}
+
+// benchCDRs returns n distinct calls
+func benchCDRs(n int) []model.RMSCDR {
+	run := uuid.NewString()[:8]
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	cdrs := make([]model.RMSCDR, n)
+	for i := range cdrs {
+		t := start.Add(time.Duration(i) * time.Second)
+		cdrs[i] = model.RMSCDR{
+			UID:           uuid.NewString(),
+			Direction:     "Incoming",
+			Time:          t,
+			UnixTimestamp: t.Unix(),
+			Source:        "0821234567",
+			Destination:   "2001",
+			Duration:      65,
+			Size:          512.5,
+			ExistsINDB:    true,
+			Authentic:     "Yes",
+			FileName:      fmt.Sprintf("bench-%s-%d.wav", run, i),
+			SipCallID:     fmt.Sprintf("%s-%d@pbx", run, i),
+		}
+	}
+	return cdrs
+}
+
+func BenchmarkInsertCDRsBatch(b *testing.B) {
+	db := benchDB(b)
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		cdrs := benchCDRs(benchRows)
+		b.StartTimer()
+		for start := 0; start < len(cdrs); start += 100 {
+			if _, err := InsertCDRsBatch(ctx, db, cdrs[start:min(start+100, len(cdrs))]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(b.N*benchRows)/b.Elapsed().Seconds(), "rows/s")
+}
+
+func BenchmarkBulkLoadCDRsTx(b *testing.B) {
+	db := benchDB(b)
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		cdrs := benchCDRs(benchRows)
+		b.StartTimer()
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		inserted, err := BulkLoadCDRsTx(ctx, tx, cdrs)
+		if err != nil {
+			tx.Rollback()
+			b.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+		if len(inserted) != len(cdrs) {
+			b.Fatalf("inserted %d of %d rows", len(inserted), len(cdrs))
+		}
+	}
+	b.ReportMetric(float64(b.N*benchRows)/b.Elapsed().Seconds(), "rows/s")
+}
+
+func TestBulkLoadSkipsStoredCalls(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	if err := PrepareImport(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	// a row loaded before the call_key, without a file name or sip call id
+	legacy := time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC)
+	if _, err := db.Exec("INSERT INTO rmscdr (uid, time, unix_timestamp) VALUES ('legacy', ?, ?)", legacy, legacy.Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureCallKey(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	cdrs := benchCDRs(4)
+	if _, err := InsertCDRsBatch(ctx, db, cdrs[:2]); err != nil {
+		t.Fatal(err)
+	}
+	reexported := cdrs[2]
+	reexported.UID = "reexported"
+	reexported.Duration = 70
+	blank := model.RMSCDR{UID: "blank", Time: legacy, UnixTimestamp: legacy.Unix()}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	inserted, err := BulkLoadCDRsTx(ctx, tx, []model.RMSCDR{cdrs[1], cdrs[2], reexported, blank, cdrs[3]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted) != 2 || inserted[0].UID != cdrs[2].UID || inserted[1].UID != cdrs[3].UID {
+		t.Errorf("inserted %+v, want the first export of the 2 new calls", inserted)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var stored []string
+	if err := db.Select(&stored, "SELECT uid FROM rmscdr ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"legacy", cdrs[0].UID, cdrs[1].UID, cdrs[2].UID, cdrs[3].UID}
+	if fmt.Sprint(stored) != fmt.Sprint(want) {
+		t.Errorf("stored %v, want %v", stored, want)
+	}
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+func TestEveryInsertPathWritesCallKey(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	if err := EnsureCallKey(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	cdrs := benchCDRs(4)
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := InsertCDRsBatchTx(ctx, tx, cdrs[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BulkLoadCDRsTx(ctx, tx, cdrs[2:3]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpsertCDRsBatchTx(ctx, tx, cdrs[3:], nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	var missing int
+	if err := tx.GetContext(ctx, &missing, "SELECT COUNT(*) FROM rmscdr WHERE call_key IS NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if missing != 0 {
+		t.Errorf("%d rows were stored without a call_key", missing)
+	}
+	// a plain insert of a stored call now hits the unique index
+	if _, err := InsertCDRsBatchTx(ctx, tx, cdrs[2:3]); err == nil {
+		t.Error("a call bulk loaded before was inserted again")
+	}
+}
+
+func TestEnsureCallKeyMergesCallsStoredTwice(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	if err := ensureTable(ctx, db, TableCDR); err != nil {
+		t.Fatal(err)
+	}
+	// the loader stored a call again for every import of the same export before it had a call_key
+	cdrs := benchCDRs(2)
+	copied := cdrs[0]
+	copied.UID = "copied"
+	copied.Duration = 70
+	same := cdrs[0]
+	same.UID = "same"
+	for _, cdr := range []model.RMSCDR{cdrs[0], cdrs[1], copied, same} {
+		if _, err := db.NamedExec(`INSERT INTO rmscdr (uid, direction, time, unix_timestamp, flagged, source, destination, duration, size, exists_in_db, local_copy, authentic, file_name, sip_call_id)
+			VALUES (:uid, :direction, :time, :unix_timestamp, :flagged, :source, :destination, :duration, :size, :exists_in_db, :local_copy, :authentic, :file_name, :sip_call_id)`, cdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := EnsureCallKey(ctx, db); err != nil {
+		t.Fatalf("EnsureCallKey with calls stored twice: %v", err)
+	}
+	var stored []string
+	if err := db.Select(&stored, "SELECT uid FROM rmscdr ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(stored) != fmt.Sprint([]string{cdrs[0].UID, cdrs[1].UID}) {
+		t.Errorf("stored %v, want the first row of each call", stored)
+	}
+	var history []model.CDRChange
+	if err := db.Select(&history, "SELECT uid, column_name, old_value, new_value, import_file_id FROM rmscdr_history ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	want := []model.CDRChange{
+		{UID: cdrs[0].UID, Column: "uid", OldValue: "copied", NewValue: cdrs[0].UID},
+		{UID: cdrs[0].UID, Column: "duration", OldValue: "70", NewValue: "65"},
+		{UID: cdrs[0].UID, Column: "uid", OldValue: "same", NewValue: cdrs[0].UID},
+	}
+	if fmt.Sprint(history) != fmt.Sprint(want) {
+		t.Errorf("history %+v, want %+v", history, want)
+	}
+	var purged []string
+	if err := db.Select(&purged, "SELECT p.uid FROM retention_purged p JOIN retention_audit a ON a.id = p.audit_id WHERE a.rule_name = ? ORDER BY p.uid", MergeRuleName); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(purged) != "[copied same]" {
+		t.Errorf("purged %v, want the deleted copies", purged)
+	}
+
+	// the first upsert matches the kept row and a second run merges nothing
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	reexported := cdrs[0]
+	reexported.Duration = 80
+	result, err := UpsertCDRsBatchTx(ctx, tx, []model.RMSCDR{reexported}, []string{"duration"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Inserted) != 0 || len(result.Updated) != 1 {
+		t.Errorf("upsert inserted %d and updated %d calls, want the kept row updated", len(result.Inserted), len(result.Updated))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureCallKey(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	var audits int
+	if err := db.Get(&audits, "SELECT COUNT(*) FROM retention_audit"); err != nil {
+		t.Fatal(err)
+	}
+	if audits != 1 {
+		t.Errorf("%d merges recorded, want 1", audits)
+	}
+}
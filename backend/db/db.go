@@ -2,14 +2,15 @@ package db
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
 
 	"github.com/jmoiron/sqlx"
 
+	"github.com/pienaahj/rmsloader/backend/apperr"
 	li "github.com/pienaahj/rmsloader/backend/logwrapper"
 	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/privacy"
 )
 
 
@@ -46,14 +47,14 @@ func CheckDB(ctx context.Context, db *sqlx.DB) error {
 	err := db.Ping()
 	if err != nil {
 		li.Logger.L.Printf("Ping failed without context: %v", err)
-		return fmt.Errorf("db.PingContext: %w", err)
+		return apperr.Wrap(apperr.DBConnect, "db.PingContext", err)
 	}
 	li.Logger.L.Info("Mysql status after normal ping: ", status)
 	if err := db.PingContext(ctx); err != nil {
 		status = "down"
 		msg := fmt.Sprintf("PingContext error: %v , db: %s ", err, status)
 		li.Logger.L.Info(CallFrom, msg, err)
-		return fmt.Errorf("db.PingContext: %w", err)
+		return apperr.Wrap(apperr.DBConnect, "db.PingContext", err)
 	}
 
 	li.Logger.L.Info("Mysql status: ", status)
@@ -63,69 +64,31 @@ func CheckDB(ctx context.Context, db *sqlx.DB) error {
 
 // check if the table is existing
 func CheckTableExistsWithShow(ctx context.Context, db *sqlx.DB, tableName string) (bool, error) {
-	var table string
-	// Safely format the query string
-	query := fmt.Sprintf("SHOW TABLES LIKE '%s'", tableName)
-	err := db.GetContext(ctx, &table, query)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil // Table doesn't exist
-		}
-		newErr := fmt.Errorf("db.GetContext error in CheckTable: %w", err)
-		return false, newErr // An error occurred
-	}
-	return table == tableName, nil
+	return storeFor(db).TableExists(ctx, db, tableName)
 }
-// AddCDR adds new recording metadata to the database
-func AddCDR(ctx context.Context, db *sqlx.DB, r *model.RMSCDR) (int64, error) {
-	CallFrom = "AddCDR in db "
-	// get a connection to the database
-	// check if db is still contactable
-	status := "up"
-	if err := db.PingContext(ctx); err != nil {
-		status = "down"
-	}
-	conn, err := db.Conn(ctx)
-	if err != nil {
-		li.Logger.ErrMySQLConnectionMessage(CallFrom, err)
-		return 0, err
-	}
-	defer conn.Close() // Return the connection to the pool.
-	// check if the table is existing
-	tableOK, err := CheckTableExistsWithShow(ctx, db, TableCDR)
+// ensureTable creates a table from the schema of the store if it does not exist yet
+func ensureTable(ctx context.Context, db *sqlx.DB, tableName string) error {
+	CallFrom := "ensureTable in db "
+	store := storeFor(db)
+	tableOK, err := store.TableExists(ctx, db, tableName)
 	if err != nil {
 		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
-		return 0, err
+		return err
 	}
-	if !tableOK {
-		li.Logger.L.Info(CallFrom, "Table does not exist, create it")
-		// create the schema if it doesn't exist
-		result := db.MustExecContext(ctx, schema)
-		if result != nil {
-			msg := fmt.Sprintf("db : %s schema created successfully, result %v ", status, result)
-			li.Logger.L.Info(CallFrom, msg)
-		}
+	if tableOK {
+		return nil
 	}
-
-	// add the new cdr record to the database
-	tx := db.MustBeginTx(ctx, &sql.TxOptions{Isolation: 6, ReadOnly: false})
-	// spew.Dump(r)
-	//durationInSeconds := int64(record.Duration.Seconds())
-	res, err := tx.NamedExecContext(ctx, `INSERT INTO rmscdr (uid, direction, time, unix_timestamp, flagged, source, destination, duration, size, exists_in_db, local_copy, authentic, file_name , msip_call_id )
-		 VALUES (:uid, :direction, :time, :unix_timestamp, :flagged, :source, :destination, :duration, :size, :exists_in_db, :local_copy, :authentic, :file_name, :sip_call_id)`, r)
+	statements, err := store.Schema(tableName)
 	if err != nil {
-		li.Logger.L.Printf("problematic cdr: %#v", r)
-		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
-		return 0, err
+		return err
 	}
-	// ra, _ := res.RowsAffected()
-	idInserted, _ := res.LastInsertId()
-	err = tx.Commit()
-	if err != nil {
-		li.Logger.ErrDbCommitMessage(CallFrom, err)
-		return 0, err
+	li.Logger.L.Info(CallFrom, "Table ", tableName, " does not exist, create it")
+	for _, statement := range statements {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("creating table %s: %w", tableName, err)
+		}
 	}
-	return idInserted, nil
+	return nil
 }
 
 // insertCDRsBatch executes batch inserts for better performance
@@ -142,25 +105,30 @@ func InsertCDRsBatch(ctx context.Context, db *sqlx.DB, batch []model.RMSCDR) (in
 		return 0, err
 	}
 	defer conn.Close() // Return the connection to the pool.
-	// check if the table is existing
-	tableOK, err := CheckTableExistsWithShow(ctx, db, TableCDR)
-	if err != nil {
-		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+	// create the table with its call_key if it doesn't exist
+	if err := EnsureCallKey(ctx, db); err != nil {
 		return 0, err
 	}
-	if !tableOK {
-		li.Logger.L.Info(CallFrom, "Table does not exist, create it")
-		// create the schema if it doesn't exist
-		result := db.MustExecContext(ctx, schema)
-		if result != nil {
-			msg := fmt.Sprintf("db : %s schema created successfully, result %v ", status, result)
-			li.Logger.L.Info(CallFrom, msg)
-		}
-	}
-	li.Logger.L.Printf("%s: Inserting batch of %d records, values: %#v", CallFrom, len(batch), batch)
-	query := `INSERT INTO rmscdr (uid, direction, time, unix_timestamp, flagged, source, destination, duration, size, exists_in_db, local_copy, authentic, file_name, sip_call_id )
-		 VALUES (:uid, :direction, :time, :unix_timestamp, :flagged, :source, :destination, :duration, :size, :exists_in_db, :local_copy, :authentic, :file_name, :sip_call_id )`
-	res, err := db.NamedExecContext(ctx, query, batch)
+	li.Logger.L.Info(CallFrom, "db status: ", status)
+	return insertCDRs(ctx, db, batch)
+}
+
+// InsertCDRsBatchTx inserts a batch of CDRs inside the transaction of an import unit, see PrepareImport
+func InsertCDRsBatchTx(ctx context.Context, tx *sqlx.Tx, batch []model.RMSCDR) (int64, error) {
+	return insertCDRs(ctx, tx, batch)
+}
+
+// insertCDRs inserts a batch of CDRs in one statement, each with its call_key so the unique index sees it
+func insertCDRs(ctx context.Context, e sqlx.ExtContext, batch []model.RMSCDR) (int64, error) {
+	CallFrom := "insertCDRs in db "
+	li.Logger.L.Printf("%s: Inserting batch of %d records, values: %#v", CallFrom, len(batch), privacy.CDRsForLog(batch))
+	rows := make([]keyedCDR, len(batch))
+	for i, cdr := range batch {
+		rows[i] = keyedCDR{cdr, cdr.CallKey()}
+	}
+	query := `INSERT INTO rmscdr (uid, direction, time, unix_timestamp, flagged, source, destination, duration, size, exists_in_db, local_copy, authentic, file_name, sip_call_id, call_key )
+		 VALUES (:uid, :direction, :time, :unix_timestamp, :flagged, :source, :destination, :duration, :size, :exists_in_db, :local_copy, :authentic, :file_name, :sip_call_id, :call_key )`
+	res, err := sqlx.NamedExecContext(ctx, e, query, rows)
 	if err != nil {
 		return 0, err
 	}
@@ -209,25 +177,3 @@ func CountCDR(ctx context.Context, db *sqlx.DB) (int64, error) {
 	}
 	return count, nil
 }
-
-// get a cdr by uid
-func GetCDRByUID(ctx context.Context, db *sqlx.DB, uid string) (string, error) {
-	CallFrom = "GetCDRByUID "
-	var cdr *model.RMSCDR
-	tableOK, err := CheckTableExistsWithShow(ctx, db, TableCDR)
-	if err != nil {
-		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
-		return "", err
-	}
-	if !tableOK {
-		li.Logger.L.Info(CallFrom, "Table does not exist")
-		err := errors.New("table does not exist")
-		return "", err
-	}
-	err = db.GetContext(ctx, &cdr, "SELECT * FROM rmscdr WHERE uid = ?", uid)
-	if err != nil {
-		li.Logger.ErrMySQLRetrieveMessage(CallFrom, fmt.Sprint(uid), err)
-		return "", err
-	}
-	return cdr.UID, nil
-}
\ No newline at end of file
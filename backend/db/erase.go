@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// AnonymiseCDRs writes the replaced source and destination of a chunk of CDRs in one transaction.
+// chained is called inside the transaction with the rows as they are now, to link them to the hash chain.
+func AnonymiseCDRs(ctx context.Context, db *sqlx.DB, chunk []model.RMSCDR, chained func(CDRTx, []model.RMSCDR) error) (int64, error) {
+	CallFrom := "AnonymiseCDRs in db "
+	if len(chunk) == 0 {
+		return 0, nil
+	}
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		li.Logger.ErrMySQLConnectionMessage(CallFrom, err)
+		return 0, err
+	}
+	defer tx.Rollback()
+	var updated int64
+	for _, cdr := range chunk {
+		res, err := tx.ExecContext(ctx, tx.Rebind("UPDATE rmscdr SET source = ?, destination = ? WHERE id = ?"), cdr.Source, cdr.Destination, cdr.ID)
+		if err != nil {
+			li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+			return 0, fmt.Errorf("anonymising rmscdr: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		updated += n
+	}
+	if chained != nil {
+		if err := chained(&sqlTx{tx: tx}, chunk); err != nil {
+			return 0, fmt.Errorf("chaining anonymised rows: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		li.Logger.ErrDbCommitMessage(CallFrom, err)
+		return 0, err
+	}
+	return updated, nil
+}
+
+// EraseHistory removes the values from the source and destination changes in rmscdr_history.
+// With anonymise the values are replaced by erased, otherwise the changes are deleted.
+func EraseHistory(ctx context.Context, db *sqlx.DB, values []string, anonymise bool, erased string) (int64, error) {
+	CallFrom := "EraseHistory in db "
+	if len(values) == 0 {
+		return 0, nil
+	}
+	exists, err := CheckTableExistsWithShow(ctx, db, TableHistory)
+	if err != nil || !exists {
+		return 0, err
+	}
+	in := "(" + strings.TrimSuffix(strings.Repeat("?,", len(values)), ",") + ")"
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	columns := "column_name IN ('source', 'destination')"
+	var statements []string
+	var stmtArgs [][]interface{}
+	if anonymise {
+		for _, column := range []string{"old_value", "new_value"} {
+			statements = append(statements, "UPDATE rmscdr_history SET "+column+" = ? WHERE "+columns+" AND "+column+" IN "+in)
+			stmtArgs = append(stmtArgs, append([]interface{}{erased}, args...))
+		}
+	} else {
+		statements = append(statements, "DELETE FROM rmscdr_history WHERE "+columns+" AND (old_value IN "+in+" OR new_value IN "+in+")")
+		stmtArgs = append(stmtArgs, append(append([]interface{}{}, args...), args...))
+	}
+	var changed int64
+	for i, statement := range statements {
+		res, err := db.ExecContext(ctx, db.Rebind(statement), stmtArgs[i]...)
+		if err != nil {
+			li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+			return changed, fmt.Errorf("erasing %s: %w", TableHistory, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return changed, err
+		}
+		changed += n
+	}
+	return changed, nil
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// StreamCDRs calls fn for every CDR matching the where clause in time order without loading them all
+func StreamCDRs(ctx context.Context, db *sqlx.DB, where string, args []interface{}, fn func(model.RMSCDR) error) error {
+	CallFrom := "StreamCDRs in db "
+	if where == "" {
+		where = "1 = 1"
+	}
+	rows, err := db.QueryxContext(ctx, db.Rebind("SELECT "+cdrColumns+" FROM rmscdr WHERE "+where+" ORDER BY unix_timestamp, id"), args...)
+	if err != nil {
+		li.Logger.ErrCDRRetrievalMessage(CallFrom, err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cdr model.RMSCDR
+		if err := rows.StructScan(&cdr); err != nil {
+			return err
+		}
+		if err := fn(cdr); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
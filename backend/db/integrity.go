@@ -0,0 +1,213 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+const (
+	TableHash  = "rmscdr_hash"
+	TableChain = "rmscdr_chain"
+)
+
+var hashSchema = `
+CREATE TABLE IF NOT EXISTS rmscdr_hash (
+	id BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	uid VARCHAR(50) NOT NULL,
+	file_name VARCHAR(100),
+	sha256 CHAR(64) NOT NULL,
+	size BIGINT,
+	hashed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX (uid)
+);`
+
+var chainSchema = `
+CREATE TABLE IF NOT EXISTS rmscdr_chain (
+	seq BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	uid VARCHAR(50) NOT NULL,
+	prev_hash CHAR(64) NOT NULL,
+	row_hash CHAR(64) NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX (uid)
+);`
+
+// ChainRow is a chain entry joined with the current state of its CDR, CDR is nil if the row was deleted
+type ChainRow struct {
+	Entry model.ChainEntry
+	CDR   *model.RMSCDR
+	// the row was deleted by a retention purge
+	Purged bool
+}
+
+// InsertRecordingHashes stores the hashes of the recordings linked to a batch of CDRs
+func InsertRecordingHashes(ctx context.Context, db *sqlx.DB, hashes []model.RecordingHash) (int64, error) {
+	CallFrom := "InsertRecordingHashes in db "
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+	if err := ensureTable(ctx, db, TableHash); err != nil {
+		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+		return 0, err
+	}
+	return insertRecordingHashes(ctx, db, hashes)
+}
+
+// InsertRecordingHashesTx stores the recording hashes of a batch inside the transaction of an import unit
+func InsertRecordingHashesTx(ctx context.Context, tx *sqlx.Tx, hashes []model.RecordingHash) (int64, error) {
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+	return insertRecordingHashes(ctx, tx, hashes)
+}
+
+// insertRecordingHashes inserts the recording hashes of a batch in one statement
+func insertRecordingHashes(ctx context.Context, e sqlx.ExtContext, hashes []model.RecordingHash) (int64, error) {
+	CallFrom := "insertRecordingHashes in db "
+	res, err := sqlx.NamedExecContext(ctx, e, `INSERT INTO rmscdr_hash (uid, file_name, sha256, size, hashed_at)
+		 VALUES (:uid, :file_name, :sha256, :size, :hashed_at)`, hashes)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return 0, fmt.Errorf("inserting recording hashes: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// StreamRecordingHashes calls fn for every stored recording hash in import order
+func StreamRecordingHashes(ctx context.Context, db *sqlx.DB, fn func(model.RecordingHash) error) error {
+	CallFrom := "StreamRecordingHashes in db "
+	if err := ensureTable(ctx, db, TableHash); err != nil {
+		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+		return err
+	}
+	rows, err := db.QueryxContext(ctx, "SELECT uid, file_name, sha256, size, hashed_at FROM rmscdr_hash ORDER BY id")
+	if err != nil {
+		li.Logger.ErrMySQLRetrieveMessage(CallFrom, TableHash, err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h model.RecordingHash
+		if err := rows.StructScan(&h); err != nil {
+			return err
+		}
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// LastChainHashTx returns the row hash at the end of the chain, empty if the chain is empty.
+// The last entry stays locked until the transaction ends so concurrent imports append in turn.
+func LastChainHashTx(ctx context.Context, tx *sqlx.Tx) (string, error) {
+	CallFrom := "LastChainHashTx in db "
+	var last string
+	err := tx.GetContext(ctx, &last, "SELECT row_hash FROM rmscdr_chain ORDER BY seq DESC LIMIT 1"+storeFor(tx).ForUpdate())
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		li.Logger.ErrMySQLRetrieveMessage(CallFrom, TableChain, err)
+		return "", err
+	}
+	return last, nil
+}
+
+// InsertChainEntriesTx appends entries to the hash chain in the order given inside the transaction of an import unit
+func InsertChainEntriesTx(ctx context.Context, tx *sqlx.Tx, entries []model.ChainEntry) (int64, error) {
+	CallFrom := "InsertChainEntriesTx in db "
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	res, err := tx.NamedExecContext(ctx, `INSERT INTO rmscdr_chain (uid, prev_hash, row_hash, created_at)
+		 VALUES (:uid, :prev_hash, :row_hash, :created_at)`, entries)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return 0, fmt.Errorf("appending to the hash chain: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// StreamChain calls fn for every chain entry in chain order together with the current CDR row
+func StreamChain(ctx context.Context, db *sqlx.DB, fn func(ChainRow) error) error {
+	CallFrom := "StreamChain in db "
+	if err := ensureTable(ctx, db, TableChain); err != nil {
+		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+		return err
+	}
+	if err := ensureTable(ctx, db, TableRetentionPurged); err != nil {
+		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+		return err
+	}
+	rows, err := db.QueryxContext(ctx, `SELECT c.seq, c.uid, c.prev_hash, c.row_hash, c.created_at,
+		r.uid, r.direction, r.unix_timestamp, r.flagged, r.source, r.destination, r.duration, r.size,
+		r.exists_in_db, r.local_copy, r.authentic, r.file_name, r.sip_call_id, p.uid IS NOT NULL
+		FROM rmscdr_chain c LEFT JOIN rmscdr r ON r.uid = c.uid LEFT JOIN retention_purged p ON p.uid = c.uid
+		ORDER BY c.seq`)
+	if err != nil {
+		li.Logger.ErrMySQLRetrieveMessage(CallFrom, TableChain, err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			row                            ChainRow
+			uid, direction, source, dest   sql.NullString
+			authentic, fileName, sipCallID sql.NullString
+			unixTimestamp, duration        sql.NullInt64
+			flagged, existsInDB, localCopy sql.NullBool
+			size                           sql.NullFloat64
+		)
+		err := rows.Scan(&row.Entry.Seq, &row.Entry.UID, &row.Entry.PrevHash, &row.Entry.RowHash, &row.Entry.CreatedAt,
+			&uid, &direction, &unixTimestamp, &flagged, &source, &dest, &duration, &size,
+			&existsInDB, &localCopy, &authentic, &fileName, &sipCallID, &row.Purged)
+		if err != nil {
+			return err
+		}
+		if uid.Valid {
+			row.CDR = &model.RMSCDR{
+				UID:           uid.String,
+				Direction:     direction.String,
+				UnixTimestamp: unixTimestamp.Int64,
+				Flagged:       flagged.Bool,
+				Source:        source.String,
+				Destination:   dest.String,
+				Duration:      duration.Int64,
+				Size:          size.Float64,
+				ExistsINDB:    existsInDB.Bool,
+				LocalCopy:     localCopy.Bool,
+				Authentic:     authentic.String,
+				FileName:      fileName.String,
+				SipCallID:     sipCallID.String,
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// CountUnchainedCDRs returns the number of CDR rows without an entry in the hash chain
+func CountUnchainedCDRs(ctx context.Context, db *sqlx.DB) (int64, error) {
+	CallFrom := "CountUnchainedCDRs in db "
+	if err := ensureTable(ctx, db, TableChain); err != nil {
+		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+		return 0, err
+	}
+	var count int64
+	err := db.GetContext(ctx, &count, `SELECT COUNT(*) FROM rmscdr r
+		WHERE NOT EXISTS (SELECT 1 FROM rmscdr_chain c WHERE c.uid = r.uid)`)
+	if err != nil {
+		li.Logger.ErrCDRRetrievalMessage(CallFrom, err)
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+const TableImportFiles = "import_files"
+
+var importFilesSchema = `
+CREATE TABLE IF NOT EXISTS import_files (
+	id BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	file_name VARCHAR(255) NOT NULL,
+	sha256 CHAR(64) NOT NULL,
+	size BIGINT NOT NULL,
+	rows_total BIGINT NOT NULL DEFAULT 0,
+	rows_loaded BIGINT NOT NULL DEFAULT 0,
+	status VARCHAR(10) NOT NULL,
+	error TEXT,
+	started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	finished_at TIMESTAMP NULL,
+	UNIQUE KEY (sha256)
+);`
+
+// PrepareImport creates the tables written by an import up front, table changes would commit an open transaction
+func PrepareImport(ctx context.Context, db *sqlx.DB) error {
+	CallFrom := "PrepareImport in db "
+	for _, table := range []string{TableCDR, TableAudio, TableHash, TableChain, TableImportFiles, TableImportRuns} {
+		if err := ensureTable(ctx, db, table); err != nil {
+			li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// GetImportFile returns the ledger entry of a file by its content hash, nil if it was never imported
+func GetImportFile(ctx context.Context, db *sqlx.DB, sha256 string) (*model.ImportFile, error) {
+	CallFrom := "GetImportFile in db "
+	var f model.ImportFile
+	err := db.GetContext(ctx, &f, db.Rebind(`SELECT id, file_name, sha256, size, rows_total, rows_loaded, status, COALESCE(error, '') AS error, started_at, finished_at
+		FROM import_files WHERE sha256 = ?`), sha256)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		li.Logger.ErrMySQLRetrieveMessage(CallFrom, TableImportFiles, err)
+		return nil, err
+	}
+	return &f, nil
+}
+
+// StartImportFile writes the ledger entry of a file before its rows are loaded, a retried file keeps its entry
+func StartImportFile(ctx context.Context, db *sqlx.DB, f *model.ImportFile) error {
+	CallFrom := "StartImportFile in db "
+	f.Status = model.ImportLoading
+	f.StartedAt = time.Now()
+	if f.ID != 0 {
+		_, err := db.ExecContext(ctx, db.Rebind("UPDATE import_files SET file_name = ?, rows_total = ?, status = ?, error = NULL, started_at = ?, finished_at = NULL WHERE id = ?"),
+			f.FileName, f.Rows, f.Status, f.StartedAt, f.ID)
+		if err != nil {
+			li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+			return fmt.Errorf("restarting import ledger entry: %w", err)
+		}
+		return nil
+	}
+	id, err := storeFor(db).InsertID(ctx, db, `INSERT INTO import_files (file_name, sha256, size, rows_total, rows_loaded, status, started_at)
+		VALUES (:file_name, :sha256, :size, :rows_total, :rows_loaded, :status, :started_at)`, f)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return fmt.Errorf("writing import ledger entry: %w", err)
+	}
+	f.ID = id
+	return nil
+}
+
+// UpdateImportFileTx records the rows committed with a unit of the file in the same transaction,
+// the file is loaded once all its rows are
+func UpdateImportFileTx(ctx context.Context, tx *sqlx.Tx, f *model.ImportFile) error {
+	CallFrom := "UpdateImportFileTx in db "
+	var finished *time.Time
+	status := model.ImportLoading
+	if f.RowsLoaded >= f.Rows {
+		now := time.Now()
+		finished = &now
+		status = model.ImportLoaded
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind("UPDATE import_files SET rows_loaded = ?, status = ?, finished_at = ? WHERE id = ?"),
+		f.RowsLoaded, status, finished, f.ID); err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return fmt.Errorf("updating import ledger entry: %w", err)
+	}
+	f.Status = status
+	f.FinishedAt = finished
+	return nil
+}
+
+// FailImportFile marks a file as failed after its transaction was rolled back, the next run retries it
+func FailImportFile(ctx context.Context, db *sqlx.DB, f *model.ImportFile, cause error) error {
+	CallFrom := "FailImportFile in db "
+	now := time.Now()
+	f.Status = model.ImportFailed
+	f.Error = cause.Error()
+	f.FinishedAt = &now
+	if _, err := db.ExecContext(ctx, db.Rebind("UPDATE import_files SET status = ?, error = ?, finished_at = ? WHERE id = ?"),
+		f.Status, f.Error, now, f.ID); err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return fmt.Errorf("marking import ledger entry failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+)
+
+// the defaults of the lock settings
+const (
+	DefaultLockName  = "rmsloader-import"
+	defaultHeartbeat = 15 * time.Second
+)
+
+// errNoSessionLocks is returned by the stores whose database has no session locks
+var errNoSessionLocks = errors.New("the database has no session locks")
+
+// ImportLock is held by the one loader allowed to import into a database
+type ImportLock interface {
+	// Lost is closed when the lock can no longer be confirmed, the import has to stop
+	Lost() <-chan struct{}
+	// Release frees the lock and stops its heartbeat
+	Release(ctx context.Context) error
+}
+
+// LockHolder names one acquisition of a lock, the host and process id of this loader and a random token.
+// The lock table lets a holder take its own lock again, so two imports of the same process must not share one.
+func LockHolder() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), uuid.NewString()[:8])
+}
+
+// RunLock is an ImportLock in the database. On MySQL it is a GET_LOCK and on PostgreSQL an advisory lock,
+// held by a connection of its own and freed by the server when the connection drops. On SQLite it is a row
+// of job_locks that expires unless the heartbeat renews it, so the lock of a loader that died goes stale
+// and is taken over. The scheduled jobs hold such a row on every database, see AcquireTableLock.
+type RunLock struct {
+	db     *sqlx.DB
+	name   string
+	holder string
+	// the connection holding a session lock, nil for the lock table
+	conn     *sqlx.Conn
+	interval time.Duration
+	lost     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// AcquireImportLock takes the named lock without waiting and starts its heartbeat. It fails with DB_LOCKED
+// when another loader holds the lock. The lock table entry expires after three missed heartbeats.
+func AcquireImportLock(ctx context.Context, db *sqlx.DB, name string, holder string, heartbeat time.Duration) (*RunLock, error) {
+	op := "db.AcquireImportLock"
+	l := newRunLock(db, name, holder, heartbeat)
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.DBConnect, op, err)
+	}
+	taken, err := storeFor(db).SessionLock(ctx, conn, name)
+	switch {
+	case errors.Is(err, errNoSessionLocks):
+		conn.Close()
+		if taken, err = TryLock(ctx, db, name, holder, l.ttl()); err != nil {
+			return nil, apperr.Wrap(apperr.DBWrite, op, err)
+		}
+		if !taken {
+			return nil, apperr.New(apperr.DBLocked, op, "another import is running, held by "+lockTableHolder(ctx, db, name))
+		}
+	case err != nil:
+		conn.Close()
+		return nil, apperr.Wrap(apperr.DBRead, op, err)
+	case !taken:
+		conn.Close()
+		return nil, apperr.New(apperr.DBLocked, op, "another import is running")
+	default:
+		l.conn = conn
+	}
+	go l.heartbeat()
+	return l, nil
+}
+
+// AcquireTableLock takes the named lock in the lock table on every database, without waiting, and renews it
+// every heartbeat until it is released. It fails with DB_LOCKED when another holder has the lock. The entry
+// expires after three missed heartbeats.
+func AcquireTableLock(ctx context.Context, db *sqlx.DB, name string, holder string, heartbeat time.Duration) (*RunLock, error) {
+	op := "db.AcquireTableLock"
+	l := newRunLock(db, name, holder, heartbeat)
+	taken, err := TryLock(ctx, db, name, holder, l.ttl())
+	if err != nil {
+		return nil, apperr.Wrap(apperr.DBWrite, op, err)
+	}
+	if !taken {
+		return nil, apperr.New(apperr.DBLocked, op, "the lock "+name+" is held by "+lockTableHolder(ctx, db, name))
+	}
+	go l.heartbeat()
+	return l, nil
+}
+
+func newRunLock(db *sqlx.DB, name string, holder string, heartbeat time.Duration) *RunLock {
+	if heartbeat <= 0 {
+		heartbeat = defaultHeartbeat
+	}
+	return &RunLock{
+		db:       db,
+		name:     name,
+		holder:   holder,
+		interval: heartbeat,
+		lost:     make(chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// heartbeat confirms the lock every interval until it is released. A session lock is held as long as its
+// connection answers, a lock table entry is renewed.
+func (l *RunLock) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), l.interval)
+		err := l.confirm(ctx)
+		cancel()
+		if err != nil {
+			li.Logger.L.WithFields(logrus.Fields{
+				"lock":   l.name,
+				"holder": l.holder,
+				"err":    err,
+			}).Error("lock lost")
+			close(l.lost)
+			return
+		}
+	}
+}
+
+func (l *RunLock) confirm(ctx context.Context) error {
+	if l.conn != nil {
+		return l.conn.PingContext(ctx)
+	}
+	taken, err := TryLock(ctx, l.db, l.name, l.holder, l.ttl())
+	if err != nil {
+		return err
+	}
+	if !taken {
+		return fmt.Errorf("the lock was taken over by %s", lockTableHolder(ctx, l.db, l.name))
+	}
+	return nil
+}
+
+func (l *RunLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *RunLock) Release(ctx context.Context) error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+		if l.conn == nil {
+			err = Unlock(ctx, l.db, l.name, l.holder)
+			return
+		}
+		err = storeFor(l.db).SessionUnlock(ctx, l.conn, l.name)
+		if cerr := l.conn.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// ttl is the time a lock table entry is good for without a heartbeat
+func (l *RunLock) ttl() time.Duration {
+	return 3 * l.interval
+}
+
+// lockTableHolder describes the holder of a lock table entry for the logs
+func lockTableHolder(ctx context.Context, db *sqlx.DB, name string) string {
+	var row struct {
+		Holder     string     `db:"holder"`
+		AcquiredAt *time.Time `db:"acquired_at"`
+	}
+	err := db.GetContext(ctx, &row, db.Rebind("SELECT holder, acquired_at FROM job_locks WHERE name = ?"), name)
+	if err != nil || row.AcquiredAt == nil {
+		return "an unknown loader"
+	}
+	return fmt.Sprintf("%s since %s", row.Holder, row.AcquiredAt.Format(time.RFC3339))
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+)
+
+// sqliteDB opens a new sqlite database for one test
+func sqliteDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	store, err := Open(context.Background(), DriverSQLite, filepath.Join(t.TempDir(), "lock.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DB().Close() })
+	return store.DB()
+}
+
+func TestImportLockExcludesOtherLoaders(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	lock, err := AcquireImportLock(ctx, db, DefaultLockName, "a:1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AcquireImportLock(ctx, db, DefaultLockName, "b:2", time.Minute); !errors.Is(err, apperr.ErrDBLocked) {
+		t.Fatalf("a second loader got %v, want DB_LOCKED", err)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = AcquireImportLock(ctx, db, DefaultLockName, "b:2", time.Minute)
+	if err != nil {
+		t.Fatalf("the released lock was not free: %v", err)
+	}
+	lock.Release(ctx)
+}
+
+func TestImportLockExcludesSameProcess(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	// two imports of one serve process each name a holder of their own
+	lock, err := AcquireImportLock(ctx, db, DefaultLockName, LockHolder(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release(ctx)
+	if _, err := AcquireImportLock(ctx, db, DefaultLockName, LockHolder(), time.Minute); !errors.Is(err, apperr.ErrDBLocked) {
+		t.Fatalf("a second import of the process got %v, want DB_LOCKED", err)
+	}
+}
+
+func TestTableLockRenewed(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	lock, err := AcquireTableLock(ctx, db, "schedule:import", LockHolder(), 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release(ctx)
+	// well past the first expiry, the heartbeat has kept the lock
+	time.Sleep(150 * time.Millisecond)
+	if taken, err := TryLock(ctx, db, "schedule:import", "b:2", time.Hour); err != nil || taken {
+		t.Errorf("another loader took a renewed lock: %v", err)
+	}
+	if _, err := AcquireTableLock(ctx, db, "schedule:import", LockHolder(), time.Minute); !errors.Is(err, apperr.ErrDBLocked) {
+		t.Errorf("a second job got %v, want DB_LOCKED", err)
+	}
+}
+
+func TestImportLockTakesOverStaleLock(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	// a loader that died left its lock behind, it ran out a second ago
+	if taken, err := TryLock(ctx, db, DefaultLockName, "a:1", -time.Second); err != nil || !taken {
+		t.Fatalf("a could not take the lock: %v", err)
+	}
+	lock, err := AcquireImportLock(ctx, db, DefaultLockName, "b:2", time.Minute)
+	if err != nil {
+		t.Fatalf("the stale lock was not taken over: %v", err)
+	}
+	lock.Release(ctx)
+}
+
+func TestImportLockLost(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	lock, err := AcquireImportLock(ctx, db, DefaultLockName, "a:1", 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release(ctx)
+	// another loader took the lock over while a was stalled
+	_, err = db.ExecContext(ctx, "UPDATE job_locks SET holder = 'b:2', expires_at = ? WHERE name = ?", time.Now().UTC().Add(time.Hour), DefaultLockName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lock.Lost():
+	case <-time.After(2 * time.Second):
+		t.Fatal("the heartbeat did not notice the lock was taken over")
+	}
+	// the lock of b is left alone by the release of a
+	lock.Release(ctx)
+	if taken, err := TryLock(ctx, db, DefaultLockName, "c:3", time.Hour); err != nil || taken {
+		t.Errorf("c took the lock b holds: %v", err)
+	}
+}
@@ -0,0 +1,521 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// ErrTxDone is returned by a MemoryRepository transaction used after Commit or Rollback
+var ErrTxDone = errors.New("transaction already committed or rolled back")
+
+// MemoryRepository is a CDRRepository held in memory for tests. It keeps the rules of the sql
+// repository that an import relies on: a transaction is applied at Commit or not at all, a call
+// is stored once after EnsureCallKey and the ledger entries are updated the same way.
+// Transactions are applied one after the other, a commit replaces what was written since the
+// transaction began.
+type MemoryRepository struct {
+	// Fail is called with the name of every method before it runs, a non nil error is returned
+	// by the method instead, eg. "UpsertCDRs" or "Commit"
+	Fail func(op string) error
+
+	mu    sync.Mutex
+	state memState
+	// the holders of the import locks by name, a lock is not part of a transaction
+	locks map[string]string
+}
+
+// memState is everything a MemoryRepository stores
+type memState struct {
+	cdrs      []model.RMSCDR
+	audio     []model.AudioInfo
+	hashes    []model.RecordingHash
+	chain     []model.ChainEntry
+	files     []model.ImportFile
+	runs      []model.ImportRun
+	history   []model.CDRChange
+	summaries []model.CallSummary
+	// calls are unique once the call key is ensured
+	keyed  bool
+	nextID int64
+}
+
+// clone copies the state so a transaction can change it on its own
+func (s memState) clone() memState {
+	s.cdrs = slices.Clone(s.cdrs)
+	s.audio = slices.Clone(s.audio)
+	s.hashes = slices.Clone(s.hashes)
+	s.chain = slices.Clone(s.chain)
+	s.files = slices.Clone(s.files)
+	s.runs = slices.Clone(s.runs)
+	s.history = slices.Clone(s.history)
+	s.summaries = slices.Clone(s.summaries)
+	return s
+}
+
+// id returns the next generated id
+func (s *memState) id() int64 {
+	s.nextID++
+	return s.nextID
+}
+
+// stored returns the stored calls by their call key
+func (s *memState) stored() map[string]int {
+	keys := make(map[string]int, len(s.cdrs))
+	for i, cdr := range s.cdrs {
+		keys[cdr.CallKey()] = i
+	}
+	return keys
+}
+
+// NewMemoryRepository returns an empty repository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{}
+}
+
+func (r *MemoryRepository) fail(op string) error {
+	if r.Fail == nil {
+		return nil
+	}
+	return r.Fail(op)
+}
+
+// CDRs returns the stored calls in insert order
+func (r *MemoryRepository) CDRs() []model.RMSCDR {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.state.cdrs)
+}
+
+// Audio returns the stored recording details
+func (r *MemoryRepository) Audio() []model.AudioInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.state.audio)
+}
+
+// RecordingHashes returns the stored recording hashes
+func (r *MemoryRepository) RecordingHashes() []model.RecordingHash {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.state.hashes)
+}
+
+// Chain returns the hash chain in chain order
+func (r *MemoryRepository) Chain() []model.ChainEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.state.chain)
+}
+
+// ImportFiles returns the import ledger
+func (r *MemoryRepository) ImportFiles() []model.ImportFile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.state.files)
+}
+
+// ImportRuns returns the run records in start order
+func (r *MemoryRepository) ImportRuns() []model.ImportRun {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.state.runs)
+}
+
+// History returns the changes recorded by upserts
+func (r *MemoryRepository) History() []model.CDRChange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.state.history)
+}
+
+// Summaries returns the daily summaries ordered by day and extension
+func (r *MemoryRepository) Summaries() []model.CallSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.state.summaries)
+}
+
+func (r *MemoryRepository) PrepareImport(ctx context.Context) error {
+	return r.fail("PrepareImport")
+}
+
+func (r *MemoryRepository) EnsureCallKey(ctx context.Context) error {
+	if err := r.fail("EnsureCallKey"); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.state.keyed {
+		copies, changes := mergeDuplicates(r.state.cdrs, time.Now())
+		r.state.cdrs = slices.DeleteFunc(r.state.cdrs, func(cdr model.RMSCDR) bool {
+			return slices.ContainsFunc(copies, func(c model.RMSCDR) bool { return c.UID == cdr.UID })
+		})
+		r.state.history = append(r.state.history, changes...)
+	}
+	r.state.keyed = true
+	return nil
+}
+
+func (r *MemoryRepository) GetImportFile(ctx context.Context, sha256 string) (*model.ImportFile, error) {
+	if err := r.fail("GetImportFile"); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.state.files {
+		if f.SHA256 == sha256 {
+			return &f, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemoryRepository) StartImportFile(ctx context.Context, f *model.ImportFile) error {
+	if err := r.fail("StartImportFile"); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f.Status = model.ImportLoading
+	f.StartedAt = time.Now()
+	f.Error = ""
+	f.FinishedAt = nil
+	if f.ID == 0 {
+		for _, stored := range r.state.files {
+			if stored.SHA256 == f.SHA256 {
+				return fmt.Errorf("writing import ledger entry: duplicate sha256 %s", f.SHA256)
+			}
+		}
+		f.ID = r.state.id()
+		r.state.files = append(r.state.files, *f)
+		return nil
+	}
+	return r.state.updateFile(*f)
+}
+
+func (r *MemoryRepository) FailImportFile(ctx context.Context, f *model.ImportFile, cause error) error {
+	if err := r.fail("FailImportFile"); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	f.Status = model.ImportFailed
+	f.Error = cause.Error()
+	f.FinishedAt = &now
+	return r.state.updateFile(*f)
+}
+
+// updateFile replaces the ledger entry with the id of f
+func (s *memState) updateFile(f model.ImportFile) error {
+	for i := range s.files {
+		if s.files[i].ID == f.ID {
+			s.files[i] = f
+			return nil
+		}
+	}
+	return fmt.Errorf("no import ledger entry %d", f.ID)
+}
+
+func (r *MemoryRepository) StartImportRun(ctx context.Context, run *model.ImportRun) error {
+	if err := r.fail("StartImportRun"); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stored := range r.state.runs {
+		if stored.ID == run.ID {
+			return fmt.Errorf("writing import run: duplicate id %s", run.ID)
+		}
+	}
+	r.state.runs = append(r.state.runs, *run)
+	return nil
+}
+
+func (r *MemoryRepository) FinishImportRun(ctx context.Context, run *model.ImportRun) error {
+	if err := r.fail("FinishImportRun"); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.state.runs {
+		if r.state.runs[i].ID == run.ID {
+			r.state.runs[i] = *run
+			return nil
+		}
+	}
+	return fmt.Errorf("no import run %s", run.ID)
+}
+
+func (r *MemoryRepository) LastSucceededImportRun(ctx context.Context) (*model.ImportRun, error) {
+	if err := r.fail("LastSucceededImportRun"); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var last *model.ImportRun
+	for i := range r.state.runs {
+		run := r.state.runs[i]
+		if run.Status == model.RunSucceeded && (last == nil || !run.StartedAt.Before(last.StartedAt)) {
+			last = &run
+		}
+	}
+	return last, nil
+}
+
+func (r *MemoryRepository) LockImport(ctx context.Context, name string, holder string, heartbeat time.Duration) (ImportLock, error) {
+	if err := r.fail("LockImport"); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if other, held := r.locks[name]; held && other != holder {
+		return nil, apperr.New(apperr.DBLocked, "db.MemoryRepository.LockImport", "another import is running, held by "+other)
+	}
+	if r.locks == nil {
+		r.locks = make(map[string]string)
+	}
+	r.locks[name] = holder
+	return &memoryLock{repo: r, name: name, lost: make(chan struct{})}, nil
+}
+
+// memoryLock is the import lock of a MemoryRepository, it is never lost
+type memoryLock struct {
+	repo *MemoryRepository
+	name string
+	lost chan struct{}
+}
+
+func (l *memoryLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *memoryLock) Release(ctx context.Context) error {
+	l.repo.mu.Lock()
+	defer l.repo.mu.Unlock()
+	delete(l.repo.locks, l.name)
+	return nil
+}
+
+// RefreshDailySummary recomputes the summaries of a day the way RefreshDailySummary does in sql
+func (r *MemoryRepository) RefreshDailySummary(ctx context.Context, day time.Time, inbound []string) error {
+	if err := r.fail("RefreshDailySummary"); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 1)
+	summaries := r.state.summaries[:0]
+	for _, s := range r.state.summaries {
+		if !s.Day.Equal(start) {
+			summaries = append(summaries, s)
+		}
+	}
+	byExtension := make(map[string]*model.CallSummary)
+	var extensions []string
+	for _, cdr := range r.state.cdrs {
+		if cdr.UnixTimestamp < start.Unix() || cdr.UnixTimestamp >= end.Unix() {
+			continue
+		}
+		in := slices.Contains(inbound, cdr.Direction)
+		ext := cdr.Source
+		if in {
+			ext = cdr.Destination
+		}
+		s, ok := byExtension[ext]
+		if !ok {
+			s = &model.CallSummary{Day: start, Extension: ext}
+			byExtension[ext] = s
+			extensions = append(extensions, ext)
+		}
+		s.Calls++
+		s.TotalDuration += cdr.Duration
+		s.MaxDuration = max(s.MaxDuration, cdr.Duration)
+		if in {
+			s.Inbound++
+		} else {
+			s.Outbound++
+		}
+		if cdr.Flagged {
+			s.Flagged++
+		}
+		s.TotalSize += cdr.Size
+	}
+	for _, ext := range extensions {
+		summaries = append(summaries, *byExtension[ext])
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if !summaries[i].Day.Equal(summaries[j].Day) {
+			return summaries[i].Day.Before(summaries[j].Day)
+		}
+		return summaries[i].Extension < summaries[j].Extension
+	})
+	r.state.summaries = summaries
+	return nil
+}
+
+func (r *MemoryRepository) Begin(ctx context.Context) (CDRTx, error) {
+	if err := r.fail("Begin"); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &memTx{repo: r, state: r.state.clone()}, nil
+}
+
+// memTx is a MemoryRepository transaction working on a copy of the state
+type memTx struct {
+	repo  *MemoryRepository
+	state memState
+	done  bool
+}
+
+// begin checks the transaction is open and the operation is not failed
+func (t *memTx) begin(op string) error {
+	if t.done {
+		return ErrTxDone
+	}
+	return t.repo.fail(op)
+}
+
+// insert stores calls with a new id, a call stored before fails once the call key is ensured
+func (t *memTx) insert(batch []model.RMSCDR) error {
+	keys := t.state.stored()
+	for _, cdr := range batch {
+		key := cdr.CallKey()
+		if _, ok := keys[key]; ok && t.state.keyed {
+			return fmt.Errorf("duplicate call_key %s of %s", key, cdr.UID)
+		}
+		cdr.ID = t.state.id()
+		keys[key] = len(t.state.cdrs)
+		t.state.cdrs = append(t.state.cdrs, cdr)
+	}
+	return nil
+}
+
+func (t *memTx) BulkLoadCDRs(ctx context.Context, batch []model.RMSCDR) ([]model.RMSCDR, error) {
+	if err := t.begin("BulkLoadCDRs"); err != nil {
+		return nil, err
+	}
+	keys := t.state.stored()
+	var inserted []model.RMSCDR
+	for _, cdr := range distinctCalls(batch) {
+		if _, ok := keys[cdr.CallKey()]; !ok {
+			inserted = append(inserted, cdr)
+		}
+	}
+	if err := t.insert(inserted); err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+func (t *memTx) UpsertCDRs(ctx context.Context, batch []model.RMSCDR, columns []string, importFileID int64) (UpsertResult, error) {
+	if err := t.begin("UpsertCDRs"); err != nil {
+		return UpsertResult{}, err
+	}
+	if err := checkUpsertColumns(columns); err != nil {
+		return UpsertResult{}, err
+	}
+	order, latest := batchCallKeys(batch)
+	keys := t.state.stored()
+	existing := make(map[string]model.RMSCDR, len(order))
+	for _, key := range order {
+		if i, ok := keys[key]; ok {
+			existing[key] = t.state.cdrs[i]
+		}
+	}
+	result, rows := planUpsert(batch, order, latest, existing, columns, importFileID)
+	for _, row := range rows {
+		if i, ok := keys[row.CallKey]; ok {
+			t.state.cdrs[i] = row.RMSCDR
+			continue
+		}
+		row.ID = t.state.id()
+		keys[row.CallKey] = len(t.state.cdrs)
+		t.state.cdrs = append(t.state.cdrs, row.RMSCDR)
+	}
+	for _, change := range result.Changes {
+		change.ID = t.state.id()
+		t.state.history = append(t.state.history, change)
+	}
+	return result, nil
+}
+
+func (t *memTx) InsertAudio(ctx context.Context, batch []model.AudioInfo) (int64, error) {
+	if err := t.begin("InsertAudio"); err != nil {
+		return 0, err
+	}
+	t.state.audio = append(t.state.audio, batch...)
+	return int64(len(batch)), nil
+}
+
+func (t *memTx) InsertRecordingHashes(ctx context.Context, hashes []model.RecordingHash) (int64, error) {
+	if err := t.begin("InsertRecordingHashes"); err != nil {
+		return 0, err
+	}
+	t.state.hashes = append(t.state.hashes, hashes...)
+	return int64(len(hashes)), nil
+}
+
+func (t *memTx) LastChainHash(ctx context.Context) (string, error) {
+	if err := t.begin("LastChainHash"); err != nil {
+		return "", err
+	}
+	if len(t.state.chain) == 0 {
+		return "", nil
+	}
+	return t.state.chain[len(t.state.chain)-1].RowHash, nil
+}
+
+func (t *memTx) InsertChainEntries(ctx context.Context, entries []model.ChainEntry) (int64, error) {
+	if err := t.begin("InsertChainEntries"); err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		entry.Seq = t.state.id()
+		t.state.chain = append(t.state.chain, entry)
+	}
+	return int64(len(entries)), nil
+}
+
+func (t *memTx) UpdateImportFile(ctx context.Context, f *model.ImportFile) error {
+	if err := t.begin("UpdateImportFile"); err != nil {
+		return err
+	}
+	var finished *time.Time
+	status := model.ImportLoading
+	if f.RowsLoaded >= f.Rows {
+		now := time.Now()
+		finished = &now
+		status = model.ImportLoaded
+	}
+	f.Status = status
+	f.FinishedAt = finished
+	return t.state.updateFile(*f)
+}
+
+func (t *memTx) Commit() error {
+	if err := t.begin("Commit"); err != nil {
+		return err
+	}
+	t.done = true
+	t.repo.mu.Lock()
+	defer t.repo.mu.Unlock()
+	t.repo.state = t.state
+	return nil
+}
+
+func (t *memTx) Rollback() error {
+	t.done = true
+	return nil
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// CDRRepository is the storage an import writes to, see SQLRepository and MemoryRepository
+type CDRRepository interface {
+	// PrepareImport creates the tables written by an import
+	PrepareImport(ctx context.Context) error
+	// EnsureCallKey makes the stored calls ready for upserts
+	EnsureCallKey(ctx context.Context) error
+	// GetImportFile returns the ledger entry of a file by its content hash, nil if it was never imported
+	GetImportFile(ctx context.Context, sha256 string) (*model.ImportFile, error)
+	// StartImportFile writes the ledger entry of a file before its rows are loaded
+	StartImportFile(ctx context.Context, f *model.ImportFile) error
+	// FailImportFile marks a file as failed after its transaction was rolled back
+	FailImportFile(ctx context.Context, f *model.ImportFile, cause error) error
+	// StartImportRun writes the record of a run as it starts
+	StartImportRun(ctx context.Context, run *model.ImportRun) error
+	// FinishImportRun records the counts and final status of a run
+	FinishImportRun(ctx context.Context, run *model.ImportRun) error
+	// LastSucceededImportRun returns the latest run that succeeded, nil if there is none
+	LastSucceededImportRun(ctx context.Context) (*model.ImportRun, error)
+	// LockImport takes the named import lock for holder, it fails with DB_LOCKED while another holder has it
+	LockImport(ctx context.Context, name string, holder string, heartbeat time.Duration) (ImportLock, error)
+	// RefreshDailySummary recomputes the summary rows of one day
+	RefreshDailySummary(ctx context.Context, day time.Time, inbound []string) error
+	// Begin opens the transaction of an import unit
+	Begin(ctx context.Context) (CDRTx, error)
+}
+
+// CDRTx is the transaction of an import unit, nothing written through it is stored before Commit
+type CDRTx interface {
+	// BulkLoadCDRs inserts the calls not stored yet and returns them
+	BulkLoadCDRs(ctx context.Context, batch []model.RMSCDR) ([]model.RMSCDR, error)
+	// UpsertCDRs inserts the calls not stored yet and updates the columns of the others, without columns
+	// the calls already stored are left as they are
+	UpsertCDRs(ctx context.Context, batch []model.RMSCDR, columns []string, importFileID int64) (UpsertResult, error)
+	InsertAudio(ctx context.Context, batch []model.AudioInfo) (int64, error)
+	InsertRecordingHashes(ctx context.Context, hashes []model.RecordingHash) (int64, error)
+	// LastChainHash returns the row hash at the end of the chain and holds the chain until the transaction ends
+	LastChainHash(ctx context.Context) (string, error)
+	InsertChainEntries(ctx context.Context, entries []model.ChainEntry) (int64, error)
+	// UpdateImportFile records the rows loaded with the unit in the ledger entry of the file
+	UpdateImportFile(ctx context.Context, f *model.ImportFile) error
+	Commit() error
+	// Rollback discards the transaction, it does nothing after Commit
+	Rollback() error
+}
+
+// SQLRepository is the CDRRepository of a database connection pool
+type SQLRepository struct {
+	DB *sqlx.DB
+}
+
+// NewSQLRepository returns the repository of a connection pool
+func NewSQLRepository(db *sqlx.DB) *SQLRepository {
+	return &SQLRepository{DB: db}
+}
+
+func (r *SQLRepository) PrepareImport(ctx context.Context) error {
+	return PrepareImport(ctx, r.DB)
+}
+
+func (r *SQLRepository) EnsureCallKey(ctx context.Context) error {
+	return EnsureCallKey(ctx, r.DB)
+}
+
+func (r *SQLRepository) GetImportFile(ctx context.Context, sha256 string) (*model.ImportFile, error) {
+	return GetImportFile(ctx, r.DB, sha256)
+}
+
+func (r *SQLRepository) StartImportFile(ctx context.Context, f *model.ImportFile) error {
+	return StartImportFile(ctx, r.DB, f)
+}
+
+func (r *SQLRepository) FailImportFile(ctx context.Context, f *model.ImportFile, cause error) error {
+	return FailImportFile(ctx, r.DB, f, cause)
+}
+
+func (r *SQLRepository) StartImportRun(ctx context.Context, run *model.ImportRun) error {
+	return StartImportRun(ctx, r.DB, run)
+}
+
+func (r *SQLRepository) FinishImportRun(ctx context.Context, run *model.ImportRun) error {
+	return FinishImportRun(ctx, r.DB, run)
+}
+
+func (r *SQLRepository) LastSucceededImportRun(ctx context.Context) (*model.ImportRun, error) {
+	return LastSucceededImportRun(ctx, r.DB)
+}
+
+func (r *SQLRepository) LockImport(ctx context.Context, name string, holder string, heartbeat time.Duration) (ImportLock, error) {
+	return AcquireImportLock(ctx, r.DB, name, holder, heartbeat)
+}
+
+func (r *SQLRepository) RefreshDailySummary(ctx context.Context, day time.Time, inbound []string) error {
+	return RefreshDailySummary(ctx, r.DB, day, inbound)
+}
+
+func (r *SQLRepository) Begin(ctx context.Context) (CDRTx, error) {
+	CallFrom := "SQLRepository.Begin in db "
+	tx, err := r.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		li.Logger.ErrMySQLConnectionMessage(CallFrom, err)
+		return nil, err
+	}
+	return &sqlTx{tx}, nil
+}
+
+// sqlTx is the CDRTx of a database transaction
+type sqlTx struct {
+	tx *sqlx.Tx
+}
+
+func (t *sqlTx) BulkLoadCDRs(ctx context.Context, batch []model.RMSCDR) ([]model.RMSCDR, error) {
+	return BulkLoadCDRsTx(ctx, t.tx, batch)
+}
+
+func (t *sqlTx) UpsertCDRs(ctx context.Context, batch []model.RMSCDR, columns []string, importFileID int64) (UpsertResult, error) {
+	return UpsertCDRsBatchTx(ctx, t.tx, batch, columns, importFileID)
+}
+
+func (t *sqlTx) InsertAudio(ctx context.Context, batch []model.AudioInfo) (int64, error) {
+	return InsertAudioBatchTx(ctx, t.tx, batch)
+}
+
+func (t *sqlTx) InsertRecordingHashes(ctx context.Context, hashes []model.RecordingHash) (int64, error) {
+	return InsertRecordingHashesTx(ctx, t.tx, hashes)
+}
+
+func (t *sqlTx) LastChainHash(ctx context.Context) (string, error) {
+	return LastChainHashTx(ctx, t.tx)
+}
+
+func (t *sqlTx) InsertChainEntries(ctx context.Context, entries []model.ChainEntry) (int64, error) {
+	return InsertChainEntriesTx(ctx, t.tx, entries)
+}
+
+func (t *sqlTx) UpdateImportFile(ctx context.Context, f *model.ImportFile) error {
+	return UpdateImportFileTx(ctx, t.tx, f)
+}
+
+func (t *sqlTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *sqlTx) Rollback() error {
+	return t.tx.Rollback()
+}
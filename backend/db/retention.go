@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+const (
+	TableRetentionAudit  = "retention_audit"
+	TableRetentionPurged = "retention_purged"
+)
+
+var retentionAuditSchema = `
+CREATE TABLE IF NOT EXISTS retention_audit (
+	id BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	rule_name VARCHAR(100) NOT NULL,
+	cutoff TIMESTAMP NULL,
+	dry_run TINYINT(1),
+	rows_matched BIGINT,
+	rows_deleted BIGINT,
+	archive_file VARCHAR(255),
+	started_at TIMESTAMP NULL,
+	finished_at TIMESTAMP NULL
+);`
+
+var retentionPurgedSchema = `
+CREATE TABLE IF NOT EXISTS retention_purged (
+	uid VARCHAR(50) NOT NULL PRIMARY KEY,
+	audit_id BIGINT(20) UNSIGNED NOT NULL,
+	INDEX (audit_id)
+);`
+
+// cdrColumns lists the rmscdr columns in table order. Most columns allow NULL, they are read as their zero
+// value so rows written by other tools can still be scanned into a model.RMSCDR.
+const cdrColumns = "id, uid, COALESCE(direction, '') AS direction, time, COALESCE(unix_timestamp, 0) AS unix_timestamp, " +
+	"COALESCE(flagged, FALSE) AS flagged, COALESCE(source, '') AS source, COALESCE(destination, '') AS destination, " +
+	"COALESCE(duration, 0) AS duration, COALESCE(size, 0) AS size, COALESCE(exists_in_db, FALSE) AS exists_in_db, " +
+	"COALESCE(local_copy, FALSE) AS local_copy, COALESCE(authentic, '') AS authentic, COALESCE(file_name, '') AS file_name, " +
+	"COALESCE(sip_call_id, '') AS sip_call_id"
+
+// CountCDRsWhere returns the number of CDRs matching the where clause and their time range
+func CountCDRsWhere(ctx context.Context, db *sqlx.DB, where string, args []interface{}) (int64, int64, int64, error) {
+	CallFrom := "CountCDRsWhere in db "
+	var res struct {
+		Count int64  `db:"count"`
+		First *int64 `db:"first"`
+		Last  *int64 `db:"last"`
+	}
+	query := "SELECT COUNT(*) AS count, MIN(unix_timestamp) AS first, MAX(unix_timestamp) AS last FROM rmscdr WHERE " + where
+	if err := db.GetContext(ctx, &res, db.Rebind(query), args...); err != nil {
+		li.Logger.ErrCDRRetrievalMessage(CallFrom, err)
+		return 0, 0, 0, err
+	}
+	var first, last int64
+	if res.First != nil {
+		first = *res.First
+	}
+	if res.Last != nil {
+		last = *res.Last
+	}
+	return res.Count, first, last, nil
+}
+
+// SelectCDRChunk returns up to limit CDRs matching the where clause with an id above afterID, in id order
+func SelectCDRChunk(ctx context.Context, db *sqlx.DB, where string, args []interface{}, afterID int64, limit int) ([]model.RMSCDR, error) {
+	CallFrom := "SelectCDRChunk in db "
+	query := "SELECT " + cdrColumns + " FROM rmscdr WHERE (" + where + ") AND id > ? ORDER BY id LIMIT ?"
+	var chunk []model.RMSCDR
+	err := db.SelectContext(ctx, &chunk, db.Rebind(query), append(append([]interface{}{}, args...), afterID, limit)...)
+	if err != nil {
+		li.Logger.ErrCDRRetrievalMessage(CallFrom, err)
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// PurgeCDRs deletes a chunk of CDRs and their audio and hash details in one transaction.
+// The uids are remembered against the audit entry so verify can tell a purge from tampering.
+func PurgeCDRs(ctx context.Context, db *sqlx.DB, auditID int64, chunk []model.RMSCDR) (int64, error) {
+	CallFrom := "PurgeCDRs in db "
+	if len(chunk) == 0 {
+		return 0, nil
+	}
+	if err := ensureTable(ctx, db, TableRetentionPurged); err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		li.Logger.ErrMySQLConnectionMessage(CallFrom, err)
+		return 0, err
+	}
+	defer tx.Rollback()
+	deleted, err := purgeCDRsTx(ctx, db, tx, auditID, chunk)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		li.Logger.ErrDbCommitMessage(CallFrom, err)
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// purgeCDRsTx deletes a chunk of CDRs with their details in tx, retention_purged has to exist
+func purgeCDRsTx(ctx context.Context, db *sqlx.DB, tx *sqlx.Tx, auditID int64, chunk []model.RMSCDR) (int64, error) {
+	CallFrom := "PurgeCDRs in db "
+	ids := make([]interface{}, len(chunk))
+	uids := make([]interface{}, len(chunk))
+	purged := make([]map[string]interface{}, len(chunk))
+	for i, cdr := range chunk {
+		ids[i] = cdr.ID
+		uids[i] = cdr.UID
+		purged[i] = map[string]interface{}{"uid": cdr.UID, "audit_id": auditID}
+	}
+	inIDs := "(" + strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",") + ")"
+	for _, table := range []string{TableAudio, TableHash} {
+		exists, err := CheckTableExistsWithShow(ctx, db, table)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			if _, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM "+table+" WHERE uid IN "+inIDs), uids...); err != nil {
+				return 0, fmt.Errorf("purging %s: %w", table, err)
+			}
+		}
+	}
+	res, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM rmscdr WHERE id IN "+inIDs), ids...)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return 0, fmt.Errorf("purging rmscdr: %w", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.NamedExecContext(ctx, storeFor(db).InsertIgnore("retention_purged (uid, audit_id) VALUES (:uid, :audit_id)"), purged); err != nil {
+		return 0, fmt.Errorf("recording purged uids: %w", err)
+	}
+	return deleted, nil
+}
+
+// StartRetentionAudit writes the audit entry of a purge before any rows are deleted
+func StartRetentionAudit(ctx context.Context, db *sqlx.DB, audit *model.RetentionAudit) error {
+	CallFrom := "StartRetentionAudit in db "
+	if err := ensureTable(ctx, db, TableRetentionAudit); err != nil {
+		return err
+	}
+	id, err := storeFor(db).InsertID(ctx, db, `INSERT INTO retention_audit (rule_name, cutoff, dry_run, rows_matched, rows_deleted, archive_file, started_at, finished_at)
+		VALUES (:rule_name, :cutoff, :dry_run, :rows_matched, :rows_deleted, :archive_file, :started_at, :finished_at)`, audit)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return err
+	}
+	audit.ID = id
+	return nil
+}
+
+// FinishRetentionAudit records the outcome of a purge
+func FinishRetentionAudit(ctx context.Context, db *sqlx.DB, audit *model.RetentionAudit) error {
+	CallFrom := "FinishRetentionAudit in db "
+	_, err := db.NamedExecContext(ctx, `UPDATE retention_audit SET rows_matched = :rows_matched, rows_deleted = :rows_deleted,
+		archive_file = :archive_file, finished_at = :finished_at WHERE id = :id`, audit)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+const TableImportRuns = "import_runs"
+
+var importRunsSchema = `
+CREATE TABLE IF NOT EXISTS import_runs (
+	id CHAR(36) NOT NULL PRIMARY KEY,
+	status VARCHAR(10) NOT NULL,
+	host VARCHAR(255) NOT NULL,
+	version VARCHAR(100) NOT NULL,
+	config_hash CHAR(64) NOT NULL,
+	files_found BIGINT NOT NULL DEFAULT 0,
+	files_imported BIGINT NOT NULL DEFAULT 0,
+	files_skipped BIGINT NOT NULL DEFAULT 0,
+	files_failed BIGINT NOT NULL DEFAULT 0,
+	rows_parsed BIGINT NOT NULL DEFAULT 0,
+	rows_rejected BIGINT NOT NULL DEFAULT 0,
+	rows_inserted BIGINT NOT NULL DEFAULT 0,
+	error TEXT,
+	started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	finished_at TIMESTAMP NULL,
+	INDEX (started_at)
+);`
+
+// importRunColumns lists the import_runs columns in table order
+const importRunColumns = "id, status, host, version, config_hash, files_found, files_imported, files_skipped, files_failed, rows_parsed, rows_rejected, rows_inserted, COALESCE(error, '') AS error, started_at, finished_at"
+
+// StartImportRun writes the record of a run as it starts
+func StartImportRun(ctx context.Context, db *sqlx.DB, run *model.ImportRun) error {
+	CallFrom := "StartImportRun in db "
+	_, err := db.NamedExecContext(ctx, `INSERT INTO import_runs (id, status, host, version, config_hash, started_at)
+		VALUES (:id, :status, :host, :version, :config_hash, :started_at)`, run)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return fmt.Errorf("writing import run: %w", err)
+	}
+	return nil
+}
+
+// FinishImportRun records the counts and final status of a run
+func FinishImportRun(ctx context.Context, db *sqlx.DB, run *model.ImportRun) error {
+	CallFrom := "FinishImportRun in db "
+	_, err := db.NamedExecContext(ctx, `UPDATE import_runs SET status = :status, files_found = :files_found,
+		files_imported = :files_imported, files_skipped = :files_skipped, files_failed = :files_failed,
+		rows_parsed = :rows_parsed, rows_rejected = :rows_rejected, rows_inserted = :rows_inserted,
+		error = :error, finished_at = :finished_at WHERE id = :id`, run)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return fmt.Errorf("updating import run: %w", err)
+	}
+	return nil
+}
+
+// ListImportRuns returns the latest runs, newest first
+func ListImportRuns(ctx context.Context, db *sqlx.DB, limit int) ([]model.ImportRun, error) {
+	CallFrom := "ListImportRuns in db "
+	if err := ensureTable(ctx, db, TableImportRuns); err != nil {
+		return nil, err
+	}
+	var runs []model.ImportRun
+	err := db.SelectContext(ctx, &runs, db.Rebind("SELECT "+importRunColumns+" FROM import_runs ORDER BY started_at DESC LIMIT ?"), limit)
+	if err != nil {
+		li.Logger.ErrMySQLRetrieveMessage(CallFrom, TableImportRuns, err)
+		return nil, err
+	}
+	return runs, nil
+}
+
+// GetImportRun returns a run by its id, nil if there is none
+func GetImportRun(ctx context.Context, db *sqlx.DB, id string) (*model.ImportRun, error) {
+	CallFrom := "GetImportRun in db "
+	if err := ensureTable(ctx, db, TableImportRuns); err != nil {
+		return nil, err
+	}
+	var run model.ImportRun
+	err := db.GetContext(ctx, &run, db.Rebind("SELECT "+importRunColumns+" FROM import_runs WHERE id = ?"), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		li.Logger.ErrMySQLRetrieveMessage(CallFrom, TableImportRuns, err)
+		return nil, err
+	}
+	return &run, nil
+}
+
+// LastSucceededImportRun returns the latest run that succeeded, nil if there is none
+func LastSucceededImportRun(ctx context.Context, db *sqlx.DB) (*model.ImportRun, error) {
+	CallFrom := "LastSucceededImportRun in db "
+	if err := ensureTable(ctx, db, TableImportRuns); err != nil {
+		return nil, err
+	}
+	var run model.ImportRun
+	err := db.GetContext(ctx, &run, db.Rebind("SELECT "+importRunColumns+" FROM import_runs WHERE status = ? ORDER BY started_at DESC LIMIT 1"), model.RunSucceeded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		li.Logger.ErrMySQLRetrieveMessage(CallFrom, TableImportRuns, err)
+		return nil, err
+	}
+	return &run, nil
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// the tables of the scheduler
+const (
+	TableJobLocks = "job_locks"
+	TableJobRuns  = "job_runs"
+)
+
+var jobLocksSchema = `
+CREATE TABLE IF NOT EXISTS job_locks (
+	name VARCHAR(100) NOT NULL PRIMARY KEY,
+	holder VARCHAR(255) NOT NULL,
+	acquired_at TIMESTAMP NULL,
+	expires_at TIMESTAMP NULL
+);`
+
+var jobRunsSchema = `
+CREATE TABLE IF NOT EXISTS job_runs (
+	id BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	job VARCHAR(100) NOT NULL,
+	kind VARCHAR(20) NOT NULL,
+	host VARCHAR(255) NOT NULL,
+	status VARCHAR(10) NOT NULL,
+	error TEXT,
+	scheduled_at TIMESTAMP NULL,
+	started_at TIMESTAMP NULL,
+	finished_at TIMESTAMP NULL,
+	INDEX (started_at)
+);`
+
+// jobRunColumns lists the job_runs columns in table order
+const jobRunColumns = "id, job, kind, host, status, COALESCE(error, '') AS error, scheduled_at, started_at, finished_at"
+
+// TryLock takes the named lock for holder until ttl has passed, unless another holder has it.
+// A lock that was not released in time is taken over, so a loader that died does not block the others.
+func TryLock(ctx context.Context, db *sqlx.DB, name string, holder string, ttl time.Duration) (bool, error) {
+	CallFrom := "TryLock in db "
+	if err := ensureTable(ctx, db, TableJobLocks); err != nil {
+		return false, err
+	}
+	// the times are written in UTC by every loader, so the expiry compares the same clock
+	now := time.Now().UTC()
+	// the row of the lock is created free the first time it is used
+	_, err := db.ExecContext(ctx, db.Rebind(storeFor(db).InsertIgnore("job_locks (name, holder, acquired_at, expires_at) VALUES (?, '', ?, ?)")), name, now, now)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return false, fmt.Errorf("creating lock %s: %w", name, err)
+	}
+	result, err := db.ExecContext(ctx, db.Rebind(`UPDATE job_locks SET holder = ?, acquired_at = ?, expires_at = ?
+		WHERE name = ? AND (expires_at <= ? OR holder = ?)`), holder, now, now.Add(ttl), name, now, holder)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return false, fmt.Errorf("taking lock %s: %w", name, err)
+	}
+	taken, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return taken == 1, nil
+}
+
+// Unlock releases the named lock if holder still has it
+func Unlock(ctx context.Context, db *sqlx.DB, name string, holder string) error {
+	CallFrom := "Unlock in db "
+	_, err := db.ExecContext(ctx, db.Rebind("UPDATE job_locks SET expires_at = ? WHERE name = ? AND holder = ?"), time.Now().UTC(), name, holder)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return fmt.Errorf("releasing lock %s: %w", name, err)
+	}
+	return nil
+}
+
+// StartJobRun writes the record of a scheduled job as it starts and sets its id
+func StartJobRun(ctx context.Context, db *sqlx.DB, run *model.JobRun) error {
+	CallFrom := "StartJobRun in db "
+	if err := ensureTable(ctx, db, TableJobRuns); err != nil {
+		return err
+	}
+	id, err := storeFor(db).InsertID(ctx, db, `INSERT INTO job_runs (job, kind, host, status, error, scheduled_at, started_at, finished_at)
+		VALUES (:job, :kind, :host, :status, :error, :scheduled_at, :started_at, :finished_at)`, run)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return fmt.Errorf("writing job run: %w", err)
+	}
+	run.ID = id
+	return nil
+}
+
+// FinishJobRun records the outcome of a scheduled job
+func FinishJobRun(ctx context.Context, db *sqlx.DB, run *model.JobRun) error {
+	CallFrom := "FinishJobRun in db "
+	_, err := db.NamedExecContext(ctx, `UPDATE job_runs SET status = :status, error = :error, finished_at = :finished_at WHERE id = :id`, run)
+	if err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return fmt.Errorf("updating job run: %w", err)
+	}
+	return nil
+}
+
+// ListJobRuns returns the latest scheduled job runs, newest first
+func ListJobRuns(ctx context.Context, db *sqlx.DB, limit int) ([]model.JobRun, error) {
+	CallFrom := "ListJobRuns in db "
+	if err := ensureTable(ctx, db, TableJobRuns); err != nil {
+		return nil, err
+	}
+	var runs []model.JobRun
+	err := db.SelectContext(ctx, &runs, db.Rebind("SELECT "+jobRunColumns+" FROM job_runs ORDER BY started_at DESC, id DESC LIMIT ?"), limit)
+	if err != nil {
+		li.Logger.ErrMySQLRetrieveMessage(CallFrom, TableJobRuns, err)
+		return nil, err
+	}
+	return runs, nil
+}
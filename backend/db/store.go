@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// the supported database drivers
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+func init() {
+	// sqlx does not know the name of the pure go sqlite driver
+	sqlx.BindDriver(DriverSQLite, sqlx.QUESTION)
+}
+
+// Store is a storage backend of the loader and knows the sql dialect of its database.
+// The functions of this package take the connection pool of a store and look the store up
+// from its driver name, so a *sqlx.DB is all callers pass around.
+type Store interface {
+	// DB returns the connection pool
+	DB() *sqlx.DB
+	// Driver returns the driver name, mysql, postgres or sqlite
+	Driver() string
+	// TableExists reports whether a table exists
+	TableExists(ctx context.Context, q sqlx.QueryerContext, table string) (bool, error)
+	// ColumnExists reports whether a table has a column
+	ColumnExists(ctx context.Context, q sqlx.QueryerContext, table string, column string) (bool, error)
+	// Schema returns the statements creating a table and its indexes
+	Schema(table string) ([]string, error)
+	// CreateUniqueIndex creates a unique index on a column unless it exists
+	CreateUniqueIndex(ctx context.Context, e sqlx.ExtContext, table string, name string, column string) error
+	// InsertIgnore returns an insert of into, "table (columns) VALUES (...)", skipping rows that violate a unique key
+	InsertIgnore(into string) string
+	// Upsert returns the clause updating columns of the row that conflicts on the unique key column
+	Upsert(key string, columns []string) string
+	// ForUpdate returns the clause locking the selected rows until the transaction ends
+	ForUpdate() string
+	// DateParam returns a placeholder bound as a date
+	DateParam() string
+	// InsertID runs a named insert of one row and returns its generated id
+	InsertID(ctx context.Context, e sqlx.ExtContext, query string, arg interface{}) (int64, error)
+	// StageCDRs creates the temporary rmscdr_stage table of the transaction and loads rows into it
+	StageCDRs(ctx context.Context, tx *sqlx.Tx, rows []model.RMSCDR) error
+	// DropStage drops the staging table again
+	DropStage(ctx context.Context, tx *sqlx.Tx) error
+	// SessionLock takes the named lock for the session of conn without waiting, the server frees it when the
+	// session ends. It reports false when another session holds the lock and errNoSessionLocks when the
+	// database has no such locks.
+	SessionLock(ctx context.Context, conn *sqlx.Conn, name string) (bool, error)
+	// SessionUnlock frees a lock taken by SessionLock
+	SessionUnlock(ctx context.Context, conn *sqlx.Conn, name string) error
+}
+
+// Open connects to the database at dsn with the named driver, mysql when empty
+func Open(ctx context.Context, driver string, dsn string) (Store, error) {
+	switch driver {
+	case "":
+		driver = DriverMySQL
+	case DriverMySQL, DriverPostgres:
+	case DriverSQLite:
+		dsn = sqliteDSN(dsn)
+	default:
+		return nil, apperr.New(apperr.ConfigInvalid, "db.Open", fmt.Sprintf("unsupported database driver %q, use mysql, postgres or sqlite", driver))
+	}
+	db, err := sqlx.ConnectContext(ctx, driver, dsn)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.DBConnect, "db.Open", err)
+	}
+	return storeFor(db), nil
+}
+
+// storeFor returns the store of a connection pool or a transaction, the pool of a store built from
+// a transaction is nil
+func storeFor(e interface{ DriverName() string }) Store {
+	db, _ := e.(*sqlx.DB)
+	switch e.DriverName() {
+	case DriverPostgres:
+		return postgresStore{db}
+	case DriverSQLite:
+		return sqliteStore{db}
+	default:
+		return mysqlStore{db}
+	}
+}
+
+// StoreOf returns the store of a connection pool
+func StoreOf(db *sqlx.DB) Store {
+	return storeFor(db)
+}
+
+// sqliteDSN adds the settings the loader relies on to a sqlite file name: writers wait for each other
+// instead of failing and a transaction takes the write lock when it begins
+func sqliteDSN(dsn string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	if !strings.Contains(dsn, "busy_timeout") {
+		dsn += sep + "_pragma=busy_timeout(10000)"
+		sep = "&"
+	}
+	if !strings.Contains(dsn, "journal_mode") && !strings.Contains(dsn, ":memory:") && !strings.Contains(dsn, "mode=memory") {
+		dsn += sep + "_pragma=journal_mode(WAL)"
+		sep = "&"
+	}
+	if !strings.Contains(dsn, "_txlock") {
+		dsn += sep + "_txlock=immediate"
+	}
+	return dsn
+}
+
+// schemaStatements looks a table up in the schemas of a dialect
+func schemaStatements(schemas map[string][]string, driver string, table string) ([]string, error) {
+	statements, ok := schemas[table]
+	if !ok {
+		return nil, fmt.Errorf("no %s schema for table %s", driver, table)
+	}
+	return statements, nil
+}
+
+// upsertSet returns "c = <new value>" for every column joined by commas
+func upsertSet(columns []string, newValue func(string) string) string {
+	set := make([]string, len(columns))
+	for i, column := range columns {
+		set[i] = column + " = " + newValue(column)
+	}
+	return strings.Join(set, ", ")
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// mysqlStore is the MySQL backend the loader started with
+type mysqlStore struct {
+	db *sqlx.DB
+}
+
+// mysqlSchemas are the schemas declared next to the functions of each table
+var mysqlSchemas = map[string][]string{
+	TableCDR:             {schema},
+	TableAudio:           {audioSchema},
+	TableHash:            {hashSchema},
+	TableChain:           {chainSchema},
+	TableImportFiles:     {importFilesSchema},
+	TableImportRuns:      {importRunsSchema},
+	TableRetentionAudit:  {retentionAuditSchema},
+	TableRetentionPurged: {retentionPurgedSchema},
+	TableDailySummary:    {dailySummarySchema},
+	TableHistory:         {historySchema},
+	TableJobLocks:        {jobLocksSchema},
+	TableJobRuns:         {jobRunsSchema},
+}
+
+func (s mysqlStore) DB() *sqlx.DB { return s.db }
+
+func (mysqlStore) Driver() string { return DriverMySQL }
+
+func (mysqlStore) TableExists(ctx context.Context, q sqlx.QueryerContext, table string) (bool, error) {
+	var name string
+	// SHOW statements cannot be prepared with placeholders on every server, the names are constants
+	err := sqlx.GetContext(ctx, q, &name, fmt.Sprintf("SHOW TABLES LIKE '%s'", table))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("db.GetContext error in CheckTable: %w", err)
+	}
+	return name == table, nil
+}
+
+func (mysqlStore) ColumnExists(ctx context.Context, q sqlx.QueryerContext, table string, column string) (bool, error) {
+	rows, err := q.QueryxContext(ctx, fmt.Sprintf("SHOW COLUMNS FROM %s LIKE '%s'", table, column))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+func (mysqlStore) Schema(table string) ([]string, error) {
+	return schemaStatements(mysqlSchemas, DriverMySQL, table)
+}
+
+func (mysqlStore) CreateUniqueIndex(ctx context.Context, e sqlx.ExtContext, table string, name string, column string) error {
+	rows, err := e.QueryxContext(ctx, fmt.Sprintf("SHOW INDEX FROM %s WHERE Key_name = '%s'", table, name))
+	if err != nil {
+		return err
+	}
+	exists := rows.Next()
+	rows.Close()
+	if exists {
+		return nil
+	}
+	_, err = e.ExecContext(ctx, "CREATE UNIQUE INDEX "+name+" ON "+table+" ("+column+")")
+	return err
+}
+
+func (mysqlStore) InsertIgnore(into string) string {
+	return "INSERT IGNORE INTO " + into
+}
+
+// Upsert sets the key to itself without columns, mysql has no DO NOTHING and INSERT IGNORE would hide other errors
+func (mysqlStore) Upsert(key string, columns []string) string {
+	if len(columns) == 0 {
+		return " ON DUPLICATE KEY UPDATE " + key + " = " + key
+	}
+	return " ON DUPLICATE KEY UPDATE " + upsertSet(columns, func(c string) string { return "VALUES(" + c + ")" })
+}
+
+func (mysqlStore) ForUpdate() string { return " FOR UPDATE" }
+
+func (mysqlStore) DateParam() string { return "?" }
+
+func (mysqlStore) InsertID(ctx context.Context, e sqlx.ExtContext, query string, arg interface{}) (int64, error) {
+	res, err := sqlx.NamedExecContext(ctx, e, query, arg)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// StageCDRs streams the rows with LOAD DATA LOCAL INFILE, the server has to allow local_infile.
+// Temporary tables are private to the connection of the transaction and do not commit it.
+func (s mysqlStore) StageCDRs(ctx context.Context, tx *sqlx.Tx, rows []model.RMSCDR) error {
+	if err := s.DropStage(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "CREATE TEMPORARY TABLE rmscdr_stage LIKE rmscdr"); err != nil {
+		return fmt.Errorf("creating staging table: %w", err)
+	}
+	name := "rmscdr-" + uuid.NewString()
+	pr, pw := io.Pipe()
+	mysql.RegisterReaderHandler(name, func() io.Reader { return pr })
+	defer mysql.DeregisterReaderHandler(name)
+	go func() {
+		pw.CloseWithError(writeTSV(pw, rows))
+	}()
+	_, err := tx.ExecContext(ctx, `LOAD DATA LOCAL INFILE 'Reader::`+name+`' INTO TABLE rmscdr_stage
+		CHARACTER SET utf8mb4 FIELDS TERMINATED BY '\t' ESCAPED BY '\\' LINES TERMINATED BY '\n' (`+bulkColumns+`)`)
+	// unblocks the writer when the server never asked for the rows
+	pr.Close()
+	if err != nil {
+		return fmt.Errorf("loading staging table: %w", err)
+	}
+	return nil
+}
+
+func (mysqlStore) DropStage(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, "DROP TEMPORARY TABLE IF EXISTS rmscdr_stage")
+	return err
+}
+
+// SessionLock takes a GET_LOCK named lock, lock names are limited to 64 characters
+func (mysqlStore) SessionLock(ctx context.Context, conn *sqlx.Conn, name string) (bool, error) {
+	var got sql.NullInt64
+	if err := conn.QueryRowxContext(ctx, "SELECT GET_LOCK(?, 0)", name).Scan(&got); err != nil {
+		return false, err
+	}
+	return got.Valid && got.Int64 == 1, nil
+}
+
+func (mysqlStore) SessionUnlock(ctx context.Context, conn *sqlx.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", name)
+	return err
+}
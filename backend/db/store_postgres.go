@@ -0,0 +1,293 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// postgresStore is the PostgreSQL backend
+type postgresStore struct {
+	db *sqlx.DB
+}
+
+// postgresSchemas are the mysql tables in PostgreSQL types, indexes are separate statements
+var postgresSchemas = map[string][]string{
+	TableCDR: {`
+CREATE TABLE IF NOT EXISTS rmscdr (
+	id BIGSERIAL PRIMARY KEY,
+	uid VARCHAR(50) NOT NULL,
+	direction VARCHAR(10),
+	time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	unix_timestamp BIGINT,
+	flagged BOOLEAN,
+	source VARCHAR(100),
+	destination VARCHAR(100),
+	duration BIGINT,
+	size DOUBLE PRECISION,
+	exists_in_db BOOLEAN,
+	local_copy BOOLEAN,
+	authentic VARCHAR(20),
+	file_name VARCHAR(100),
+	sip_call_id VARCHAR(150)
+);`,
+		"CREATE INDEX IF NOT EXISTS rmscdr_unix_timestamp ON rmscdr (unix_timestamp, uid)",
+	},
+	TableAudio: {`
+CREATE TABLE IF NOT EXISTS rmscdr_audio (
+	id BIGSERIAL PRIMARY KEY,
+	uid VARCHAR(50) NOT NULL,
+	file_name VARCHAR(100),
+	codec VARCHAR(30),
+	sample_rate INTEGER,
+	channels INTEGER,
+	bits_per_sample INTEGER,
+	audio_duration_ms BIGINT,
+	duration_delta DOUBLE PRECISION,
+	duration_mismatch BOOLEAN
+);`,
+		"CREATE INDEX IF NOT EXISTS rmscdr_audio_uid ON rmscdr_audio (uid)",
+		"CREATE INDEX IF NOT EXISTS rmscdr_audio_duration_mismatch ON rmscdr_audio (duration_mismatch)",
+	},
+	TableHash: {`
+CREATE TABLE IF NOT EXISTS rmscdr_hash (
+	id BIGSERIAL PRIMARY KEY,
+	uid VARCHAR(50) NOT NULL,
+	file_name VARCHAR(100),
+	sha256 CHAR(64) NOT NULL,
+	size BIGINT,
+	hashed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+		"CREATE INDEX IF NOT EXISTS rmscdr_hash_uid ON rmscdr_hash (uid)",
+	},
+	TableChain: {`
+CREATE TABLE IF NOT EXISTS rmscdr_chain (
+	seq BIGSERIAL PRIMARY KEY,
+	uid VARCHAR(50) NOT NULL,
+	prev_hash CHAR(64) NOT NULL,
+	row_hash CHAR(64) NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+		"CREATE INDEX IF NOT EXISTS rmscdr_chain_uid ON rmscdr_chain (uid)",
+	},
+	TableImportFiles: {`
+CREATE TABLE IF NOT EXISTS import_files (
+	id BIGSERIAL PRIMARY KEY,
+	file_name VARCHAR(255) NOT NULL,
+	sha256 CHAR(64) NOT NULL UNIQUE,
+	size BIGINT NOT NULL,
+	rows_total BIGINT NOT NULL DEFAULT 0,
+	rows_loaded BIGINT NOT NULL DEFAULT 0,
+	status VARCHAR(10) NOT NULL,
+	error TEXT,
+	started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	finished_at TIMESTAMP NULL
+);`},
+	TableImportRuns: {`
+CREATE TABLE IF NOT EXISTS import_runs (
+	id CHAR(36) NOT NULL PRIMARY KEY,
+	status VARCHAR(10) NOT NULL,
+	host VARCHAR(255) NOT NULL,
+	version VARCHAR(100) NOT NULL,
+	config_hash CHAR(64) NOT NULL,
+	files_found BIGINT NOT NULL DEFAULT 0,
+	files_imported BIGINT NOT NULL DEFAULT 0,
+	files_skipped BIGINT NOT NULL DEFAULT 0,
+	files_failed BIGINT NOT NULL DEFAULT 0,
+	rows_parsed BIGINT NOT NULL DEFAULT 0,
+	rows_rejected BIGINT NOT NULL DEFAULT 0,
+	rows_inserted BIGINT NOT NULL DEFAULT 0,
+	error TEXT,
+	started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	finished_at TIMESTAMP NULL
+);`,
+		"CREATE INDEX IF NOT EXISTS import_runs_started_at ON import_runs (started_at)",
+	},
+	TableRetentionAudit: {`
+CREATE TABLE IF NOT EXISTS retention_audit (
+	id BIGSERIAL PRIMARY KEY,
+	rule_name VARCHAR(100) NOT NULL,
+	cutoff TIMESTAMP NULL,
+	dry_run BOOLEAN,
+	rows_matched BIGINT,
+	rows_deleted BIGINT,
+	archive_file VARCHAR(255),
+	started_at TIMESTAMP NULL,
+	finished_at TIMESTAMP NULL
+);`},
+	TableRetentionPurged: {`
+CREATE TABLE IF NOT EXISTS retention_purged (
+	uid VARCHAR(50) NOT NULL PRIMARY KEY,
+	audit_id BIGINT NOT NULL
+);`,
+		"CREATE INDEX IF NOT EXISTS retention_purged_audit_id ON retention_purged (audit_id)",
+	},
+	TableDailySummary: {`
+CREATE TABLE IF NOT EXISTS cdr_daily_summary (
+	day DATE NOT NULL,
+	extension VARCHAR(100) NOT NULL,
+	calls BIGINT NOT NULL,
+	total_duration BIGINT NOT NULL,
+	max_duration BIGINT NOT NULL,
+	inbound BIGINT NOT NULL,
+	outbound BIGINT NOT NULL,
+	flagged BIGINT NOT NULL,
+	total_size DOUBLE PRECISION NOT NULL,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (day, extension)
+);`,
+		"CREATE INDEX IF NOT EXISTS cdr_daily_summary_extension ON cdr_daily_summary (extension, day)",
+	},
+	TableHistory: {`
+CREATE TABLE IF NOT EXISTS rmscdr_history (
+	id BIGSERIAL PRIMARY KEY,
+	uid VARCHAR(50) NOT NULL,
+	column_name VARCHAR(30) NOT NULL,
+	old_value TEXT,
+	new_value TEXT,
+	import_file_id BIGINT NOT NULL,
+	changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+		"CREATE INDEX IF NOT EXISTS rmscdr_history_uid ON rmscdr_history (uid)",
+		"CREATE INDEX IF NOT EXISTS rmscdr_history_import_file_id ON rmscdr_history (import_file_id)",
+	},
+	TableJobLocks: {`
+CREATE TABLE IF NOT EXISTS job_locks (
+	name VARCHAR(100) NOT NULL PRIMARY KEY,
+	holder VARCHAR(255) NOT NULL,
+	acquired_at TIMESTAMP NULL,
+	expires_at TIMESTAMP NULL
+);`},
+	TableJobRuns: {`
+CREATE TABLE IF NOT EXISTS job_runs (
+	id BIGSERIAL PRIMARY KEY,
+	job VARCHAR(100) NOT NULL,
+	kind VARCHAR(20) NOT NULL,
+	host VARCHAR(255) NOT NULL,
+	status VARCHAR(10) NOT NULL,
+	error TEXT,
+	scheduled_at TIMESTAMP NULL,
+	started_at TIMESTAMP NULL,
+	finished_at TIMESTAMP NULL
+);`,
+		"CREATE INDEX IF NOT EXISTS job_runs_started_at ON job_runs (started_at)",
+	},
+}
+
+func (s postgresStore) DB() *sqlx.DB { return s.db }
+
+func (postgresStore) Driver() string { return DriverPostgres }
+
+func (postgresStore) TableExists(ctx context.Context, q sqlx.QueryerContext, table string) (bool, error) {
+	var count int
+	err := sqlx.GetContext(ctx, q, &count, `SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name = $1`, table)
+	if err != nil {
+		return false, fmt.Errorf("db.GetContext error in CheckTable: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (postgresStore) ColumnExists(ctx context.Context, q sqlx.QueryerContext, table string, column string) (bool, error) {
+	var count int
+	err := sqlx.GetContext(ctx, q, &count, `SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`, table, column)
+	return count > 0, err
+}
+
+func (postgresStore) Schema(table string) ([]string, error) {
+	return schemaStatements(postgresSchemas, DriverPostgres, table)
+}
+
+func (postgresStore) CreateUniqueIndex(ctx context.Context, e sqlx.ExtContext, table string, name string, column string) error {
+	_, err := e.ExecContext(ctx, "CREATE UNIQUE INDEX IF NOT EXISTS "+name+" ON "+table+" ("+column+")")
+	return err
+}
+
+func (postgresStore) InsertIgnore(into string) string {
+	return "INSERT INTO " + into + " ON CONFLICT DO NOTHING"
+}
+
+func (postgresStore) Upsert(key string, columns []string) string {
+	if len(columns) == 0 {
+		return " ON CONFLICT (" + key + ") DO NOTHING"
+	}
+	return " ON CONFLICT (" + key + ") DO UPDATE SET " + upsertSet(columns, func(c string) string { return "excluded." + c })
+}
+
+func (postgresStore) ForUpdate() string { return " FOR UPDATE" }
+
+func (postgresStore) DateParam() string { return "CAST(? AS DATE)" }
+
+// InsertID asks for the id with RETURNING, lib/pq does not implement LastInsertId
+func (postgresStore) InsertID(ctx context.Context, e sqlx.ExtContext, query string, arg interface{}) (int64, error) {
+	rows, err := sqlx.NamedQueryContext(ctx, e, query+" RETURNING id", arg)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var id int64
+	if rows.Next() {
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+	}
+	return id, rows.Err()
+}
+
+// StageCDRs copies the rows into the staging table with COPY FROM STDIN
+func (s postgresStore) StageCDRs(ctx context.Context, tx *sqlx.Tx, rows []model.RMSCDR) error {
+	if err := s.DropStage(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "CREATE TEMPORARY TABLE rmscdr_stage AS SELECT "+bulkColumns+" FROM rmscdr WITH NO DATA"); err != nil {
+		return fmt.Errorf("creating staging table: %w", err)
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(TableCDRStage, strings.Split(bulkColumns, ", ")...))
+	if err != nil {
+		return fmt.Errorf("loading staging table: %w", err)
+	}
+	defer stmt.Close()
+	for _, cdr := range rows {
+		if _, err := stmt.ExecContext(ctx, cdrValues(cdr)...); err != nil {
+			return fmt.Errorf("loading staging table: %w", err)
+		}
+	}
+	// flushes the copy
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("loading staging table: %w", err)
+	}
+	return nil
+}
+
+func (postgresStore) DropStage(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, "DROP TABLE IF EXISTS pg_temp.rmscdr_stage")
+	return err
+}
+
+// SessionLock takes a session advisory lock, keyed by the hash of the name
+func (postgresStore) SessionLock(ctx context.Context, conn *sqlx.Conn, name string) (bool, error) {
+	var got bool
+	if err := conn.QueryRowxContext(ctx, "SELECT pg_try_advisory_lock($1)", advisoryKey(name)).Scan(&got); err != nil {
+		return false, err
+	}
+	return got, nil
+}
+
+func (postgresStore) SessionUnlock(ctx context.Context, conn *sqlx.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", advisoryKey(name))
+	return err
+}
+
+// advisoryKey turns a lock name into the bigint key of an advisory lock
+func advisoryKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
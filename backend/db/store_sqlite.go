@@ -0,0 +1,268 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// sqliteStore is the embedded SQLite backend for small sites and tests. Transactions take the
+// write lock when they begin, see sqliteDSN, so there is no row locking.
+type sqliteStore struct {
+	db *sqlx.DB
+}
+
+// sqliteSchemas are the mysql tables in SQLite types, the driver reads TIMESTAMP and DATE columns back as times
+var sqliteSchemas = map[string][]string{
+	TableCDR: {`
+CREATE TABLE IF NOT EXISTS rmscdr (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid VARCHAR(50) NOT NULL,
+	direction VARCHAR(10),
+	time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	unix_timestamp INTEGER,
+	flagged BOOLEAN,
+	source VARCHAR(100),
+	destination VARCHAR(100),
+	duration INTEGER,
+	size DOUBLE,
+	exists_in_db BOOLEAN,
+	local_copy BOOLEAN,
+	authentic VARCHAR(20),
+	file_name VARCHAR(100),
+	sip_call_id VARCHAR(150)
+);`,
+		"CREATE INDEX IF NOT EXISTS rmscdr_unix_timestamp ON rmscdr (unix_timestamp, uid)",
+	},
+	TableAudio: {`
+CREATE TABLE IF NOT EXISTS rmscdr_audio (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid VARCHAR(50) NOT NULL,
+	file_name VARCHAR(100),
+	codec VARCHAR(30),
+	sample_rate INTEGER,
+	channels INTEGER,
+	bits_per_sample INTEGER,
+	audio_duration_ms INTEGER,
+	duration_delta DOUBLE,
+	duration_mismatch BOOLEAN
+);`,
+		"CREATE INDEX IF NOT EXISTS rmscdr_audio_uid ON rmscdr_audio (uid)",
+		"CREATE INDEX IF NOT EXISTS rmscdr_audio_duration_mismatch ON rmscdr_audio (duration_mismatch)",
+	},
+	TableHash: {`
+CREATE TABLE IF NOT EXISTS rmscdr_hash (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid VARCHAR(50) NOT NULL,
+	file_name VARCHAR(100),
+	sha256 CHAR(64) NOT NULL,
+	size INTEGER,
+	hashed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+		"CREATE INDEX IF NOT EXISTS rmscdr_hash_uid ON rmscdr_hash (uid)",
+	},
+	TableChain: {`
+CREATE TABLE IF NOT EXISTS rmscdr_chain (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid VARCHAR(50) NOT NULL,
+	prev_hash CHAR(64) NOT NULL,
+	row_hash CHAR(64) NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+		"CREATE INDEX IF NOT EXISTS rmscdr_chain_uid ON rmscdr_chain (uid)",
+	},
+	TableImportFiles: {`
+CREATE TABLE IF NOT EXISTS import_files (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	file_name VARCHAR(255) NOT NULL,
+	sha256 CHAR(64) NOT NULL UNIQUE,
+	size INTEGER NOT NULL,
+	rows_total INTEGER NOT NULL DEFAULT 0,
+	rows_loaded INTEGER NOT NULL DEFAULT 0,
+	status VARCHAR(10) NOT NULL,
+	error TEXT,
+	started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	finished_at TIMESTAMP NULL
+);`},
+	TableImportRuns: {`
+CREATE TABLE IF NOT EXISTS import_runs (
+	id CHAR(36) NOT NULL PRIMARY KEY,
+	status VARCHAR(10) NOT NULL,
+	host VARCHAR(255) NOT NULL,
+	version VARCHAR(100) NOT NULL,
+	config_hash CHAR(64) NOT NULL,
+	files_found INTEGER NOT NULL DEFAULT 0,
+	files_imported INTEGER NOT NULL DEFAULT 0,
+	files_skipped INTEGER NOT NULL DEFAULT 0,
+	files_failed INTEGER NOT NULL DEFAULT 0,
+	rows_parsed INTEGER NOT NULL DEFAULT 0,
+	rows_rejected INTEGER NOT NULL DEFAULT 0,
+	rows_inserted INTEGER NOT NULL DEFAULT 0,
+	error TEXT,
+	started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	finished_at TIMESTAMP NULL
+);`,
+		"CREATE INDEX IF NOT EXISTS import_runs_started_at ON import_runs (started_at)",
+	},
+	TableRetentionAudit: {`
+CREATE TABLE IF NOT EXISTS retention_audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	rule_name VARCHAR(100) NOT NULL,
+	cutoff TIMESTAMP NULL,
+	dry_run BOOLEAN,
+	rows_matched INTEGER,
+	rows_deleted INTEGER,
+	archive_file VARCHAR(255),
+	started_at TIMESTAMP NULL,
+	finished_at TIMESTAMP NULL
+);`},
+	TableRetentionPurged: {`
+CREATE TABLE IF NOT EXISTS retention_purged (
+	uid VARCHAR(50) NOT NULL PRIMARY KEY,
+	audit_id INTEGER NOT NULL
+);`,
+		"CREATE INDEX IF NOT EXISTS retention_purged_audit_id ON retention_purged (audit_id)",
+	},
+	TableDailySummary: {`
+CREATE TABLE IF NOT EXISTS cdr_daily_summary (
+	day DATE NOT NULL,
+	extension VARCHAR(100) NOT NULL,
+	calls INTEGER NOT NULL,
+	total_duration INTEGER NOT NULL,
+	max_duration INTEGER NOT NULL,
+	inbound INTEGER NOT NULL,
+	outbound INTEGER NOT NULL,
+	flagged INTEGER NOT NULL,
+	total_size DOUBLE NOT NULL,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (day, extension)
+);`,
+		"CREATE INDEX IF NOT EXISTS cdr_daily_summary_extension ON cdr_daily_summary (extension, day)",
+	},
+	TableHistory: {`
+CREATE TABLE IF NOT EXISTS rmscdr_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uid VARCHAR(50) NOT NULL,
+	column_name VARCHAR(30) NOT NULL,
+	old_value TEXT,
+	new_value TEXT,
+	import_file_id INTEGER NOT NULL,
+	changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+		"CREATE INDEX IF NOT EXISTS rmscdr_history_uid ON rmscdr_history (uid)",
+		"CREATE INDEX IF NOT EXISTS rmscdr_history_import_file_id ON rmscdr_history (import_file_id)",
+	},
+	TableJobLocks: {`
+CREATE TABLE IF NOT EXISTS job_locks (
+	name VARCHAR(100) NOT NULL PRIMARY KEY,
+	holder VARCHAR(255) NOT NULL,
+	acquired_at TIMESTAMP NULL,
+	expires_at TIMESTAMP NULL
+);`},
+	TableJobRuns: {`
+CREATE TABLE IF NOT EXISTS job_runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	job VARCHAR(100) NOT NULL,
+	kind VARCHAR(20) NOT NULL,
+	host VARCHAR(255) NOT NULL,
+	status VARCHAR(10) NOT NULL,
+	error TEXT,
+	scheduled_at TIMESTAMP NULL,
+	started_at TIMESTAMP NULL,
+	finished_at TIMESTAMP NULL
+);`,
+		"CREATE INDEX IF NOT EXISTS job_runs_started_at ON job_runs (started_at)",
+	},
+}
+
+func (s sqliteStore) DB() *sqlx.DB { return s.db }
+
+func (sqliteStore) Driver() string { return DriverSQLite }
+
+func (sqliteStore) TableExists(ctx context.Context, q sqlx.QueryerContext, table string) (bool, error) {
+	var count int
+	err := sqlx.GetContext(ctx, q, &count, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+	if err != nil {
+		return false, fmt.Errorf("db.GetContext error in CheckTable: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (sqliteStore) ColumnExists(ctx context.Context, q sqlx.QueryerContext, table string, column string) (bool, error) {
+	var count int
+	err := sqlx.GetContext(ctx, q, &count, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column)
+	return count > 0, err
+}
+
+func (sqliteStore) Schema(table string) ([]string, error) {
+	return schemaStatements(sqliteSchemas, DriverSQLite, table)
+}
+
+func (sqliteStore) CreateUniqueIndex(ctx context.Context, e sqlx.ExtContext, table string, name string, column string) error {
+	_, err := e.ExecContext(ctx, "CREATE UNIQUE INDEX IF NOT EXISTS "+name+" ON "+table+" ("+column+")")
+	return err
+}
+
+func (sqliteStore) InsertIgnore(into string) string {
+	return "INSERT OR IGNORE INTO " + into
+}
+
+func (sqliteStore) Upsert(key string, columns []string) string {
+	if len(columns) == 0 {
+		return " ON CONFLICT (" + key + ") DO NOTHING"
+	}
+	return " ON CONFLICT (" + key + ") DO UPDATE SET " + upsertSet(columns, func(c string) string { return "excluded." + c })
+}
+
+// ForUpdate is empty, the transaction already holds the write lock of the database
+func (sqliteStore) ForUpdate() string { return "" }
+
+func (sqliteStore) DateParam() string { return "?" }
+
+func (sqliteStore) InsertID(ctx context.Context, e sqlx.ExtContext, query string, arg interface{}) (int64, error) {
+	res, err := sqlx.NamedExecContext(ctx, e, query, arg)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// StageCDRs inserts the rows into the staging table with one prepared statement, the database is local
+func (s sqliteStore) StageCDRs(ctx context.Context, tx *sqlx.Tx, rows []model.RMSCDR) error {
+	if err := s.DropStage(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "CREATE TEMPORARY TABLE rmscdr_stage AS SELECT "+bulkColumns+" FROM rmscdr WHERE 0"); err != nil {
+		return fmt.Errorf("creating staging table: %w", err)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", strings.Count(bulkColumns, ",")+1), ", ")
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO rmscdr_stage ("+bulkColumns+") VALUES ("+placeholders+")")
+	if err != nil {
+		return fmt.Errorf("loading staging table: %w", err)
+	}
+	defer stmt.Close()
+	for _, cdr := range rows {
+		if _, err := stmt.ExecContext(ctx, cdrValues(cdr)...); err != nil {
+			return fmt.Errorf("loading staging table: %w", err)
+		}
+	}
+	return nil
+}
+
+func (sqliteStore) DropStage(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, "DROP TABLE IF EXISTS temp.rmscdr_stage")
+	return err
+}
+
+// SessionLock is not supported, the database is a file and the lock table is used instead
+func (sqliteStore) SessionLock(ctx context.Context, conn *sqlx.Conn, name string) (bool, error) {
+	return false, errNoSessionLocks
+}
+
+func (sqliteStore) SessionUnlock(ctx context.Context, conn *sqlx.Conn, name string) error {
+	return errNoSessionLocks
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+func TestUpsertClauses(t *testing.T) {
+	tests := []struct {
+		store   Store
+		columns []string
+		want    string
+	}{
+		{mysqlStore{}, nil, " ON DUPLICATE KEY UPDATE call_key = call_key"},
+		{mysqlStore{}, []string{"duration", "size"}, " ON DUPLICATE KEY UPDATE duration = VALUES(duration), size = VALUES(size)"},
+		{postgresStore{}, nil, " ON CONFLICT (call_key) DO NOTHING"},
+		{postgresStore{}, []string{"duration"}, " ON CONFLICT (call_key) DO UPDATE SET duration = excluded.duration"},
+		{sqliteStore{}, nil, " ON CONFLICT (call_key) DO NOTHING"},
+		{sqliteStore{}, []string{"duration"}, " ON CONFLICT (call_key) DO UPDATE SET duration = excluded.duration"},
+	}
+	for _, tt := range tests {
+		if got := tt.store.Upsert("call_key", tt.columns); got != tt.want {
+			t.Errorf("%s Upsert(%v) = %q, want %q", tt.store.Driver(), tt.columns, got, tt.want)
+		}
+	}
+}
+
+func TestSQLiteSchema(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	store := StoreOf(db)
+	for table := range sqliteSchemas {
+		// a second run finds the table
+		for range 2 {
+			if err := ensureTable(ctx, db, table); err != nil {
+				t.Fatalf("creating %s: %v", table, err)
+			}
+		}
+		exists, err := store.TableExists(ctx, db, table)
+		if err != nil || !exists {
+			t.Errorf("table %s exists %v, %v", table, exists, err)
+		}
+	}
+	if _, err := store.Schema("nope"); err == nil {
+		t.Error("a table without a schema was created")
+	}
+	for column, want := range map[string]bool{"sip_call_id": true, "call_key": false} {
+		exists, err := store.ColumnExists(ctx, db, TableCDR, column)
+		if err != nil || exists != want {
+			t.Errorf("column %s exists %v, %v, want %v", column, exists, err, want)
+		}
+	}
+}
+
+func TestSQLiteUpsert(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	if err := EnsureCallKey(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	cdrs := benchCDRs(2)
+	upsert := func(batch []model.RMSCDR, columns []string) UpsertResult {
+		t.Helper()
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		result, err := UpsertCDRsBatchTx(ctx, tx, batch, columns, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if result := upsert(cdrs, nil); len(result.Inserted) != 2 {
+		t.Fatalf("inserted %d calls, want 2", len(result.Inserted))
+	}
+
+	reexported := cdrs[0]
+	reexported.UID = "reexported"
+	reexported.Duration = 80
+	reexported.Source = "0831234567"
+	// without columns a call stored before is left as it is
+	if result := upsert([]model.RMSCDR{reexported}, nil); len(result.Inserted) != 0 || result.Unchanged != 1 {
+		t.Errorf("upsert without columns inserted %d and left %d calls", len(result.Inserted), result.Unchanged)
+	}
+	result := upsert([]model.RMSCDR{reexported, cdrs[1]}, []string{"duration"})
+	if len(result.Updated) != 1 || result.Unchanged != 1 {
+		t.Errorf("updated %d and left %d calls, want 1 each", len(result.Updated), result.Unchanged)
+	}
+	var stored model.RMSCDR
+	if err := db.Get(&stored, "SELECT "+cdrColumns+" FROM rmscdr WHERE uid = ?", cdrs[0].UID); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Duration != 80 || stored.Source != cdrs[0].Source {
+		t.Errorf("stored duration %d and source %s, want only the duration updated", stored.Duration, stored.Source)
+	}
+	var history []model.CDRChange
+	if err := db.Select(&history, "SELECT uid, column_name, old_value, new_value, import_file_id FROM rmscdr_history"); err != nil {
+		t.Fatal(err)
+	}
+	want := model.CDRChange{UID: cdrs[0].UID, Column: "duration", OldValue: "65", NewValue: "80", ImportFileID: 7}
+	if len(history) != 1 || history[0] != want {
+		t.Errorf("history %+v, want %+v", history, want)
+	}
+}
+
+func TestSQLiteLocksUseTheLockTable(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := StoreOf(db).SessionLock(ctx, conn, DefaultLockName); !errors.Is(err, errNoSessionLocks) {
+		t.Fatalf("SessionLock on sqlite returned %v", err)
+	}
+	lock, err := AcquireImportLock(ctx, db, DefaultLockName, "a:1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var holder string
+	if err := db.Get(&holder, "SELECT holder FROM job_locks WHERE name = ?", DefaultLockName); err != nil || holder != "a:1" {
+		t.Errorf("job_locks holds %q, %v, want a:1", holder, err)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// a released lock has expired
+	var expires time.Time
+	if err := db.Get(&expires, "SELECT expires_at FROM job_locks WHERE name = ?", DefaultLockName); err != nil || expires.After(time.Now()) {
+		t.Errorf("the released lock expires at %v, %v", expires, err)
+	}
+}
+
+func TestSQLiteStageCDRs(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	if err := EnsureCallKey(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	store := StoreOf(db)
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	cdrs := benchCDRs(3)
+	// staging again replaces the rows of the unit before
+	for _, rows := range [][]model.RMSCDR{cdrs, cdrs[:2]} {
+		if err := store.StageCDRs(ctx, tx, rows); err != nil {
+			t.Fatal(err)
+		}
+		var staged []model.RMSCDR
+		if err := tx.Select(&staged, "SELECT uid, file_name, sip_call_id, unix_timestamp, duration, size FROM rmscdr_stage ORDER BY unix_timestamp"); err != nil {
+			t.Fatal(err)
+		}
+		if len(staged) != len(rows) {
+			t.Fatalf("staged %d rows, want %d", len(staged), len(rows))
+		}
+		for i, cdr := range staged {
+			if cdr.UID != rows[i].UID || cdr.CallKey() != rows[i].CallKey() || cdr.Duration != rows[i].Duration || cdr.Size != rows[i].Size {
+				t.Errorf("staged %+v, want %+v", cdr, rows[i])
+			}
+		}
+	}
+	if err := store.DropStage(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("SELECT COUNT(*) FROM rmscdr_stage"); err == nil {
+		t.Error("the staging table is still there")
+	}
+}
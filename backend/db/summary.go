@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+const TableDailySummary = "cdr_daily_summary"
+
+var dailySummarySchema = `
+CREATE TABLE IF NOT EXISTS cdr_daily_summary (
+	day DATE NOT NULL,
+	extension VARCHAR(100) NOT NULL,
+	calls BIGINT NOT NULL,
+	total_duration BIGINT NOT NULL,
+	max_duration BIGINT NOT NULL,
+	inbound BIGINT NOT NULL,
+	outbound BIGINT NOT NULL,
+	flagged BIGINT NOT NULL,
+	total_size DOUBLE NOT NULL,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (day, extension),
+	INDEX (extension, day)
+);`
+
+// RefreshDailySummary recomputes the summary rows of one day from rmscdr.
+// The day is the RMS wall clock date, the way the import stores the call times.
+func RefreshDailySummary(ctx context.Context, db *sqlx.DB, day time.Time, inbound []string) error {
+	CallFrom := "RefreshDailySummary in db "
+	if err := ensureTable(ctx, db, TableDailySummary); err != nil {
+		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+		return err
+	}
+	store := storeFor(db)
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 1)
+	in := "(" + strings.TrimSuffix(strings.Repeat("?,", len(inbound)), ",") + ")"
+	if len(inbound) == 0 {
+		in = "('')"
+	}
+	query := `INSERT INTO cdr_daily_summary (day, extension, calls, total_duration, max_duration, inbound, outbound, flagged, total_size)
+		SELECT ` + store.DateParam() + `, ext, COUNT(*), COALESCE(SUM(duration), 0), COALESCE(MAX(duration), 0),
+			SUM(CASE WHEN is_in = 1 THEN 1 ELSE 0 END), SUM(CASE WHEN is_in = 1 THEN 0 ELSE 1 END),
+			SUM(CASE WHEN flagged THEN 1 ELSE 0 END), COALESCE(SUM(size), 0)
+		FROM (SELECT CASE WHEN direction IN ` + in + ` THEN COALESCE(destination, '') ELSE COALESCE(source, '') END AS ext,
+			CASE WHEN direction IN ` + in + ` THEN 1 ELSE 0 END AS is_in, duration, flagged, size
+			FROM rmscdr WHERE unix_timestamp >= ? AND unix_timestamp < ?) calls
+		GROUP BY ext`
+	args := []interface{}{start.Format("2006-01-02")}
+	for i := 0; i < 2; i++ {
+		for _, d := range inbound {
+			args = append(args, d)
+		}
+	}
+	args = append(args, start.Unix(), end.Unix())
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		li.Logger.ErrMySQLConnectionMessage(CallFrom, err)
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM cdr_daily_summary WHERE day = "+store.DateParam()), start.Format("2006-01-02")); err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return fmt.Errorf("clearing summary of %s: %w", start.Format("2006-01-02"), err)
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return fmt.Errorf("summarising %s: %w", start.Format("2006-01-02"), err)
+	}
+	if err := tx.Commit(); err != nil {
+		li.Logger.ErrDbCommitMessage(CallFrom, err)
+		return err
+	}
+	return nil
+}
+
+// GetDailySummaries returns the summary rows from the first day up to but excluding the last, optionally for one extension
+func GetDailySummaries(ctx context.Context, db *sqlx.DB, from time.Time, to time.Time, extension string) ([]model.CallSummary, error) {
+	CallFrom := "GetDailySummaries in db "
+	if err := ensureTable(ctx, db, TableDailySummary); err != nil {
+		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+		return nil, err
+	}
+	query := `SELECT day, extension, calls, total_duration, max_duration, inbound, outbound, flagged, total_size
+		FROM cdr_daily_summary WHERE day >= ? AND day < ?`
+	args := []interface{}{from.Format("2006-01-02"), to.Format("2006-01-02")}
+	if extension != "" {
+		query += " AND extension = ?"
+		args = append(args, extension)
+	}
+	query += " ORDER BY day, extension"
+	var rows []model.CallSummary
+	if err := db.SelectContext(ctx, &rows, db.Rebind(query), args...); err != nil {
+		li.Logger.ErrCDRRetrievalMessage(CallFrom, err)
+		return nil, err
+	}
+	return rows, nil
+}
+
+// CDRTimeRange returns the first and last call time in rmscdr as stored, zero times when the table is empty
+func CDRTimeRange(ctx context.Context, db *sqlx.DB) (time.Time, time.Time, error) {
+	CallFrom := "CDRTimeRange in db "
+	var res struct {
+		First sql.NullInt64 `db:"first"`
+		Last  sql.NullInt64 `db:"last"`
+	}
+	err := db.GetContext(ctx, &res, "SELECT MIN(unix_timestamp) AS first, MAX(unix_timestamp) AS last FROM rmscdr")
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		li.Logger.ErrCDRRetrievalMessage(CallFrom, err)
+		return time.Time{}, time.Time{}, err
+	}
+	if !res.First.Valid {
+		return time.Time{}, time.Time{}, nil
+	}
+	return time.Unix(res.First.Int64, 0).UTC(), time.Unix(res.Last.Int64, 0).UTC(), nil
+}
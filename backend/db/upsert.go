@@ -0,0 +1,390 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/sirupsen/logrus"
+)
+
+const TableHistory = "rmscdr_history"
+
+// MergeRuleName is the retention_audit rule of the copies of calls EnsureCallKey deleted
+const MergeRuleName = "merge-duplicate-calls"
+
+var historySchema = `
+CREATE TABLE IF NOT EXISTS rmscdr_history (
+	id BIGINT(20) UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	uid VARCHAR(50) NOT NULL,
+	column_name VARCHAR(30) NOT NULL,
+	old_value TEXT,
+	new_value TEXT,
+	import_file_id BIGINT(20) UNSIGNED NOT NULL,
+	changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX (uid),
+	INDEX (import_file_id)
+);`
+
+// callKeyChunk is the number of rows EnsureCallKey fills in per statement
+const callKeyChunk = 1000
+
+// mutableColumn reads and copies a column a later export may change
+type mutableColumn struct {
+	get func(model.RMSCDR) string
+	set func(dst *model.RMSCDR, src model.RMSCDR)
+}
+
+// mutableColumns are the columns an upsert can update, the columns of the stable key and the identity are not
+var mutableColumns = map[string]mutableColumn{
+	"direction": {
+		func(c model.RMSCDR) string { return c.Direction },
+		func(dst *model.RMSCDR, src model.RMSCDR) { dst.Direction = src.Direction },
+	},
+	"flagged": {
+		func(c model.RMSCDR) string { return strconv.FormatBool(c.Flagged) },
+		func(dst *model.RMSCDR, src model.RMSCDR) { dst.Flagged = src.Flagged },
+	},
+	"source": {
+		func(c model.RMSCDR) string { return c.Source },
+		func(dst *model.RMSCDR, src model.RMSCDR) { dst.Source = src.Source },
+	},
+	"destination": {
+		func(c model.RMSCDR) string { return c.Destination },
+		func(dst *model.RMSCDR, src model.RMSCDR) { dst.Destination = src.Destination },
+	},
+	"duration": {
+		func(c model.RMSCDR) string { return strconv.FormatInt(c.Duration, 10) },
+		func(dst *model.RMSCDR, src model.RMSCDR) {
+			dst.Duration = src.Duration
+			dst.TalkDuration = src.TalkDuration
+		},
+	},
+	"size": {
+		func(c model.RMSCDR) string { return strconv.FormatFloat(c.Size, 'f', -1, 64) },
+		func(dst *model.RMSCDR, src model.RMSCDR) { dst.Size = src.Size },
+	},
+	"exists_in_db": {
+		func(c model.RMSCDR) string { return strconv.FormatBool(c.ExistsINDB) },
+		func(dst *model.RMSCDR, src model.RMSCDR) { dst.ExistsINDB = src.ExistsINDB },
+	},
+	"local_copy": {
+		func(c model.RMSCDR) string { return strconv.FormatBool(c.LocalCopy) },
+		func(dst *model.RMSCDR, src model.RMSCDR) { dst.LocalCopy = src.LocalCopy },
+	},
+	"authentic": {
+		func(c model.RMSCDR) string { return c.Authentic },
+		func(dst *model.RMSCDR, src model.RMSCDR) { dst.Authentic = src.Authentic },
+	},
+}
+
+// UpsertResult holds the rows of an upserted batch as they are stored after it
+type UpsertResult struct {
+	// calls that were not in rmscdr
+	Inserted []model.RMSCDR
+	// calls whose mutable columns changed, with the uid of the stored row
+	Updated []model.RMSCDR
+	// calls stored with the same values
+	Unchanged int
+	Changes   []model.CDRChange
+}
+
+// keyedCDR is a row written by an upsert with its call_key, see model.RMSCDR.CallKey
+type keyedCDR struct {
+	model.RMSCDR
+	CallKey string `db:"call_key"`
+}
+
+// EnsureCallKey adds the call_key column with its unique index to rmscdr and fills it in for the rows
+// loaded before. Calls the loader stored twice before it had a call_key are merged first, see mergeDuplicateCalls.
+func EnsureCallKey(ctx context.Context, db *sqlx.DB) error {
+	CallFrom := "EnsureCallKey in db "
+	for _, table := range []string{TableCDR, TableHistory} {
+		if err := ensureTable(ctx, db, table); err != nil {
+			li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+			return err
+		}
+	}
+	store := storeFor(db)
+	exists, err := store.ColumnExists(ctx, db, TableCDR, "call_key")
+	if err != nil {
+		li.Logger.ErrMySQLFilesMessage(CallFrom, err)
+		return err
+	}
+	if !exists {
+		li.Logger.L.Info(CallFrom, "adding the call_key column to rmscdr")
+		if _, err := db.ExecContext(ctx, "ALTER TABLE rmscdr ADD COLUMN call_key CHAR(40) NULL"); err != nil {
+			li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+			return fmt.Errorf("adding call_key to rmscdr: %w", err)
+		}
+	}
+	for {
+		var rows []struct {
+			ID            int64          `db:"id"`
+			FileName      sql.NullString `db:"file_name"`
+			SipCallID     sql.NullString `db:"sip_call_id"`
+			UnixTimestamp sql.NullInt64  `db:"unix_timestamp"`
+		}
+		err := db.SelectContext(ctx, &rows, db.Rebind("SELECT id, file_name, sip_call_id, unix_timestamp FROM rmscdr WHERE call_key IS NULL ORDER BY id LIMIT ?"), callKeyChunk)
+		if err != nil {
+			li.Logger.ErrCDRRetrievalMessage(CallFrom, err)
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			li.Logger.ErrMySQLConnectionMessage(CallFrom, err)
+			return err
+		}
+		update := tx.Rebind("UPDATE rmscdr SET call_key = ? WHERE id = ?")
+		for _, row := range rows {
+			key := model.RMSCDR{FileName: row.FileName.String, SipCallID: row.SipCallID.String, UnixTimestamp: row.UnixTimestamp.Int64}.CallKey()
+			if _, err := tx.ExecContext(ctx, update, key, row.ID); err != nil {
+				tx.Rollback()
+				li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+				return fmt.Errorf("filling in call_key: %w", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			li.Logger.ErrDbCommitMessage(CallFrom, err)
+			return err
+		}
+		li.Logger.L.Info(CallFrom, "filled in the call_key of ", len(rows), " rows")
+	}
+	if err := store.CreateUniqueIndex(ctx, db, TableCDR, "rmscdr_call_key", "call_key"); err != nil {
+		li.Logger.L.Warn(CallFrom, "indexing call_key of rmscdr failed, merging the calls stored twice: ", err)
+		if err := mergeDuplicateCalls(ctx, db); err != nil {
+			return err
+		}
+		if err := store.CreateUniqueIndex(ctx, db, TableCDR, "rmscdr_call_key", "call_key"); err != nil {
+			li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+			return fmt.Errorf("indexing call_key of rmscdr: %w", err)
+		}
+	}
+	return nil
+}
+
+// mergeDuplicateCalls keeps the first row of every call stored more than once and deletes the others. The
+// values of a deleted copy are moved to rmscdr_history, see mergeDuplicates, and its uid is recorded as purged
+// under a MergeRuleName entry of retention_audit, so verify accepts the missing rows. It runs once, when the
+// unique index of the call_key cannot be created.
+func mergeDuplicateCalls(ctx context.Context, db *sqlx.DB) error {
+	CallFrom := "mergeDuplicateCalls in db "
+	var keys []string
+	if err := db.SelectContext(ctx, &keys, "SELECT call_key FROM rmscdr GROUP BY call_key HAVING COUNT(*) > 1"); err != nil {
+		li.Logger.ErrCDRRetrievalMessage(CallFrom, err)
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	li.Logger.L.Warn(CallFrom, len(keys), " calls are stored more than once, keeping the first row of each")
+	for _, table := range []string{TableRetentionAudit, TableRetentionPurged} {
+		if err := ensureTable(ctx, db, table); err != nil {
+			return err
+		}
+	}
+	audit := model.RetentionAudit{RuleName: MergeRuleName, Cutoff: time.Now(), StartedAt: time.Now()}
+	if err := StartRetentionAudit(ctx, db, &audit); err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += callKeyChunk {
+		query, args, err := sqlx.In("SELECT "+cdrColumns+" FROM rmscdr WHERE call_key IN (?) ORDER BY id", keys[start:min(start+callKeyChunk, len(keys))])
+		if err != nil {
+			return err
+		}
+		var rows []model.RMSCDR
+		if err := db.SelectContext(ctx, &rows, db.Rebind(query), args...); err != nil {
+			li.Logger.ErrCDRRetrievalMessage(CallFrom, err)
+			return err
+		}
+		copies, changes := mergeDuplicates(rows, time.Now())
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			li.Logger.ErrMySQLConnectionMessage(CallFrom, err)
+			return err
+		}
+		if _, err := tx.NamedExecContext(ctx, `INSERT INTO rmscdr_history (uid, column_name, old_value, new_value, import_file_id, changed_at)
+			VALUES (:uid, :column_name, :old_value, :new_value, :import_file_id, :changed_at)`, changes); err != nil {
+			tx.Rollback()
+			li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+			return fmt.Errorf("recording merged calls: %w", err)
+		}
+		deleted, err := purgeCDRsTx(ctx, db, tx, audit.ID, copies)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("merging calls stored twice: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			li.Logger.ErrDbCommitMessage(CallFrom, err)
+			return err
+		}
+		audit.RowsMatched += int64(len(copies))
+		audit.RowsDeleted += deleted
+	}
+	finished := time.Now()
+	audit.FinishedAt = &finished
+	li.Logger.L.Warn(CallFrom, "deleted ", audit.RowsDeleted, " copies of calls stored twice, rebuild the summaries with report -rebuild")
+	return FinishRetentionAudit(ctx, db, &audit)
+}
+
+// mergeDuplicates takes the rows of calls stored more than once in id order and returns every row after
+// the first of its call. For each of them rmscdr_history gets the change of the uid to the uid of the
+// first row and the change of each mutable column that differs, from the value of the copy.
+// The changes carry no import ledger entry.
+func mergeDuplicates(rows []model.RMSCDR, now time.Time) ([]model.RMSCDR, []model.CDRChange) {
+	columns := slices.Sorted(maps.Keys(mutableColumns))
+	first := make(map[string]model.RMSCDR, len(rows))
+	var copies []model.RMSCDR
+	var changes []model.CDRChange
+	for _, cdr := range rows {
+		key := cdr.CallKey()
+		kept, ok := first[key]
+		if !ok {
+			first[key] = cdr
+			continue
+		}
+		copies = append(copies, cdr)
+		changes = append(changes, model.CDRChange{UID: kept.UID, Column: "uid", OldValue: cdr.UID, NewValue: kept.UID, ChangedAt: now})
+		for _, column := range columns {
+			get := mutableColumns[column].get
+			if oldValue, newValue := get(cdr), get(kept); oldValue != newValue {
+				changes = append(changes, model.CDRChange{UID: kept.UID, Column: column, OldValue: oldValue, NewValue: newValue, ChangedAt: now})
+			}
+		}
+	}
+	return copies, changes
+}
+
+// UpsertCDRsBatchTx inserts the new calls of a batch and updates the given mutable columns of the calls
+// already stored, every changed value is recorded in rmscdr_history against the import ledger entry.
+// Calls are matched on their call_key, see EnsureCallKey.
+func UpsertCDRsBatchTx(ctx context.Context, tx *sqlx.Tx, batch []model.RMSCDR, columns []string, importFileID int64) (UpsertResult, error) {
+	CallFrom := "UpsertCDRsBatchTx in db "
+	if err := checkUpsertColumns(columns); err != nil {
+		return UpsertResult{}, err
+	}
+	order, latest := batchCallKeys(batch)
+	if len(order) == 0 {
+		return UpsertResult{}, nil
+	}
+
+	store := storeFor(tx)
+	// lock the stored rows so the history matches what the update replaced
+	query, args, err := sqlx.In("SELECT "+cdrColumns+" FROM rmscdr WHERE call_key IN (?)"+store.ForUpdate(), order)
+	if err != nil {
+		return UpsertResult{}, err
+	}
+	var stored []model.RMSCDR
+	if err := tx.SelectContext(ctx, &stored, tx.Rebind(query), args...); err != nil {
+		li.Logger.ErrCDRRetrievalMessage(CallFrom, err)
+		return UpsertResult{}, err
+	}
+	existing := make(map[string]model.RMSCDR, len(stored))
+	for _, cdr := range stored {
+		existing[cdr.CallKey()] = cdr
+	}
+	result, rows := planUpsert(batch, order, latest, existing, columns, importFileID)
+	if len(rows) == 0 {
+		return result, nil
+	}
+
+	insert := `INSERT INTO rmscdr (uid, direction, time, unix_timestamp, flagged, source, destination, duration, size, exists_in_db, local_copy, authentic, file_name, sip_call_id, call_key)
+		 VALUES (:uid, :direction, :time, :unix_timestamp, :flagged, :source, :destination, :duration, :size, :exists_in_db, :local_copy, :authentic, :file_name, :sip_call_id, :call_key)`
+	// the rows are new or changed, the clause only matters for a call another import stored meanwhile
+	insert += store.Upsert("call_key", columns)
+	if _, err := tx.NamedExecContext(ctx, insert, rows); err != nil {
+		li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+		return result, fmt.Errorf("upserting cdrs: %w", err)
+	}
+	if len(result.Changes) > 0 {
+		if _, err := tx.NamedExecContext(ctx, `INSERT INTO rmscdr_history (uid, column_name, old_value, new_value, import_file_id, changed_at)
+			VALUES (:uid, :column_name, :old_value, :new_value, :import_file_id, :changed_at)`, result.Changes); err != nil {
+			li.Logger.ErrMySQLWriteMessage(CallFrom, err)
+			return result, fmt.Errorf("recording cdr history: %w", err)
+		}
+	}
+	li.Logger.L.WithFields(logrus.Fields{
+		"CallFrom":  CallFrom,
+		"inserted":  len(result.Inserted),
+		"updated":   len(result.Updated),
+		"unchanged": result.Unchanged,
+	}).Info("batch upserted")
+	return result, nil
+}
+
+// checkUpsertColumns fails on a column an upsert cannot update
+func checkUpsertColumns(columns []string) error {
+	for _, column := range columns {
+		if _, ok := mutableColumns[column]; !ok {
+			return fmt.Errorf("column %q cannot be updated by an upsert", column)
+		}
+	}
+	return nil
+}
+
+// batchCallKeys returns the distinct call keys of a batch in order and the index of the last export of
+// each call, the last export of a call repeated in the batch wins
+func batchCallKeys(batch []model.RMSCDR) ([]string, map[string]int) {
+	latest := make(map[string]int, len(batch))
+	var order []string
+	for i, cdr := range batch {
+		key := cdr.CallKey()
+		if _, ok := latest[key]; !ok {
+			order = append(order, key)
+		}
+		latest[key] = i
+	}
+	return order, latest
+}
+
+// planUpsert compares the calls of a batch with their stored rows and returns the outcome and the rows to write
+func planUpsert(batch []model.RMSCDR, order []string, latest map[string]int, existing map[string]model.RMSCDR,
+	columns []string, importFileID int64) (UpsertResult, []keyedCDR) {
+	var result UpsertResult
+	now := time.Now()
+	var rows []keyedCDR
+	for _, key := range order {
+		cdr := batch[latest[key]]
+		old, ok := existing[key]
+		if !ok {
+			rows = append(rows, keyedCDR{cdr, key})
+			result.Inserted = append(result.Inserted, cdr)
+			continue
+		}
+		updated := old
+		var changed bool
+		for _, column := range columns {
+			c := mutableColumns[column]
+			if oldValue, newValue := c.get(old), c.get(cdr); oldValue != newValue {
+				changed = true
+				c.set(&updated, cdr)
+				result.Changes = append(result.Changes, model.CDRChange{
+					UID:          old.UID,
+					Column:       column,
+					OldValue:     oldValue,
+					NewValue:     newValue,
+					ImportFileID: importFileID,
+					ChangedAt:    now,
+				})
+			}
+		}
+		if !changed {
+			result.Unchanged++
+			continue
+		}
+		rows = append(rows, keyedCDR{updated, key})
+		result.Updated = append(result.Updated, updated)
+	}
+	return result, rows
+}
@@ -0,0 +1,339 @@
+// Package export streams filtered CDRs out of the database as csv, the RMS semicolon layout, json lines or xlsx
+package export
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/privacy"
+)
+
+// the export formats
+const (
+	FormatCSV   = "csv"
+	FormatRMS   = "rms"
+	FormatJSONL = "jsonl"
+	FormatXLSX  = "xlsx"
+)
+
+// RMSLocationName is the time zone of the RMS recorder, the stored times are its wall clock
+var RMSLocationName = "Africa/Johannesburg"
+
+// Columns lists the exportable columns in table order
+var Columns = []string{"id", "uid", "direction", "time", "unix_timestamp", "flagged", "source", "destination",
+	"duration", "size", "exists_in_db", "local_copy", "authentic", "file_name", "sip_call_id"}
+
+// Filter selects the CDRs to export
+type Filter struct {
+	// calls from this time, inclusive
+	From time.Time
+	// calls before this time, exclusive
+	To        time.Time
+	Direction string
+	// match the source or the destination
+	Extension string
+	Flagged   *bool
+}
+
+// Options controls the layout of the export
+type Options struct {
+	Format string
+	// the columns to write, all columns when empty, ignored by the RMS layout
+	Columns []string
+	// the time zone of the timestamps written
+	Location *time.Location
+	// gzip the output
+	Gzip bool
+	// mask the source and destination numbers
+	Mask bool
+}
+
+// ParseValues reads a filter and options from query values, shared by the export command and the api.
+// Dates are given as 2006-01-02 or 2006-01-02 15:04:05 in RMS time.
+func ParseValues(values url.Values) (Filter, Options, error) {
+	var filter Filter
+	opts := Options{Format: FormatCSV, Mask: model.Settings.Privacy.MaskExports}
+	var err error
+	if v := values.Get("from"); v != "" {
+		if filter.From, err = parseDate(v); err != nil {
+			return filter, opts, fmt.Errorf("invalid from date: %w", err)
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if filter.To, err = parseDate(v); err != nil {
+			return filter, opts, fmt.Errorf("invalid to date: %w", err)
+		}
+	}
+	filter.Direction = values.Get("direction")
+	filter.Extension = values.Get("extension")
+	if v := values.Get("flagged"); v != "" {
+		flagged, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, opts, fmt.Errorf("invalid flagged value: %w", err)
+		}
+		filter.Flagged = &flagged
+	}
+	if v := values.Get("format"); v != "" {
+		opts.Format = strings.ToLower(v)
+	}
+	switch opts.Format {
+	case FormatCSV, FormatRMS, FormatJSONL, FormatXLSX:
+	default:
+		return filter, opts, fmt.Errorf("unknown format %q, use csv, rms, jsonl or xlsx", opts.Format)
+	}
+	if v := values.Get("columns"); v != "" {
+		for _, column := range strings.Split(v, ",") {
+			column = strings.TrimSpace(column)
+			if !validColumn(column) {
+				return filter, opts, fmt.Errorf("unknown column %q", column)
+			}
+			opts.Columns = append(opts.Columns, column)
+		}
+	}
+	tz := values.Get("tz")
+	if tz == "" {
+		tz = RMSLocationName
+	}
+	if opts.Location, err = time.LoadLocation(tz); err != nil {
+		return filter, opts, fmt.Errorf("invalid time zone: %w", err)
+	}
+	if v := values.Get("gzip"); v != "" {
+		if opts.Gzip, err = strconv.ParseBool(v); err != nil {
+			return filter, opts, fmt.Errorf("invalid gzip value: %w", err)
+		}
+	}
+	// masking can be asked for but not turned off when the exports are masked
+	if v := values.Get("mask"); v != "" {
+		mask, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, opts, fmt.Errorf("invalid mask value: %w", err)
+		}
+		opts.Mask = opts.Mask || mask
+	}
+	return filter, opts, nil
+}
+
+// parseDate parses a filter date the way the import stores times, the RMS wall clock as utc
+func parseDate(v string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q, use 2006-01-02 or 2006-01-02 15:04:05", v)
+}
+
+func validColumn(column string) bool {
+	for _, c := range Columns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// Where builds the where clause of a filter
+func (f Filter) Where() (string, []interface{}) {
+	var parts []string
+	var args []interface{}
+	if !f.From.IsZero() {
+		parts = append(parts, "unix_timestamp >= ?")
+		args = append(args, f.From.Unix())
+	}
+	if !f.To.IsZero() {
+		parts = append(parts, "unix_timestamp < ?")
+		args = append(args, f.To.Unix())
+	}
+	if f.Direction != "" {
+		parts = append(parts, "direction = ?")
+		args = append(args, f.Direction)
+	}
+	if f.Extension != "" {
+		parts = append(parts, "(source = ? OR destination = ?)")
+		args = append(args, f.Extension, f.Extension)
+	}
+	if f.Flagged != nil {
+		parts = append(parts, "flagged = ?")
+		args = append(args, *f.Flagged)
+	}
+	return strings.Join(parts, " AND "), args
+}
+
+// ContentType returns the mime type of the export
+func (o Options) ContentType() string {
+	if o.Gzip {
+		return "application/gzip"
+	}
+	switch o.Format {
+	case FormatJSONL:
+		return "application/x-ndjson"
+	case FormatXLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case FormatRMS:
+		return "text/csv; charset=ISO-8859-1"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// FileName returns a file name for the export
+func (o Options) FileName(now time.Time) string {
+	ext := map[string]string{FormatCSV: ".csv", FormatRMS: ".csv", FormatJSONL: ".jsonl", FormatXLSX: ".xlsx"}[o.Format]
+	name := "rmscdr_" + now.Format("20060102T150405") + ext
+	if o.Gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+// rowWriter writes the rows of one export format
+type rowWriter interface {
+	WriteRow(cdr model.RMSCDR) error
+	Close() error
+}
+
+// Write streams the CDRs matching the filter to w and returns the number of rows written. Nothing is written
+// to w until the query returned its first row or finished, so a query that fails leaves w untouched.
+func Write(ctx context.Context, db *sqlx.DB, w io.Writer, filter Filter, opts Options) (int64, error) {
+	if opts.Location == nil {
+		opts.Location = rmsLocation()
+	}
+	if len(opts.Columns) == 0 {
+		opts.Columns = Columns
+	}
+	var gz *gzip.Writer
+	var rw rowWriter
+	start := func() error {
+		if rw != nil {
+			return nil
+		}
+		out := w
+		if opts.Gzip {
+			gz = gzip.NewWriter(w)
+			out = gz
+		}
+		var err error
+		rw, err = newRowWriter(out, opts)
+		return err
+	}
+	var count int64
+	where, args := filter.Where()
+	err := dbs.StreamCDRs(ctx, db, where, args, func(cdr model.RMSCDR) error {
+		if err := start(); err != nil {
+			return err
+		}
+		count++
+		if opts.Mask {
+			cdr = privacy.MaskCDR(cdr)
+		}
+		return rw.WriteRow(cdr)
+	})
+	if err == nil {
+		// no rows matched, the export is the header alone
+		err = start()
+	}
+	if rw == nil {
+		return count, err
+	}
+	if cerr := rw.Close(); err == nil {
+		err = cerr
+	}
+	if gz != nil {
+		if cerr := gz.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return count, err
+}
+
+func newRowWriter(w io.Writer, opts Options) (rowWriter, error) {
+	switch opts.Format {
+	case FormatRMS:
+		return newRMSWriter(w, opts)
+	case FormatJSONL:
+		return newJSONLWriter(w, opts), nil
+	case FormatXLSX:
+		return newXLSXWriter(w, opts)
+	}
+	return newCSVWriter(w, opts)
+}
+
+// recordedTime returns the call time in the export time zone.
+// The import stores the RMS wall clock labelled as utc, so the wall clock is read back in the RMS zone first.
+func recordedTime(t time.Time, loc *time.Location) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), rmsLocation()).In(loc)
+}
+
+// rmsLocation loads the RMS time zone once, falling back to utc if the zone database is missing
+var rmsLocation = sync.OnceValue(func() *time.Location {
+	loc, err := time.LoadLocation(RMSLocationName)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+})
+
+// value returns the typed value of a column
+func value(cdr model.RMSCDR, column string, loc *time.Location) interface{} {
+	switch column {
+	case "id":
+		return cdr.ID
+	case "uid":
+		return cdr.UID
+	case "direction":
+		return cdr.Direction
+	case "time":
+		return recordedTime(cdr.Time, loc)
+	case "unix_timestamp":
+		return cdr.UnixTimestamp
+	case "flagged":
+		return cdr.Flagged
+	case "source":
+		return cdr.Source
+	case "destination":
+		return cdr.Destination
+	case "duration":
+		return cdr.Duration
+	case "size":
+		return cdr.Size
+	case "exists_in_db":
+		return cdr.ExistsINDB
+	case "local_copy":
+		return cdr.LocalCopy
+	case "authentic":
+		return cdr.Authentic
+	case "file_name":
+		return cdr.FileName
+	case "sip_call_id":
+		return cdr.SipCallID
+	}
+	return nil
+}
+
+// text returns the csv text of a column value
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,249 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/text/encoding/charmap"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// exportDB opens a new sqlite database holding two calls. The times are the RMS wall clock stored as utc,
+// the way the import stores them.
+func exportDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	ctx := context.Background()
+	store, err := dbs.Open(ctx, dbs.DriverSQLite, filepath.Join(t.TempDir(), "export.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := store.DB()
+	t.Cleanup(func() { db.Close() })
+	if err := dbs.PrepareImport(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	second := first.Add(90 * time.Minute)
+	cdrs := []model.RMSCDR{
+		{UID: "uid-1", Direction: "Incoming", Time: first, UnixTimestamp: first.Unix(), Flagged: true,
+			Source: "0821234567", Destination: "2001", Duration: 65, Size: 12.5, ExistsINDB: true,
+			Authentic: "Yes", FileName: "café.wav", SipCallID: "1@pbx"},
+		{UID: "uid-2", Direction: "Outgoing", Time: second, UnixTimestamp: second.Unix(),
+			Source: "2002", Destination: "0839876543", Duration: 3725, FileName: "out, 2.wav", SipCallID: "2@pbx"},
+	}
+	if _, err := dbs.InsertCDRsBatch(ctx, db, cdrs); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// export writes the calls of the database with the options and returns the output
+func export(t *testing.T, db *sqlx.DB, filter Filter, opts Options) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if _, err := Write(context.Background(), db, &out, filter, opts); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestCSV(t *testing.T) {
+	db := exportDB(t)
+	records, err := csv.NewReader(bytes.NewReader(export(t, db, Filter{}, Options{Format: FormatCSV}))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ",") != strings.Join(Columns, ",") {
+		t.Fatalf("the export holds %q, want the header and 2 calls", records)
+	}
+	row := make(map[string]string)
+	for i, column := range records[0] {
+		row[column] = records[1][i]
+	}
+	want := map[string]string{
+		"uid": "uid-1", "time": "2024-03-04T10:00:00+02:00", "flagged": "true", "source": "0821234567",
+		"duration": "65", "size": "12.5", "file_name": "café.wav",
+	}
+	for column, v := range want {
+		if row[column] != v {
+			t.Errorf("%s = %q, want %q", column, row[column], v)
+		}
+	}
+	if records[2][13] != "out, 2.wav" {
+		t.Errorf("the quoted file name reads back as %q", records[2][13])
+	}
+}
+
+func TestColumnsAndTimeZone(t *testing.T) {
+	db := exportDB(t)
+	opts := Options{Format: FormatCSV, Columns: []string{"uid", "time", "destination"}, Location: time.UTC}
+	got := string(export(t, db, Filter{Direction: "Outgoing"}, opts))
+	want := "uid,time,destination\nuid-2,2024-03-04T09:30:00Z,0839876543\n"
+	if got != want {
+		t.Errorf("the export is\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRMS(t *testing.T) {
+	db := exportDB(t)
+	out := export(t, db, Filter{}, Options{Format: FormatRMS, Columns: []string{"uid"}})
+	if !bytes.Contains(out, []byte("caf\xe9.wav")) {
+		t.Errorf("the export is not ISO-8859-1: %q", out)
+	}
+	r := csv.NewReader(charmap.ISO8859_1.NewDecoder().Reader(bytes.NewReader(out)))
+	r.Comma = ';'
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ";") != strings.Join(rmsHeader, ";") {
+		t.Fatalf("the export holds %q, want the RMS header and 2 calls", records)
+	}
+	first := "Incoming;2024-03-04 10:00:00;Yes;0821234567;2001;1 min 5 sec;12.5;Yes;No;Yes;café.wav;1@pbx"
+	if got := strings.Join(records[1], ";"); got != first {
+		t.Errorf("the first call is\n%s\nwant\n%s", got, first)
+	}
+	if records[2][5] != "1 hour 2 min 5 sec" || records[2][2] != "No" {
+		t.Errorf("the second call is %q", records[2])
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	db := exportDB(t)
+	out := export(t, db, Filter{Flagged: new(bool)}, Options{Format: FormatJSONL, Columns: []string{"uid", "time", "duration", "flagged"}})
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("the export holds %d lines, want the unflagged call", len(lines))
+	}
+	var row map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &row); err != nil {
+		t.Fatal(err)
+	}
+	if len(row) != 4 || row["uid"] != "uid-2" || row["time"] != "2024-03-04T11:30:00+02:00" ||
+		row["duration"] != float64(3725) || row["flagged"] != false {
+		t.Errorf("the call is %v", row)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	db := exportDB(t)
+	out := export(t, db, Filter{}, Options{Format: FormatCSV, Gzip: true, Columns: []string{"uid"}})
+	zr, err := gzip.NewReader(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "uid\nuid-1\nuid-2\n" {
+		t.Errorf("the gzipped export holds %q", plain)
+	}
+}
+
+func TestMask(t *testing.T) {
+	db := exportDB(t)
+	out := string(export(t, db, Filter{}, Options{Format: FormatCSV, Mask: true, Columns: []string{"source", "destination"}}))
+	if out != "source,destination\n*******567,2001\n2002,*******543\n" {
+		t.Errorf("the masked export is %q", out)
+	}
+}
+
+func TestNoRowsIsHeader(t *testing.T) {
+	db := exportDB(t)
+	out := string(export(t, db, Filter{Extension: "9999"}, Options{Format: FormatCSV, Columns: []string{"uid"}}))
+	if out != "uid\n" {
+		t.Errorf("an export without calls is %q", out)
+	}
+}
+
+// sheet is the part of the sheet xml read back by the test
+type sheet struct {
+	Rows []struct {
+		Cells []struct {
+			Type   string `xml:"t,attr"`
+			Value  string `xml:"v"`
+			Inline string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func TestXLSX(t *testing.T) {
+	db := exportDB(t)
+	out := export(t, db, Filter{}, Options{Format: FormatXLSX, Columns: []string{"uid", "time", "duration", "size", "flagged", "file_name"}})
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		parts[f.Name] = f
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/worksheets/sheet1.xml"} {
+		if parts[name] == nil {
+			t.Fatalf("the workbook has no %s", name)
+		}
+	}
+	f, err := parts["xl/worksheets/sheet1.xml"].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var s sheet
+	if err := xml.NewDecoder(f).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Rows) != 3 {
+		t.Fatalf("the sheet has %d rows, want the header and 2 calls", len(s.Rows))
+	}
+	var got []string
+	for _, c := range s.Rows[1].Cells {
+		got = append(got, c.Type+":"+c.Value+c.Inline)
+	}
+	want := "inlineStr:uid-1|inlineStr:2024-03-04 10:00:00|n:65|n:12.5|b:1|inlineStr:café.wav"
+	if strings.Join(got, "|") != want {
+		t.Errorf("the first call is\n%s\nwant\n%s", strings.Join(got, "|"), want)
+	}
+	if h := s.Rows[0].Cells[0]; h.Type != "inlineStr" || h.Inline != "uid" {
+		t.Errorf("the header starts with %+v", h)
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	filter, opts, err := ParseValues(url.Values{
+		"from": {"2024-03-01"}, "to": {"2024-03-02 12:00:00"}, "flagged": {"true"}, "format": {"XLSX"},
+		"columns": {"uid, time"}, "tz": {"UTC"}, "gzip": {"1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.From.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) || !filter.To.Equal(time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)) ||
+		filter.Flagged == nil || !*filter.Flagged {
+		t.Errorf("the filter is %+v", filter)
+	}
+	if opts.Format != FormatXLSX || strings.Join(opts.Columns, ",") != "uid,time" || opts.Location != time.UTC || !opts.Gzip {
+		t.Errorf("the options are %+v", opts)
+	}
+	if opts.FileName(time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)) != "rmscdr_20240304T050607.xlsx.gz" || opts.ContentType() != "application/gzip" {
+		t.Errorf("the download is %s as %s", opts.FileName(time.Time{}), opts.ContentType())
+	}
+	for _, bad := range []url.Values{{"format": {"xml"}}, {"columns": {"password"}}, {"tz": {"Mars/Base"}}, {"from": {"yesterday"}}} {
+		if _, _, err := ParseValues(bad); err == nil {
+			t.Errorf("%v was accepted", bad)
+		}
+	}
+}
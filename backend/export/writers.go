@@ -0,0 +1,130 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// rmsHeader is the header row of an RMS csv export
+var rmsHeader = []string{"Direction", "Time", "Flagged", "Source", "Destination", "Duration", "Size",
+	"Exists in DB", "Local copy", "Authentic", "File name", "SIP call ID"}
+
+// csvWriter writes the selected columns as comma separated utf-8
+type csvWriter struct {
+	w    *csv.Writer
+	opts Options
+}
+
+func newCSVWriter(w io.Writer, opts Options) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w), opts: opts}
+	return cw, cw.w.Write(opts.Columns)
+}
+
+func (c *csvWriter) WriteRow(cdr model.RMSCDR) error {
+	record := make([]string, len(c.opts.Columns))
+	for i, column := range c.opts.Columns {
+		record[i] = text(value(cdr, column, c.opts.Location))
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// rmsWriter writes the semicolon separated ISO-8859-1 layout of the RMS export, it can be imported again
+type rmsWriter struct {
+	w       *csv.Writer
+	encoder io.Writer
+	opts    Options
+}
+
+func newRMSWriter(w io.Writer, opts Options) (*rmsWriter, error) {
+	// characters outside Latin-1 are replaced rather than failing the export
+	encoder := encoding.ReplaceUnsupported(charmap.ISO8859_1.NewEncoder()).Writer(w)
+	cw := csv.NewWriter(encoder)
+	cw.Comma = ';'
+	rw := &rmsWriter{w: cw, encoder: encoder, opts: opts}
+	return rw, cw.Write(rmsHeader)
+}
+
+func (r *rmsWriter) WriteRow(cdr model.RMSCDR) error {
+	return r.w.Write([]string{
+		cdr.Direction,
+		recordedTime(cdr.Time, r.opts.Location).Format("2006-01-02 15:04:05"),
+		yesNo(cdr.Flagged),
+		cdr.Source,
+		cdr.Destination,
+		rmsDuration(time.Duration(cdr.Duration) * time.Second),
+		strconv.FormatFloat(cdr.Size, 'f', -1, 64),
+		yesNo(cdr.ExistsINDB),
+		yesNo(cdr.LocalCopy),
+		cdr.Authentic,
+		cdr.FileName,
+		cdr.SipCallID,
+	})
+}
+
+func (r *rmsWriter) Close() error {
+	r.w.Flush()
+	if err := r.w.Error(); err != nil {
+		return err
+	}
+	// the encoder holds back partial input until it is closed
+	if c, ok := r.encoder.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
+// rmsDuration formats a duration the way RMS does eg. "1 hour 2 min 50 sec"
+func rmsDuration(d time.Duration) string {
+	hours := int(d / time.Hour)
+	minutes := int(d % time.Hour / time.Minute)
+	seconds := int(d % time.Minute / time.Second)
+	switch {
+	case hours > 0:
+		return fmt.Sprintf("%d hour %d min %d sec", hours, minutes, seconds)
+	case minutes > 0:
+		return fmt.Sprintf("%d min %d sec", minutes, seconds)
+	}
+	return fmt.Sprintf("%d sec", seconds)
+}
+
+// jsonlWriter writes one json object per line with the selected columns
+type jsonlWriter struct {
+	enc  *json.Encoder
+	opts Options
+}
+
+func newJSONLWriter(w io.Writer, opts Options) *jsonlWriter {
+	return &jsonlWriter{enc: json.NewEncoder(w), opts: opts}
+}
+
+func (j *jsonlWriter) WriteRow(cdr model.RMSCDR) error {
+	row := make(map[string]interface{}, len(j.opts.Columns))
+	for _, column := range j.opts.Columns {
+		row[column] = value(cdr, column, j.opts.Location)
+	}
+	return j.enc.Encode(row)
+}
+
+func (j *jsonlWriter) Close() error {
+	return nil
+}
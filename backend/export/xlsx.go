@@ -0,0 +1,116 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// the static parts of a single sheet workbook
+var xlsxParts = []struct{ name, body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="CDRs" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`},
+}
+
+// xlsxWriter streams the rows into the sheet of a minimal workbook, strings are written inline
+// so nothing has to be held in memory for a shared string table
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	opts  Options
+}
+
+func newXLSXWriter(w io.Writer, opts Options) (*xlsxWriter, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.body); err != nil {
+			return nil, err
+		}
+	}
+	f, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	x := &xlsxWriter{zw: zw, sheet: bufio.NewWriter(f), opts: opts}
+	x.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	header := make([]interface{}, len(opts.Columns))
+	for i, column := range opts.Columns {
+		header[i] = column
+	}
+	return x, x.writeCells(header)
+}
+
+func (x *xlsxWriter) WriteRow(cdr model.RMSCDR) error {
+	cells := make([]interface{}, len(x.opts.Columns))
+	for i, column := range x.opts.Columns {
+		v := value(cdr, column, x.opts.Location)
+		// spreadsheets have no time zones, write the wall clock of the chosen zone
+		if t, ok := v.(time.Time); ok {
+			v = t.Format("2006-01-02 15:04:05")
+		}
+		cells[i] = v
+	}
+	return x.writeCells(cells)
+}
+
+func (x *xlsxWriter) writeCells(cells []interface{}) error {
+	x.sheet.WriteString("<row>")
+	for _, cell := range cells {
+		switch v := cell.(type) {
+		case int64:
+			fmt.Fprintf(x.sheet, `<c t="n"><v>%d</v></c>`, v)
+		case float64:
+			fmt.Fprintf(x.sheet, `<c t="n"><v>%s</v></c>`, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			b := 0
+			if v {
+				b = 1
+			}
+			fmt.Fprintf(x.sheet, `<c t="b"><v>%d</v></c>`, b)
+		default:
+			x.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			if err := xml.EscapeText(x.sheet, []byte(text(v))); err != nil {
+				return err
+			}
+			x.sheet.WriteString(`</t></is></c>`)
+		}
+	}
+	_, err := x.sheet.WriteString("</row>")
+	return err
+}
+
+func (x *xlsxWriter) Close() error {
+	x.sheet.WriteString("</sheetData></worksheet>")
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
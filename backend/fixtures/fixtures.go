@@ -0,0 +1,311 @@
+// Package fixtures generates sample RMS csv exports with optional defects, for tests and load benchmarks
+package fixtures
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// header is the header row RMS writes at the top of an export
+var header = []string{"Direction", "Time", "Flagged", "From", "To", "Duration", "Size",
+	"Exists in DB", "Local copy", "Authentic", "File name", "SIP Call ID"}
+
+// bom is the byte order mark RMS writes before the ISO-8859-1 content
+var bom = []byte{0xEF, 0xBB, 0xBF}
+
+// the defects that can be injected into the rows
+const (
+	DefectShortLine   = "short_line"
+	DefectBadTime     = "bad_time"
+	DefectNineDigit   = "nine_digit"
+	DefectOddDuration = "odd_duration"
+)
+
+const timeLayout = "2006-01-02 15:04:05"
+
+// kilobytesPerSecond is the size of a G.711 recording, 8000 bytes a second
+const kilobytesPerSecond = 8000.0 / 1024
+
+// badTimes are time values readCSV rejects
+var badTimes = []string{"01/03/2024 08:15", "2024-02-30 10:00:00", "2024-03-01T08:15:00Z", "", "2024-03-01 25:61:00"}
+
+// oddDurations are durations that parse but are unusual, long or written differently
+var oddDurations = []string{"0 sec", "1 hour 0 min 0 sec", "95 sec", "61 min 2 sec", "3 min", "", "12 hour 0 min 1 sec"}
+
+// Options controls the generated files
+type Options struct {
+	// the folder the files are written to, it is created if missing
+	Dir string
+	// the rows per file, the header is not counted
+	Rows  int
+	Files int
+	// the calls are spread over [From, To)
+	From time.Time
+	To   time.Time
+	// the internal extensions taking part in the calls
+	Extensions []string
+	// the share of rows given each defect, between 0 and 1, a row has at most one defect
+	ShortLines   float64
+	BadTimes     float64
+	NineDigits   float64
+	OddDurations float64
+	// the random seed, the same seed and options write the same files
+	Seed int64
+}
+
+// Report counts what was written
+type Report struct {
+	Files   []string       `json:"files"`
+	Rows    int            `json:"rows"`
+	Defects map[string]int `json:"defects"`
+	Seed    int64          `json:"seed"`
+}
+
+// ParseExtensions reads a comma separated list of extensions and ranges, eg. "2001-2020,3001"
+func ParseExtensions(s string) ([]string, error) {
+	var extensions []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			extensions = append(extensions, part)
+			continue
+		}
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extension range %q: %w", part, err)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil || to < from {
+			return nil, fmt.Errorf("invalid extension range %q", part)
+		}
+		for n := from; n <= to; n++ {
+			// keep the width of the first extension, eg. 0100-0110
+			extensions = append(extensions, fmt.Sprintf("%0*d", len(first), n))
+		}
+	}
+	if len(extensions) == 0 {
+		return nil, fmt.Errorf("no extensions in %q", s)
+	}
+	return extensions, nil
+}
+
+func (o Options) validate() error {
+	switch {
+	case o.Rows < 0:
+		return fmt.Errorf("invalid row count %d", o.Rows)
+	case o.Files < 1:
+		return fmt.Errorf("invalid file count %d", o.Files)
+	case !o.To.After(o.From):
+		return fmt.Errorf("the date range %s to %s is empty", o.From.Format(timeLayout), o.To.Format(timeLayout))
+	case len(o.Extensions) == 0:
+		return fmt.Errorf("no extensions given")
+	}
+	total := 0.0
+	for _, rate := range []float64{o.ShortLines, o.BadTimes, o.NineDigits, o.OddDurations} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid defect rate %v, want 0 to 1", rate)
+		}
+		total += rate
+	}
+	if total > 1 {
+		return fmt.Errorf("the defect rates add up to %v, more than 1", total)
+	}
+	return nil
+}
+
+// Generate writes opts.Files RMS csv exports of opts.Rows calls each into opts.Dir
+func Generate(opts Options) (*Report, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	g := &generator{opts: opts, rnd: rand.New(rand.NewSource(opts.Seed))}
+	report := &Report{Defects: make(map[string]int), Seed: opts.Seed}
+	// the files cover consecutive parts of the date range, like daily exports
+	span := opts.To.Sub(opts.From) / time.Duration(opts.Files)
+	for i := 0; i < opts.Files; i++ {
+		from := opts.From.Add(time.Duration(i) * span)
+		name := filepath.Join(opts.Dir, fmt.Sprintf("rms-export-%s-%03d.csv", from.Format("20060102"), i+1))
+		if err := g.writeFile(name, from, from.Add(span), report); err != nil {
+			return report, fmt.Errorf("cannot write %s: %w", name, err)
+		}
+		report.Files = append(report.Files, name)
+	}
+	return report, nil
+}
+
+// generator holds the random source and the call counter shared by the files
+type generator struct {
+	opts  Options
+	rnd   *rand.Rand
+	calls int
+}
+
+func (g *generator) writeFile(name string, from, to time.Time, report *Report) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := g.write(f, from, to, report); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// write writes the bom, the header and the rows of one file in time order
+func (g *generator) write(w io.Writer, from, to time.Time, report *Report) error {
+	if _, err := w.Write(bom); err != nil {
+		return err
+	}
+	encoder := encoding.ReplaceUnsupported(charmap.ISO8859_1.NewEncoder()).Writer(w)
+	cw := csv.NewWriter(encoder)
+	cw.Comma = ';'
+	cw.UseCRLF = true
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	times := make([]time.Time, g.opts.Rows)
+	for i := range times {
+		times[i] = from.Add(time.Duration(g.rnd.Int63n(int64(to.Sub(from))))).Truncate(time.Second)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	for _, t := range times {
+		row, defect := g.row(t)
+		if defect != "" {
+			report.Defects[defect]++
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+		report.Rows++
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	// the encoder holds back partial input until it is closed
+	if c, ok := encoder.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// row builds one call at time t and returns the defect injected into it, if any
+func (g *generator) row(t time.Time) ([]string, string) {
+	g.calls++
+	extension := g.opts.Extensions[g.rnd.Intn(len(g.opts.Extensions))]
+	external := fmt.Sprintf("0%d%08d", 1+g.rnd.Intn(8), g.rnd.Intn(100000000))
+	defect := g.defect()
+
+	var direction, prefix, source, destination string
+	switch n := g.rnd.Intn(10); {
+	case n < 5:
+		direction, prefix, source, destination = "Incoming", "in", external, extension
+	case n < 9:
+		direction, prefix, source, destination = "Outgoing", "out", extension, external
+	default:
+		direction, prefix = "Internal", "int"
+		source, destination = extension, g.opts.Extensions[g.rnd.Intn(len(g.opts.Extensions))]
+	}
+	if defect == DefectNineDigit {
+		// RMS drops the leading zero of some numbers, an internal call becomes incoming to have one
+		if direction == "Internal" {
+			direction, prefix, source = "Incoming", "in", external
+		}
+		if direction == "Incoming" {
+			source = source[1:]
+		} else {
+			destination = destination[1:]
+		}
+	}
+
+	// most calls are short, a few run long
+	seconds := 5 + int(g.rnd.ExpFloat64()*90)
+	duration := rmsDuration(time.Duration(seconds) * time.Second)
+	if defect == DefectOddDuration {
+		duration = oddDurations[g.rnd.Intn(len(oddDurations))]
+	}
+	timestamp := t.Format(timeLayout)
+	if defect == DefectBadTime {
+		timestamp = badTimes[g.rnd.Intn(len(badTimes))]
+	}
+
+	row := []string{
+		direction,
+		timestamp,
+		yesNo(g.rnd.Intn(20) == 0),
+		source,
+		destination,
+		duration,
+		strconv.FormatFloat(float64(seconds)*kilobytesPerSecond, 'f', 1, 64) + " KB",
+		yesNo(g.rnd.Intn(50) != 0),
+		yesNo(g.rnd.Intn(4) == 0),
+		"Yes",
+		fmt.Sprintf("%s/%s-%06d.wav", t.Format("2006/01/02"), prefix, g.calls),
+		fmt.Sprintf("%016x@pbx", g.rnd.Uint64()),
+	}
+	if defect == DefectShortLine {
+		// the export was cut off somewhere after the time
+		row = row[:2+g.rnd.Intn(len(row)-3)]
+	}
+	return row, defect
+}
+
+// defect picks the defect of the next row by the configured rates
+func (g *generator) defect() string {
+	n := g.rnd.Float64()
+	for _, d := range []struct {
+		name string
+		rate float64
+	}{
+		{DefectShortLine, g.opts.ShortLines},
+		{DefectBadTime, g.opts.BadTimes},
+		{DefectNineDigit, g.opts.NineDigits},
+		{DefectOddDuration, g.opts.OddDurations},
+	} {
+		if n < d.rate {
+			return d.name
+		}
+		n -= d.rate
+	}
+	return ""
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
+// rmsDuration formats a duration the way RMS does eg. "1 hour 2 min 50 sec"
+func rmsDuration(d time.Duration) string {
+	hours := int(d / time.Hour)
+	minutes := int(d % time.Hour / time.Minute)
+	seconds := int(d % time.Minute / time.Second)
+	switch {
+	case hours > 0:
+		return fmt.Sprintf("%d hour %d min %d sec", hours, minutes, seconds)
+	case minutes > 0:
+		return fmt.Sprintf("%d min %d sec", minutes, seconds)
+	}
+	return fmt.Sprintf("%d sec", seconds)
+}
@@ -0,0 +1,110 @@
+// Package health checks whether the loader can do its work, for the readiness endpoint and the healthcheck command
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/source"
+)
+
+// checkTimeout bounds each check so a hanging database does not hang the probe
+const checkTimeout = 3 * time.Second
+
+// Check is the result of one readiness check
+type Check struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Report holds the readiness checks, the loader is ready when all of them passed
+type Report struct {
+	Ready  bool    `json:"ready"`
+	Checks []Check `json:"checks"`
+}
+
+// Ready checks that the database is reachable, the log files are writable and the csv folder can be read.
+// A remote source does not read csv_path, so the folder is only checked for the local source.
+func Ready(ctx context.Context, db *sqlx.DB) Report {
+	report := Report{Ready: true}
+	add := func(name string, err error) {
+		c := Check{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			report.Ready = false
+		}
+		report.Checks = append(report.Checks, c)
+	}
+	add("database", checkDB(ctx, db))
+	for _, path := range logFiles() {
+		add("log "+filepath.Base(path), checkWritable(path))
+	}
+	if !source.IsRemote(model.Settings.Source) {
+		add("csv_path", checkReadableDir(model.PathVars.CSVPath))
+	}
+	return report
+}
+
+func checkDB(ctx context.Context, db *sqlx.DB) error {
+	if db == nil {
+		return errors.New("no database connection")
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	// a plain ping, the probe runs every few seconds and must not fill the logs
+	return db.PingContext(ctx)
+}
+
+// logFiles returns the paths of the log files written by the import, they are configured under the log folder as /logs/name
+func logFiles() []string {
+	var paths []string
+	for _, p := range []string{model.PathVars.DbLogs, model.PathVars.AnalysisLogs, model.PathVars.OddDates} {
+		if p == "" {
+			continue
+		}
+		paths = append(paths, filepath.Join(model.PathVars.LogPath, strings.TrimPrefix(p, "/logs/")))
+	}
+	return paths
+}
+
+// checkWritable opens the file for appending, which creates it if it is missing
+func checkWritable(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func checkReadableDir(path string) error {
+	if path == "" {
+		return errors.New("csv_path is not set")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a folder", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// reading one entry proves the folder can be listed
+	if _, err := f.ReadDir(1); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package health
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// readyPaths points the log files and csv_path into a temp folder and returns it
+func readyPaths(t *testing.T) string {
+	t.Helper()
+	savedPaths, savedSettings := model.PathVars, model.Settings
+	t.Cleanup(func() { model.PathVars, model.Settings = savedPaths, savedSettings })
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "csv"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	model.PathVars.LogPath = dir
+	model.PathVars.DbLogs = "/logs/db.log"
+	model.PathVars.AnalysisLogs = "/logs/analysis.log"
+	model.PathVars.OddDates = ""
+	model.PathVars.CSVPath = filepath.Join(dir, "csv")
+	model.Settings.Source = model.SourceSettings{}
+	return dir
+}
+
+func sqliteDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	store, err := dbs.Open(context.Background(), dbs.DriverSQLite, filepath.Join(t.TempDir(), "health.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DB().Close() })
+	return store.DB()
+}
+
+func TestReady(t *testing.T) {
+	db := sqliteDB(t)
+	closed := sqliteDB(t)
+	closed.Close()
+	tests := []struct {
+		name  string
+		db    *sqlx.DB
+		setup func(dir string)
+		// the checks that fail, by name
+		failed []string
+	}{
+		{"ready", db, nil, nil},
+		{"no database", nil, nil, []string{"database"}},
+		{"database closed", closed, nil, []string{"database"}},
+		{"log folder missing", db, func(dir string) {
+			model.PathVars.LogPath = filepath.Join(dir, "missing")
+		}, []string{"log db.log", "log analysis.log"}},
+		{"log file is a folder", db, func(dir string) {
+			os.Mkdir(filepath.Join(dir, "db.log"), 0o755)
+		}, []string{"log db.log"}},
+		{"csv_path unset", db, func(dir string) {
+			model.PathVars.CSVPath = ""
+		}, []string{"csv_path"}},
+		{"csv_path missing", db, func(dir string) {
+			model.PathVars.CSVPath = filepath.Join(dir, "missing")
+		}, []string{"csv_path"}},
+		{"csv_path is a file", db, func(dir string) {
+			model.PathVars.CSVPath = filepath.Join(dir, "file.csv")
+			os.WriteFile(model.PathVars.CSVPath, nil, 0o644)
+		}, []string{"csv_path"}},
+		{"remote source skips csv_path", db, func(dir string) {
+			model.PathVars.CSVPath = ""
+			model.Settings.Source.Type = "sftp"
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := readyPaths(t)
+			if tt.setup != nil {
+				tt.setup(dir)
+			}
+			report := Ready(context.Background(), tt.db)
+			var failed []string
+			names := make(map[string]bool)
+			for _, c := range report.Checks {
+				names[c.Name] = true
+				if !c.OK {
+					failed = append(failed, c.Name)
+					if c.Error == "" {
+						t.Errorf("check %s failed without an error", c.Name)
+					}
+				}
+			}
+			if report.Ready != (len(tt.failed) == 0) {
+				t.Errorf("ready %v with the failed checks %v", report.Ready, failed)
+			}
+			if len(failed) != len(tt.failed) {
+				t.Fatalf("failed checks %v, want %v", failed, tt.failed)
+			}
+			for i := range failed {
+				if failed[i] != tt.failed[i] {
+					t.Errorf("failed checks %v, want %v", failed, tt.failed)
+				}
+			}
+			if want := model.Settings.Source.Type == ""; names["csv_path"] != want {
+				t.Errorf("csv_path checked %v, want %v", names["csv_path"], want)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+// Package integrity provides tamper evidence for the recordings and the imported CDR rows
+package integrity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/sirupsen/logrus"
+)
+
+// genesisHash is the previous hash of the first entry in the chain
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// HashFile returns the hex encoded SHA-256 and the size of the file at path
+func HashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// RowHash chains a CDR row to the previous hash. The fields are the ones stored in rmscdr,
+// the unix timestamp stands in for the time column so the hash is independent of the db time zone.
+func RowHash(prevHash string, cdr model.RMSCDR) string {
+	fields := []string{
+		prevHash,
+		cdr.UID,
+		cdr.Direction,
+		strconv.FormatInt(cdr.UnixTimestamp, 10),
+		strconv.FormatBool(cdr.Flagged),
+		cdr.Source,
+		cdr.Destination,
+		strconv.FormatInt(cdr.Duration, 10),
+		strconv.FormatFloat(cdr.Size, 'g', -1, 64),
+		strconv.FormatBool(cdr.ExistsINDB),
+		strconv.FormatBool(cdr.LocalCopy),
+		cdr.Authentic,
+		cdr.FileName,
+		cdr.SipCallID,
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x1f")))
+	return hex.EncodeToString(sum[:])
+}
+
+// HashRecordings hashes the recordings linked to a batch of CDRs, CDRs without a recording are skipped
+func HashRecordings(batch []model.RMSCDR, locate func(string) (string, error)) []model.RecordingHash {
+	CallFrom := "HashRecordings "
+	var hashes []model.RecordingHash
+	for _, cdr := range batch {
+		path, err := locate(cdr.FileName)
+		if err != nil {
+			continue
+		}
+		sum, size, err := HashFile(path)
+		if err != nil {
+			li.Logger.ErrReadFilesMessage(CallFrom, path, err)
+			continue
+		}
+		hashes = append(hashes, model.RecordingHash{
+			UID:      cdr.UID,
+			FileName: cdr.FileName,
+			SHA256:   sum,
+			Size:     size,
+			HashedAt: time.Now(),
+		})
+	}
+	return hashes
+}
+
+// AppendChain links a batch of imported CDRs to the end of the hash chain inside the transaction that inserts them
+func AppendChain(ctx context.Context, tx dbs.CDRTx, batch []model.RMSCDR) error {
+	prev, err := tx.LastChainHash(ctx)
+	if err != nil {
+		return err
+	}
+	if prev == "" {
+		prev = genesisHash
+	}
+	entries := make([]model.ChainEntry, 0, len(batch))
+	now := time.Now()
+	for _, cdr := range batch {
+		rowHash := RowHash(prev, cdr)
+		entries = append(entries, model.ChainEntry{
+			UID:       cdr.UID,
+			PrevHash:  prev,
+			RowHash:   rowHash,
+			CreatedAt: now,
+		})
+		prev = rowHash
+	}
+	_, err = tx.InsertChainEntries(ctx, entries)
+	return err
+}
+
+// Finding is a single integrity problem found by Verify
+type Finding struct {
+	UID    string `json:"uid"`
+	File   string `json:"file,omitempty"`
+	Seq    int64  `json:"seq,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Report is the outcome of a verify run
+type Report struct {
+	RecordingsChecked int64     `json:"recordings_checked"`
+	RecordingsChanged []Finding `json:"recordings_changed"`
+	RecordingsMissing []Finding `json:"recordings_missing"`
+	ChainChecked      int64     `json:"chain_checked"`
+	ChainBroken       []Finding `json:"chain_broken"`
+	RowsEdited        []Finding `json:"rows_edited"`
+	RowsDeleted       []Finding `json:"rows_deleted"`
+	Unchained         int64     `json:"unchained"`
+}
+
+// OK reports whether no tampering was found
+func (r Report) OK() bool {
+	return len(r.RecordingsChanged) == 0 && len(r.RecordingsMissing) == 0 &&
+		len(r.ChainBroken) == 0 && len(r.RowsEdited) == 0 && len(r.RowsDeleted) == 0
+}
+
+// VerifyRecordings re-hashes the recordings hashed at import and reports the ones that changed or disappeared
+func VerifyRecordings(ctx context.Context, db *sqlx.DB, locate func(string) (string, error), report *Report) error {
+	CallFrom := "VerifyRecordings "
+	return dbs.StreamRecordingHashes(ctx, db, func(h model.RecordingHash) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.RecordingsChecked++
+		path, err := locate(h.FileName)
+		if err != nil {
+			report.RecordingsMissing = append(report.RecordingsMissing, Finding{UID: h.UID, File: h.FileName, Reason: "recording not found"})
+			return nil
+		}
+		sum, size, err := HashFile(path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				report.RecordingsMissing = append(report.RecordingsMissing, Finding{UID: h.UID, File: h.FileName, Reason: "recording not found"})
+				return nil
+			}
+			li.Logger.ErrReadFilesMessage(CallFrom, path, err)
+			return err
+		}
+		if sum != h.SHA256 || size != h.Size {
+			li.Logger.L.WithFields(logrus.Fields{
+				"CallFrom": CallFrom,
+				"uid":      h.UID,
+				"file":     h.FileName,
+				"expected": h.SHA256,
+				"actual":   sum,
+			}).Warn("recording changed since import")
+			report.RecordingsChanged = append(report.RecordingsChanged, Finding{UID: h.UID, File: h.FileName, Reason: "hash changed since import"})
+		}
+		return nil
+	})
+}
+
+// VerifyChain walks the hash chain, checks the links and compares each entry with the current CDR row.
+// Only the latest entry of a uid is compared with the row, earlier entries are kept for the links.
+func VerifyChain(ctx context.Context, db *sqlx.DB, report *Report) error {
+	// find the latest entry for every uid first
+	latest := make(map[string]int64)
+	err := dbs.StreamChain(ctx, db, func(row dbs.ChainRow) error {
+		latest[row.Entry.UID] = row.Entry.Seq
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	prev := genesisHash
+	err = dbs.StreamChain(ctx, db, func(row dbs.ChainRow) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.ChainChecked++
+		entry := row.Entry
+		if entry.PrevHash != prev {
+			report.ChainBroken = append(report.ChainBroken, Finding{UID: entry.UID, Seq: entry.Seq, Reason: "previous hash does not match, chain entries removed or altered"})
+		}
+		prev = entry.RowHash
+		if latest[entry.UID] != entry.Seq {
+			return nil
+		}
+		if row.CDR == nil && row.Purged {
+			return nil
+		}
+		if row.CDR == nil {
+			report.RowsDeleted = append(report.RowsDeleted, Finding{UID: entry.UID, Seq: entry.Seq, Reason: "row deleted from rmscdr"})
+			return nil
+		}
+		if RowHash(entry.PrevHash, *row.CDR) != entry.RowHash {
+			report.RowsEdited = append(report.RowsEdited, Finding{UID: entry.UID, File: row.CDR.FileName, Seq: entry.Seq, Reason: "row edited in rmscdr"})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	report.Unchained, err = dbs.CountUnchainedCDRs(ctx, db)
+	return err
+}
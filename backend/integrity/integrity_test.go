@@ -0,0 +1,211 @@
+package integrity
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// calls returns n calls with a recording each
+func calls(n int) []model.RMSCDR {
+	at := time.Date(2024, 2, 3, 8, 0, 0, 0, time.UTC)
+	cdrs := make([]model.RMSCDR, n)
+	for i := range cdrs {
+		id := string(rune('a' + i))
+		t := at.Add(time.Duration(i) * time.Minute)
+		cdrs[i] = model.RMSCDR{
+			UID:           "uid-" + id,
+			Direction:     "Incoming",
+			Time:          t,
+			UnixTimestamp: t.Unix(),
+			Source:        "0821234567",
+			Destination:   "2001",
+			Duration:      30,
+			FileName:      id + ".wav",
+			SipCallID:     id + "@pbx",
+		}
+	}
+	return cdrs
+}
+
+// chainedDB opens a new sqlite database holding the calls linked in the hash chain
+func chainedDB(t *testing.T, cdrs []model.RMSCDR) *sqlx.DB {
+	t.Helper()
+	ctx := context.Background()
+	store, err := dbs.Open(ctx, dbs.DriverSQLite, filepath.Join(t.TempDir(), "integrity.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := store.DB()
+	t.Cleanup(func() { db.Close() })
+	if err := dbs.PrepareImport(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbs.InsertCDRsBatch(ctx, db, cdrs); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := dbs.NewSQLRepository(db).Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendChain(ctx, tx, cdrs); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// verifyChain returns the report of the hash chain
+func verifyChain(t *testing.T, db *sqlx.DB) Report {
+	t.Helper()
+	var report Report
+	if err := VerifyChain(context.Background(), db, &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// exec runs a statement against the database, standing in for someone editing it by hand
+func exec(t *testing.T, db *sqlx.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(db.Rebind(query), args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRowHash(t *testing.T) {
+	cdr := calls(1)[0]
+	h := RowHash(genesisHash, cdr)
+	if len(h) != 64 || RowHash(genesisHash, cdr) != h {
+		t.Fatalf("RowHash = %q, want a stable sha-256", h)
+	}
+	if RowHash(h, cdr) == h {
+		t.Error("the previous hash does not change the hash")
+	}
+	edited := cdr
+	edited.Duration++
+	if RowHash(genesisHash, edited) == h {
+		t.Error("the duration does not change the hash")
+	}
+	// the time column is left out, the unix timestamp stands in for it
+	moved := cdr
+	moved.Time = cdr.Time.In(time.FixedZone("SAST", 2*60*60))
+	if RowHash(genesisHash, moved) != h {
+		t.Error("the time zone of the time changes the hash")
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, db *sqlx.DB)
+		check  func(r Report) bool
+	}{
+		{"untouched", func(*testing.T, *sqlx.DB) {}, func(r Report) bool {
+			return r.OK() && r.ChainChecked == 3 && r.Unchained == 0
+		}},
+		{"edited row", func(t *testing.T, db *sqlx.DB) {
+			exec(t, db, "UPDATE rmscdr SET duration = 300 WHERE uid = ?", "uid-b")
+		}, func(r Report) bool {
+			return len(r.RowsEdited) == 1 && r.RowsEdited[0].UID == "uid-b" && len(r.ChainBroken) == 0
+		}},
+		{"deleted row", func(t *testing.T, db *sqlx.DB) {
+			exec(t, db, "DELETE FROM rmscdr WHERE uid = ?", "uid-c")
+		}, func(r Report) bool {
+			return len(r.RowsDeleted) == 1 && r.RowsDeleted[0].UID == "uid-c" && len(r.RowsEdited) == 0
+		}},
+		{"broken link", func(t *testing.T, db *sqlx.DB) {
+			exec(t, db, "DELETE FROM rmscdr_chain WHERE uid = ?", "uid-a")
+		}, func(r Report) bool {
+			return len(r.ChainBroken) == 1 && r.ChainBroken[0].UID == "uid-b" && r.Unchained == 1
+		}},
+		{"edited entry", func(t *testing.T, db *sqlx.DB) {
+			exec(t, db, "UPDATE rmscdr_chain SET row_hash = ? WHERE uid = ?", genesisHash, "uid-a")
+		}, func(r Report) bool {
+			return len(r.ChainBroken) == 1 && r.ChainBroken[0].UID == "uid-b"
+		}},
+		{"purged row", func(t *testing.T, db *sqlx.DB) {
+			chunk, err := dbs.SelectCDRChunk(context.Background(), db, "uid = ?", []interface{}{"uid-c"}, 0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dbs.PurgeCDRs(context.Background(), db, 1, chunk); err != nil {
+				t.Fatal(err)
+			}
+		}, func(r Report) bool {
+			return r.OK() && r.ChainChecked == 3
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := chainedDB(t, calls(3))
+			tt.tamper(t, db)
+			if r := verifyChain(t, db); !tt.check(r) {
+				t.Errorf("verify reported %+v", r)
+			}
+		})
+	}
+}
+
+func TestVerifyRecordings(t *testing.T) {
+	cdrs := calls(3)
+	db := chainedDB(t, cdrs)
+	dir := t.TempDir()
+	for _, cdr := range cdrs {
+		if err := os.WriteFile(filepath.Join(dir, cdr.FileName), []byte("RIFF "+cdr.UID), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	locate := func(name string) (string, error) {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+	ctx := context.Background()
+	hashes := HashRecordings(cdrs, locate)
+	if len(hashes) != 3 {
+		t.Fatalf("hashed %d recordings, want 3", len(hashes))
+	}
+	if _, err := dbs.InsertRecordingHashes(ctx, db, hashes); err != nil {
+		t.Fatal(err)
+	}
+
+	var clean Report
+	if err := VerifyRecordings(ctx, db, locate, &clean); err != nil {
+		t.Fatal(err)
+	}
+	if !clean.OK() || clean.RecordingsChecked != 3 {
+		t.Errorf("untouched recordings reported %+v", clean)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "a.wav"), []byte("RIFF changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "b.wav")); err != nil {
+		t.Fatal(err)
+	}
+	var report Report
+	if err := VerifyRecordings(ctx, db, locate, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.RecordingsChanged) != 1 || report.RecordingsChanged[0].UID != "uid-a" {
+		t.Errorf("changed recordings %+v, want uid-a", report.RecordingsChanged)
+	}
+	if len(report.RecordingsMissing) != 1 || report.RecordingsMissing[0].UID != "uid-b" {
+		t.Errorf("missing recordings %+v, want uid-b", report.RecordingsMissing)
+	}
+	if report.OK() {
+		t.Error("a changed recording passed")
+	}
+}
@@ -0,0 +1,249 @@
+package logwrapper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the log outputs
+const (
+	OutputFile     = "file"
+	OutputStdout   = "stdout"
+	OutputStderr   = "stderr"
+	OutputSyslog   = "syslog"
+	OutputJournald = "journald"
+)
+
+// DefaultFile is the app log written by the file output when none is configured
+const DefaultFile = "/root/logs/appLogs.txt"
+
+// the size of the write buffer in front of the outputs
+const bufferSize = 64 * 1024
+
+// Options configures the logger set up by Init
+type Options struct {
+	// trace, debug, info, warn or error, defaults to info
+	Level string `json:"level"`
+	// json or text, defaults to json
+	Format string `json:"format"`
+	// any of file, stdout, stderr, syslog and journald, defaults to file
+	Outputs []string `json:"outputs"`
+	// the app log written by the file output, defaults to DefaultFile
+	File string `json:"file"`
+	// how often buffered entries are written out, defaults to 1. Errors are written out at once
+	FlushSeconds int `json:"flush_seconds"`
+	// the syslog server eg. udp and logs.local:514, the local syslog when the address is empty
+	SyslogNetwork string `json:"syslog_network"`
+	SyslogAddress string `json:"syslog_address"`
+	// the name of the app in syslog and journald entries, defaults to rmsloader
+	Tag string `json:"tag"`
+	// when the app log is rotated and how many rotated files are kept
+	Rotation RotateOptions `json:"rotation"`
+}
+
+// Init replaces the logger with one configured by opts. Until it is called the logger writes json to stderr.
+// It closes the logger it replaces.
+func Init(opts Options) error {
+	level := logrus.InfoLevel
+	if opts.Level != "" {
+		var err error
+		if level, err = logrus.ParseLevel(opts.Level); err != nil {
+			return err
+		}
+	}
+	var formatter logrus.Formatter
+	switch opts.Format {
+	case "", "json":
+		formatter = &logrus.JSONFormatter{}
+	case "text":
+		formatter = &logrus.TextFormatter{FullTimestamp: true, DisableColors: true}
+	default:
+		return fmt.Errorf("unknown log format %q, want json or text", opts.Format)
+	}
+	outputs := opts.Outputs
+	if len(outputs) == 0 {
+		outputs = []string{OutputFile}
+	}
+	tag := opts.Tag
+	if tag == "" {
+		tag = "rmsloader"
+	}
+
+	l := &StandardLogger{L: logrus.New()}
+	var writers []io.Writer
+	for _, output := range outputs {
+		switch output {
+		case OutputFile:
+			path := opts.File
+			if path == "" {
+				path = DefaultFile
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				l.close()
+				return err
+			}
+			file, err := OpenRotatingFile(path, opts.Rotation)
+			if err != nil {
+				l.close()
+				return err
+			}
+			l.File = file
+			writers = append(writers, file)
+		case OutputStdout:
+			writers = append(writers, os.Stdout)
+		case OutputStderr:
+			writers = append(writers, os.Stderr)
+		case OutputSyslog:
+			hook, err := newSyslogHook(opts.SyslogNetwork, opts.SyslogAddress, tag)
+			if err != nil {
+				l.close()
+				return fmt.Errorf("connecting to syslog: %w", err)
+			}
+			l.addHook(hook)
+		case OutputJournald:
+			hook, err := newJournaldHook(tag)
+			if err != nil {
+				l.close()
+				return fmt.Errorf("connecting to journald: %w", err)
+			}
+			l.addHook(hook)
+		default:
+			l.close()
+			return fmt.Errorf("unknown log output %q", output)
+		}
+	}
+	l.buf = &bufferedWriter{w: bufio.NewWriterSize(io.MultiWriter(writers...), bufferSize)}
+	l.L.SetOutput(l.buf)
+	l.L.SetLevel(level)
+	l.L.Formatter = formatter
+	// errors are written out with the entry rather than on the next flush
+	l.L.AddHook(&flushHook{buf: l.buf})
+
+	interval := time.Duration(opts.FlushSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	l.stop = make(chan struct{})
+	l.stopped = make(chan struct{})
+	go l.flushEvery(interval)
+
+	old := Logger
+	Logger = l
+	old.close()
+	return nil
+}
+
+// bufferedWriter collects the entries so they are written out in blocks
+type bufferedWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+	// write out after the next entry
+	urgent bool
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.w.Write(p)
+	if err == nil && b.urgent {
+		err = b.w.Flush()
+	}
+	b.urgent = false
+	return n, err
+}
+
+// Flush writes the buffered entries out
+func (b *bufferedWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.w.Flush()
+}
+
+// flushHook marks error entries to be written out at once, it fires before the entry is written
+type flushHook struct {
+	buf *bufferedWriter
+}
+
+func (h *flushHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+func (h *flushHook) Fire(entry *logrus.Entry) error {
+	h.buf.mu.Lock()
+	h.buf.urgent = true
+	h.buf.mu.Unlock()
+	return nil
+}
+
+// flushEvery writes the buffer out every interval until the logger is closed
+func (lm *StandardLogger) flushEvery(interval time.Duration) {
+	defer close(lm.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := lm.buf.Flush(); err != nil {
+				fmt.Fprintln(os.Stderr, "flushing the log failed:", err)
+			}
+		case <-lm.stop:
+			return
+		}
+	}
+}
+
+// addHook adds a hook that is closed with the logger
+func (lm *StandardLogger) addHook(hook closingHook) {
+	lm.L.AddHook(hook)
+	lm.closers = append(lm.closers, hook)
+}
+
+// closingHook is a hook holding a connection
+type closingHook interface {
+	logrus.Hook
+	io.Closer
+}
+
+// Flush writes the buffered entries out without waiting for the disk
+func (lm *StandardLogger) Flush() error {
+	if lm.buf == nil {
+		return nil
+	}
+	return lm.buf.Flush()
+}
+
+// close stops the flushing, writes the buffer out and closes the outputs. Entries logged afterwards go
+// to stderr so nothing is lost during shutdown.
+func (lm *StandardLogger) close() {
+	if lm == nil {
+		return
+	}
+	lm.Mu.Lock()
+	defer lm.Mu.Unlock()
+	if lm.stop != nil {
+		close(lm.stop)
+		<-lm.stopped
+		lm.stop = nil
+	}
+	if err := lm.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, "flushing the log failed:", err)
+	}
+	lm.L.SetOutput(os.Stderr)
+	lm.L.ReplaceHooks(make(logrus.LevelHooks))
+	if lm.File != nil {
+		lm.File.Sync()
+		lm.File.Close()
+		lm.File = nil
+	}
+	for _, c := range lm.closers {
+		c.Close()
+	}
+	lm.closers = nil
+}
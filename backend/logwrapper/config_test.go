@@ -0,0 +1,148 @@
+package logwrapper
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// initLogger runs Init and puts the logger of the other tests back afterwards
+func initLogger(t *testing.T, opts Options) error {
+	t.Helper()
+	saved := Logger
+	err := Init(opts)
+	t.Cleanup(func() {
+		if Logger != saved {
+			Logger.close()
+			Logger = NewLogger(nil)
+		}
+	})
+	return err
+}
+
+// fileLog returns the entries written to the app log at path so far
+func fileLog(t *testing.T, path string) string {
+	t.Helper()
+	if err := Logger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return content(t, path)
+}
+
+func TestInitLevelAndFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		logged []string
+		// the entries left out below the level
+		dropped []string
+		json    bool
+	}{
+		{"defaults", Options{}, []string{"info entry", "warn entry"}, []string{"debug entry"}, true},
+		{"debug json", Options{Level: "debug", Format: "json"}, []string{"debug entry", "info entry"}, nil, true},
+		{"warn text", Options{Level: "warn", Format: "text"}, []string{"warn entry"}, []string{"debug entry", "info entry"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.File = filepath.Join(t.TempDir(), "logs", "app.log")
+			if err := initLogger(t, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			Logger.L.Debug("debug entry")
+			Logger.L.Info("info entry")
+			Logger.L.Warn("warn entry")
+			log := fileLog(t, tt.opts.File)
+			for _, want := range tt.logged {
+				if !strings.Contains(log, want) {
+					t.Errorf("the log has no %q: %s", want, log)
+				}
+			}
+			for _, dropped := range tt.dropped {
+				if strings.Contains(log, dropped) {
+					t.Errorf("the log has %q below the level", dropped)
+				}
+			}
+			first, _, _ := strings.Cut(log, "\n")
+			var entry map[string]interface{}
+			if isJSON := json.Unmarshal([]byte(first), &entry) == nil; isJSON != tt.json {
+				t.Errorf("the entry %q is json %v, want %v", first, isJSON, tt.json)
+			}
+			if !tt.json && !strings.Contains(first, "level=") {
+				t.Errorf("the entry %q is not text", first)
+			}
+		})
+	}
+}
+
+func TestInitOutputs(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	err = initLogger(t, Options{Outputs: []string{OutputStdout}})
+	os.Stdout = saved
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Logger.File != nil {
+		t.Error("the stdout output opened a file")
+	}
+	Logger.L.Error("to stdout")
+	w.Close()
+	out, _ := io.ReadAll(r)
+	if !strings.Contains(string(out), "to stdout") {
+		t.Errorf("stdout got %q", out)
+	}
+
+	// the file and stderr outputs together
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := initLogger(t, Options{Outputs: []string{OutputFile, OutputStderr}, File: path}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Logger.File.(*RotatingFile); !ok {
+		t.Fatalf("the file output writes to %T", Logger.File)
+	}
+	Logger.L.Info("to the file")
+	if log := fileLog(t, path); !strings.Contains(log, "to the file") {
+		t.Errorf("the app log has %q", log)
+	}
+}
+
+func TestInitInvalid(t *testing.T) {
+	dir := t.TempDir()
+	blocked := filepath.Join(dir, "file")
+	if err := os.WriteFile(blocked, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"level", Options{Level: "loud"}, "not a valid logrus Level"},
+		{"format", Options{Format: "xml"}, "unknown log format"},
+		{"output", Options{Outputs: []string{"kafka"}}, "unknown log output"},
+		{"file under a file", Options{File: filepath.Join(blocked, "app.log")}, "not a directory"},
+		{"syslog network", Options{Outputs: []string{OutputSyslog}, SyslogNetwork: "bogus", SyslogAddress: "x:1"}, "connecting to syslog"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.opts.File == "" {
+				tt.opts.File = filepath.Join(dir, "app.log")
+			}
+			before := Logger
+			err := initLogger(t, tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Init returned %v, want %q", err, tt.want)
+			}
+			if Logger != before {
+				t.Error("a failed Init replaced the logger")
+			}
+		})
+	}
+}
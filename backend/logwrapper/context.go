@@ -0,0 +1,28 @@
+package logwrapper
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// entryKey is the context key of the log entry
+type entryKey struct{}
+
+// WithEntry returns a context carrying entry, whatever is logged through FromContext carries its fields
+func WithEntry(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, entry)
+}
+
+// WithFields returns a context carrying the entry of ctx with fields added
+func WithFields(ctx context.Context, fields logrus.Fields) context.Context {
+	return WithEntry(ctx, FromContext(ctx).WithFields(fields))
+}
+
+// FromContext returns the entry carried by ctx, or an entry of Logger without fields
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(entryKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(Logger.L)
+}
@@ -0,0 +1,107 @@
+package logwrapper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journalSocket is where journald takes entries in its native protocol
+const journalSocket = "/run/systemd/journal/socket"
+
+// maxJournalMessage keeps an entry within the size of one datagram
+const maxJournalMessage = 48 * 1024
+
+// journaldHook sends the entries to journald with their fields as journal fields
+type journaldHook struct {
+	conn *net.UnixConn
+	tag  string
+}
+
+func newJournaldHook(tag string) (closingHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldHook{conn: conn, tag: tag}, nil
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	var b bytes.Buffer
+	message := entry.Message
+	if len(message) > maxJournalMessage {
+		message = message[:maxJournalMessage]
+	}
+	journalField(&b, "MESSAGE", message)
+	journalField(&b, "PRIORITY", strconv.Itoa(journalPriority(entry.Level)))
+	journalField(&b, "SYSLOG_IDENTIFIER", h.tag)
+	for k, v := range entry.Data {
+		value := fmt.Sprint(v)
+		if len(value) > maxJournalMessage {
+			value = value[:maxJournalMessage]
+		}
+		journalField(&b, journalKey(k), value)
+	}
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+func (h *journaldHook) Close() error {
+	return h.conn.Close()
+}
+
+// journalField writes one field, values holding a newline are sent with their length
+func journalField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", key, value)
+		return
+	}
+	b.WriteString(key)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalKey turns a logrus field into a journal field name, upper case letters, digits and underscores
+// not starting with an underscore
+func journalKey(k string) string {
+	key := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, k)
+	key = strings.TrimLeft(key, "_")
+	if key == "" || (key[0] >= '0' && key[0] <= '9') {
+		key = "F_" + key
+	}
+	return key
+}
+
+// journalPriority maps a level to a syslog priority
+func journalPriority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	}
+	return 7
+}
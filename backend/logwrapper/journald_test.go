@@ -0,0 +1,89 @@
+package logwrapper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestJournaldHook(t *testing.T) {
+	addr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "journal.sock"), Net: "unixgram"}
+	journal, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Skipf("no unix datagram sockets: %v", err)
+	}
+	defer journal.Close()
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := &journaldHook{conn: conn, tag: "loader-test"}
+	defer hook.Close()
+
+	entry := logrus.NewEntry(logrus.New()).WithFields(logrus.Fields{"CallFrom": "test ", "9lives": 1})
+	entry.Level = logrus.WarnLevel
+	entry.Message = "first line\nsecond line"
+	if err := hook.Fire(entry); err != nil {
+		t.Fatal(err)
+	}
+	journal.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64*1024)
+	n, err := journal.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	for _, want := range []string{"PRIORITY=4\n", "SYSLOG_IDENTIFIER=loader-test\n", "CALLFROM=test \n", "F_9LIVES=1\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("the entry %q has no %q", got, want)
+		}
+	}
+	// a message holding a newline is sent with its length
+	var message bytes.Buffer
+	message.WriteString("MESSAGE\n")
+	binary.Write(&message, binary.LittleEndian, uint64(len(entry.Message)))
+	message.WriteString(entry.Message + "\n")
+	if !strings.Contains(got, message.String()) {
+		t.Errorf("the entry %q has no length prefixed message", got)
+	}
+}
+
+func TestJournalKey(t *testing.T) {
+	tests := map[string]string{
+		"CallFrom":   "CALLFROM",
+		"import-id":  "IMPORT_ID",
+		"_private":   "PRIVATE",
+		"9lives":     "F_9LIVES",
+		"__":         "F_",
+		"file.name":  "FILE_NAME",
+		"rows_total": "ROWS_TOTAL",
+	}
+	for in, want := range tests {
+		if got := journalKey(in); got != want {
+			t.Errorf("journalKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestJournalPriority(t *testing.T) {
+	tests := map[logrus.Level]int{
+		logrus.PanicLevel: 2,
+		logrus.FatalLevel: 2,
+		logrus.ErrorLevel: 3,
+		logrus.WarnLevel:  4,
+		logrus.InfoLevel:  6,
+		logrus.DebugLevel: 7,
+		logrus.TraceLevel: 7,
+	}
+	for level, want := range tests {
+		if got := journalPriority(level); got != want {
+			t.Errorf("journalPriority(%s) = %d, want %d", level, got, want)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package logwrapper
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat stamps the rotated files, it sorts in time order
+const backupTimeFormat = "20060102T150405"
+
+// RotateOptions controls when a log file is rotated and how many rotated files are kept
+type RotateOptions struct {
+	// rotate when the file would grow past this size, 0 turns size rotation off
+	MaxSizeMB int `json:"max_size_mb"`
+	// rotate at the start of every period of this many hours, 24 rotates daily at midnight UTC, 0 turns it off
+	RotateHours int `json:"rotate_hours"`
+	// the rotated files kept per log, the oldest are deleted, 0 keeps them all
+	MaxBackups int `json:"max_backups"`
+	// gzip the rotated files
+	Compress bool `json:"compress"`
+}
+
+// RotatingFile is an append only log file that is renamed to name-20060102T150405.ext and started afresh
+// when it grows too big or a new period starts. The rotated files are compressed and pruned in the background.
+// Its methods are safe for concurrent use, and on a nil file they fail like those of a nil *os.File.
+type RotatingFile struct {
+	path   string
+	opts   RotateOptions
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	period time.Time
+	// set by Close, a nil file that is not closed failed to reopen after a rotation
+	closed bool
+	// the background compression and pruning, one at a time
+	tidying sync.Mutex
+	tidied  sync.WaitGroup
+}
+
+// OpenRotatingFile opens path for appending, creating it if needed. A relative path is made absolute
+// so the file can still be rotated after the working directory changed.
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &RotatingFile{path: abs, opts: opts}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Path returns the absolute path of the current file
+func (r *RotatingFile) Path() string {
+	if r == nil {
+		return ""
+	}
+	return r.path
+}
+
+// open opens the current file, the period of an existing file is taken from its last write
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.period = r.periodOf(time.Now())
+	if r.size > 0 {
+		r.period = r.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+// periodOf returns the start of the rotation period holding t
+func (r *RotatingFile) periodOf(t time.Time) time.Time {
+	if r.opts.RotateHours <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(time.Duration(r.opts.RotateHours) * time.Hour)
+}
+
+// Write appends p, rotating first when p would take the file past its size or a new period started.
+// While the file cannot be opened again after a rotation the entries go to stderr, every write retries it.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	if r == nil {
+		return 0, os.ErrInvalid
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return os.Stderr.Write(p)
+		}
+	}
+	maxSize := int64(r.opts.MaxSizeMB) * 1024 * 1024
+	period := r.periodOf(time.Now())
+	if r.size == 0 {
+		// an empty file is not worth keeping, it just moves on to the new period
+		r.period = period
+	}
+	if (maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > maxSize) || period.After(r.period) {
+		if err := r.rotate(); err != nil {
+			// keep logging to the old file rather than losing the entry
+			fmt.Fprintf(os.Stderr, "rotating log %s failed: %v\n", r.path, err)
+		}
+		if r.file == nil {
+			return os.Stderr.Write(p)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// WriteString appends s
+func (r *RotatingFile) WriteString(s string) (int, error) {
+	return r.Write([]byte(s))
+}
+
+// Rotate starts a new file now
+func (r *RotatingFile) Rotate() error {
+	if r == nil {
+		return os.ErrInvalid
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return os.ErrClosed
+	}
+	return r.rotate()
+}
+
+// rotate renames the current file and opens a new one, the rotated files are compressed and pruned in the
+// background so the writers are not held up. When the new file cannot be opened the file is left nil.
+func (r *RotatingFile) rotate() error {
+	var closeErr error
+	if r.file != nil {
+		closeErr = r.file.Close()
+		r.file = nil
+	}
+	backup := r.backupName(time.Now())
+	renameErr := os.Rename(r.path, backup)
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	r.tidied.Add(1)
+	go func() {
+		defer r.tidied.Done()
+		if err := r.tidy(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "tidying rotated log %s failed: %v\n", backup, err)
+		}
+	}()
+	return closeErr
+}
+
+// tidy compresses a rotated file and prunes the oldest ones
+func (r *RotatingFile) tidy(backup string) error {
+	r.tidying.Lock()
+	defer r.tidying.Unlock()
+	if r.opts.Compress {
+		if err := compressFile(backup); err != nil {
+			return err
+		}
+	}
+	return r.prune()
+}
+
+// backupName returns the name of a file rotated at t, files rotated within the same second are counted on
+func (r *RotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(r.path)
+	stamp := t.UTC().Format(backupTimeFormat)
+	base := strings.TrimSuffix(r.path, ext) + "-" + stamp
+	n := -1
+	backups, _ := r.backups()
+	for _, b := range backups {
+		if b.stamp == stamp {
+			n = max(n, b.n)
+		}
+	}
+	if n < 0 {
+		return base + ext
+	}
+	return fmt.Sprintf("%s-%d%s", base, n+1, ext)
+}
+
+// prune deletes the oldest rotated files beyond MaxBackups
+func (r *RotatingFile) prune() error {
+	if r.opts.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := r.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > r.opts.MaxBackups {
+		if err := os.Remove(backups[0].path); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// backup is a rotated log file
+type backup struct {
+	path  string
+	stamp string
+	// the counter added to files rotated within the same second
+	n int
+}
+
+// backups lists the rotated files of the log, oldest first
+func (r *RotatingFile) backups() ([]backup, error) {
+	ext := filepath.Ext(r.path)
+	prefix := filepath.Base(strings.TrimSuffix(r.path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(r.path))
+	if err != nil {
+		return nil, err
+	}
+	var found []backup
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".gz")
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		stamp, counter, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), "-")
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		b := backup{path: filepath.Join(filepath.Dir(r.path), e.Name()), stamp: stamp}
+		if counter != "" {
+			if b.n, err = strconv.Atoi(counter); err != nil {
+				continue
+			}
+		}
+		found = append(found, b)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].stamp != found[j].stamp {
+			return found[i].stamp < found[j].stamp
+		}
+		return found[i].n < found[j].n
+	})
+	return found, nil
+}
+
+// Sync commits the current file to disk
+func (r *RotatingFile) Sync() error {
+	if r == nil {
+		return os.ErrInvalid
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return os.ErrClosed
+	}
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+// Close closes the current file and waits for the rotated files to be compressed, later writes fail
+func (r *RotatingFile) Close() error {
+	if r == nil {
+		return os.ErrInvalid
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return os.ErrClosed
+	}
+	var err error
+	if r.file != nil {
+		err = r.file.Close()
+		r.file = nil
+	}
+	r.closed = true
+	r.mu.Unlock()
+	r.tidied.Wait()
+	return err
+}
+
+// compressFile gzips path to path.gz and removes path
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	in.Close()
+	return os.Remove(path)
+}
@@ -0,0 +1,222 @@
+package logwrapper
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openLog opens app.log in a new folder
+func openLog(t *testing.T, opts RotateOptions) *RotatingFile {
+	t.Helper()
+	r, err := OpenRotatingFile(filepath.Join(t.TempDir(), "app.log"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// write appends s to the log
+func write(t *testing.T, r *RotatingFile, s string) {
+	t.Helper()
+	if _, err := r.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rotated returns the rotated files of the log, oldest first
+func rotated(t *testing.T, r *RotatingFile) []backup {
+	t.Helper()
+	backups, err := r.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backups
+}
+
+// content returns the content of a log file, gzipped files are unzipped
+func content(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var rd io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rd = zr
+	}
+	b, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotateOnSize(t *testing.T) {
+	r := openLog(t, RotateOptions{MaxSizeMB: 1})
+	half := strings.Repeat("a", 600*1024)
+	write(t, r, half)
+	if got := rotated(t, r); len(got) != 0 {
+		t.Fatalf("rotated %d files below the size", len(got))
+	}
+	write(t, r, strings.Repeat("b", 600*1024))
+
+	got := rotated(t, r)
+	if len(got) != 1 {
+		t.Fatalf("rotated %d files past the size, want 1", len(got))
+	}
+	if content(t, got[0].path) != half {
+		t.Errorf("the rotated file does not hold the first write")
+	}
+	if c := content(t, r.Path()); len(c) != 600*1024 || c[0] != 'b' {
+		t.Errorf("the new file holds %d bytes", len(c))
+	}
+}
+
+func TestRotateOnPeriod(t *testing.T) {
+	r := openLog(t, RotateOptions{RotateHours: 1})
+	write(t, r, "first\n")
+	write(t, r, "same period\n")
+	if got := rotated(t, r); len(got) != 0 {
+		t.Fatalf("rotated %d files within the period", len(got))
+	}
+	// the file was started in the previous hour
+	r.period = r.period.Add(-time.Hour)
+	write(t, r, "next period\n")
+
+	got := rotated(t, r)
+	if len(got) != 1 {
+		t.Fatalf("rotated %d files on a new period, want 1", len(got))
+	}
+	if c := content(t, got[0].path); c != "first\nsame period\n" {
+		t.Errorf("the rotated file holds %q", c)
+	}
+	if c := content(t, r.Path()); c != "next period\n" {
+		t.Errorf("the new file holds %q", c)
+	}
+}
+
+func TestBackupNamesWithinASecond(t *testing.T) {
+	r := openLog(t, RotateOptions{})
+	at := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	dir := filepath.Dir(r.Path())
+	if got := r.backupName(at); got != filepath.Join(dir, "app-20240506T070809.log") {
+		t.Errorf("the first backup is %s", got)
+	}
+	for _, name := range []string{"app-20240506T070809.log", "app-20240506T070809-1.log.gz"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := r.backupName(at); got != filepath.Join(dir, "app-20240506T070809-2.log") {
+		t.Errorf("the third backup of the second is %s", got)
+	}
+
+	// rotations in quick succession never overwrite each other
+	for i := range 3 {
+		write(t, r, strings.Repeat("x", i+1))
+		if err := r.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := rotated(t, r); len(got) != 5 {
+		t.Errorf("kept %d rotated files, want 5", len(got))
+	}
+}
+
+func TestRotateCompresses(t *testing.T) {
+	r := openLog(t, RotateOptions{Compress: true})
+	write(t, r, "compressed\n")
+	if err := r.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	write(t, r, "current\n")
+	// Close waits for the background compression
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := rotated(t, r)
+	if len(got) != 1 || !strings.HasSuffix(got[0].path, ".log.gz") {
+		t.Fatalf("rotated %+v, want one gzipped file", got)
+	}
+	if c := content(t, got[0].path); c != "compressed\n" {
+		t.Errorf("the gzipped file holds %q", c)
+	}
+	if c := content(t, r.Path()); c != "current\n" {
+		t.Errorf("the current file holds %q", c)
+	}
+}
+
+func TestRotatePrunes(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		r := openLog(t, RotateOptions{MaxBackups: 2, Compress: compress})
+		for _, s := range []string{"1", "2", "3", "4"} {
+			write(t, r, s)
+			if err := r.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := rotated(t, r)
+		if len(got) != 2 {
+			t.Fatalf("compress %v kept %d rotated files, want 2", compress, len(got))
+		}
+		if a, b := content(t, got[0].path), content(t, got[1].path); a != "3" || b != "4" {
+			t.Errorf("compress %v kept %q and %q, want the newest", compress, a, b)
+		}
+	}
+}
+
+func TestWriteAfterFailedReopen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenRotatingFile(filepath.Join(dir, "app.log"), RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stderr, err := os.CreateTemp(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stderr
+	os.Stderr = stderr
+	defer func() { os.Stderr = saved }()
+
+	// the folder of the log is gone, the new file cannot be opened
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Rotate(); err == nil {
+		t.Fatal("rotating into a removed folder succeeded")
+	}
+	write(t, r, "to stderr\n")
+	if c := content(t, stderr.Name()); c != "to stderr\n" {
+		t.Errorf("stderr holds %q", c)
+	}
+
+	// once the folder is back the log is reopened
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write(t, r, "back\n")
+	if c := content(t, r.Path()); c != "back\n" {
+		t.Errorf("the reopened file holds %q", c)
+	}
+}
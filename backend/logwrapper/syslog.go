@@ -0,0 +1,26 @@
+//go:build !windows && !plan9
+
+package logwrapper
+
+import (
+	"log/syslog"
+
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// syslogHook sends the entries to syslog at the priority of their level
+type syslogHook struct {
+	*lsyslog.SyslogHook
+}
+
+func (h syslogHook) Close() error {
+	return h.Writer.Close()
+}
+
+func newSyslogHook(network, address, tag string) (closingHook, error) {
+	hook, err := lsyslog.NewSyslogHook(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogHook{hook}, nil
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package logwrapper
+
+import "errors"
+
+func newSyslogHook(network, address, tag string) (closingHook, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+
+package logwrapper
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogOutput(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	opts := Options{Outputs: []string{OutputSyslog}, SyslogNetwork: "udp", SyslogAddress: server.LocalAddr().String(), Tag: "loader-test"}
+	if err := initLogger(t, opts); err != nil {
+		t.Fatal(err)
+	}
+	if Logger.File != nil {
+		t.Error("the syslog output opened a file")
+	}
+	Logger.L.Error("to syslog")
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	// an error of the daemon facility is priority 3*8+3
+	for _, want := range []string{"<27>", "loader-test", "to syslog"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("syslog got %q without %q", msg, want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"os/signal"
 	"runtime/debug"
 	"syscall"
@@ -15,9 +16,15 @@ import (
 	// _ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 
+	"github.com/pienaahj/rmsloader/backend/api"
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	dbs "github.com/pienaahj/rmsloader/backend/db"
 	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/metrics"
 	"github.com/pienaahj/rmsloader/backend/model"
 	"github.com/pienaahj/rmsloader/backend/process"
+	"github.com/pienaahj/rmsloader/backend/secrets"
+	"github.com/pienaahj/rmsloader/backend/source"
 
 	"github.com/sirupsen/logrus"
 )
@@ -31,8 +38,12 @@ const (
 )
 
 func main() {
+	// the docker healthcheck probes every 30 seconds, it must not write the logs or the metrics textfile
+	if name, args := commandFromArgs(os.Args[1:]); name == "healthcheck" {
+		os.Exit(healthcheck(args))
+	}
 	// Block until an interrupt signal is received
-	fmt.Println("Main started") // <<< this should appear regardless
+	fmt.Fprintln(os.Stderr, "Main started") // <<< this should appear regardless
 	// create the context
 	ctx , cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -41,24 +52,49 @@ func main() {
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 		<-sigs
-		fmt.Println("rmsloader shutting down gracefully")
+		fmt.Fprintln(os.Stderr, "rmsloader shutting down gracefully")
 		cancel()
 	}()
 
 	// check the directories
 	fileSystem, _ := os.Getwd()
+	// Populate the LogFiles map, this reads the settings, until then the log goes to stderr
+	model.ProcessLogFileLocations()
 	// Start the app logger
+	if err := li.Init(model.LogOptions()); err != nil {
+		li.Logger.L.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Could not configure the app log, logging to stderr")
+	}
 	li.CreateLogger()
 	li.Logger.L.Println("rmsloader is running...")
 	li.Logger.L.Println("Current working directory: ", fileSystem)
-	// Populate the LogFiles map
-	model.ProcessLogFileLocations()
+	// carry the metrics of the previous run over so they survive a run without new calls
+	if path := model.Settings.Metrics.Textfile; path != "" {
+		if err := metrics.RestoreTextfile(path); err != nil {
+			li.Logger.L.WithFields(logrus.Fields{
+				"textfile": path,
+				"err":      err,
+			}).Warn("Could not read the previous metrics")
+		}
+	}
 
 	var (
 		err error
 		db  *sqlx.DB
 	)
 
+	// split the sub command from its arguments, without one the arguments are the import flags
+	name, args := commandFromArgs(os.Args[1:])
+	var opts process.Options
+	if name == "" {
+		opts, err = importOptions(args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
 	defer func() {
 		err := recover()
 		if err != nil {
@@ -95,7 +131,47 @@ func main() {
 		}
 	}()
 
-	
+	// a remote source is connected to once for the import, the default reads csv_path
+	if name == "" && source.IsRemote(model.Settings.Source) {
+		opts.Source, err = source.Open(ctx, model.Settings.Source)
+		if err != nil {
+			li.Logger.Error("Main ", err)
+			fmt.Fprintln(os.Stderr, err)
+			GracefulShutdown(nil, 1)
+		}
+		defer opts.Source.Close()
+		li.Logger.L.Printf("Main: Reading the csv files from %s", opts.Source)
+	}
+
+	// a dry run only validates the csv files and does not need the database
+	if opts.DryRun {
+		li.Logger.L.Printf("Main: Validating csv files at %s", model.PathVars.CSVPath)
+		err = process.Process(ctx, model.PathVars.CSVPath, nil, opts)
+		if err != nil {
+			li.Logger.L.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("Dry run failed")
+			fmt.Fprintln(os.Stderr, err)
+			GracefulShutdown(nil, 1)
+		}
+		GracefulShutdown(nil, 0)
+	}
+
+	// some commands work on files only and do not need the database
+	if offlineCommands[name] {
+		li.Logger.L.Printf("Main: Running command %s", name)
+		err = runCommand(ctx, name, nil, args)
+		if err != nil {
+			li.Logger.L.WithFields(logrus.Fields{
+				"command": name,
+				"error":   err,
+			}).Error("Command failed")
+			fmt.Fprintln(os.Stderr, err)
+			GracefulShutdown(nil, 1)
+		}
+		GracefulShutdown(nil, 0)
+	}
+
 	// Get the username and password
 	// config := LoadEnvironment(false, "cdr")
 	// load the tls config
@@ -107,9 +183,27 @@ func main() {
 	})
 	// initialize the db connection
 	li.Logger.L.Println("Connecting to database...")
-	// load the mysql config
-	configcdr := LoadEnvironment(true, "cdr")
-	li.Logger.L.Printf("Connecting to mysql databases cdr with config: %#v", configcdr)
+	driver, dsn := model.Settings.Database.Driver, model.Settings.Database.DSN
+	if driver == "" {
+		driver = dbs.DriverMySQL
+	}
+	// a dsn holding a password is kept out of pathConfig.json as the RMSLOADER_DB_DSN secret
+	if dsn == "" {
+		if dsn, err = secrets.GetOr("RMSLOADER_DB_DSN", ""); err != nil {
+			li.Logger.Error("Main ", err)
+			GracefulShutdown(nil, 1)
+		}
+	}
+	if driver == dbs.DriverMySQL && dsn == "" {
+		// load the mysql config
+		configcdr, err := LoadEnvironment(true, "cdr")
+		if err != nil {
+			li.Logger.Error("Main ", err)
+			GracefulShutdown(nil, 1)
+		}
+		li.Logger.L.Printf("Connecting to mysql database %s at %s as %s", configcdr.DBName, configcdr.Addr, configcdr.User)
+		dsn = configcdr.FormatDSN()
+	}
 	// load the tls config
 	// Before establishing the database connection
 	mysql.RegisterTLSConfig("customcdr", &tls.Config{
@@ -117,21 +211,25 @@ func main() {
 		// For example, to skip server certificate verification:
 		InsecureSkipVerify: true,
 	})
-	// Retry connecting to the MySQL server
+	// Retry connecting to the database server
 	for i := 0; i < maxRetries; i++ {
-		db, err = sqlx.Connect("mysql", configcdr.FormatDSN())
-		if err != nil {
+		store, openErr := dbs.Open(ctx, driver, dsn)
+		if openErr != nil {
+			err = openErr
+			metrics.DBConnectionRetries.Inc()
 			time.Sleep(connectionRetry)
 			continue
 		}
+		db = store.DB()
 
 		// Ping the database to check if it's alive
 		err = db.PingContext(ctx)
 		if err == nil {
-			li.Logger.L.Println("Connected to MySQL successfully")
+			li.Logger.L.Printf("Connected to %s successfully", driver)
 			break
 		} else {
-			li.Logger.L.Printf("Error pinging MySQL: %v", err)
+			li.Logger.L.Printf("Error pinging %s: %v", driver, err)
+			metrics.DBConnectionRetries.Inc()
 			time.Sleep(retryInterval)
 		}
 	}
@@ -143,6 +241,32 @@ func main() {
 	defer db.Close()
 
 	li.Logger.L.Println("Database connection established")
+
+	// run a sub command instead of the import when one is given
+	if name != "" {
+		li.Logger.L.Printf("Main: Running command %s", name)
+		err = runCommand(ctx, name, db, args)
+		if err != nil {
+			li.Logger.L.WithFields(logrus.Fields{
+				"command": name,
+				"error":   err,
+			}).Error("Command failed")
+			fmt.Fprintln(os.Stderr, err)
+			GracefulShutdown(db, 1)
+		}
+		GracefulShutdown(db, 0)
+	}
+	// serve the metrics while the import runs, the serve command has them on the api
+	if model.Settings.Metrics.Enabled && model.Settings.Metrics.ListenAddr != "" {
+		go func() {
+			if err := api.ListenAndServe(ctx, model.Settings.Metrics.ListenAddr, metrics.Handler()); err != nil {
+				li.Logger.L.WithFields(logrus.Fields{
+					"addr": model.Settings.Metrics.ListenAddr,
+					"err":  err,
+				}).Error("Metrics server failed")
+			}
+		}()
+	}
 	li.Logger.L.Println("Parsing new recordings...")
 
 	li.Logger.L.Info("Starting process")
@@ -150,12 +274,26 @@ func main() {
 	// make a new db object
 
 	li.Logger.L.Printf("Main: Proccessing csv files at %s", model.PathVars.CSVPath)
-	err = process.Process(ctx, model.PathVars.CSVPath, db)
+	err = process.Process(ctx, model.PathVars.CSVPath, dbs.NewSQLRepository(db), opts)
+	// an import that never started leaves the metrics of the last run that did
+	writeTextfile(err)
+	if errors.Is(err, apperr.ErrDBLocked) {
+		li.Logger.L.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("Another import is running, terminating...")
+		fmt.Fprintln(os.Stderr, "another import is running:", err)
+		GracefulShutdown(db, exitLocked)
+	}
+	// an empty folder is a quiet window, the run succeeded
+	if errors.Is(err, process.ErrNoFiles) {
+		li.Logger.L.Info("No files to import")
+		GracefulShutdown(db, 0)
+	}
 	if err != nil {
 		li.Logger.L.WithFields(logrus.Fields{
 			"error": err,
 		}).Error("Error processing wav files, terminating...")
-		GracefulShutdown(db)
+		GracefulShutdown(db, 1)
 		return
 	}
 	li.Logger.L.Println("Database populated successfully")
@@ -165,12 +303,28 @@ func main() {
 	li.Logger.L.Println("RMSLOADER COMPLETED SUCCESSFULLY")
 	li.Logger.L.Println("****************************************************************")
 	li.Logger.L.Println()
-	GracefulShutdown(db)
+	GracefulShutdown(db, 0)
 
 }
 
-func GracefulShutdown(db *sqlx.DB) {
-	fmt.Println("Shutting down...")
+// exitLocked is the exit code of an import that did not start because another import is running,
+// EX_TEMPFAIL so a cron wrapper can tell it from a failed import, which exits with 1, and try again later
+const exitLocked = 75
+
+// writeTextfile leaves the metrics of an import run for the node exporter. Only an import writes it, the other
+// commands start with empty counters and would wipe the counts of the last run.
+func writeTextfile(runErr error) {
+	path := model.Settings.Metrics.Textfile
+	if err := metrics.WriteImportTextfile(path, runErr); err != nil {
+		li.Logger.L.WithFields(logrus.Fields{
+			"textfile": path,
+			"err":      err,
+		}).Error("Could not write the metrics")
+	}
+}
+
+func GracefulShutdown(db *sqlx.DB, code int) {
+	fmt.Fprintln(os.Stderr, "Shutting down...")
 	// sync the logger
 	li.Logger.Sync()
 	// close the logger
@@ -181,23 +335,35 @@ func GracefulShutdown(db *sqlx.DB) {
 	}
 	Close()  // Close the log resources
 	time.Sleep(5 * time.Second) // Give time for logs to appear
-	os.Exit(0)
+	os.Exit(code)
 }
 
-// load the environmental variables env true if app is running in docker
-func LoadEnvironment(env bool, name string) mysql.Config {
-	// DB_PASSWORD := os.Getenv("DB_PASSWORD")
+// load the environmental variables env true if app is running in docker.
+// The password has no default, it is read with the secrets package like the other settings
+func LoadEnvironment(env bool, name string) (mysql.Config, error) {
 	if name == "cdr" {
-		// DB_NAME := os.Getenv("DB_NAME_GO_CDR")
-		// DB_USER := os.Getenv("DB_USER_GO")
-		// DB_ADDR := os.Getenv("DB_ADDR_GO_CDR")
-		// DB_PASSWORD := os.Getenv("DB_PASSWORD_GO")
+		user, err := secrets.GetOr("DB_USER_GO", "new_gouser")
+		if err != nil {
+			return mysql.Config{}, err
+		}
+		password, err := secrets.Get("DB_PASSWORD_GO")
+		if err != nil {
+			return mysql.Config{}, err
+		}
+		addr, err := secrets.GetOr("DB_ADDR_GO_CDR", "192.168.128.10:3306")
+		if err != nil {
+			return mysql.Config{}, err
+		}
+		dbName, err := secrets.GetOr("DB_NAME_GO_CDR", "Rmsdb")
+		if err != nil {
+			return mysql.Config{}, err
+		}
 		cfg := mysql.Config{
-			User:                 "new_gouser",
-			Passwd:               "NOTAPASSWORD",
+			User:                 user,
+			Passwd:               password,
 			Net:                  "tcp",
-			Addr:                 "192.168.128.10:3306",
-			DBName:               "Rmsdb",
+			Addr:                 addr,
+			DBName:               dbName,
 			AllowNativePasswords: true,
 			ParseTime:            true,
 			CheckConnLiveness:    true,
@@ -205,10 +371,10 @@ func LoadEnvironment(env bool, name string) mysql.Config {
 		}
 		// Enable TLS (optional)
 		cfg.TLSConfig = "customcdr"
-		return cfg
+		return cfg, nil
 	}
 	
-	return mysql.Config{}
+	return mysql.Config{}, nil
 }
 // Close resources
 func Close() {
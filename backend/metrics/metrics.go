@@ -0,0 +1,115 @@
+// Package metrics holds the prometheus metrics of the loader, served on /metrics or written to a textfile
+package metrics
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+)
+
+// the file states counted by Files
+const (
+	FileDiscovered = "discovered"
+	FileProcessed  = "processed"
+	FileSkipped    = "skipped"
+	FileFailed     = "failed"
+)
+
+// the row states counted by Rows
+const (
+	RowParsed   = "parsed"
+	RowInserted = "inserted"
+	RowSkipped  = "skipped"
+)
+
+// Registry holds the loader metrics and the go runtime metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Files counts the csv files by state, skipped files were imported before
+	Files = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmsloader_files_total",
+		Help: "CSV files discovered, processed, skipped as already imported or failed.",
+	}, []string{"state"})
+	// Rows counts the csv rows parsed, and the rows inserted or skipped as duplicates in committed units
+	Rows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmsloader_rows_total",
+		Help: "CSV rows parsed, inserted or skipped as already stored.",
+	}, []string{"state"})
+	// RowsRejected counts the rows the csv reader rejected by reason
+	RowsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmsloader_rows_rejected_total",
+		Help: "CSV rows rejected by the reader, by reason.",
+	}, []string{"reason"})
+	// BatchInsertSeconds times the insert statements of a batch by mode, insert, bulk or upsert
+	BatchInsertSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rmsloader_batch_insert_duration_seconds",
+		Help:    "Time taken to write one batch of calls.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"mode"})
+	// DBConnectionRetries counts the failed attempts to open or ping the database at start up
+	DBConnectionRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rmsloader_db_connection_retries_total",
+		Help: "Failed attempts to connect to the database before giving up or succeeding.",
+	})
+	// LastSuccessfulImport is the time of the last run that stored new calls without failures
+	LastSuccessfulImport = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rmsloader_last_successful_import_timestamp_seconds",
+		Help: "Unix time of the last import that stored new calls without failures.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(Files, Rows, RowsRejected, BatchInsertSeconds, DBConnectionRetries, LastSuccessfulImport,
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// WriteTextfile writes the metrics to path for the node exporter textfile collector, the file is replaced atomically
+func WriteTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, Registry)
+}
+
+// WriteImportTextfile writes the textfile after an import run that ended with runErr. An import that did not start
+// because another import holds the lock leaves the textfile of the last run alone, as does an empty path.
+func WriteImportTextfile(path string, runErr error) error {
+	if path == "" || errors.Is(runErr, apperr.ErrDBLocked) {
+		return nil
+	}
+	return WriteTextfile(path)
+}
+
+// RestoreTextfile carries the last successful import time over from the textfile of the previous run,
+// so a run without new calls does not reset it. A missing file is not an error.
+func RestoreTextfile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(f)
+	if err != nil {
+		return err
+	}
+	if family, ok := families["rmsloader_last_successful_import_timestamp_seconds"]; ok && len(family.GetMetric()) > 0 {
+		LastSuccessfulImport.Set(family.GetMetric()[0].GetGauge().GetValue())
+	}
+	return nil
+}
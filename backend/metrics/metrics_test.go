@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+)
+
+// run counts what an import of one file with a rejected row does
+func run() {
+	Files.WithLabelValues(FileDiscovered).Inc()
+	Files.WithLabelValues(FileProcessed).Inc()
+	Rows.WithLabelValues(RowParsed).Add(4)
+	Rows.WithLabelValues(RowInserted).Add(3)
+	Rows.WithLabelValues(RowSkipped).Add(1)
+	RowsRejected.WithLabelValues("short_line").Inc()
+	BatchInsertSeconds.WithLabelValues("insert").Observe(0.01)
+	LastSuccessfulImport.Set(1700000000)
+}
+
+func TestCollectors(t *testing.T) {
+	before := testutil.ToFloat64(Rows.WithLabelValues(RowInserted))
+	run()
+	if got := testutil.ToFloat64(Rows.WithLabelValues(RowInserted)) - before; got != 3 {
+		t.Errorf("inserted rows grew by %v, want 3", got)
+	}
+	// every loader metric is registered besides the runtime metrics
+	names := []string{
+		"rmsloader_files_total",
+		"rmsloader_rows_total",
+		"rmsloader_rows_rejected_total",
+		"rmsloader_batch_insert_duration_seconds",
+		"rmsloader_db_connection_retries_total",
+		"rmsloader_last_successful_import_timestamp_seconds",
+		"go_goroutines",
+	}
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := make(map[string]bool)
+	for _, f := range families {
+		gathered[f.GetName()] = true
+	}
+	for _, name := range names {
+		if !gathered[name] {
+			t.Errorf("%s is not registered", name)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `rmsloader_rows_total{state="inserted"}`) {
+		t.Errorf("/metrics answered %d without the row counts", rec.Code)
+	}
+}
+
+func TestTextfileAfterRun(t *testing.T) {
+	run()
+	path := filepath.Join(t.TempDir(), "rmsloader.prom")
+	if err := WriteImportTextfile(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inserted := fmt.Sprintf(`rmsloader_rows_total{state="inserted"} %v`, testutil.ToFloat64(Rows.WithLabelValues(RowInserted)))
+	for _, want := range []string{
+		inserted,
+		`rmsloader_rows_rejected_total{reason="short_line"}`,
+		`rmsloader_batch_insert_duration_seconds_count{mode="insert"}`,
+		"rmsloader_last_successful_import_timestamp_seconds 1.7e+09",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("the textfile has no %s", want)
+		}
+	}
+
+	// the next run starts from zero and carries the last successful import over
+	LastSuccessfulImport.Set(0)
+	if err := RestoreTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(LastSuccessfulImport); got != 1700000000 {
+		t.Errorf("restored the last successful import as %v", got)
+	}
+	if err := RestoreTextfile(filepath.Join(t.TempDir(), "missing.prom")); err != nil {
+		t.Errorf("a missing textfile returned %v", err)
+	}
+}
+
+func TestTextfileSkippedWhenLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rmsloader.prom")
+	if err := os.WriteFile(path, []byte("# the last run\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	locked := apperr.New(apperr.DBLocked, "process.Process", "another import is running")
+	if err := WriteImportTextfile(path, fmt.Errorf("import: %w", locked)); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "# the last run\n" {
+		t.Errorf("an import that did not start wrote the textfile: %q", data)
+	}
+	// a failed run did start, its counts are written
+	if err := WriteImportTextfile(path, errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "rmsloader_files_total") {
+		t.Errorf("a failed run did not write the textfile: %q", data)
+	}
+	if err := WriteImportTextfile("", nil); err != nil {
+		t.Errorf("no textfile configured returned %v", err)
+	}
+}
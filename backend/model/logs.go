@@ -1,14 +1,17 @@
 package model
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"strings"
 
 	"os"
 
+	"github.com/pienaahj/rmsloader/backend/apperr"
 	li "github.com/pienaahj/rmsloader/backend/logwrapper"
 
 	"github.com/sirupsen/logrus"
@@ -17,8 +20,8 @@ import (
 // the log files
 var LogFiles map[string]string
 
-// make the log file map to close them later
-var LogFileLiterals map[string]*os.File
+// make the log file map to close them later, the files rotate by Settings.Logs.Rotation
+var LogFileLiterals map[string]*li.RotatingFile
 var PathVars struct {
 	SourcePath      string `json:"source_path"`
 	CSVPath		    string `json:"csv_path"`
@@ -34,22 +37,29 @@ var PathVars struct {
 func ProcessLogFileLocations() map[string]string {
 	CallFrom := "ProcessLogFileLocations "
 	// make the logFiles map
-	LogFileLiterals = make(map[string]*os.File)
+	LogFileLiterals = make(map[string]*li.RotatingFile)
 	// get the paths loaded from the json file
 	paths, err := os.Open("./pathConfig.json")
 	if err != nil {
-		li.Logger.L.WithFields(logrus.Fields{
-			"CallFrom": CallFrom,
-			"err": err,
-		}).Error("Failed to load pathConfig.json")
+		li.Logger.Error(CallFrom, &apperr.Error{Code: apperr.ConfigInvalid, Op: "pathConfig.json", Msg: "cannot open", Err: err})
 		os.Exit(1)
 	}
 	defer paths.Close()
-	err = json.NewDecoder(paths).Decode(&PathVars)
+	config, err := io.ReadAll(paths)
 	if err != nil {
-		li.Logger.L.WithFields(logrus.Fields{
-			"err": err,
-		}).Error("Failed to decode pathConfig.json variables")
+		li.Logger.Error(CallFrom, &apperr.Error{Code: apperr.ConfigInvalid, Op: "pathConfig.json", Msg: "cannot read", Err: err})
+		os.Exit(1)
+	}
+	ConfigHash = fmt.Sprintf("%x", sha256.Sum256(config))
+	err = json.Unmarshal(config, &PathVars)
+	if err != nil {
+		li.Logger.Error(CallFrom, &apperr.Error{Code: apperr.ConfigInvalid, Op: "pathConfig.json", Msg: "cannot decode the paths", Err: err})
+		os.Exit(1)
+	}
+	// the feature settings share the file with the paths
+	err = json.Unmarshal(config, &Settings)
+	if err != nil {
+		li.Logger.Error(CallFrom, &apperr.Error{Code: apperr.ConfigInvalid, Op: "pathConfig.json", Msg: "cannot decode the settings", Err: err})
 		os.Exit(1)
 	}
 
@@ -149,42 +159,39 @@ func ProcessLogFileLocations() map[string]string {
 // create all the log files if they don't exist
 func createLogFiles(filename string) error {
 	CallFrom := "createLogFiles "
-	var file *os.File
-	// Create the log file if it doesn't exist
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
 		li.Logger.L.Printf("%s: %s log file does not exist, creating it", CallFrom, filename)
-		file, err = os.Create(filename)
-		if err != nil {
-			if os.IsPermission(err) {
-				li.Logger.ErrWriteFilesMessage(CallFrom, "Permission denied creating log file", err)
-				return err
-			} else {
-				msg := fmt.Sprintf("Failed to create log file, %s", filename)
-				li.Logger.ErrWriteFilesMessage(CallFrom, msg, err)
-			}
-			return err
-			}
+	}
+	// open the log file for appending, it is created if it doesn't exist
+	file, err := li.OpenRotatingFile(filename, Settings.Logs.Rotation)
+	if err != nil {
+		if os.IsPermission(err) {
+			li.Logger.ErrWriteFilesMessage(CallFrom, "Permission denied creating log file", err)
+		} else {
+			msg := fmt.Sprintf("Failed to create log file, %s", filename)
+			li.Logger.ErrWriteFilesMessage(CallFrom, msg, err)
 		}
-	
+		return err
+	}
 	// li.Logger.InfoLogFileCreateMessage(CallFrom, filename)
 	// defer file.Close() moved to Close()
-	// if created remember the file
+	// remember the file
 	LogFileLiterals[filename] = file
 	return nil
 }
 // Close file resources
 func Close() {
 	// close the log files
-	CloseFile(LogFileLiterals["DbLogs"])
-	CloseFile(LogFileLiterals["AnalysisLogs"])
-	CloseFile(LogFileLiterals["OddDates"])
+	for _, file := range LogFileLiterals {
+		CloseFile(file)
+	}
 }
 
 // close the logFile
-func CloseFile(file *os.File) {
+func CloseFile(file *li.RotatingFile) {
 	err := file.Close()
 	if err != nil {
-		li.Logger.L.Printf("Error closing file: %s with error:%v", file.Name(), err)
+		li.Logger.L.Printf("Error closing file: %s with error:%v", file.Path(), err)
 	}
 }
 // ChangePath return path directory
@@ -1,7 +1,9 @@
 package model
 
 import (
+	"crypto/sha1"
 	"database/sql/driver"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"time"
@@ -68,6 +70,42 @@ type RMSCDR struct {
 	FileName string `db:"file_name" json:"file_name"`
 	// sip call ID
 	SipCallID string `db:"sip_call_id" json:"sip_call_id"`
+	// wav header details of the linked recording, nil if not inspected
+	Audio *AudioInfo `db:"-" json:"audio,omitempty"`
+}
+
+// NaturalKey identifies a call independent of its uid, RMS exports the same call with the same
+// recording, sip call id and time every time it is exported
+func (c RMSCDR) NaturalKey() string {
+	return c.FileName + "|" + c.SipCallID + "|" + strconv.FormatInt(c.UnixTimestamp, 10)
+}
+
+// CallKey is the hex SHA-1 of the natural key, rmscdr holds it in the unique call_key column
+func (c RMSCDR) CallKey() string {
+	sum := sha1.Sum([]byte(c.NaturalKey()))
+	return hex.EncodeToString(sum[:])
+}
+
+// AudioInfo represents the wav header details of the recording linked to a CDR
+type AudioInfo struct {
+	// the uid of the CDR
+	UID string `db:"uid" json:"uid"`
+	// The recording file name
+	FileName string `db:"file_name" json:"file_name"`
+	// codec name eg. pcm, g711-alaw
+	Codec string `db:"codec" json:"codec"`
+	// samples per second
+	SampleRate int64 `db:"sample_rate" json:"sample_rate"`
+	// number of channels
+	Channels int64 `db:"channels" json:"channels"`
+	// bits per sample
+	BitsPerSample int64 `db:"bits_per_sample" json:"bits_per_sample"`
+	// exact audio length in milliseconds
+	AudioDurationMs int64 `db:"audio_duration_ms" json:"audio_duration_ms"`
+	// csv duration minus audio length in seconds
+	DurationDelta float64 `db:"duration_delta" json:"duration_delta"`
+	// the csv duration disagrees with the audio length beyond the tolerance
+	DurationMismatch bool `db:"duration_mismatch" json:"duration_mismatch"`
 }
 
 // cater for the duration conversion and database storage
@@ -167,3 +205,160 @@ var Log = logrus.New()
 // 	Callee         string `db:"callee" json:"callee"`
 // 	CalleeCategory string `db:"callee_category" json:"callee_category"`
 // }
+
+// RecordingHash represents the SHA-256 of a recording taken at import
+type RecordingHash struct {
+	// the uid of the CDR
+	UID string `db:"uid" json:"uid"`
+	// The recording file name
+	FileName string `db:"file_name" json:"file_name"`
+	// hex encoded SHA-256 of the recording
+	SHA256 string `db:"sha256" json:"sha256"`
+	// size of the recording in bytes
+	Size int64 `db:"size" json:"size"`
+	// when the hash was taken
+	HashedAt time.Time `db:"hashed_at" json:"hashed_at"`
+}
+
+// ChainEntry represents a link in the hash chain over imported CDR rows
+type ChainEntry struct {
+	// position in the chain
+	Seq int64 `db:"seq" json:"seq"`
+	// the uid of the CDR
+	UID string `db:"uid" json:"uid"`
+	// the row hash of the previous entry
+	PrevHash string `db:"prev_hash" json:"prev_hash"`
+	// SHA-256 over the previous hash and the CDR fields
+	RowHash string `db:"row_hash" json:"row_hash"`
+	// when the entry was added
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// RetentionAudit represents the audit log entry of a retention purge
+type RetentionAudit struct {
+	ID int64 `db:"id" json:"id"`
+	// the retention rule that expired the rows
+	RuleName string `db:"rule_name" json:"rule_name"`
+	// rows older than the cutoff expire
+	Cutoff time.Time `db:"cutoff" json:"cutoff"`
+	// counted only, nothing archived or deleted
+	DryRun bool `db:"dry_run" json:"dry_run"`
+	RowsMatched int64 `db:"rows_matched" json:"rows_matched"`
+	RowsDeleted int64 `db:"rows_deleted" json:"rows_deleted"`
+	// the archive holding the deleted rows
+	ArchiveFile string `db:"archive_file" json:"archive_file"`
+	StartedAt time.Time `db:"started_at" json:"started_at"`
+	FinishedAt *time.Time `db:"finished_at" json:"finished_at"`
+}
+
+// CallSummary represents the call statistics of an extension over a day or a month
+type CallSummary struct {
+	// the day 2006-01-02 or the month 2006-01
+	Period string `db:"-" json:"period"`
+	// the first day of the period
+	Day time.Time `db:"day" json:"-"`
+	// the internal party of the calls, empty when summed over all extensions
+	Extension string `db:"extension" json:"extension"`
+	Calls int64 `db:"calls" json:"calls"`
+	// durations in seconds
+	TotalDuration int64 `db:"total_duration" json:"total_duration"`
+	AvgDuration float64 `db:"-" json:"avg_duration"`
+	MaxDuration int64 `db:"max_duration" json:"max_duration"`
+	Inbound int64 `db:"inbound" json:"inbound"`
+	Outbound int64 `db:"outbound" json:"outbound"`
+	Flagged int64 `db:"flagged" json:"flagged"`
+	// total recording size
+	TotalSize float64 `db:"total_size" json:"total_size"`
+}
+
+// the states of a file in the import ledger
+const (
+	ImportLoading = "loading"
+	ImportLoaded  = "loaded"
+	ImportFailed  = "failed"
+)
+
+// ImportFile represents the import ledger entry of a csv file
+type ImportFile struct {
+	ID int64 `db:"id" json:"id"`
+	FileName string `db:"file_name" json:"file_name"`
+	// the file content, an unchanged file is not imported twice
+	SHA256 string `db:"sha256" json:"sha256"`
+	Size int64 `db:"size" json:"size"`
+	// the rows in the file and the rows committed so far
+	Rows int64 `db:"rows_total" json:"rows_total"`
+	RowsLoaded int64 `db:"rows_loaded" json:"rows_loaded"`
+	// loading, loaded or failed
+	Status string `db:"status" json:"status"`
+	Error string `db:"error" json:"error"`
+	StartedAt time.Time `db:"started_at" json:"started_at"`
+	FinishedAt *time.Time `db:"finished_at" json:"finished_at"`
+}
+
+// the final states of an import run
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	RunCancelled = "cancelled"
+)
+
+// ImportRun represents the summary record of one import run
+type ImportRun struct {
+	// the run id, it is logged as run_id with every entry of the run
+	ID string `db:"id" json:"id"`
+	// running, succeeded, failed or cancelled
+	Status string `db:"status" json:"status"`
+	Host string `db:"host" json:"host"`
+	Version string `db:"version" json:"version"`
+	// the sha256 of pathConfig.json
+	ConfigHash string `db:"config_hash" json:"config_hash"`
+	// the csv files found, imported, skipped as imported before and failed
+	FilesFound int64 `db:"files_found" json:"files_found"`
+	FilesImported int64 `db:"files_imported" json:"files_imported"`
+	FilesSkipped int64 `db:"files_skipped" json:"files_skipped"`
+	FilesFailed int64 `db:"files_failed" json:"files_failed"`
+	// the rows parsed, rejected by the reader and stored
+	RowsParsed int64 `db:"rows_parsed" json:"rows_parsed"`
+	RowsRejected int64 `db:"rows_rejected" json:"rows_rejected"`
+	RowsInserted int64 `db:"rows_inserted" json:"rows_inserted"`
+	Error string `db:"error" json:"error"`
+	StartedAt time.Time `db:"started_at" json:"started_at"`
+	FinishedAt *time.Time `db:"finished_at" json:"finished_at"`
+}
+
+// the states of a scheduled job run, a job that found its lock taken is skipped
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobSkipped   = "skipped"
+)
+
+// JobRun represents one execution of a scheduled job
+type JobRun struct {
+	ID int64 `db:"id" json:"id"`
+	// the name and kind of the job in the schedule
+	Job string `db:"job" json:"job"`
+	Kind string `db:"kind" json:"kind"`
+	Host string `db:"host" json:"host"`
+	// running, succeeded, failed or skipped
+	Status string `db:"status" json:"status"`
+	Error string `db:"error" json:"error"`
+	// the time the cron expression gave, the job starts as soon after as it can
+	ScheduledAt time.Time `db:"scheduled_at" json:"scheduled_at"`
+	StartedAt time.Time `db:"started_at" json:"started_at"`
+	FinishedAt *time.Time `db:"finished_at" json:"finished_at"`
+}
+
+// CDRChange represents a column of a CDR changed by a later export of the same call
+type CDRChange struct {
+	ID int64 `db:"id" json:"id"`
+	UID string `db:"uid" json:"uid"`
+	Column string `db:"column_name" json:"column"`
+	OldValue string `db:"old_value" json:"old_value"`
+	NewValue string `db:"new_value" json:"new_value"`
+	// the import ledger entry of the file that changed it
+	ImportFileID int64 `db:"import_file_id" json:"import_file_id"`
+	ChangedAt time.Time `db:"changed_at" json:"changed_at"`
+}
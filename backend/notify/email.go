@@ -0,0 +1,185 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/secrets"
+)
+
+// defaultEmailTimeout is the time a mail may take to send
+const defaultEmailTimeout = 30 * time.Second
+
+// sendEmail mails the summary of the notification to the recipients of the settings, with the rejected rows
+// attached when the settings ask for them
+func sendEmail(ctx context.Context, settings model.EmailSettings, n Notification) error {
+	op := "notify.sendEmail"
+	msg, err := mailMessage(settings, n)
+	if err != nil {
+		return apperr.Wrap(apperr.Internal, op, err)
+	}
+	user, err := secrets.GetOr("SMTP_USERNAME", settings.User)
+	if err != nil {
+		return err
+	}
+	var password string
+	if user != "" {
+		if password, err = secrets.Get("SMTP_PASSWORD"); err != nil {
+			return err
+		}
+	}
+	timeout := defaultEmailTimeout
+	if settings.TimeoutSeconds > 0 {
+		timeout = time.Duration(settings.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := deliver(ctx, settings, user, password, msg); err != nil {
+		return apperr.Wrap(apperr.NotifySend, op, err)
+	}
+	return nil
+}
+
+// deliver hands msg to the smtp server, it logs in when a user is given
+func deliver(ctx context.Context, settings model.EmailSettings, user string, password string, msg []byte) error {
+	host, _, _ := net.SplitHostPort(settings.Addr)
+	tlsConfig := &tls.Config{ServerName: host}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", settings.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if settings.TLS == TLSImplicit {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if settings.TLS == "" || settings.TLS == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	// the password is only sent over an encrypted connection or to the local host
+	if user != "" {
+		if err := c.Auth(smtp.PlainAuth("", user, password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(settings.From); err != nil {
+		return err
+	}
+	for _, to := range settings.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// mailMessage is the notification as a MIME message, the summary as text and the rejected rows as a csv file
+func mailMessage(settings model.EmailSettings, n Notification) ([]byte, error) {
+	var buf bytes.Buffer
+	body := multipart.NewWriter(&buf)
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", settings.From)
+	header("To", strings.Join(settings.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", n.Subject()))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "multipart/mixed; boundary="+body.Boundary())
+	buf.WriteString("\r\n")
+
+	part, err := body.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(n.Summary(), "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	if settings.AttachRejects && len(n.Rejects.Rows) > 0 {
+		name := "rejects-" + n.Run.ID + ".csv"
+		part, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType("text/csv", map[string]string{"charset": "utf-8", "name": name})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		data, err := RejectsCSV(n.Rejects.Rows)
+		if err != nil {
+			return nil, err
+		}
+		writeBase64(part, data)
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RejectsCSV writes the rejected rows as csv with a header row
+func RejectsCSV(rows []Reject) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"file", "line", "reason", "code", "detail"})
+	for _, r := range rows {
+		w.Write([]string{r.File, strconv.Itoa(r.Line), r.Reason, r.Code, r.Detail})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// writeBase64 writes data base64 encoded in lines of 76 characters, as a mail needs
+func writeBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
@@ -0,0 +1,257 @@
+// Package notify tells people about the outcome of an import run. A run that failed, was cancelled, succeeded
+// or crossed a threshold of rejected rows or failed files is posted to webhooks, as signed JSON or as a Slack
+// message, and mailed with a summary and the rejected rows attached as a csv file.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// the events of a run, a run raises the event of its final status and the threshold event when it crossed one
+const (
+	EventSucceeded = model.RunSucceeded
+	EventFailed    = model.RunFailed
+	EventCancelled = model.RunCancelled
+	EventThreshold = "threshold"
+)
+
+// the formats of a webhook
+const (
+	FormatJSON  = "json"
+	FormatSlack = "slack"
+)
+
+// the ways a mail is encrypted
+const (
+	TLSStartTLS = "starttls"
+	TLSImplicit = "tls"
+	TLSNone     = "none"
+)
+
+// MaxRejects is the number of rejected rows a notification carries, the rows after it are only counted
+const MaxRejects = 10000
+
+// defaultEvents are notified when the settings name none
+var defaultEvents = []string{EventFailed, EventThreshold}
+
+// Reject is a row of a csv file the run could not import
+type Reject struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+// Rejects collects the rejected rows of a run, the first MaxRejects rows are kept and all of them are counted
+type Rejects struct {
+	Rows     []Reject
+	ByReason map[string]int
+}
+
+// Add records a rejected row
+func (r *Rejects) Add(reject Reject) {
+	if r.ByReason == nil {
+		r.ByReason = make(map[string]int)
+	}
+	r.ByReason[reject.Reason]++
+	if len(r.Rows) < MaxRejects {
+		r.Rows = append(r.Rows, reject)
+	}
+}
+
+// Notification is the outcome of a run as it is sent
+type Notification struct {
+	Run model.ImportRun
+	// the events of the run that the settings notify
+	Events  []string
+	Rejects Rejects
+}
+
+// Event is the main event of the notification, the status of the run unless only a threshold is notified
+func (n Notification) Event() string {
+	if len(n.Events) == 0 {
+		return n.Run.Status
+	}
+	return n.Events[0]
+}
+
+// Subject is the one line summary of the run
+func (n Notification) Subject() string {
+	run := n.Run
+	switch {
+	case run.Status == model.RunSucceeded && run.RowsRejected > 0:
+		return fmt.Sprintf("rmsloader import succeeded on %s with %d rejected rows", run.Host, run.RowsRejected)
+	case run.Status == model.RunSucceeded && run.FilesFailed > 0:
+		return fmt.Sprintf("rmsloader import succeeded on %s with %d failed files", run.Host, run.FilesFailed)
+	}
+	return fmt.Sprintf("rmsloader import %s on %s", run.Status, run.Host)
+}
+
+// Summary describes the run in a few lines of text
+func (n Notification) Summary() string {
+	run := n.Run
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", n.Subject())
+	fmt.Fprintf(&b, "run:      %s\n", run.ID)
+	fmt.Fprintf(&b, "version:  %s\n", run.Version)
+	fmt.Fprintf(&b, "started:  %s\n", run.StartedAt.Format(time.RFC3339))
+	if run.FinishedAt != nil {
+		fmt.Fprintf(&b, "took:     %s\n", run.FinishedAt.Sub(run.StartedAt).Round(time.Second))
+	}
+	fmt.Fprintf(&b, "files:    %d found, %d imported, %d skipped, %d failed\n", run.FilesFound, run.FilesImported, run.FilesSkipped, run.FilesFailed)
+	fmt.Fprintf(&b, "rows:     %d parsed, %d rejected, %d inserted\n", run.RowsParsed, run.RowsRejected, run.RowsInserted)
+	if reasons := n.reasons(); reasons != "" {
+		fmt.Fprintf(&b, "rejected: %s\n", reasons)
+	}
+	if run.Error != "" {
+		fmt.Fprintf(&b, "error:    %s\n", run.Error)
+	}
+	return b.String()
+}
+
+// reasons lists the rejected rows by reason, the most frequent first
+func (n Notification) reasons() string {
+	var reasons []string
+	for reason := range n.Rejects.ByReason {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		a, b := n.Rejects.ByReason[reasons[i]], n.Rejects.ByReason[reasons[j]]
+		return a > b || a == b && reasons[i] < reasons[j]
+	})
+	for i, reason := range reasons {
+		reasons[i] = fmt.Sprintf("%s %d", reason, n.Rejects.ByReason[reason])
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// Events returns the events of run that the settings notify, none when the run is not notified
+func Events(settings model.NotifySettings, run model.ImportRun) []string {
+	wanted := settings.Events
+	if len(wanted) == 0 {
+		wanted = defaultEvents
+	}
+	var events []string
+	if slices.Contains(wanted, run.Status) {
+		events = append(events, run.Status)
+	}
+	if slices.Contains(wanted, EventThreshold) && Crossed(settings, run) {
+		events = append(events, EventThreshold)
+	}
+	return events
+}
+
+// Crossed tells whether run crossed one of the thresholds of the settings
+func Crossed(settings model.NotifySettings, run model.ImportRun) bool {
+	if settings.RejectedRows > 0 && run.RowsRejected >= settings.RejectedRows {
+		return true
+	}
+	if read := run.RowsParsed + run.RowsRejected; settings.RejectedPercent > 0 && read > 0 &&
+		float64(run.RowsRejected)*100/float64(read) >= settings.RejectedPercent {
+		return true
+	}
+	return settings.FailedFiles > 0 && run.FilesFailed >= settings.FailedFiles
+}
+
+// Validate checks the events, the webhooks and the mail settings
+func Validate(settings model.NotifySettings) error {
+	invalid := func(msg string) error {
+		return apperr.New(apperr.ConfigInvalid, "notify.Validate", msg)
+	}
+	for _, event := range settings.Events {
+		switch event {
+		case EventSucceeded, EventFailed, EventCancelled, EventThreshold:
+		default:
+			return invalid(fmt.Sprintf("unknown notify event %q, use succeeded, failed, cancelled or threshold", event))
+		}
+	}
+	if settings.RejectedRows < 0 || settings.RejectedPercent < 0 || settings.FailedFiles < 0 {
+		return invalid("the notify thresholds cannot be negative")
+	}
+	for i, hook := range settings.Webhooks {
+		name := hook.Name
+		if name == "" {
+			name = fmt.Sprintf("%d", i+1)
+		}
+		if u, err := url.Parse(hook.URL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return invalid(fmt.Sprintf("webhook %s needs an http or https url", name))
+		}
+		switch hook.Format {
+		case "", FormatJSON, FormatSlack:
+		default:
+			return invalid(fmt.Sprintf("webhook %s: unknown format %q, use json or slack", name, hook.Format))
+		}
+		if (hook.Retries != nil && *hook.Retries < 0) || hook.TimeoutSeconds < 0 {
+			return invalid(fmt.Sprintf("webhook %s: retries and timeout_seconds cannot be negative", name))
+		}
+	}
+	email := settings.Email
+	if !email.Enabled {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(email.Addr); err != nil {
+		return invalid(fmt.Sprintf("the notify email needs the smtp server as host:port, not %q", email.Addr))
+	}
+	switch email.TLS {
+	case "", TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		return invalid(fmt.Sprintf("unknown email tls %q, use starttls, tls or none", email.TLS))
+	}
+	if email.From == "" || len(email.To) == 0 {
+		return invalid("the notify email needs a from address and at least one to address")
+	}
+	return nil
+}
+
+// Send posts the notification to every webhook and mails it, a failed channel does not stop the others.
+// The errors of the channels are returned joined.
+func Send(ctx context.Context, settings model.NotifySettings, n Notification) error {
+	if err := Validate(settings); err != nil {
+		return err
+	}
+	var errs []error
+	for _, hook := range settings.Webhooks {
+		if err := postWebhook(ctx, hook, n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if settings.Email.Enabled {
+		if err := sendEmail(ctx, settings.Email, n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run notifies the outcome of a finished run when the settings ask for one of its events. A notification
+// that cannot be sent is logged, it does not change the outcome of the run.
+func Run(ctx context.Context, settings model.NotifySettings, run model.ImportRun, rejects Rejects) {
+	if !settings.Enabled {
+		return
+	}
+	events := Events(settings, run)
+	if len(events) == 0 {
+		return
+	}
+	log := li.FromContext(ctx).WithFields(logrus.Fields{"events": strings.Join(events, ",")})
+	if err := Send(ctx, settings, Notification{Run: run, Events: events, Rejects: rejects}); err != nil {
+		log.WithFields(apperr.Fields(err)).WithField("err", err).Error("could not send the notification of the run")
+		return
+	}
+	log.Info("notification of the run sent")
+}
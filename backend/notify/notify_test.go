@@ -0,0 +1,259 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+func init() {
+	retryWait = time.Millisecond
+}
+
+// failedRun is a run that rejected rows and failed a file
+func failedRun() Notification {
+	started := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	finished := started.Add(90 * time.Second)
+	n := Notification{
+		Run: model.ImportRun{ID: "run-1", Status: model.RunFailed, Host: "loader1", StartedAt: started, FinishedAt: &finished,
+			FilesFound: 2, FilesImported: 1, FilesFailed: 1, RowsParsed: 8, RowsRejected: 2, RowsInserted: 8,
+			Error: "1 of 2 files failed to import"},
+		Events: []string{EventFailed, EventThreshold},
+	}
+	n.Rejects.Add(Reject{File: "a.csv", Line: 3, Reason: "invalid_time", Code: "PARSE_TIME", Detail: "bad time"})
+	n.Rejects.Add(Reject{File: "a.csv", Line: 7, Reason: "short_line", Code: "PARSE_SHORT_LINE", Detail: "4 fields"})
+	return n
+}
+
+func TestEvents(t *testing.T) {
+	settings := model.NotifySettings{RejectedPercent: 10, FailedFiles: 1}
+	tests := []struct {
+		name string
+		run  model.ImportRun
+		want string
+	}{
+		{"clean", model.ImportRun{Status: model.RunSucceeded, RowsParsed: 100}, ""},
+		{"few rejects", model.ImportRun{Status: model.RunSucceeded, RowsParsed: 95, RowsRejected: 5}, ""},
+		{"many rejects", model.ImportRun{Status: model.RunSucceeded, RowsParsed: 90, RowsRejected: 10}, "threshold"},
+		{"failed", model.ImportRun{Status: model.RunFailed}, "failed"},
+		{"failed file", model.ImportRun{Status: model.RunFailed, FilesFailed: 1}, "failed,threshold"},
+		{"cancelled", model.ImportRun{Status: model.RunCancelled}, ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(Events(settings, tt.run), ","); got != tt.want {
+			t.Errorf("%s: events %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookSignedAndRetried(t *testing.T) {
+	t.Setenv("NOTIFY_WEBHOOK_SECRET", "hook-key")
+	var tries int
+	var payload webhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		if tries < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if want := Sign([]byte("hook-key"), r.Header.Get(HeaderTimestamp), body); r.Header.Get(HeaderSignature) != want {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		json.Unmarshal(body, &payload)
+	}))
+	defer server.Close()
+	settings := model.NotifySettings{Webhooks: []model.WebhookSettings{{Name: "ops", URL: server.URL, Secret: "NOTIFY_WEBHOOK_SECRET"}}}
+
+	if err := Send(context.Background(), settings, failedRun()); err != nil {
+		t.Fatal(err)
+	}
+	if tries != 3 {
+		t.Errorf("posted %d times, want 3", tries)
+	}
+	if payload.Event != EventFailed || payload.Run.ID != "run-1" || payload.RejectsByReason["invalid_time"] != 1 {
+		t.Errorf("payload %+v", payload)
+	}
+}
+
+func TestWebhookGivesUpOnRefusal(t *testing.T) {
+	var tries int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		http.Error(w, "no such hook", http.StatusNotFound)
+	}))
+	defer server.Close()
+	settings := model.NotifySettings{Webhooks: []model.WebhookSettings{{Name: "ops", URL: server.URL}}}
+
+	if err := Send(context.Background(), settings, failedRun()); !errors.Is(err, apperr.ErrNotifySend) {
+		t.Errorf("a refused post gave %v, want NOTIFY_SEND", err)
+	}
+	if tries != 1 {
+		t.Errorf("a refused post was tried %d times", tries)
+	}
+}
+
+func TestWebhookWithoutRetries(t *testing.T) {
+	var tries int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	none := 0
+	settings := model.NotifySettings{Webhooks: []model.WebhookSettings{{Name: "ops", URL: server.URL, Retries: &none}}}
+
+	if err := Send(context.Background(), settings, failedRun()); !errors.Is(err, apperr.ErrNotifySend) {
+		t.Errorf("a failed post gave %v, want NOTIFY_SEND", err)
+	}
+	if tries != 1 {
+		t.Errorf("posted %d times with retries 0, want 1", tries)
+	}
+}
+
+func TestSlackMessage(t *testing.T) {
+	var msg slackPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&msg)
+	}))
+	defer server.Close()
+	settings := model.NotifySettings{Webhooks: []model.WebhookSettings{{URL: server.URL, Format: FormatSlack}}}
+
+	if err := Send(context.Background(), settings, failedRun()); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != "rmsloader import failed on loader1" || len(msg.Attachments) != 1 || msg.Attachments[0].Color != "danger" {
+		t.Errorf("message %+v", msg)
+	}
+}
+
+// smtpStub stands in for an smtp server, it accepts one mail and hands its message to got
+func smtpStub(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 stub ready")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply("250-stub")
+				reply("250 8BITMIME")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				got <- data.String()
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func TestEmailAttachesRejects(t *testing.T) {
+	addr, got := smtpStub(t)
+	settings := model.NotifySettings{Email: model.EmailSettings{Enabled: true, Addr: addr, From: "loader@example.com",
+		To: []string{"ops@example.com"}, AttachRejects: true}}
+
+	if err := Send(context.Background(), settings, failedRun()); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(<-got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject := msg.Header.Get("Subject"); subject != "rmsloader import failed on loader1" {
+		t.Errorf("subject %q", subject)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	text, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, _ := io.ReadAll(text)
+	if !strings.Contains(string(summary), "rejected: invalid_time 1, short_line 1") {
+		t.Errorf("summary %q", summary)
+	}
+	attachment, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.FileName() != "rejects-run-1.csv" {
+		t.Errorf("attachment named %q", attachment.FileName())
+	}
+	data, _ := io.ReadAll(base64.NewDecoder(base64.StdEncoding, attachment))
+	want := "file,line,reason,code,detail\na.csv,3,invalid_time,PARSE_TIME,bad time\na.csv,7,short_line,PARSE_SHORT_LINE,4 fields\n"
+	if string(data) != want {
+		t.Errorf("attachment %q, want %q", data, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings model.NotifySettings
+		ok       bool
+	}{
+		{"webhook", model.NotifySettings{Webhooks: []model.WebhookSettings{{URL: "https://hooks.example.com/x", Format: FormatSlack}}}, true},
+		{"unknown event", model.NotifySettings{Events: []string{"finished"}}, false},
+		{"no url", model.NotifySettings{Webhooks: []model.WebhookSettings{{Name: "ops"}}}, false},
+		{"unknown format", model.NotifySettings{Webhooks: []model.WebhookSettings{{URL: "https://hooks.example.com/x", Format: "xml"}}}, false},
+		{"no recipients", model.NotifySettings{Email: model.EmailSettings{Enabled: true, Addr: "smtp:25", From: "a@b"}}, false},
+		{"no port", model.NotifySettings{Email: model.EmailSettings{Enabled: true, Addr: "smtp", From: "a@b", To: []string{"c@d"}}}, false},
+	}
+	for _, tt := range tests {
+		if err := Validate(tt.settings); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/secrets"
+)
+
+// the headers of a json webhook post
+const (
+	HeaderEvent     = "X-Rmsloader-Event"
+	HeaderTimestamp = "X-Rmsloader-Timestamp"
+	HeaderSignature = "X-Rmsloader-Signature"
+)
+
+// the defaults of the webhook settings
+const (
+	defaultRetries        = 3
+	defaultWebhookTimeout = 10 * time.Second
+)
+
+// retryWait is the wait before the first retry of a post, it doubles with every retry
+var retryWait = time.Second
+
+// webhookPayload is the body of a json webhook post
+type webhookPayload struct {
+	Event           string          `json:"event"`
+	Events          []string        `json:"events"`
+	Summary         string          `json:"summary"`
+	Run             model.ImportRun `json:"run"`
+	RejectsByReason map[string]int  `json:"rejects_by_reason,omitempty"`
+}
+
+// slackPayload is a message for a Slack incoming webhook, Mattermost and Rocket.Chat accept it too
+type slackPayload struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Text   string       `json:"text"`
+	Fields []slackField `json:"fields,omitempty"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// Sign returns the signature of a json webhook post, sha256= and the hex HMAC-SHA256 of the timestamp, a dot
+// and the body. A receiver checks it with the same key and rejects old timestamps to stop replays.
+func Sign(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook posts the notification to hook, retrying a post the server failed or could not be reached for
+func postWebhook(ctx context.Context, hook model.WebhookSettings, n Notification) error {
+	op := "notify.postWebhook " + hook.Name
+	body, err := webhookBody(hook, n)
+	if err != nil {
+		return apperr.Wrap(apperr.Internal, op, err)
+	}
+	var key []byte
+	if hook.Format != FormatSlack && hook.Secret != "" {
+		secret, err := secrets.Get(hook.Secret)
+		if err != nil {
+			return err
+		}
+		key = []byte(secret)
+	}
+	retries := defaultRetries
+	if hook.Retries != nil {
+		retries = *hook.Retries
+	}
+	timeout := defaultWebhookTimeout
+	if hook.TimeoutSeconds > 0 {
+		timeout = time.Duration(hook.TimeoutSeconds) * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	log := li.FromContext(ctx).WithFields(logrus.Fields{"webhook": hook.Name})
+	wait := retryWait
+	for try := 0; ; try++ {
+		retry, err := post(ctx, client, hook.URL, body, key, n.Event())
+		if err == nil {
+			return nil
+		}
+		if !retry || try == retries {
+			return apperr.Wrap(apperr.NotifySend, op, err)
+		}
+		log.WithFields(logrus.Fields{"try": try + 1, "err": err}).Warn("webhook post failed, it is retried")
+		select {
+		case <-ctx.Done():
+			return apperr.Wrap(apperr.NotifySend, op, ctx.Err())
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// post sends one webhook request, it tells whether a failed post is worth retrying
+func post(ctx context.Context, client *http.Client, url string, body []byte, key []byte, event string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "rmsloader/"+model.Version)
+	req.Header.Set(HeaderEvent, event)
+	if key != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(HeaderTimestamp, timestamp)
+		req.Header.Set(HeaderSignature, Sign(key, timestamp, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("the webhook answered %s", resp.Status)
+}
+
+// webhookBody is the json of the notification in the format of hook
+func webhookBody(hook model.WebhookSettings, n Notification) ([]byte, error) {
+	if hook.Format == FormatSlack {
+		return json.Marshal(slackMessage(n))
+	}
+	return json.Marshal(webhookPayload{
+		Event:           n.Event(),
+		Events:          n.Events,
+		Summary:         n.Summary(),
+		Run:             n.Run,
+		RejectsByReason: n.Rejects.ByReason,
+	})
+}
+
+// slackMessage is the notification as a Slack message, red for a failed run and amber for a crossed threshold
+func slackMessage(n Notification) slackPayload {
+	run := n.Run
+	color := "good"
+	switch {
+	case run.Status == model.RunFailed:
+		color = "danger"
+	case run.Status == model.RunCancelled || slices.Contains(n.Events, EventThreshold):
+		color = "warning"
+	}
+	fields := []slackField{
+		{Title: "Files", Value: fmt.Sprintf("%d imported, %d failed of %d", run.FilesImported, run.FilesFailed, run.FilesFound), Short: true},
+		{Title: "Rows", Value: fmt.Sprintf("%d inserted, %d rejected", run.RowsInserted, run.RowsRejected), Short: true},
+	}
+	if reasons := n.reasons(); reasons != "" {
+		fields = append(fields, slackField{Title: "Rejected", Value: reasons})
+	}
+	if run.Error != "" {
+		fields = append(fields, slackField{Title: "Error", Value: run.Error})
+	}
+	return slackPayload{
+		Text: n.Subject(),
+		Attachments: []slackAttachment{{
+			Color:  color,
+			Text:   "run " + run.ID,
+			Fields: fields,
+		}},
+	}
+}
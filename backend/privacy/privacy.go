@@ -0,0 +1,193 @@
+// Package privacy protects the phone numbers in the source and destination of a CDR: it masks them in logs
+// and exports and replaces them with a keyed hash before they are stored when pseudonymisation is on
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/secrets"
+)
+
+// the defaults of the privacy settings
+const (
+	defaultKeepDigits = 3
+	defaultMinDigits  = 6
+	defaultKeyEnv     = "RMSLOADER_PSEUDONYM_KEY"
+)
+
+// PseudonymPrefix marks a stored number as a keyed hash
+const PseudonymPrefix = "p:"
+
+// Erased replaces the number of an anonymised subject
+const Erased = "erased"
+
+// the columns of a csv line holding numbers
+const (
+	sourceField      = 3
+	destinationField = 4
+)
+
+// MaskWith replaces all but the last keep digits of number with *, numbers with fewer than minDigits digits
+// are extensions and are returned as they are. Other characters, like a leading +, are kept.
+func MaskWith(number string, keep int, minDigits int) string {
+	digits := countDigits(number)
+	if digits < minDigits || strings.HasPrefix(number, PseudonymPrefix) {
+		return number
+	}
+	var b strings.Builder
+	seen := 0
+	for _, r := range number {
+		if unicode.IsDigit(r) {
+			seen++
+			if seen <= digits-keep {
+				r = '*'
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Mask masks number with the configured digits
+func Mask(number string) string {
+	return MaskWith(number, keepDigits(), minDigits())
+}
+
+// MaskCDR returns the CDR with its numbers masked
+func MaskCDR(cdr model.RMSCDR) model.RMSCDR {
+	cdr.Source = Mask(cdr.Source)
+	cdr.Destination = Mask(cdr.Destination)
+	return cdr
+}
+
+// LineForLog returns a copy of a csv line of an RMS export with the numbers masked when the logs are masked
+func LineForLog(line []string) []string {
+	if !model.Settings.Privacy.MaskLogs {
+		return line
+	}
+	masked := append([]string(nil), line...)
+	for _, i := range []int{sourceField, destinationField} {
+		if i < len(masked) {
+			masked[i] = Mask(masked[i])
+		}
+	}
+	return masked
+}
+
+// CDRsForLog returns a copy of the CDRs with the numbers masked when the logs are masked
+func CDRsForLog(cdrs []model.RMSCDR) []model.RMSCDR {
+	if !model.Settings.Privacy.MaskLogs {
+		return cdrs
+	}
+	masked := make([]model.RMSCDR, len(cdrs))
+	for i, cdr := range cdrs {
+		masked[i] = MaskCDR(cdr)
+	}
+	return masked
+}
+
+// Key returns the key of the pseudonyms from the configured secret
+func Key() ([]byte, error) {
+	name := model.Settings.Privacy.KeyEnv
+	if name == "" {
+		name = defaultKeyEnv
+	}
+	key, err := secrets.GetOr(name, "")
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, apperr.New(apperr.ConfigInvalid, "privacy.Key", name+" holds no pseudonymisation key")
+	}
+	return []byte(key), nil
+}
+
+// Pseudonym returns the keyed hash stored in place of number. The same number and key always give the same
+// pseudonym so calls can still be counted per number. Extensions are returned as they are.
+func Pseudonym(key []byte, number string) string {
+	if number == "" || strings.HasPrefix(number, PseudonymPrefix) || countDigits(number) < minDigits() {
+		return number
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(number))
+	return PseudonymPrefix + hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Pseudonymise replaces the numbers of the CDRs with their pseudonyms when pseudonymisation is on
+func Pseudonymise(cdrs []model.RMSCDR) error {
+	if !model.Settings.Privacy.Pseudonymise {
+		return nil
+	}
+	key, err := Key()
+	if err != nil {
+		return err
+	}
+	for i := range cdrs {
+		cdrs[i].Source = Pseudonym(key, cdrs[i].Source)
+		cdrs[i].Destination = Pseudonym(key, cdrs[i].Destination)
+	}
+	return nil
+}
+
+// Candidates returns the values a number of a subject may be stored as: the number the way the import
+// stores it and its pseudonym when a key is set
+func Candidates(number string) []string {
+	n := Normalise(number)
+	if n == "" {
+		return nil
+	}
+	values := []string{n}
+	if n != number {
+		values = append(values, number)
+	}
+	if key, err := Key(); err == nil {
+		values = append(values, Pseudonym(key, n))
+	}
+	return values
+}
+
+// Normalise removes spaces, dashes and brackets from a number and adds the leading zero RMS drops
+// from nine digit numbers, like the import does
+func Normalise(number string) string {
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(number) {
+		if unicode.IsDigit(r) || (r == '+' && b.Len() == 0) {
+			b.WriteRune(r)
+		}
+	}
+	n := b.String()
+	if len(n) == 9 {
+		n = "0" + n
+	}
+	return n
+}
+
+func countDigits(s string) int {
+	n := 0
+	for _, r := range s {
+		if unicode.IsDigit(r) {
+			n++
+		}
+	}
+	return n
+}
+
+func keepDigits() int {
+	if k := model.Settings.Privacy.KeepDigits; k > 0 {
+		return k
+	}
+	return defaultKeepDigits
+}
+
+func minDigits() int {
+	if m := model.Settings.Privacy.MinDigits; m > 0 {
+		return m
+	}
+	return defaultMinDigits
+}
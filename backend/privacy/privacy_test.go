@@ -0,0 +1,100 @@
+package privacy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+func TestMaskWith(t *testing.T) {
+	tests := []struct {
+		name      string
+		number    string
+		keep      int
+		minDigits int
+		want      string
+	}{
+		{"national", "0821234567", 3, 6, "*******567"},
+		{"international", "+27821234567", 3, 6, "+********567"},
+		{"nine digits", "821234567", 3, 6, "******567"},
+		{"formatting kept", "082 123-4567", 4, 6, "*** ***-4567"},
+		{"keep all digits", "0821234567", 10, 6, "0821234567"},
+		{"keep more than the digits", "0821234567", 12, 6, "0821234567"},
+		{"keep none", "0821234567", 0, 6, "**********"},
+		{"extension", "2001", 3, 6, "2001"},
+		{"one digit short", "12345", 3, 6, "12345"},
+		{"at min digits", "123456", 3, 6, "***456"},
+		{"pseudonym", "p:0123456789abcdef0123456789abcdef", 3, 6, "p:0123456789abcdef0123456789abcdef"},
+		{"empty", "", 3, 6, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MaskWith(tt.number, tt.keep, tt.minDigits); got != tt.want {
+				t.Errorf("MaskWith(%q, %d, %d) = %q, want %q", tt.number, tt.keep, tt.minDigits, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalise(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{"0821234567", "0821234567"},
+		{"821234567", "0821234567"},
+		{" 082 123-4567 ", "0821234567"},
+		{"(082) 123 4567", "0821234567"},
+		{"+27 82 123 4567", "+27821234567"},
+		{"082+1234567", "0821234567"},
+		{"2001", "2001"},
+		{"no digits", ""},
+	}
+	for _, tt := range tests {
+		if got := Normalise(tt.number); got != tt.want {
+			t.Errorf("Normalise(%q) = %q, want %q", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestPseudonym(t *testing.T) {
+	key := []byte("test key")
+	p := Pseudonym(key, "0821234567")
+	if !strings.HasPrefix(p, PseudonymPrefix) || len(p) != len(PseudonymPrefix)+32 {
+		t.Fatalf("Pseudonym = %q, want %s and 32 hex digits", p, PseudonymPrefix)
+	}
+	if again := Pseudonym(key, "0821234567"); again != p {
+		t.Errorf("the same number gave %q and %q", p, again)
+	}
+	if other := Pseudonym(key, "0821234568"); other == p {
+		t.Errorf("two numbers share the pseudonym %q", p)
+	}
+	if other := Pseudonym([]byte("other key"), "0821234567"); other == p {
+		t.Errorf("two keys give the same pseudonym %q", p)
+	}
+	for _, number := range []string{"", "2001", p} {
+		if got := Pseudonym(key, number); got != number {
+			t.Errorf("Pseudonym(%q) = %q, want it unchanged", number, got)
+		}
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	saved := model.Settings
+	t.Cleanup(func() { model.Settings = saved })
+	model.Settings.Privacy.KeyEnv = "RMSLOADER_TEST_PSEUDONYM_KEY"
+
+	t.Setenv("RMSLOADER_TEST_PSEUDONYM_KEY", "")
+	if got := Candidates("82 123 4567"); len(got) != 2 || got[0] != "0821234567" || got[1] != "82 123 4567" {
+		t.Errorf("without a key Candidates = %q", got)
+	}
+	t.Setenv("RMSLOADER_TEST_PSEUDONYM_KEY", "test key")
+	got := Candidates("0821234567")
+	if len(got) != 2 || got[1] != Pseudonym([]byte("test key"), "0821234567") {
+		t.Errorf("with a key Candidates = %q", got)
+	}
+	if got := Candidates("none"); got != nil {
+		t.Errorf("Candidates without digits = %q", got)
+	}
+}
@@ -0,0 +1,104 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/wav"
+	"github.com/sirupsen/logrus"
+)
+
+// the default allowed difference between the csv duration and the audio length
+const defaultDurationTolerance = 2.0
+
+// RecordingPath finds the recording named in a CDR under the recordings folder
+func RecordingPath(fileName string) (string, error) {
+	if fileName == "" {
+		return "", fs.ErrNotExist
+	}
+	base := model.RecordingsPath()
+	// the file name may carry the sub folders of the recorder or only the name
+	candidates := []string{filepath.Join(base, fileName), filepath.Join(base, filepath.Base(fileName))}
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err == nil && info.Mode().IsRegular() {
+			return candidate, nil
+		}
+	}
+	return "", fs.ErrNotExist
+}
+
+// inspectRecording reads the wav header of the recording linked to the cdr and flags a duration mismatch.
+// Mismatches are written to the analysis log f.
+func inspectRecording(cdr *model.RMSCDR, f *li.RotatingFile) error {
+	CallFrom := "inspectRecording "
+	path, err := RecordingPath(cdr.FileName)
+	if err != nil {
+		return err
+	}
+	info, err := wav.ReadFile(path)
+	if err != nil {
+		li.Logger.ErrReadFilesMessage(CallFrom, path, err)
+		return err
+	}
+	tolerance := model.Settings.Audio.ToleranceSeconds
+	if tolerance <= 0 {
+		tolerance = defaultDurationTolerance
+	}
+	delta := float64(cdr.Duration) - info.Duration.Seconds()
+	cdr.Audio = &model.AudioInfo{
+		UID:              cdr.UID,
+		FileName:         cdr.FileName,
+		Codec:            info.Codec,
+		SampleRate:       int64(info.SampleRate),
+		Channels:         int64(info.Channels),
+		BitsPerSample:    int64(info.BitsPerSample),
+		AudioDurationMs:  info.Duration.Milliseconds(),
+		DurationDelta:    math.Round(delta*1000) / 1000,
+		DurationMismatch: math.Abs(delta) > tolerance,
+	}
+	if cdr.Audio.DurationMismatch {
+		li.Logger.L.WithFields(logrus.Fields{
+			"CallFrom":       CallFrom,
+			"uid":            cdr.UID,
+			"file":           cdr.FileName,
+			"csv_duration":   cdr.Duration,
+			"audio_duration": info.Duration.Round(time.Millisecond).String(),
+		}).Warn("csv duration disagrees with the recording")
+		if f != nil {
+			msg := fmt.Sprintf("Called from: %s, Duration mismatch for %s: csv %ds, audio %s\n", CallFrom, cdr.FileName, cdr.Duration, info.Duration.Round(time.Millisecond))
+			if _, err := f.WriteString(msg); err != nil {
+				li.Logger.ErrWriteFilesMessage(CallFrom, msg, err)
+			}
+		}
+	}
+	return nil
+}
+
+// inspectRecordings inspects the recordings of a batch and returns the audio details found
+func inspectRecordings(batch []model.RMSCDR, f *li.RotatingFile) []model.AudioInfo {
+	CallFrom := "inspectRecordings "
+	var audio []model.AudioInfo
+	for i := range batch {
+		err := inspectRecording(&batch[i], f)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				li.Logger.L.WithFields(logrus.Fields{
+					"CallFrom": CallFrom,
+					"file":     batch[i].FileName,
+					"err":      err,
+				}).Warn("could not inspect recording")
+			}
+			continue
+		}
+		audio = append(audio, *batch[i].Audio)
+	}
+	return audio
+}
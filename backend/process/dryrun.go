@@ -0,0 +1,197 @@
+package process
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/source"
+	"github.com/sirupsen/logrus"
+)
+
+// the reasons a csv row is rejected
+const (
+	RejectMalformed = "malformed_csv"
+	RejectShortLine = "short_line"
+	RejectTime      = "invalid_time"
+	RejectDuration  = "invalid_duration"
+	RejectSize      = "invalid_size"
+	RejectFile      = "unreadable_file"
+)
+
+// rejectCodes are the error codes of the reject reasons
+var rejectCodes = map[string]apperr.Code{
+	RejectMalformed: apperr.ParseCSV,
+	RejectShortLine: apperr.ParseShortLine,
+	RejectTime:      apperr.ParseTime,
+	RejectDuration:  apperr.ParseDuration,
+	RejectSize:      apperr.ParseSize,
+	RejectFile:      apperr.IORead,
+}
+
+// Options controls an import run
+type Options struct {
+	// only parse and validate the csv files, nothing is written to the database
+	DryRun bool
+	// the file the dry-run report is written to as json, none when empty
+	ReportPath string
+	// where the csv files are read from, the folder given to Process when nil
+	Source source.Source
+}
+
+// Reject is a csv row that could not be imported
+type Reject struct {
+	Line   int         `json:"line"`
+	Reason string      `json:"reason"`
+	Code   apperr.Code `json:"code"`
+	Detail string      `json:"detail"`
+}
+
+// FileStats holds the counts of one csv file
+type FileStats struct {
+	File string `json:"file"`
+	// the rows parsed into CDRs
+	Rows int `json:"rows"`
+	// the numbers that needed a leading zero
+	PrefixFixed int      `json:"prefix_fixed"`
+	Rejected    []Reject `json:"rejected,omitempty"`
+}
+
+// Duplicate is a natural key found more than once in the files of a run
+type Duplicate struct {
+	Key   string   `json:"key"`
+	Count int      `json:"count"`
+	Files []string `json:"files"`
+}
+
+// ValidationReport describes what an import of the csv files would do
+type ValidationReport struct {
+	FilesFound   int            `json:"files_found"`
+	RowsParsed   int            `json:"rows_parsed"`
+	RowsRejected int            `json:"rows_rejected"`
+	Rejects      map[string]int `json:"rejects_by_reason"`
+	Duplicates   []Duplicate    `json:"duplicates"`
+	PrefixFixed  int            `json:"prefix_fixed"`
+	// the range of call times covered, in RMS time
+	First time.Time   `json:"first"`
+	Last  time.Time   `json:"last"`
+	Files []FileStats `json:"files"`
+}
+
+// OK reports whether every row of every file can be imported
+func (r *ValidationReport) OK() bool {
+	return r.RowsRejected == 0 && len(r.Duplicates) == 0
+}
+
+// Validate parses every csv file in path without touching the database and reports the rows that would be rejected
+func Validate(path string, f *li.RotatingFile, fExt string) (*ValidationReport, error) {
+	CallFrom := "Validate "
+	files, err := ListCSVFiles(path, f, fExt)
+	if err != nil {
+		return nil, err
+	}
+	report := &ValidationReport{FilesFound: len(files), Rejects: make(map[string]int)}
+	seen := make(map[string]*Duplicate)
+	var keys []string
+	for _, file := range files {
+		cdrs, stats, err := readCSV(file, true)
+		if err != nil {
+			// the file could not be read at all, the rows read so far are dropped
+			stats.Rows = 0
+			stats.Rejected = append(stats.Rejected, Reject{Reason: RejectFile, Code: rejectCodes[RejectFile], Detail: err.Error()})
+			cdrs = nil
+		}
+		report.Files = append(report.Files, *stats)
+		report.RowsParsed += stats.Rows
+		report.PrefixFixed += stats.PrefixFixed
+		for _, r := range stats.Rejected {
+			report.RowsRejected++
+			report.Rejects[r.Reason]++
+		}
+		for _, cdr := range cdrs {
+			if report.First.IsZero() || cdr.Time.Before(report.First) {
+				report.First = cdr.Time
+			}
+			if cdr.Time.After(report.Last) {
+				report.Last = cdr.Time
+			}
+			key := cdr.NaturalKey()
+			d, ok := seen[key]
+			if !ok {
+				d = &Duplicate{Key: key}
+				seen[key] = d
+				keys = append(keys, key)
+			}
+			d.Count++
+			if len(d.Files) == 0 || d.Files[len(d.Files)-1] != file {
+				d.Files = append(d.Files, file)
+			}
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if d := seen[key]; d.Count > 1 {
+			report.Duplicates = append(report.Duplicates, *d)
+		}
+	}
+	li.Logger.L.WithFields(logrus.Fields{
+		"CallFrom":   CallFrom,
+		"files":      report.FilesFound,
+		"rows":       report.RowsParsed,
+		"rejected":   report.RowsRejected,
+		"duplicates": len(report.Duplicates),
+	}).Info("csv files validated")
+	return report, nil
+}
+
+// Print writes the report in a readable form
+func (r *ValidationReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "Files found: %d\n", r.FilesFound)
+	fmt.Fprintf(w, "Rows parsed: %d\n", r.RowsParsed)
+	fmt.Fprintf(w, "Rows rejected: %d\n", r.RowsRejected)
+	var reasons []string
+	for reason := range r.Rejects {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  %s: %d\n", reason, r.Rejects[reason])
+	}
+	fmt.Fprintf(w, "Duplicate keys: %d\n", len(r.Duplicates))
+	for _, d := range r.Duplicates {
+		fmt.Fprintf(w, "  %s x%d in %v\n", d.Key, d.Count, d.Files)
+	}
+	if r.RowsParsed > 0 {
+		fmt.Fprintf(w, "Date range: %s to %s\n", r.First.Format("2006-01-02 15:04:05"), r.Last.Format("2006-01-02 15:04:05"))
+	}
+	fmt.Fprintf(w, "Numbers prefix fixed: %d\n", r.PrefixFixed)
+	for _, file := range r.Files {
+		if len(file.Rejected) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s:\n", filepath.Base(file.File))
+		for _, reject := range file.Rejected {
+			fmt.Fprintf(w, "  line %d %s: %s\n", reject.Line, reject.Reason, reject.Detail)
+		}
+	}
+}
+
+// writeReport writes the report as json to path
+func writeReport(report *ValidationReport, path string) error {
+	CallFrom := "writeReport "
+	out, err := os.Create(path)
+	if err != nil {
+		li.Logger.ErrOpenFilesMessage(CallFrom, path, err)
+		return err
+	}
+	if err := ToJSON(report, out); err != nil {
+		out.Close()
+		return fmt.Errorf("writing report %s: %w", path, err)
+	}
+	return out.Close()
+}
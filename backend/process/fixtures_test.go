@@ -0,0 +1,84 @@
+package process
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/fixtures"
+)
+
+func TestReadGeneratedFixtures(t *testing.T) {
+	opts := fixtures.Options{
+		Dir:          t.TempDir(),
+		Rows:         500,
+		Files:        2,
+		From:         time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		To:           time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC),
+		Extensions:   []string{"2001", "2002", "2003"},
+		ShortLines:   0.02,
+		BadTimes:     0.02,
+		NineDigits:   0.05,
+		OddDurations: 0.05,
+		Seed:         42,
+	}
+	report, err := fixtures.Generate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 2 || report.Rows != 1000 {
+		t.Fatalf("wrote %d rows to %d files, want 1000 to 2", report.Rows, len(report.Files))
+	}
+
+	var rows, short, badTime, prefixed int
+	for _, file := range report.Files {
+		cdrs, stats, err := readCSV(file, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows += len(cdrs)
+		prefixed += stats.PrefixFixed
+		for _, r := range stats.Rejected {
+			switch r.Reason {
+			case RejectShortLine:
+				short++
+			case RejectTime:
+				badTime++
+			default:
+				t.Errorf("%s: unexpected reject %+v", file, r)
+			}
+		}
+		for _, cdr := range cdrs {
+			if cdr.Time.Before(opts.From) || !cdr.Time.Before(opts.To) {
+				t.Errorf("call %s at %v is outside the date range", cdr.SipCallID, cdr.Time)
+			}
+		}
+	}
+	d := report.Defects
+	if short != d[fixtures.DefectShortLine] || badTime != d[fixtures.DefectBadTime] || prefixed != d[fixtures.DefectNineDigit] {
+		t.Errorf("read %d short lines, %d bad times, %d prefixes fixed, the report has %v", short, badTime, prefixed, d)
+	}
+	if rows != report.Rows-short-badTime {
+		t.Errorf("read %d rows, want %d", rows, report.Rows-short-badTime)
+	}
+	if d[fixtures.DefectOddDuration] == 0 || d[fixtures.DefectNineDigit] == 0 {
+		t.Errorf("defects %v, want every kind injected", d)
+	}
+
+	// the same seed writes the same files
+	again := opts
+	again.Dir = t.TempDir()
+	second, err := fixtures.Generate(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := os.ReadFile(report.Files[0])
+	repeat, _ := os.ReadFile(second.Files[0])
+	if !bytes.Equal(first, repeat) {
+		t.Error("the same seed wrote different files")
+	}
+	if !bytes.HasPrefix(first, []byte{0xEF, 0xBB, 0xBF}) {
+		t.Error("the file does not start with a byte order mark")
+	}
+}
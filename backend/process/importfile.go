@@ -0,0 +1,239 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/integrity"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/metrics"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/notify"
+	"github.com/pienaahj/rmsloader/backend/privacy"
+	"github.com/pienaahj/rmsloader/backend/report"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// importBatch holds the rows of one insert statement and the details read from their recordings
+type importBatch struct {
+	cdrs   []model.RMSCDR
+	audio  []model.AudioInfo
+	hashes []model.RecordingHash
+}
+
+// importFile loads one csv file in units committed together with its import ledger entry.
+// A file whose content was loaded before is skipped, a failed file resumes after its last committed unit.
+// The rows the file rejects are added to rejects.
+func importFile(ctx context.Context, repo dbs.CDRRepository, run *model.ImportRun, file string, analysisLog *li.RotatingFile, days map[time.Time]bool, rejects *notify.Rejects) (int64, error) {
+	CallFrom := "importFile "
+	log := li.FromContext(ctx).WithField("file", filepath.Base(file))
+	sum, size, err := integrity.HashFile(file)
+	if err != nil {
+		li.Logger.ErrReadFilesMessage(CallFrom, file, err)
+		return 0, fmt.Errorf("hashing %s: %w", file, err)
+	}
+	entry, err := repo.GetImportFile(ctx, sum)
+	if err != nil {
+		return 0, err
+	}
+	if entry != nil && entry.Status == model.ImportLoaded {
+		log.Info(CallFrom, "file already imported, skipping: ", file)
+		metrics.Files.WithLabelValues(metrics.FileSkipped).Inc()
+		run.FilesSkipped++
+		return 0, nil
+	}
+	if entry == nil {
+		entry = &model.ImportFile{SHA256: sum, Size: size}
+	}
+	cdrs, stats, readErr := readCSV(file, false)
+	metrics.Rows.WithLabelValues(metrics.RowParsed).Add(float64(len(cdrs)))
+	for _, r := range stats.Rejected {
+		metrics.RowsRejected.WithLabelValues(r.Reason).Inc()
+		rejects.Add(notify.Reject{File: filepath.Base(file), Line: r.Line, Reason: r.Reason, Code: string(r.Code), Detail: r.Detail})
+	}
+	run.RowsParsed += int64(len(cdrs))
+	run.RowsRejected += int64(len(stats.Rejected))
+	entry.FileName = filepath.Base(file)
+	entry.Rows = int64(len(cdrs))
+	if err := repo.StartImportFile(ctx, entry); err != nil {
+		return 0, err
+	}
+	if readErr != nil {
+		li.Logger.ErrReadFilesMessage(CallFrom, file, readErr)
+		return 0, failImport(ctx, repo, entry, readErr)
+	}
+	if err := privacy.Pseudonymise(cdrs); err != nil {
+		return 0, failImport(ctx, repo, entry, err)
+	}
+
+	unitSize := len(cdrs)
+	if model.Settings.Import.Unit == model.ImportUnitBatch {
+		unitSize = model.ImportBatchSize()
+	}
+	start := min(int(entry.RowsLoaded), len(cdrs))
+	if start > 0 {
+		log.Infof("%s resuming %s after %d loaded rows", CallFrom, file, start)
+	}
+	var total int64
+	for {
+		end := min(start+unitSize, len(cdrs))
+		count, err := importUnit(ctx, repo, entry, cdrs[start:end], analysisLog)
+		if err != nil {
+			return total, failImport(ctx, repo, entry, err)
+		}
+		total += count
+		report.Days(cdrs[start:end], days)
+		start = end
+		if start >= len(cdrs) {
+			break
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"CallFrom": CallFrom,
+		"rows":     total,
+	}).Info("file imported")
+	metrics.Files.WithLabelValues(metrics.FileProcessed).Inc()
+	run.FilesImported++
+	return total, nil
+}
+
+// importUnit inserts the rows of a unit and moves the ledger entry on in one transaction.
+// The recordings are read before the transaction is opened so it is held no longer than the inserts take.
+func importUnit(ctx context.Context, repo dbs.CDRRepository, entry *model.ImportFile, unit []model.RMSCDR, analysisLog *li.RotatingFile) (int64, error) {
+	CallFrom := "importUnit "
+	var batches []importBatch
+	batchSize := model.ImportBatchSize()
+	for start := 0; start < len(unit); start += batchSize {
+		b := importBatch{cdrs: unit[start:min(start+batchSize, len(unit))]}
+		if model.Settings.Audio.Inspect {
+			b.audio = inspectRecordings(b.cdrs, analysisLog)
+		}
+		if model.Settings.Integrity.HashRecordings {
+			b.hashes = integrity.HashRecordings(b.cdrs, RecordingPath)
+		}
+		batches = append(batches, b)
+	}
+
+	tx, err := repo.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var count int64
+	upsert := model.Settings.Import.Upsert
+	bulk := model.Settings.Import.BulkLoad && !upsert
+	if bulk {
+		timer := prometheus.NewTimer(metrics.BatchInsertSeconds.WithLabelValues("bulk"))
+		batches, count, err = bulkLoad(ctx, tx, unit, batches)
+		timer.ObserveDuration()
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, b := range batches {
+		// the rows whose stored state is linked into the hash chain
+		chained := b.cdrs
+		if !bulk {
+			// a call stored before is matched on its call_key, an insert skips it and an upsert updates it
+			var columns []string
+			label := "insert"
+			if upsert {
+				columns, label = model.UpsertColumns(), "upsert"
+			}
+			timer := prometheus.NewTimer(metrics.BatchInsertSeconds.WithLabelValues(label))
+			res, err := tx.UpsertCDRs(ctx, b.cdrs, columns, entry.ID)
+			timer.ObserveDuration()
+			if err != nil {
+				return 0, err
+			}
+			count += int64(len(res.Inserted) + len(res.Updated))
+			// a stored call keeps the recording details stored with it
+			b = b.only(res.Inserted)
+			chained = append(res.Inserted, res.Updated...)
+		}
+		if _, err := tx.InsertAudio(ctx, b.audio); err != nil {
+			return 0, err
+		}
+		if _, err := tx.InsertRecordingHashes(ctx, b.hashes); err != nil {
+			return 0, err
+		}
+		if model.Settings.Integrity.HashChain && len(chained) > 0 {
+			if err := integrity.AppendChain(ctx, tx, chained); err != nil {
+				return 0, err
+			}
+		}
+	}
+	next := *entry
+	next.RowsLoaded += int64(len(unit))
+	if err := tx.UpdateImportFile(ctx, &next); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		li.Logger.ErrDbCommitMessage(CallFrom, err)
+		return 0, err
+	}
+	*entry = next
+	metrics.Rows.WithLabelValues(metrics.RowInserted).Add(float64(count))
+	metrics.Rows.WithLabelValues(metrics.RowSkipped).Add(float64(int64(len(unit)) - count))
+	return count, nil
+}
+
+// bulkLoad loads the whole unit through the staging table, the batches keep only the rows that were
+// inserted so the details of duplicate calls are not stored twice
+func bulkLoad(ctx context.Context, tx dbs.CDRTx, unit []model.RMSCDR, batches []importBatch) ([]importBatch, int64, error) {
+	inserted, err := tx.BulkLoadCDRs(ctx, unit)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(inserted) == len(unit) {
+		return batches, int64(len(inserted)), nil
+	}
+	filtered := make([]importBatch, 0, len(batches))
+	for _, b := range batches {
+		if f := b.only(inserted); len(f.cdrs) > 0 {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered, int64(len(inserted)), nil
+}
+
+// only returns the batch with just the rows and details of the given calls
+func (b importBatch) only(cdrs []model.RMSCDR) importBatch {
+	keep := make(map[string]bool, len(cdrs))
+	for _, cdr := range cdrs {
+		keep[cdr.UID] = true
+	}
+	var f importBatch
+	for _, cdr := range b.cdrs {
+		if keep[cdr.UID] {
+			f.cdrs = append(f.cdrs, cdr)
+		}
+	}
+	for _, a := range b.audio {
+		if keep[a.UID] {
+			f.audio = append(f.audio, a)
+		}
+	}
+	for _, h := range b.hashes {
+		if keep[h.UID] {
+			f.hashes = append(f.hashes, h)
+		}
+	}
+	return f
+}
+
+// failImport records a failed file in the ledger and returns the cause, the entry is written
+// even when the import was interrupted
+func failImport(ctx context.Context, repo dbs.CDRRepository, entry *model.ImportFile, cause error) error {
+	if err := repo.FailImportFile(context.WithoutCancel(ctx), entry, cause); err != nil {
+		li.FromContext(ctx).WithFields(logrus.Fields{
+			"file": entry.FileName,
+			"err":  err,
+		}).Error("could not record the failed import")
+	}
+	return cause
+}
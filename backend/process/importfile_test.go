@@ -0,0 +1,626 @@
+package process
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/metrics"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/notify"
+	"github.com/pienaahj/rmsloader/backend/privacy"
+	"github.com/pienaahj/rmsloader/backend/source"
+)
+
+// fixtureDir copies the named files from testdata into a new folder, as names or as name=fixture
+func fixtureDir(t *testing.T, files ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, file := range files {
+		name, fixture, ok := strings.Cut(file, "=")
+		if !ok {
+			fixture = name
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// importSettings replaces the import settings for one test
+func importSettings(t *testing.T, settings model.ImportSettings) {
+	t.Helper()
+	saved := model.Settings
+	t.Cleanup(func() { model.Settings = saved })
+	model.Settings.Import = settings
+}
+
+// failOn fails the nth call of op with err, n counts from one
+func failOn(op string, n int, err error) func(string) error {
+	var calls int
+	return func(called string) error {
+		if called != op {
+			return nil
+		}
+		calls++
+		if calls == n {
+			return err
+		}
+		return nil
+	}
+}
+
+func TestProcessImportsFiles(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	model.Settings.Summary.Enabled = true
+	model.Settings.Integrity.HashChain = true
+	repo := dbs.NewMemoryRepository()
+
+	if err := Process(context.Background(), fixtureDir(t, "valid.csv"), repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(repo.CDRs()); got != 4 {
+		t.Errorf("stored %d calls, want 4", got)
+	}
+	files := repo.ImportFiles()
+	if len(files) != 1 {
+		t.Fatalf("ledger has %d entries, want 1", len(files))
+	}
+	if f := files[0]; f.Status != model.ImportLoaded || f.Rows != 4 || f.RowsLoaded != 4 || f.FileName != "valid.csv" {
+		t.Errorf("ledger entry %+v", f)
+	}
+
+	chain := repo.Chain()
+	if len(chain) != 4 {
+		t.Fatalf("chain has %d entries, want 4", len(chain))
+	}
+	for i := 1; i < len(chain); i++ {
+		if chain[i].PrevHash != chain[i-1].RowHash {
+			t.Errorf("chain entry %d does not link to the one before", i)
+		}
+	}
+
+	// two calls on each of two days, the inbound calls are summed on their destination
+	var calls int64
+	days := make(map[string]bool)
+	for _, s := range repo.Summaries() {
+		calls += s.Calls
+		days[s.Day.Format("2006-01-02")] = true
+		if s.Extension == "2001" && s.Inbound != 1 {
+			t.Errorf("summary %+v, want one inbound call", s)
+		}
+	}
+	if calls != 4 || len(days) != 2 {
+		t.Errorf("summaries count %d calls over %d days, want 4 over 2", calls, len(days))
+	}
+}
+
+func TestProcessSkipsImportedFiles(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+
+	// the second copy has the same content under another name
+	dir := fixtureDir(t, "valid.csv", "valid_copy.csv=valid.csv")
+	if err := Process(ctx, dir, repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Process(ctx, dir, repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(repo.CDRs()); got != 4 {
+		t.Errorf("stored %d calls, want 4", got)
+	}
+	if got := len(repo.ImportFiles()); got != 1 {
+		t.Errorf("ledger has %d entries, want 1", got)
+	}
+}
+
+func TestProcessBatchUnitResumesAfterFailure(t *testing.T) {
+	importSettings(t, model.ImportSettings{Unit: model.ImportUnitBatch, BatchSize: 2})
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+	dir := fixtureDir(t, "valid.csv")
+
+	// the second batch fails, the first stays committed
+	repo.Fail = failOn("Commit", 2, errors.New("connection lost"))
+	err := Process(ctx, dir, repo, Options{})
+	if err == nil || !strings.Contains(err.Error(), "1 of 1 files failed") {
+		t.Fatalf("err %v, want the file to fail", err)
+	}
+	if got := len(repo.CDRs()); got != 2 {
+		t.Errorf("stored %d calls after the failed batch, want 2", got)
+	}
+	f := repo.ImportFiles()[0]
+	if f.Status != model.ImportFailed || f.RowsLoaded != 2 || f.Error != "connection lost" {
+		t.Errorf("ledger entry %+v, want failed after 2 rows", f)
+	}
+
+	repo.Fail = nil
+	if err := Process(ctx, dir, repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	cdrs := repo.CDRs()
+	if len(cdrs) != 4 {
+		t.Fatalf("stored %d calls after the retry, want 4", len(cdrs))
+	}
+	seen := make(map[string]bool)
+	for _, cdr := range cdrs {
+		if seen[cdr.NaturalKey()] {
+			t.Errorf("call %s stored twice", cdr.SipCallID)
+		}
+		seen[cdr.NaturalKey()] = true
+	}
+	if f := repo.ImportFiles()[0]; f.Status != model.ImportLoaded || f.RowsLoaded != 4 {
+		t.Errorf("ledger entry %+v, want loaded", f)
+	}
+}
+
+func TestProcessFileUnitRollsBack(t *testing.T) {
+	importSettings(t, model.ImportSettings{Unit: model.ImportUnitFile, BatchSize: 2})
+	repo := dbs.NewMemoryRepository()
+
+	// the second insert of the file fails, the first batch is rolled back with it
+	repo.Fail = failOn("UpsertCDRs", 2, errors.New("deadlock"))
+	if err := Process(context.Background(), fixtureDir(t, "valid.csv"), repo, Options{}); err == nil {
+		t.Fatal("the failed insert did not fail the import")
+	}
+	if got := len(repo.CDRs()); got != 0 {
+		t.Errorf("stored %d calls of a rolled back file", got)
+	}
+	if f := repo.ImportFiles()[0]; f.Status != model.ImportFailed || f.RowsLoaded != 0 {
+		t.Errorf("ledger entry %+v, want failed without rows", f)
+	}
+}
+
+func TestProcessStrictReadFailsOnlyTheBadFile(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	repo := dbs.NewMemoryRepository()
+
+	err := Process(context.Background(), fixtureDir(t, "bad_time.csv", "valid.csv"), repo, Options{})
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 files failed") {
+		t.Fatalf("err %v, want one failed file", err)
+	}
+	if got := len(repo.CDRs()); got != 4 {
+		t.Errorf("stored %d calls, want the 4 of the good file", got)
+	}
+	for _, f := range repo.ImportFiles() {
+		want := model.ImportLoaded
+		if f.FileName == "bad_time.csv" {
+			want = model.ImportFailed
+		}
+		if f.Status != want {
+			t.Errorf("%s is %s, want %s", f.FileName, f.Status, want)
+		}
+	}
+}
+
+func TestProcessRecordsRuns(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+	dir := fixtureDir(t, "bad_time.csv", "valid.csv")
+
+	if err := Process(ctx, dir, repo, Options{}); err == nil {
+		t.Fatal("the bad file did not fail the run")
+	}
+	if err := Process(ctx, dir, repo, Options{}); err == nil {
+		t.Fatal("the bad file did not fail the second run")
+	}
+	runs := repo.ImportRuns()
+	if len(runs) != 2 {
+		t.Fatalf("recorded %d runs, want 2", len(runs))
+	}
+	if runs[0].ID == "" || runs[0].ID == runs[1].ID {
+		t.Errorf("run ids %q and %q, want two different ids", runs[0].ID, runs[1].ID)
+	}
+	want := []model.ImportRun{
+		{FilesFound: 2, FilesImported: 1, FilesFailed: 1, RowsParsed: 4, RowsRejected: 1, RowsInserted: 4},
+		{FilesFound: 2, FilesSkipped: 1, FilesFailed: 1, RowsRejected: 1},
+	}
+	for i, run := range runs {
+		w := want[i]
+		if run.FilesFound != w.FilesFound || run.FilesImported != w.FilesImported || run.FilesSkipped != w.FilesSkipped ||
+			run.FilesFailed != w.FilesFailed || run.RowsParsed != w.RowsParsed || run.RowsRejected != w.RowsRejected ||
+			run.RowsInserted != w.RowsInserted {
+			t.Errorf("run %d counted %+v, want %+v", i+1, run, w)
+		}
+		if run.Status != model.RunFailed || !strings.Contains(run.Error, "1 of 2 files failed") || run.FinishedAt == nil {
+			t.Errorf("run %d finished %s with %q at %v, want failed", i+1, run.Status, run.Error, run.FinishedAt)
+		}
+	}
+}
+
+func TestProcessPseudonymisesNumbers(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	model.Settings.Privacy = model.PrivacySettings{Pseudonymise: true, KeyEnv: "RMSLOADER_TEST_PSEUDONYM_KEY"}
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+	dir := fixtureDir(t, "valid.csv")
+
+	t.Setenv("RMSLOADER_TEST_PSEUDONYM_KEY", "")
+	if err := Process(ctx, dir, repo, Options{}); !errors.Is(err, apperr.ErrConfigInvalid) {
+		t.Fatalf("import without a key returned %v, want %v", err, apperr.ErrConfigInvalid)
+	}
+	if len(repo.CDRs()) != 0 {
+		t.Fatalf("stored %d rows without a key", len(repo.CDRs()))
+	}
+
+	t.Setenv("RMSLOADER_TEST_PSEUDONYM_KEY", "secret")
+	if err := Process(ctx, dir, repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	cdrs := repo.CDRs()
+	if len(cdrs) != 4 {
+		t.Fatalf("stored %d rows, want 4", len(cdrs))
+	}
+	// the number lost its leading zero in the export, the pseudonym is taken of the fixed number
+	want := privacy.Pseudonym([]byte("secret"), "0821234567")
+	if cdrs[0].Source != want || !strings.HasPrefix(want, privacy.PseudonymPrefix) {
+		t.Errorf("source %q, want %q", cdrs[0].Source, want)
+	}
+	// extensions are kept
+	if cdrs[0].Destination != "2001" || cdrs[3].Source != "2003" {
+		t.Errorf("extensions %q and %q were changed", cdrs[0].Destination, cdrs[3].Source)
+	}
+	if got := privacy.Candidates("082 123 4567"); got[len(got)-1] != want {
+		t.Errorf("candidates %v do not hold the pseudonym %q", got, want)
+	}
+}
+
+func TestProcessMovesImportedFiles(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	done := t.TempDir()
+	model.Settings.Source = model.SourceSettings{AfterImport: source.AfterMove, MoveTo: done}
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+	dir := fixtureDir(t, "bad_time.csv", "valid.csv")
+
+	if err := Process(ctx, dir, repo, Options{}); err == nil {
+		t.Fatal("the bad file did not fail the run")
+	}
+	if _, err := os.Stat(filepath.Join(done, "valid.csv")); err != nil {
+		t.Errorf("the imported file was not moved: %v", err)
+	}
+	// the failed file stays to be retried
+	if _, err := os.Stat(filepath.Join(dir, "bad_time.csv")); err != nil {
+		t.Errorf("the failed file was moved: %v", err)
+	}
+}
+
+func TestProcessPullsCallsSinceLastImport(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	valid, err := os.ReadFile(filepath.Join("testdata", "valid.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the recorder has the calls of valid.csv in the first window and none after
+	var windows []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		windows = append(windows, r.URL.Query().Get("from"))
+		if len(windows) == 1 {
+			w.Write(valid)
+		}
+	}))
+	defer server.Close()
+	model.Settings.Source = model.SourceSettings{Type: source.TypeHTTP, HTTP: model.HTTPSourceSettings{URL: server.URL}}
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+
+	for i := range 2 {
+		src, err := source.Open(ctx, model.Settings.Source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Process(ctx, t.TempDir(), repo, Options{Source: src}); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+		src.Close()
+	}
+	if got := len(repo.CDRs()); got != 4 {
+		t.Errorf("stored %d calls, want 4", got)
+	}
+	runs := repo.ImportRuns()
+	if len(runs) != 2 || runs[1].Status != model.RunSucceeded {
+		t.Fatalf("runs %+v, want an empty window to succeed", runs)
+	}
+	loc, _ := time.LoadLocation("Africa/Johannesburg")
+	if want := runs[0].StartedAt.In(loc).Format("2006-01-02 15:04:05"); windows[1] != want {
+		t.Errorf("the second run asked from %s, want the start of the first run %s", windows[1], want)
+	}
+}
+
+func TestProcessRepullsFailedWindowOnce(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	valid, err := os.ReadFile(filepath.Join("testdata", "valid.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reexport, err := os.ReadFile(filepath.Join("testdata", "reexport.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, calls, _ := strings.Cut(strings.TrimSpace(string(valid)), "\n")
+	rows := strings.Split(calls, "\n")
+	// by the second run a new call heads the window, so every page holds other rows than before
+	newCall := strings.Split(strings.TrimSpace(string(reexport)), "\n")[3]
+	var window []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		start, end := min(page*2, len(window)), min(page*2+2, len(window))
+		w.Write([]byte(strings.Join(append([]string{header}, window[start:end]...), "\n") + "\n"))
+	}))
+	defer server.Close()
+	model.Settings.Source = model.SourceSettings{Type: source.TypeHTTP, HTTP: model.HTTPSourceSettings{URL: server.URL, PageSize: 2}}
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+	pull := func() error {
+		src, err := source.Open(ctx, model.Settings.Source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+		return Process(ctx, t.TempDir(), repo, Options{Source: src})
+	}
+
+	// the first page is committed, the second fails
+	window = rows
+	repo.Fail = failOn("Commit", 2, errors.New("connection lost"))
+	if err := pull(); err == nil {
+		t.Fatal("the failed page did not fail the run")
+	}
+	if got := len(repo.CDRs()); got != 2 {
+		t.Fatalf("stored %d calls of the failed run, want the 2 of its first page", got)
+	}
+	repo.Fail = nil
+	window = append([]string{newCall}, rows...)
+	if err := pull(); err != nil {
+		t.Fatal(err)
+	}
+	cdrs := repo.CDRs()
+	if len(cdrs) != 5 {
+		t.Errorf("stored %d calls after the window was pulled again, want 5", len(cdrs))
+	}
+	seen := make(map[string]bool)
+	for _, cdr := range cdrs {
+		if seen[cdr.NaturalKey()] {
+			t.Errorf("call %s stored twice", cdr.SipCallID)
+		}
+		seen[cdr.NaturalKey()] = true
+	}
+}
+
+func TestProcessSkipsReexportedCalls(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+
+	if err := Process(ctx, fixtureDir(t, "valid.csv"), repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	// a re-export is a new file, its calls are matched on their natural key and not their file
+	if err := Process(ctx, fixtureDir(t, "reexport.csv"), repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	cdrs := repo.CDRs()
+	if len(cdrs) != 5 {
+		t.Fatalf("stored %d calls, want 5", len(cdrs))
+	}
+	if cdrs[0].Flagged {
+		t.Error("a re-exported call was updated without upserts")
+	}
+	if runs := repo.ImportRuns(); runs[1].RowsInserted != 1 {
+		t.Errorf("the re-export inserted %d rows, want 1", runs[1].RowsInserted)
+	}
+}
+
+func TestProcessBulkLoadSkipsDuplicates(t *testing.T) {
+	importSettings(t, model.ImportSettings{BulkLoad: true})
+	repo := dbs.NewMemoryRepository()
+
+	// the re-export repeats two calls of valid.csv and adds one
+	if err := Process(context.Background(), fixtureDir(t, "reexport.csv", "valid.csv"), repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(repo.CDRs()); got != 5 {
+		t.Errorf("stored %d calls, want 5", got)
+	}
+}
+
+func TestProcessUpsertUpdatesReexportedCalls(t *testing.T) {
+	importSettings(t, model.ImportSettings{Upsert: true, UpsertColumns: []string{"flagged"}})
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+
+	if err := Process(ctx, fixtureDir(t, "valid.csv"), repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Process(ctx, fixtureDir(t, "reexport.csv"), repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	cdrs := repo.CDRs()
+	if len(cdrs) != 5 {
+		t.Fatalf("stored %d calls, want 5", len(cdrs))
+	}
+	if !cdrs[0].Flagged {
+		t.Error("the flag of the re-exported call was not updated")
+	}
+	history := repo.History()
+	if len(history) != 1 {
+		t.Fatalf("history %+v, want one change", history)
+	}
+	if h := history[0]; h.UID != cdrs[0].UID || h.Column != "flagged" || h.OldValue != "false" || h.NewValue != "true" {
+		t.Errorf("change %+v", h)
+	}
+}
+
+func TestProcessNoFiles(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	if err := Process(context.Background(), t.TempDir(), dbs.NewMemoryRepository(), Options{}); err == nil {
+		t.Error("an empty folder did not fail the import")
+	}
+}
+
+func TestProcessPrepareFailure(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	repo := dbs.NewMemoryRepository()
+	repo.Fail = failOn("PrepareImport", 1, errors.New("access denied"))
+	if err := Process(context.Background(), fixtureDir(t, "valid.csv"), repo, Options{}); err == nil || err.Error() != "access denied" {
+		t.Errorf("err %v, want access denied", err)
+	}
+	if got := len(repo.ImportFiles()); got != 0 {
+		t.Errorf("ledger has %d entries", got)
+	}
+}
+
+func TestProcessWaitsForImportLock(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	model.Settings.Lock = model.LockSettings{Enabled: true}
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+	dir := fixtureDir(t, "valid.csv")
+
+	other, err := repo.LockImport(ctx, dbs.DefaultLockName, "other:1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Process(ctx, dir, repo, Options{}); !errors.Is(err, apperr.ErrDBLocked) {
+		t.Fatalf("import under another lock returned %v, want %v", err, apperr.ErrDBLocked)
+	}
+	if len(repo.CDRs()) != 0 || len(repo.ImportRuns()) != 0 {
+		t.Fatalf("a locked import stored %d rows and %d runs", len(repo.CDRs()), len(repo.ImportRuns()))
+	}
+	other.Release(ctx)
+	if err := Process(ctx, dir, repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	// the lock is released with the run
+	if _, err := repo.LockImport(ctx, dbs.DefaultLockName, "other:1", 0); err != nil {
+		t.Errorf("the lock was kept after the run: %v", err)
+	}
+}
+
+func TestProcessNotifiesFailedRun(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	var payloads []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		json.NewDecoder(r.Body).Decode(&payload)
+		payloads = append(payloads, payload)
+	}))
+	defer server.Close()
+	model.Settings.Notify = model.NotifySettings{Enabled: true, Webhooks: []model.WebhookSettings{{URL: server.URL}}}
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+
+	// a clean run is not notified by default
+	if err := Process(ctx, fixtureDir(t, "valid.csv"), repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Process(ctx, fixtureDir(t, "bad_time.csv"), repo, Options{}); err == nil {
+		t.Fatal("the bad file did not fail the run")
+	}
+	if len(payloads) != 1 {
+		t.Fatalf("posted %d notifications, want 1", len(payloads))
+	}
+	run, _ := payloads[0]["run"].(map[string]any)
+	if payloads[0]["event"] != notify.EventFailed || run["status"] != model.RunFailed || run["files_failed"] != float64(1) {
+		t.Errorf("notification %v", payloads[0])
+	}
+}
+
+func TestProcessNoFilesIsNotNotified(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	var posts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+	}))
+	defer server.Close()
+	model.Settings.Notify = model.NotifySettings{Enabled: true, Webhooks: []model.WebhookSettings{{URL: server.URL}}}
+	repo := dbs.NewMemoryRepository()
+
+	if err := Process(context.Background(), t.TempDir(), repo, Options{}); !errors.Is(err, ErrNoFiles) {
+		t.Fatalf("an empty folder returned %v, want %v", err, ErrNoFiles)
+	}
+	if posts != 0 {
+		t.Errorf("an empty folder was notified %d times", posts)
+	}
+	// the run is recorded as succeeded, like a scheduled import that found nothing
+	if runs := repo.ImportRuns(); len(runs) != 1 || runs[0].Status != model.RunSucceeded {
+		t.Errorf("runs %+v", runs)
+	}
+}
+
+func TestProcessNotifiesCancelledRun(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	var events []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events = append(events, r.Header.Get(notify.HeaderEvent))
+	}))
+	defer server.Close()
+	model.Settings.Notify = model.NotifySettings{Enabled: true, Events: []string{notify.EventCancelled},
+		Webhooks: []model.WebhookSettings{{URL: server.URL}}}
+	// the loader was stopped, the context of the run is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := Process(ctx, fixtureDir(t, "valid.csv"), dbs.NewMemoryRepository(), Options{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("a stopped run returned %v", err)
+	}
+	if len(events) != 1 || events[0] != notify.EventCancelled {
+		t.Errorf("notified %v, want cancelled", events)
+	}
+}
+
+func TestProcessCountsMetrics(t *testing.T) {
+	importSettings(t, model.ImportSettings{})
+	repo := dbs.NewMemoryRepository()
+	ctx := context.Background()
+	counters := map[string]prometheus.Collector{
+		"discovered": metrics.Files.WithLabelValues(metrics.FileDiscovered),
+		"processed":  metrics.Files.WithLabelValues(metrics.FileProcessed),
+		"parsed":     metrics.Rows.WithLabelValues(metrics.RowParsed),
+		"inserted":   metrics.Rows.WithLabelValues(metrics.RowInserted),
+		"skipped":    metrics.Rows.WithLabelValues(metrics.RowSkipped),
+	}
+	before := make(map[string]float64)
+	for name, c := range counters {
+		before[name] = testutil.ToFloat64(c)
+	}
+	metrics.LastSuccessfulImport.Set(0)
+
+	if err := Process(ctx, fixtureDir(t, "valid.csv"), repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if testutil.ToFloat64(metrics.LastSuccessfulImport) == 0 {
+		t.Error("a run storing new calls did not set the last successful import")
+	}
+	// the re-export stores one new call and skips the two stored before
+	if err := Process(ctx, fixtureDir(t, "reexport.csv"), repo, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"discovered": 2, "processed": 2, "parsed": 7, "inserted": 5, "skipped": 2}
+	for name, c := range counters {
+		if got := testutil.ToFloat64(c) - before[name]; got != want[name] {
+			t.Errorf("%s grew by %v, want %v", name, got, want[name])
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// LockImport takes the import lock of the settings so no other loader imports into the database during the
+// run, the retention purge takes it as well. The returned context is cancelled with DB_LOCK_LOST when the
+// lock is lost, release frees the lock. Without the lock setting ctx is returned as is.
+func LockImport(ctx context.Context, repo dbs.CDRRepository) (context.Context, func(), error) {
+	settings := model.Settings.Lock
+	if !settings.Enabled {
+		return ctx, func() {}, nil
+	}
+	name := settings.Name
+	if name == "" {
+		name = dbs.DefaultLockName
+	}
+	holder := dbs.LockHolder()
+	lock, err := repo.LockImport(ctx, name, holder, time.Duration(settings.HeartbeatSeconds)*time.Second)
+	if err != nil {
+		li.FromContext(ctx).WithFields(logrus.Fields{
+			"lock": name,
+			"err":  err,
+		}).Warn("not started, the import lock is not free")
+		return ctx, nil, err
+	}
+	li.FromContext(ctx).WithFields(logrus.Fields{"lock": name, "holder": holder}).Info("import lock taken")
+	locked, cancel := context.WithCancelCause(ctx)
+	go func() {
+		select {
+		case <-lock.Lost():
+			cancel(apperr.New(apperr.DBLockLost, "process.LockImport", "the import lock "+name+" was lost, the run stopped"))
+		case <-locked.Done():
+		}
+	}()
+	release := func() {
+		cancel(nil)
+		if err := lock.Release(context.WithoutCancel(ctx)); err != nil {
+			li.FromContext(ctx).WithFields(logrus.Fields{"lock": name, "err": err}).Error("could not release the import lock")
+		}
+	}
+	return locked, release, nil
+}
+
+// lockLost returns DB_LOCK_LOST for an import stopped by the loss of its lock, err otherwise
+func lockLost(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); err != nil && errors.Is(cause, apperr.ErrDBLockLost) {
+		return cause
+	}
+	return err
+}
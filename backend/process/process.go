@@ -2,15 +2,20 @@ package process
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	dbs "github.com/pienaahj/rmsloader/backend/db"
 	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/metrics"
 	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/notify"
+	"github.com/pienaahj/rmsloader/backend/privacy"
+	"github.com/pienaahj/rmsloader/backend/report"
+	"github.com/pienaahj/rmsloader/backend/source"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,18 +28,33 @@ var (
 	StartFolder      int     = 0 // the folder representing the extension from where to start the processing
 )
 
-// the paths
-var (
-	SourcePath      string = model.ProcessLogFileLocations()["SourcePath"]
-	ExtensionsFile  string = model.ProcessLogFileLocations()["ExtensionsFile"]
-	DestinationPath string = model.ProcessLogFileLocations()["DestinationPath"]
-	LogPath         string = model.ProcessLogFileLocations()["LogPath"]
-	AppLogsPath     string = model.ProcessLogFileLocations()["AppLogsPath"]
-	DbLogs          string = model.ProcessLogFileLocations()["DbLogs"]
-	OddDates        string = model.ProcessLogFileLocations()["OddDates"]
-	AnalysisLogs    string = model.ProcessLogFileLocations()["AnalysisLogs"]
-	TempStorage     string = model.ProcessLogFileLocations()["TempStorage"]
-)
+// ErrValidationFailed is returned by a dry run that found rows that cannot be imported
+var ErrValidationFailed = errors.New("validation found rejected or duplicate rows")
+
+// ErrNoFiles is returned by an import that found no csv files
+var ErrNoFiles = errors.New("no files to process")
+
+// dryRun validates the csv files in path, prints the report and writes it to the report path
+func dryRun(ctx context.Context, path string, f *li.RotatingFile, opts Options) error {
+	report, err := Validate(path, f, ".csv")
+	if err != nil {
+		li.FromContext(ctx).WithFields(logrus.Fields{
+			"CallFrom": CallFrom,
+			"err": err,
+		}).Error("error while validating the csv files")
+		return err
+	}
+	report.Print(os.Stdout)
+	if opts.ReportPath != "" {
+		if err := writeReport(report, opts.ReportPath); err != nil {
+			return err
+		}
+	}
+	if !report.OK() {
+		return ErrValidationFailed
+	}
+	return nil
+}
 
 // get the location for data calculations
 func GetDataLocation() *time.Location {
@@ -47,61 +67,153 @@ func GetDataLocation() *time.Location {
 	return Loc
 }
 
-// Process all csv files in path
-func Process(ctx context.Context, path string, db *sqlx.DB) error {
+// Process all csv files in path into repo, a dry run only validates them and does not use repo.
+// Every file is imported on its own, a failed file is rolled back and retried on the next run.
+// Each run gets an id that is logged as run_id with its entries and is recorded in import_runs with its counts.
+func Process(ctx context.Context, path string, repo dbs.CDRRepository, opts Options) error {
 	CallFrom = "Process "
-	var cdrs []model.RMSCDR
-	batchSize := 100              // Adjust as needed
-	var TotCount int64 = 0
-	var batch []model.RMSCDR// Struct representing the CDR table
-	// var err error
-	cdrs, err := ProcessAllCSVFiles(path, model.LogFileLiterals[strings.TrimPrefix(model.PathVars.AnalysisLogs, "/logs/")], ".csv")
+	run := newRun()
+	ctx = li.WithFields(ctx, logrus.Fields{"run_id": run.ID})
+	li.FromContext(ctx).WithFields(logrus.Fields{
+		"CallFrom": CallFrom,
+		"host": run.Host,
+		"version": run.Version,
+		"dry_run": opts.DryRun,
+	}).Info("import run started")
+	analysisLog := model.LogFileLiterals[strings.TrimPrefix(model.PathVars.AnalysisLogs, "/logs/")]
+	src := exportSource(path, analysisLog, opts)
+	// the downloads of a remote source are removed when the run ends
+	dir := fetchDir(run)
+	defer os.RemoveAll(dir)
+	if opts.DryRun {
+		if opts.Source != nil {
+			var err error
+			if err = setWindow(ctx, src, nil, run); err != nil {
+				return err
+			}
+			if path, err = fetchAll(ctx, src, dir); err != nil {
+				return err
+			}
+		}
+		return dryRun(ctx, path, analysisLog, opts)
+	}
+	// only one loader imports into the database at a time
+	locked, release, err := LockImport(ctx, repo)
 	if err != nil {
-		li.Logger.L.WithFields(logrus.Fields{
+		return err
+	}
+	defer release()
+	if err := repo.PrepareImport(locked); err != nil {
+		return err
+	}
+	if err := setWindow(locked, src, repo, run); err != nil {
+		return err
+	}
+	if err := repo.StartImportRun(locked, run); err != nil {
+		return err
+	}
+	var rejects notify.Rejects
+	err = lockLost(locked, importFiles(locked, src, dir, repo, run, analysisLog, &rejects))
+	finishRun(ctx, repo, run, err)
+	// a quiet window or an empty folder is not news
+	if !errors.Is(err, ErrNoFiles) {
+		// a cancelled run is still notified, the notification gets a time of its own
+		nctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout)
+		notify.Run(nctx, model.Settings.Notify, *run, rejects)
+		cancel()
+	}
+	return err
+}
+
+// importFiles imports the csv files of src and counts them in run, remote files are downloaded to dir.
+// An imported file is handed back to src to be kept, deleted or moved. The rejected rows are added to rejects.
+func importFiles(ctx context.Context, src source.Source, dir string, repo dbs.CDRRepository, run *model.ImportRun, analysisLog *li.RotatingFile, rejects *notify.Rejects) error {
+	log := li.FromContext(ctx).WithField("source", src.String())
+	files, err := src.List(ctx)
+	if err != nil {
+		log.WithFields(logrus.Fields{
 			"CallFrom": CallFrom,
 			"err": err,
 		}).Error("error while reading the csv files")
 		return err
 	}
-	// check that files were processed
-	if len(cdrs) == 0 {
-		li.Logger.L.Info(CallFrom, "no files to process")
-		return fmt.Errorf("no files to process")
+	// a window without calls is done, the next window starts after it
+	if _, ok := src.(source.Windowed); ok && len(files) == 0 {
+		log.Info(CallFrom, "no calls in the window")
+		return nil
+	}
+	// check that files were found
+	if len(files) == 0 {
+		log.Info(CallFrom, "no files to process")
+		return ErrNoFiles
 	}
-	// loop through all the slice of cdrs returned and add them to the db
-	for _, cdr := range cdrs {
-		// Check if the record should be skipped
-		if uid, errDb := dbs.GetCDRByUID(context.Background(), db, cdr.UID);  cdr.UID == uid {
-			li.Logger.L.Info(CallFrom, "record already exists in db, skipping cdr: ", cdr.UID)
+	run.FilesFound = int64(len(files))
+	// fail before any file is read rather than once per file when the key is missing
+	if model.Settings.Privacy.Pseudonymise {
+		if _, err := privacy.Key(); err != nil {
+			return err
+		}
+	}
+	// every insert path writes the call_key, the column and its unique index have to exist first
+	if err := repo.EnsureCallKey(ctx); err != nil {
+		return err
+	}
+	metrics.Files.WithLabelValues(metrics.FileDiscovered).Add(float64(len(files)))
+	// the call days touched by the import, their summaries are refreshed at the end
+	days := make(map[time.Time]bool)
+	var loaded int
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		file, err := src.Fetch(ctx, f, dir)
+		var count int64
+		if err == nil {
+			count, err = importFile(ctx, repo, run, file, analysisLog, days, rejects)
+			run.RowsInserted += count
+			if file != f.Path {
+				os.Remove(file)
+			}
+		}
+		if err != nil {
+			run.FilesFailed++
+			metrics.Files.WithLabelValues(metrics.FileFailed).Inc()
+			log.WithFields(logrus.Fields{
+				"CallFrom": CallFrom,
+				"file": f.Path,
+				"err": err,
+			}).Error("file import rolled back, it is retried on the next run")
 			continue
-		} else if errDb != nil && errDb.Error() == "table does not exist"{
-			li.Logger.L.WithFields(logrus.Fields{
+		}
+		// the file is in the ledger now, if it cannot be moved on it is skipped by the next run
+		if err := src.Done(ctx, f); err != nil {
+			log.WithFields(logrus.Fields{
 				"CallFrom": CallFrom,
+				"file": f.Path,
 				"err": err,
-			}).Error("db empty")
+			}).Warn("file imported but not moved on from the source")
 		}
-
-		batch = append(batch, cdr)
-
-		// Process batch if it reaches the batchSize limit
-		if len(batch) >= batchSize {
-			count, err := dbs.InsertCDRsBatch(ctx, db, batch)
-			if err != nil {
-				return err
-			}
-			TotCount += count
-			batch = batch[:0] // Reset batch
+		if count > 0 {
+			loaded++
 		}
 	}
-	// Insert any remaining records
-	if len(batch) > 0 {
-		count, err := dbs.InsertCDRsBatch(ctx, db, batch)
-		if err != nil {
-			return err
+	log.Infof("Total records processed: %d", run.RowsInserted)
+	if model.Settings.Summary.Enabled && len(days) > 0 {
+		var touched []time.Time
+		for day := range days {
+			touched = append(touched, day)
 		}
-		TotCount += count
+		if err := report.Refresh(ctx, repo, touched); err != nil {
+			return fmt.Errorf("refreshing daily summaries: %w", err)
+		}
+	}
+	if run.FilesFailed > 0 {
+		return fmt.Errorf("%d of %d files failed to import", run.FilesFailed, len(files))
+	}
+	// a run that stored no new calls does not count, the feed may have stopped
+	if loaded > 0 {
+		metrics.LastSuccessfulImport.SetToCurrentTime()
 	}
-	li.Logger.L.Printf("Total records processed: %d", TotCount)
 	return nil
 }
 
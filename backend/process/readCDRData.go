@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -15,35 +16,18 @@ import (
 	"time"
 
 	"github.com/google/uuid" // get the uuid package
+	"github.com/pienaahj/rmsloader/backend/apperr"
 	li "github.com/pienaahj/rmsloader/backend/logwrapper"
 	"github.com/pienaahj/rmsloader/backend/model"
-	"github.com/sirupsen/logrus"
+	"github.com/pienaahj/rmsloader/backend/privacy"
 	"golang.org/x/text/encoding/charmap"
 	"golang.org/x/text/transform"
 )
 
-var (
-	CSVPath          string         = model.ProcessLogFileLocations()["CSVPath"]
-	// SourcePath       string         = model.ProcessLogFileLocations()["SourcePath"]
-	// DbLogs           string         = model.ProcessLogFileLocations()["DbLogs"]
-	// AnalysisLogs     string         = model.ProcessLogFileLocations()["AnalysisLogs"]
-	// Loc              *time.Location // to store the ZA time location
-	// ZA_LOCATION_NAME string         = "Africa/Johannesburg"
-)
-
-// Read the csv files names in directory path, does not process sub folders and retruns a combined slice of RMSCDR structs
-// (absolute path eg. "/Users/hendrikpienaar/github.com/data/rms_cdrs") in docker /recordings/csv or log.PathVars.CSVPath in local.
-// Requires f to be a file pointer to the database log file and FExt to be the file extension to search for including the . eg ".csv"
-func ProcessAllCSVFiles(path string, f *os.File, fExt string) ([]model.RMSCDR, error) {
-	CallFrom := "ReadAllCSVFiles "
-	// store the current directory
-	// print working dir
-	originalDir, _ := os.Getwd()
-	li.Logger.L.Printf("%s: Current working directory: %s", CallFrom, originalDir)
-	// create the return slice
-	var csvDetailX []model.RMSCDR
-	var idCount int
-
+// ListCSVFiles returns the paths of the files with extension fExt in path, skipped entries are logged to f
+func ListCSVFiles(path string, f *li.RotatingFile, fExt string) ([]string, error) {
+	CallFrom := "ListCSVFiles "
+	var files []string
 	// loop through all the files
 	li.Logger.L.Info(CallFrom, "Looping through directory to read csv files: ",path)
 	err := filepath.Walk(path, func(path string, info fs.FileInfo, err error) error {
@@ -106,57 +90,39 @@ func ProcessAllCSVFiles(path string, f *os.File, fExt string) ([]model.RMSCDR, e
 		// 	li.Logger.ErrExistFilesMessage(CallFrom, msg, err)
 		// 	return err
 		// }
-		// read the contents of the file and return the cdr details
-		li.Logger.L.Printf("Called from: %s, Reading file: %s", CallFrom, filename)
-		csvDetail, err := readCSV(path)
-		if err != nil {
-			li.Logger.ErrReadFilesMessage(CallFrom, path, err)
-			return err
-		}
-		csvDetailX = append(csvDetailX, csvDetail...)
-		// increment the id count with the number of cdr details in the file
-		idCount += len(csvDetail)
-		return nil
-		/*
-		// testing debug ********************************
-		if err != nil {
-			li.Logger.L.Errorf("!!! Error walking path: %s, err: %v", path, err)
-			return err
-		}
-		li.Logger.L.Infof(">>> Visited: %s (isDir: %v)", path, info.IsDir())
+		files = append(files, path)
 		return nil
-		// testing debug ********************************
-		*/
 	})
 	if err != nil {
+		err = apperr.Wrap(apperr.IOPath, "ListCSVFiles", err)
 		li.Logger.ErrPathWalkMessage(CallFrom, path, err)
-		return []model.RMSCDR{}, nil
-	}
-	li.Logger.L.WithFields(logrus.Fields{
-		"Call from":             CallFrom,
-		"Number of files added": len(csvDetailX),
-	})
-	// return to the original folder
-	err = model.ChangePath(originalDir)
-	if err != nil {
-		msg := fmt.Sprintf("Cannot change dir to %s", originalDir)
-		li.Logger.ErrChangePathMessage(CallFrom, msg, err)
+		return nil, err
 	}
-	li.Logger.L.Printf("%s: Number of CDR records added: %d", CallFrom, idCount)
-	return csvDetailX, nil
+	return files, nil
 }
 
-
-// readCSV reads the CDR data from csv format at a path and returns a slice of RMSCDR
-func readCSV(filename string) ([]model.RMSCDR, error) {
+// readCSV reads the CDR data from csv format at a path and returns a slice of RMSCDR and the counts of the file.
+// A lenient read records the rows that cannot be parsed as rejects and carries on, otherwise the first bad row fails the file.
+func readCSV(filename string, lenient bool) ([]model.RMSCDR, *FileStats, error) {
 	CallFrom := "readCSV "
+	stats := &FileStats{File: filename}
+	// reject records a bad row, only a lenient read carries on past it
+	reject := func(line int, reason string, err error) error {
+		code := rejectCodes[reason]
+		stats.Rejected = append(stats.Rejected, Reject{Line: line, Reason: reason, Code: code, Detail: err.Error()})
+		if lenient {
+			return nil
+		}
+		return apperr.Wrap(code, fmt.Sprintf("readCSV %s line %d", filepath.Base(filename), line), err)
+	}
 
 	msg := fmt.Sprintf("Reading CSV file: %s", filename)
 	li.Logger.L.Info(CallFrom, msg)
 	csvFile, err := os.Open(filename)
 	if err != nil {
+		err = apperr.Wrap(apperr.IOOpen, "readCSV", err)
 		li.Logger.ErrOpenFilesMessage(CallFrom, filename, err)
-		return nil, err
+		return nil, stats, err
 	}
 	defer csvFile.Close()
 	li.Logger.L.Printf("%s: Opened CSV file: %s", CallFrom, csvFile.Name())
@@ -177,23 +143,34 @@ func readCSV(filename string) ([]model.RMSCDR, error) {
 	reader.LazyQuotes = true
 	reader.FieldsPerRecord = -1
 
-	csvLines, err := reader.ReadAll()
-	if err != nil {
-		li.Logger.ErrProcessCSVMessage(CallFrom, "Reader failed on malformed CSV", err)
-		return nil, err
-	}
-
 	var cdrData []model.RMSCDR
 	// keeptrack of the missing leading zero count
 	var count int
 	// loop through the lines and create a struct
-	for i, line := range csvLines {
-		// print the row to logs
-		li.Logger.L.Info(CallFrom,"Line: ", line)
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			li.Logger.ErrProcessCSVMessage(CallFrom, "Reader failed on malformed CSV", err)
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, stats, apperr.Wrap(apperr.IORead, "readCSV", err)
+			}
+			if err := reject(parseErr.Line, RejectMalformed, err); err != nil {
+				return nil, stats, err
+			}
+			continue
+		}
+		i, _ := reader.FieldPos(0)
+		// print the row to the debug log, one entry per line is too much at info
+		li.Logger.L.Debug(CallFrom,"Line: ", privacy.LineForLog(line))
 		// check for too few columns in line
 		const expectedFields = 12
 		if len(line) < expectedFields {
-			 li.Logger.L.Warnf("Skipping short line %d (has %d fields): %#v", i+1, len(line), line)
+			 li.Logger.L.Warnf("Skipping short line %d (has %d fields): %#v", i, len(line), privacy.LineForLog(line))
+			stats.Rejected = append(stats.Rejected, Reject{Line: i, Reason: RejectShortLine, Code: rejectCodes[RejectShortLine], Detail: fmt.Sprintf("%d fields", len(line))})
 			continue
 		}
 		// skip the header row
@@ -211,7 +188,10 @@ func readCSV(filename string) ([]model.RMSCDR, error) {
 		if err != nil {
 			li.Logger.L.Info("Trying to convert time string: ", line[1])
 			li.Logger.ErrConvertToDateMessage(CallFrom, "Cannot convert time to time.Time. ", err)
-			return nil, err
+			if err := reject(i, RejectTime, err); err != nil {
+				return nil, stats, err
+			}
+			continue
 		}
 		// flagged as a boolean
 		var flagged bool
@@ -224,20 +204,29 @@ func readCSV(filename string) ([]model.RMSCDR, error) {
 		duration, err := parseDurationString(line[5])
 		if err != nil {
 			li.Logger.ErrConvertToIntMessage(CallFrom, "Cannot convert duration to time.Duration. ", err)
-			return nil, err
+			if err := reject(i, RejectDuration, err); err != nil {
+				return nil, stats, err
+			}
+			continue
 		}
 		// convert the duration
 		talkDurationSeconds, err := model.MyDuration(duration).Value()
 		if err != nil {
 			li.Logger.ErrConvertToIntMessage(CallFrom, "Cannot convert duration to time.Duration. ", err)
-			return nil, err
+			if err := reject(i, RejectDuration, err); err != nil {
+				return nil, stats, err
+			}
+			continue
 		}
 		// convert the size
 		sizeString := strings.Split(line[6], " ")
 		size, err := strconv.ParseFloat(sizeString[0], 64)
 		if err != nil {
 			li.Logger.ErrConvertToIntMessage(CallFrom, "Cannot convert size to int. ", err)
-			return nil, err
+			if err := reject(i, RejectSize, err); err != nil {
+				return nil, stats, err
+			}
+			continue
 		}
 		// convert the exists
 		var exists bool
@@ -286,7 +275,9 @@ func readCSV(filename string) ([]model.RMSCDR, error) {
 	}
 	li.Logger.L.Printf("%s: RMS CDR Data records added: %#v", CallFrom, len(cdrData))
 	li.Logger.L.Printf("%s, Number of missing leading zeros: %d in file: %s ", CallFrom, count, filename)
-	return cdrData, nil
+	stats.Rows = len(cdrData)
+	stats.PrefixFixed = count
+	return cdrData, stats, nil
 }
 
 // Convert text like "1 hour 34 min 22 sec" to time.Duration
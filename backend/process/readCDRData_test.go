@@ -0,0 +1,154 @@
+package process
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+)
+
+func TestReadCSV(t *testing.T) {
+	cdrs, stats, err := readCSV(filepath.Join("testdata", "valid.csv"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cdrs) != 4 || stats.Rows != 4 {
+		t.Fatalf("read %d rows, stats %d, want 4", len(cdrs), stats.Rows)
+	}
+	if len(stats.Rejected) != 0 {
+		t.Errorf("rejected %v", stats.Rejected)
+	}
+	// the source of the first call has lost its leading zero
+	if stats.PrefixFixed != 1 {
+		t.Errorf("prefix fixed %d, want 1", stats.PrefixFixed)
+	}
+
+	first := cdrs[0]
+	want := time.Date(2024, 3, 1, 8, 15, 0, 0, time.UTC)
+	if !first.Time.Equal(want) || first.UnixTimestamp != want.Unix() {
+		t.Errorf("time %v unix %d, want %v", first.Time, first.UnixTimestamp, want)
+	}
+	checks := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"direction", first.Direction, "Incoming"},
+		{"flagged", first.Flagged, false},
+		{"source", first.Source, "0821234567"},
+		{"destination", first.Destination, "2001"},
+		{"duration", first.Duration, int64(65)},
+		{"talk duration", first.TalkDuration, 65 * time.Second},
+		{"size", first.Size, 512.5},
+		{"exists in db", first.ExistsINDB, true},
+		{"local copy", first.LocalCopy, false},
+		{"authentic", first.Authentic, "Yes"},
+		{"file name", first.FileName, "2024/03/01/in-0001.wav"},
+		{"sip call id", first.SipCallID, "call-0001@pbx"},
+		{"flagged second", cdrs[1].Flagged, true},
+		{"duration third", cdrs[2].Duration, int64(3723)},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	if first.UID == "" || first.UID == cdrs[1].UID {
+		t.Errorf("uids %q and %q are not unique", first.UID, cdrs[1].UID)
+	}
+}
+
+func TestReadCSVStripsBOMAndCarriageReturns(t *testing.T) {
+	cdrs, _, err := readCSV(filepath.Join("testdata", "bom_crlf.csv"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cdrs) != 2 {
+		t.Fatalf("read %d rows, want 2, the header was not recognised", len(cdrs))
+	}
+	if cdrs[0].Direction != "Incoming" || cdrs[1].SipCallID != "call-0012@pbx" {
+		t.Errorf("direction %q sip call id %q", cdrs[0].Direction, cdrs[1].SipCallID)
+	}
+}
+
+func TestReadCSVRejects(t *testing.T) {
+	tests := []struct {
+		file    string
+		lenient bool
+		wantErr error
+		rows    int
+		reason  string
+		code    apperr.Code
+		line    int
+	}{
+		{"bad_time.csv", false, apperr.ErrParseTime, 0, RejectTime, apperr.ParseTime, 3},
+		{"bad_time.csv", true, nil, 2, RejectTime, apperr.ParseTime, 3},
+		// short lines are skipped even by a strict read
+		{"short_line.csv", false, nil, 2, RejectShortLine, apperr.ParseShortLine, 3},
+		{"short_line.csv", true, nil, 2, RejectShortLine, apperr.ParseShortLine, 3},
+	}
+	for _, tt := range tests {
+		cdrs, stats, err := readCSV(filepath.Join("testdata", tt.file), tt.lenient)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s lenient %v: err %v, want error %v", tt.file, tt.lenient, err, tt.wantErr)
+			continue
+		}
+		if len(cdrs) != tt.rows {
+			t.Errorf("%s lenient %v: %d rows, want %d", tt.file, tt.lenient, len(cdrs), tt.rows)
+		}
+		if len(stats.Rejected) != 1 {
+			t.Errorf("%s lenient %v: rejected %v, want one", tt.file, tt.lenient, stats.Rejected)
+			continue
+		}
+		if r := stats.Rejected[0]; r.Reason != tt.reason || r.Code != tt.code || r.Line != tt.line {
+			t.Errorf("%s lenient %v: reject %+v, want %s %s on line %d", tt.file, tt.lenient, r, tt.reason, tt.code, tt.line)
+		}
+	}
+}
+
+func TestReadCSVMissingFile(t *testing.T) {
+	_, _, err := readCSV(filepath.Join("testdata", "missing.csv"), false)
+	if !errors.Is(err, apperr.ErrIOOpen) || !errors.Is(err, fs.ErrNotExist) || apperr.KindOf(err) != apperr.KindIO {
+		t.Errorf("reading a missing file failed with %v, want %s", err, apperr.IOOpen)
+	}
+}
+
+func TestParseDurationString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"45 sec", 45 * time.Second},
+		{"2 min 50 sec", 2*time.Minute + 50*time.Second},
+		{"1 hour 34 min 22 sec", time.Hour + 34*time.Minute + 22*time.Second},
+		{"3 min", 3 * time.Minute},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		got, err := parseDurationString(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("parseDurationString(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestAddPrefix(t *testing.T) {
+	tests := []struct {
+		in    string
+		count int
+		want  string
+	}{
+		{"821234567", 1, "0821234567"},
+		{"0821234567", 0, "0821234567"},
+		{"2001", 0, "2001"},
+	}
+	for _, tt := range tests {
+		count, got := addPrefix(tt.in)
+		if count != tt.count || got != tt.want {
+			t.Errorf("addPrefix(%q) = %d, %q, want %d, %q", tt.in, count, got, tt.count, tt.want)
+		}
+	}
+}
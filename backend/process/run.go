@@ -0,0 +1,66 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// notifyTimeout is the time the notification of a finished run may take, all channels together
+const notifyTimeout = 2 * time.Minute
+
+// newRun returns the record of a run starting now
+func newRun() *model.ImportRun {
+	host, _ := os.Hostname()
+	return &model.ImportRun{
+		ID:         uuid.New().String(),
+		Status:     model.RunRunning,
+		Host:       host,
+		Version:    model.Version,
+		ConfigHash: model.ConfigHash,
+		StartedAt:  time.Now(),
+	}
+}
+
+// finishRun records the counts and the outcome of a run, the record is written even when the run was interrupted
+func finishRun(ctx context.Context, repo dbs.CDRRepository, run *model.ImportRun, err error) {
+	now := time.Now()
+	run.FinishedAt = &now
+	switch {
+	case err == nil:
+		run.Status = model.RunSucceeded
+	case errors.Is(err, ErrNoFiles):
+		// nothing was waiting to be imported, the run did not fail, as the scheduler records it
+		run.Status = model.RunSucceeded
+		run.Error = err.Error()
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		run.Status = model.RunCancelled
+		run.Error = err.Error()
+	default:
+		run.Status = model.RunFailed
+		run.Error = err.Error()
+	}
+	log := li.FromContext(ctx)
+	if err := repo.FinishImportRun(context.WithoutCancel(ctx), run); err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("could not record the finished import run")
+	}
+	log.WithFields(logrus.Fields{
+		"status":         run.Status,
+		"files_found":    run.FilesFound,
+		"files_imported": run.FilesImported,
+		"files_skipped":  run.FilesSkipped,
+		"files_failed":   run.FilesFailed,
+		"rows_parsed":    run.RowsParsed,
+		"rows_rejected":  run.RowsRejected,
+		"rows_inserted":  run.RowsInserted,
+		"seconds":        now.Sub(run.StartedAt).Seconds(),
+	}).Info("import run finished")
+}
@@ -0,0 +1,71 @@
+package process
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/source"
+)
+
+// exportSource returns where a run reads the csv files, the folder at path unless the options name a source
+func exportSource(path string, analysisLog *li.RotatingFile, opts Options) source.Source {
+	if opts.Source != nil {
+		return opts.Source
+	}
+	return source.NewLocal(path, model.Settings.Source, func(dir string) ([]string, error) {
+		return ListCSVFiles(dir, analysisLog, ".csv")
+	})
+}
+
+// fetchDir is the folder the files of a remote source are downloaded to during a run
+func fetchDir(run *model.ImportRun) string {
+	return filepath.Join(model.PathVars.TempStorage, "fetch-"+run.ID)
+}
+
+// fetchAll downloads every csv file of src to dir and returns dir, for a dry run
+func fetchAll(ctx context.Context, src source.Source, dir string) (string, error) {
+	files, err := src.List(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if _, err := src.Fetch(ctx, f, dir); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// setWindow asks a windowed source for the calls since the start of the last successful run up to the start
+// of this one, so the windows of the runs follow on without a gap. Without a successful run, or without a
+// repository on a dry run, the source falls back to its initial days. The window after a failed run holds
+// the calls that run committed again, the import skips them on their call_key.
+func setWindow(ctx context.Context, src source.Source, repo dbs.CDRRepository, run *model.ImportRun) error {
+	w, ok := src.(source.Windowed)
+	if !ok {
+		return nil
+	}
+	var from time.Time
+	if repo != nil {
+		last, err := repo.LastSucceededImportRun(ctx)
+		if err != nil {
+			return err
+		}
+		if last != nil {
+			from = last.StartedAt
+		}
+	}
+	w.SetWindow(from, run.StartedAt)
+	li.FromContext(ctx).WithFields(logrus.Fields{
+		"source": src.String(),
+		"since":  from,
+		"until":  run.StartedAt,
+	}).Info("requesting the calls since the last successful import")
+	return nil
+}
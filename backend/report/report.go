@@ -0,0 +1,176 @@
+// Package report maintains and queries the daily call summaries
+package report
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/sirupsen/logrus"
+)
+
+// the report periods
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// Query selects the summaries of a report
+type Query struct {
+	// the first day, inclusive
+	From time.Time
+	// the last day, exclusive
+	To time.Time
+	// only this extension
+	Extension string
+	// day or month
+	Period string
+	// one row per extension, otherwise the extensions are summed per period
+	ByExtension bool
+}
+
+// ParseValues reads a query from query values, shared by the report command and the api.
+// Without dates the report covers the last 30 days.
+func ParseValues(values url.Values, now time.Time) (Query, error) {
+	q := Query{Period: PeriodDay, ByExtension: true}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	q.To = today.AddDate(0, 0, 1)
+	q.From = today.AddDate(0, 0, -30)
+	var err error
+	if v := values.Get("from"); v != "" {
+		if q.From, err = time.Parse("2006-01-02", v); err != nil {
+			return q, fmt.Errorf("invalid from date, use 2006-01-02: %w", err)
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if q.To, err = time.Parse("2006-01-02", v); err != nil {
+			return q, fmt.Errorf("invalid to date, use 2006-01-02: %w", err)
+		}
+	}
+	if !q.To.After(q.From) {
+		return q, fmt.Errorf("the to date must be after the from date")
+	}
+	q.Extension = values.Get("extension")
+	if v := values.Get("period"); v != "" {
+		q.Period = v
+	}
+	if q.Period != PeriodDay && q.Period != PeriodMonth {
+		return q, fmt.Errorf("unknown period %q, use day or month", q.Period)
+	}
+	if v := values.Get("by_extension"); v != "" {
+		if q.ByExtension, err = strconv.ParseBool(v); err != nil {
+			return q, fmt.Errorf("invalid by_extension value: %w", err)
+		}
+	}
+	return q, nil
+}
+
+// Run returns the summaries of the query, months are rolled up from the daily rows
+func Run(ctx context.Context, db *sqlx.DB, q Query) ([]model.CallSummary, error) {
+	daily, err := dbs.GetDailySummaries(ctx, db, q.From, q.To, q.Extension)
+	if err != nil {
+		return nil, err
+	}
+	type key struct{ period, extension string }
+	sums := make(map[key]*model.CallSummary)
+	var keys []key
+	for _, row := range daily {
+		k := key{period: row.Day.Format("2006-01-02"), extension: row.Extension}
+		if q.Period == PeriodMonth {
+			k.period = row.Day.Format("2006-01")
+		}
+		if !q.ByExtension {
+			k.extension = ""
+		}
+		sum, ok := sums[k]
+		if !ok {
+			sum = &model.CallSummary{Period: k.period, Day: row.Day, Extension: k.extension}
+			sums[k] = sum
+			keys = append(keys, k)
+		}
+		sum.Calls += row.Calls
+		sum.TotalDuration += row.TotalDuration
+		sum.Inbound += row.Inbound
+		sum.Outbound += row.Outbound
+		sum.Flagged += row.Flagged
+		sum.TotalSize += row.TotalSize
+		if row.MaxDuration > sum.MaxDuration {
+			sum.MaxDuration = row.MaxDuration
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].period != keys[j].period {
+			return keys[i].period < keys[j].period
+		}
+		return keys[i].extension < keys[j].extension
+	})
+	summaries := make([]model.CallSummary, 0, len(keys))
+	for _, k := range keys {
+		sum := sums[k]
+		if sum.Calls > 0 {
+			sum.AvgDuration = float64(sum.TotalDuration) / float64(sum.Calls)
+		}
+		summaries = append(summaries, *sum)
+	}
+	return summaries, nil
+}
+
+// Refresh recomputes the summaries of the given days
+func Refresh(ctx context.Context, repo dbs.CDRRepository, days []time.Time) error {
+	CallFrom := "report.Refresh "
+	for _, day := range days {
+		if err := repo.RefreshDailySummary(ctx, day, model.InboundDirections()); err != nil {
+			return err
+		}
+	}
+	li.Logger.L.WithFields(logrus.Fields{
+		"CallFrom": CallFrom,
+		"days":     len(days),
+	}).Info("daily summaries refreshed")
+	return nil
+}
+
+// Rebuild recomputes the summaries of every day from the first day up to but excluding the last,
+// zero times default to the range of calls in rmscdr
+func Rebuild(ctx context.Context, db *sqlx.DB, from time.Time, to time.Time) (int, error) {
+	if from.IsZero() || to.IsZero() {
+		first, last, err := dbs.CDRTimeRange(ctx, db)
+		if err != nil {
+			return 0, err
+		}
+		if first.IsZero() {
+			return 0, nil
+		}
+		if from.IsZero() {
+			from = first
+		}
+		if to.IsZero() {
+			last = last.UTC()
+			to = time.Date(last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+		}
+	}
+	var days []time.Time
+	for day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		days = append(days, day)
+	}
+	return len(days), Refresh(ctx, dbs.NewSQLRepository(db), days)
+}
+
+// Days collects the distinct call days of a batch of CDRs into days
+func Days(batch []model.RMSCDR, days map[time.Time]bool) {
+	for _, cdr := range batch {
+		t := cdr.Time.UTC()
+		days[time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)] = true
+	}
+}
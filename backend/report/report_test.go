@@ -0,0 +1,209 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// day returns the time on a day of 2024 the way the import stores it, the RMS wall clock as utc
+func day(month time.Month, d int, hour int) time.Time {
+	return time.Date(2024, month, d, hour, 0, 0, 0, time.UTC)
+}
+
+// summaryDB opens a new sqlite database holding calls over two days in March and one in April:
+//
+//	4 March: 2001 answers 0821234567 for 60s flagged and 0839876543 for 120s, 2002 calls out for 30s
+//	5 March: 2001 calls out for 10s
+//	1 April: 2001 answers 0821234567 for 40s
+func summaryDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	ctx := context.Background()
+	store, err := dbs.Open(ctx, dbs.DriverSQLite, filepath.Join(t.TempDir(), "report.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := store.DB()
+	t.Cleanup(func() { db.Close() })
+	if err := dbs.PrepareImport(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	calls := []struct {
+		direction, source, destination string
+		at                             time.Time
+		duration                       int64
+		flagged                        bool
+	}{
+		{"Incoming", "0821234567", "2001", day(time.March, 4, 9), 60, true},
+		{"Incoming", "0839876543", "2001", day(time.March, 4, 10), 120, false},
+		{"Outgoing", "2002", "0821234567", day(time.March, 4, 23), 30, false},
+		{"Outgoing", "2001", "0839876543", day(time.March, 5, 0), 10, false},
+		{"Incoming", "0821234567", "2001", day(time.April, 1, 8), 40, false},
+	}
+	cdrs := make([]model.RMSCDR, len(calls))
+	for i, c := range calls {
+		cdrs[i] = model.RMSCDR{
+			UID:           fmt.Sprintf("uid-%d", i),
+			Direction:     c.direction,
+			Time:          c.at,
+			UnixTimestamp: c.at.Unix(),
+			Flagged:       c.flagged,
+			Source:        c.source,
+			Destination:   c.destination,
+			Duration:      c.duration,
+			Size:          float64(c.duration) / 10,
+			FileName:      fmt.Sprintf("%d.wav", i),
+			SipCallID:     fmt.Sprintf("%d@pbx", i),
+		}
+	}
+	if _, err := dbs.InsertCDRsBatch(ctx, db, cdrs); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// rebuilt returns the database with the summaries of every day with calls
+func rebuilt(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db := summaryDB(t)
+	days, err := Rebuild(context.Background(), db, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4 March up to and including 1 April
+	if days != 29 {
+		t.Errorf("rebuilt %d days, want 29", days)
+	}
+	return db
+}
+
+// run returns the report of the query
+func run(t *testing.T, db *sqlx.DB, q Query) []model.CallSummary {
+	t.Helper()
+	if q.From.IsZero() {
+		q.From, q.To = day(time.March, 1, 0), day(time.May, 1, 0)
+	}
+	summaries, err := Run(context.Background(), db, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return summaries
+}
+
+// line formats the counts of a summary
+func line(s model.CallSummary) string {
+	return fmt.Sprintf("%s %s calls=%d total=%d avg=%g max=%d in=%d out=%d flagged=%d size=%g",
+		s.Period, s.Extension, s.Calls, s.TotalDuration, s.AvgDuration, s.MaxDuration, s.Inbound, s.Outbound, s.Flagged, s.TotalSize)
+}
+
+// check compares the summaries with the wanted lines
+func check(t *testing.T, got []model.CallSummary, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		for _, s := range got {
+			t.Log(line(s))
+		}
+		t.Fatalf("got %d summaries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if l := line(got[i]); l != want[i] {
+			t.Errorf("summary %d is\n%s\nwant\n%s", i, l, want[i])
+		}
+	}
+}
+
+func TestDailyByExtension(t *testing.T) {
+	db := rebuilt(t)
+	check(t, run(t, db, Query{Period: PeriodDay, ByExtension: true}),
+		"2024-03-04 2001 calls=2 total=180 avg=90 max=120 in=2 out=0 flagged=1 size=18",
+		"2024-03-04 2002 calls=1 total=30 avg=30 max=30 in=0 out=1 flagged=0 size=3",
+		"2024-03-05 2001 calls=1 total=10 avg=10 max=10 in=0 out=1 flagged=0 size=1",
+		"2024-04-01 2001 calls=1 total=40 avg=40 max=40 in=1 out=0 flagged=0 size=4",
+	)
+}
+
+func TestMonthlyTotals(t *testing.T) {
+	db := rebuilt(t)
+	check(t, run(t, db, Query{Period: PeriodMonth}),
+		"2024-03  calls=4 total=220 avg=55 max=120 in=2 out=2 flagged=1 size=22",
+		"2024-04  calls=1 total=40 avg=40 max=40 in=1 out=0 flagged=0 size=4",
+	)
+	check(t, run(t, db, Query{Period: PeriodMonth, ByExtension: true, Extension: "2001"}),
+		"2024-03 2001 calls=3 total=190 avg=63.333333333333336 max=120 in=2 out=1 flagged=1 size=19",
+		"2024-04 2001 calls=1 total=40 avg=40 max=40 in=1 out=0 flagged=0 size=4",
+	)
+	// the to day is left out
+	check(t, run(t, db, Query{Period: PeriodDay, From: day(time.March, 5, 0), To: day(time.April, 1, 0)}),
+		"2024-03-05  calls=1 total=10 avg=10 max=10 in=0 out=1 flagged=0 size=1",
+	)
+}
+
+func TestRefreshFollowsChanges(t *testing.T) {
+	db := rebuilt(t)
+	ctx := context.Background()
+	if _, err := db.Exec("DELETE FROM rmscdr WHERE uid IN ('uid-0', 'uid-2')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE rmscdr SET duration = 300 WHERE uid = 'uid-3'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Refresh(ctx, dbs.NewSQLRepository(db), []time.Time{day(time.March, 4, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	// 5 March is not refreshed yet, a rebuild of the range catches it up
+	check(t, run(t, db, Query{Period: PeriodDay, ByExtension: true, To: day(time.March, 6, 0), From: day(time.March, 4, 0)}),
+		"2024-03-04 2001 calls=1 total=120 avg=120 max=120 in=1 out=0 flagged=0 size=12",
+		"2024-03-05 2001 calls=1 total=10 avg=10 max=10 in=0 out=1 flagged=0 size=1",
+	)
+	if days, err := Rebuild(ctx, db, day(time.March, 5, 0), day(time.March, 6, 0)); err != nil || days != 1 {
+		t.Fatalf("Rebuild = %d, %v", days, err)
+	}
+	check(t, run(t, db, Query{Period: PeriodDay, ByExtension: true, To: day(time.March, 6, 0), From: day(time.March, 4, 0)}),
+		"2024-03-04 2001 calls=1 total=120 avg=120 max=120 in=1 out=0 flagged=0 size=12",
+		"2024-03-05 2001 calls=1 total=300 avg=300 max=300 in=0 out=1 flagged=0 size=1",
+	)
+}
+
+func TestDays(t *testing.T) {
+	days := make(map[time.Time]bool)
+	Days([]model.RMSCDR{{Time: day(time.March, 4, 0)}, {Time: day(time.March, 4, 23)}, {Time: day(time.March, 5, 0)}}, days)
+	if len(days) != 2 || !days[day(time.March, 4, 0)] || !days[day(time.March, 5, 0)] {
+		t.Errorf("Days = %v, want 4 and 5 March", days)
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	now := time.Date(2024, 3, 10, 15, 4, 5, 0, time.UTC)
+	q, err := ParseValues(url.Values{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.From != day(time.February, 9, 0) || q.To != day(time.March, 11, 0) || q.Period != PeriodDay || !q.ByExtension {
+		t.Errorf("the default query is %+v", q)
+	}
+	q, err = ParseValues(url.Values{"from": {"2024-01-01"}, "to": {"2024-02-01"}, "period": {"month"}, "by_extension": {"false"}, "extension": {"2001"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.From != day(time.January, 1, 0) || q.To != day(time.February, 1, 0) || q.Period != PeriodMonth || q.ByExtension || q.Extension != "2001" {
+		t.Errorf("the query is %+v", q)
+	}
+	for _, bad := range []url.Values{
+		{"from": {"01/02/2024"}},
+		{"from": {"2024-02-01"}, "to": {"2024-02-01"}},
+		{"period": {"week"}},
+		{"by_extension": {"maybe"}},
+	} {
+		if _, err := ParseValues(bad, now); err == nil {
+			t.Errorf("%v was accepted", bad)
+		}
+	}
+}
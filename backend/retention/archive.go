@@ -0,0 +1,270 @@
+package retention
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/privacy"
+)
+
+// unsafeName matches the characters not allowed in archive file names
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// archiveHeader is the csv header of an archive, the rmscdr columns in table order
+var archiveHeader = []string{"id", "uid", "direction", "time", "unix_timestamp", "flagged", "source", "destination",
+	"duration", "size", "exists_in_db", "local_copy", "authentic", "file_name", "sip_call_id"}
+
+// archive is a gzipped csv or json lines file holding purged rows
+type archive struct {
+	path string
+	file *os.File
+	gz   *gzip.Writer
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+// newArchive creates the archive of a rule run under dir
+func newArchive(dir string, rule string, format string, now time.Time) (*archive, error) {
+	if format == "" {
+		format = "csv"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating archive folder %s: %w", dir, err)
+	}
+	ext := ".csv.gz"
+	if format == "json" {
+		ext = ".jsonl.gz"
+	}
+	name := fmt.Sprintf("rmscdr_%s_%s%s", unsafeName.ReplaceAllString(rule, "_"), now.Format("20060102T150405"), ext)
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("creating archive %s: %w", path, err)
+	}
+	a := &archive{path: path, file: file, gz: gzip.NewWriter(file)}
+	if format == "json" {
+		a.json = json.NewEncoder(a.gz)
+		return a, nil
+	}
+	a.csv = csv.NewWriter(a.gz)
+	if err := a.csv.Write(archiveHeader); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Write appends a chunk of rows and syncs them to disk
+func (a *archive) Write(chunk []model.RMSCDR) error {
+	for _, cdr := range chunk {
+		if a.json != nil {
+			if err := a.json.Encode(cdr); err != nil {
+				return err
+			}
+			continue
+		}
+		record := []string{
+			strconv.FormatInt(cdr.ID, 10),
+			cdr.UID,
+			cdr.Direction,
+			cdr.Time.Format(time.RFC3339),
+			strconv.FormatInt(cdr.UnixTimestamp, 10),
+			strconv.FormatBool(cdr.Flagged),
+			cdr.Source,
+			cdr.Destination,
+			strconv.FormatInt(cdr.Duration, 10),
+			strconv.FormatFloat(cdr.Size, 'f', -1, 64),
+			strconv.FormatBool(cdr.ExistsINDB),
+			strconv.FormatBool(cdr.LocalCopy),
+			cdr.Authentic,
+			cdr.FileName,
+			cdr.SipCallID,
+		}
+		if err := a.csv.Write(record); err != nil {
+			return err
+		}
+	}
+	if a.csv != nil {
+		a.csv.Flush()
+		if err := a.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if err := a.gz.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// Close finishes the gzip stream and closes the file
+func (a *archive) Close() error {
+	if a.csv != nil {
+		a.csv.Flush()
+	}
+	err := a.gz.Close()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// the csv columns of an archive holding numbers
+const (
+	archiveSource      = 6
+	archiveDestination = 7
+)
+
+// eraseArchives removes the rows with any of the values as the source or destination from the archives in dir,
+// or replaces the numbers with privacy.Erased when anonymise is set. A changed archive is rewritten through a
+// temporary file, a dry run only counts the rows. It returns the number of archived rows of the subject.
+func eraseArchives(dir string, values []string, anonymise bool, dryRun bool) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading archive folder %s: %w", dir, err)
+	}
+	match := make(map[string]bool, len(values))
+	for _, v := range values {
+		match[v] = true
+	}
+	var total int64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, "rmscdr_") ||
+			!(strings.HasSuffix(name, ".csv.gz") || strings.HasSuffix(name, ".jsonl.gz")) {
+			continue
+		}
+		count, err := eraseArchive(filepath.Join(dir, name), match, anonymise, dryRun)
+		if err != nil {
+			return total, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// eraseArchive erases the matching rows of one archive, the archive is only replaced when rows changed
+func eraseArchive(path string, match map[string]bool, anonymise bool, dryRun bool) (int64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("opening archive %s: %w", path, err)
+	}
+	defer in.Close()
+	gr, err := gzip.NewReader(in)
+	if err != nil {
+		return 0, fmt.Errorf("reading archive %s: %w", path, err)
+	}
+	defer gr.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".erase-*")
+	if err != nil {
+		return 0, fmt.Errorf("creating temporary archive: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	gz := gzip.NewWriter(tmp)
+	var count int64
+	if strings.HasSuffix(path, ".jsonl.gz") {
+		count, err = eraseJSON(gr, gz, match, anonymise)
+	} else {
+		count, err = eraseCSV(gr, gz, match, anonymise)
+	}
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("erasing from archive %s: %w", path, err)
+	}
+	if dryRun || count == 0 {
+		return count, nil
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, fmt.Errorf("replacing archive %s: %w", path, err)
+	}
+	return count, nil
+}
+
+// eraseCSV copies a csv archive without the rows of the subject, or with their numbers erased
+func eraseCSV(r io.Reader, w io.Writer, match map[string]bool, anonymise bool) (int64, error) {
+	cr := csv.NewReader(r)
+	cw := csv.NewWriter(w)
+	var count int64
+	for line := 0; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if line > 0 && len(record) > archiveDestination &&
+			(match[record[archiveSource]] || match[record[archiveDestination]]) {
+			count++
+			if !anonymise {
+				continue
+			}
+			for _, i := range []int{archiveSource, archiveDestination} {
+				if match[record[i]] {
+					record[i] = privacy.Erased
+				}
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return count, err
+		}
+	}
+	cw.Flush()
+	return count, cw.Error()
+}
+
+// eraseJSON copies a json lines archive without the rows of the subject, or with their numbers erased
+func eraseJSON(r io.Reader, w io.Writer, match map[string]bool, anonymise bool) (int64, error) {
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+	var count int64
+	for {
+		var cdr model.RMSCDR
+		err := dec.Decode(&cdr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if match[cdr.Source] || match[cdr.Destination] {
+			count++
+			if !anonymise {
+				continue
+			}
+			if match[cdr.Source] {
+				cdr.Source = privacy.Erased
+			}
+			if match[cdr.Destination] {
+				cdr.Destination = privacy.Erased
+			}
+		}
+		if err := enc.Encode(cdr); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
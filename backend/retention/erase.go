@@ -0,0 +1,209 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/integrity"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/privacy"
+	"github.com/pienaahj/rmsloader/backend/report"
+	"github.com/sirupsen/logrus"
+)
+
+// the erase modes
+const (
+	EraseDelete    = "delete"
+	EraseAnonymise = "anonymise"
+)
+
+// EraseRuleName names the retention audit entries of an erasure, the number itself is never recorded
+const EraseRuleName = "erase-subject"
+
+// EraseOptions changes how a subject is erased
+type EraseOptions struct {
+	// delete or anonymise, defaults to delete
+	Mode string
+	// only count the rows of the subject
+	DryRun bool
+	// the rows changed per transaction, defaults to the retention chunk size
+	ChunkSize int
+	// the folder of the retention archives, the subject is erased from them too. Not set leaves them alone.
+	ArchiveDir string
+}
+
+// EraseResult is the outcome of erasing a subject
+type EraseResult struct {
+	Mode       string    `json:"mode"`
+	Matched    int64     `json:"matched"`
+	Deleted    int64     `json:"deleted"`
+	Anonymised int64     `json:"anonymised"`
+	History    int64     `json:"history"`
+	Archived   int64     `json:"archived"`
+	First      time.Time `json:"first,omitempty"`
+	Last       time.Time `json:"last,omitempty"`
+}
+
+// Erase deletes or anonymises every CDR with number as the source or destination, and the number in the
+// change history of the upserts and the retention archives. It is matched as imported and as its pseudonym.
+// Deleted rows are not archived, and the erasure is recorded in the retention audit log so verify accepts the changes.
+func Erase(ctx context.Context, db *sqlx.DB, number string, opts EraseOptions) (EraseResult, error) {
+	CallFrom := "retention.Erase "
+	if opts.Mode == "" {
+		opts.Mode = EraseDelete
+	}
+	result := EraseResult{Mode: opts.Mode}
+	if opts.Mode != EraseDelete && opts.Mode != EraseAnonymise {
+		return result, fmt.Errorf("unknown erase mode %q, use delete or anonymise", opts.Mode)
+	}
+	values := privacy.Candidates(number)
+	if len(values) == 0 {
+		return result, fmt.Errorf("no digits in the number to erase")
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	where, args := subject(values)
+	matched, first, last, err := dbs.CountCDRsWhere(ctx, db, where, args)
+	if err != nil {
+		return result, fmt.Errorf("counting the rows of the subject: %w", err)
+	}
+	result.Matched = matched
+	if matched > 0 {
+		result.First, result.Last = time.Unix(first, 0), time.Unix(last, 0)
+	}
+	li.Logger.L.WithFields(logrus.Fields{
+		"CallFrom": CallFrom,
+		"mode":     opts.Mode,
+		"matched":  matched,
+		"dry_run":  opts.DryRun,
+	}).Info("erase subject evaluated")
+
+	audit := model.RetentionAudit{
+		RuleName:    EraseRuleName + ":" + opts.Mode,
+		Cutoff:      time.Now(),
+		DryRun:      opts.DryRun,
+		RowsMatched: matched,
+		StartedAt:   time.Now(),
+	}
+	if opts.DryRun {
+		if opts.ArchiveDir != "" {
+			if result.Archived, err = eraseArchives(opts.ArchiveDir, values, false, true); err != nil {
+				return result, err
+			}
+		}
+		finished := time.Now()
+		audit.FinishedAt = &finished
+		return result, dbs.StartRetentionAudit(ctx, db, &audit)
+	}
+	if err := dbs.StartRetentionAudit(ctx, db, &audit); err != nil {
+		return result, err
+	}
+	days := make(map[time.Time]bool)
+	if opts.Mode == EraseDelete {
+		result.Deleted, err = eraseRows(ctx, db, where, args, chunkSize, func(chunk []model.RMSCDR) (int64, error) {
+			count, err := dbs.PurgeCDRs(ctx, db, audit.ID, chunk)
+			if err == nil {
+				report.Days(chunk, days)
+			}
+			return count, err
+		})
+		if refreshErr := refreshSummaries(context.WithoutCancel(ctx), db, days); refreshErr != nil && err == nil {
+			err = refreshErr
+		}
+	} else {
+		result.Anonymised, err = eraseRows(ctx, db, where, args, chunkSize, func(chunk []model.RMSCDR) (int64, error) {
+			return anonymise(ctx, db, chunk, values)
+		})
+	}
+	if err == nil {
+		result.History, err = dbs.EraseHistory(ctx, db, values, opts.Mode == EraseAnonymise, privacy.Erased)
+	}
+	if err == nil && opts.ArchiveDir != "" {
+		result.Archived, err = eraseArchives(opts.ArchiveDir, values, opts.Mode == EraseAnonymise, false)
+	}
+	finished := time.Now()
+	audit.RowsDeleted, audit.FinishedAt = result.Deleted, &finished
+	if auditErr := dbs.FinishRetentionAudit(ctx, db, &audit); auditErr != nil && err == nil {
+		err = auditErr
+	}
+	if err != nil {
+		return result, fmt.Errorf("erasing the subject: %w", err)
+	}
+	li.Logger.L.WithFields(logrus.Fields{
+		"CallFrom":   CallFrom,
+		"mode":       opts.Mode,
+		"deleted":    result.Deleted,
+		"anonymised": result.Anonymised,
+		"history":    result.History,
+		"archived":   result.Archived,
+	}).Info("erase subject complete")
+	return result, nil
+}
+
+// subject builds the where clause of the rows with any of the values as the source or destination
+func subject(values []string) (string, []interface{}) {
+	in := "(" + strings.TrimSuffix(strings.Repeat("?,", len(values)), ",") + ")"
+	args := make([]interface{}, 0, 2*len(values))
+	for range 2 {
+		for _, v := range values {
+			args = append(args, v)
+		}
+	}
+	return "source IN " + in + " OR destination IN " + in, args
+}
+
+// eraseRows applies erase to the matching rows chunk by chunk
+func eraseRows(ctx context.Context, db *sqlx.DB, where string, args []interface{}, chunkSize int,
+	erase func([]model.RMSCDR) (int64, error)) (int64, error) {
+	var changed, afterID int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return changed, err
+		}
+		chunk, err := dbs.SelectCDRChunk(ctx, db, where, args, afterID, chunkSize)
+		if err != nil {
+			return changed, err
+		}
+		if len(chunk) == 0 {
+			return changed, nil
+		}
+		count, err := erase(chunk)
+		if err != nil {
+			return changed, err
+		}
+		changed += count
+		afterID = chunk[len(chunk)-1].ID
+	}
+}
+
+// anonymise replaces the values in a chunk and chains the changed rows when the hash chain is kept,
+// so verify compares the rows with their anonymised hashes
+func anonymise(ctx context.Context, db *sqlx.DB, chunk []model.RMSCDR, values []string) (int64, error) {
+	match := make(map[string]bool, len(values))
+	for _, v := range values {
+		match[v] = true
+	}
+	for i := range chunk {
+		if match[chunk[i].Source] {
+			chunk[i].Source = privacy.Erased
+		}
+		if match[chunk[i].Destination] {
+			chunk[i].Destination = privacy.Erased
+		}
+	}
+	var chained func(dbs.CDRTx, []model.RMSCDR) error
+	if model.Settings.Integrity.HashChain {
+		chained = func(tx dbs.CDRTx, rows []model.RMSCDR) error {
+			return integrity.AppendChain(ctx, tx, rows)
+		}
+	}
+	return dbs.AnonymiseCDRs(ctx, db, chunk, chained)
+}
@@ -0,0 +1,195 @@
+package retention
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/integrity"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/privacy"
+)
+
+const subjectNumber = "0821234567"
+
+// chainedDB opens a sqlite database holding the calls of the subject and of another number,
+// with the calls linked in the hash chain like an import with integrity.hash_chain does
+func chainedDB(t *testing.T) (*sqlx.DB, []model.RMSCDR) {
+	t.Helper()
+	saved := model.Settings
+	t.Cleanup(func() { model.Settings = saved })
+	model.Settings.Integrity.HashChain = true
+
+	at := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	cdrs := []model.RMSCDR{
+		call("1", subjectNumber, at),
+		call("2", "0839876543", at.Add(time.Minute)),
+		call("3", subjectNumber, at.Add(2*time.Minute)),
+	}
+	cdrs[2].Source, cdrs[2].Destination = "2001", subjectNumber
+	db := sqliteDB(t, cdrs)
+	ctx := context.Background()
+	tx, err := dbs.NewSQLRepository(db).Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := integrity.AppendChain(ctx, tx, cdrs); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return db, cdrs
+}
+
+// verify fails the test when the hash chain reports tampering
+func verify(t *testing.T, db *sqlx.DB) {
+	t.Helper()
+	var report integrity.Report
+	if err := integrity.VerifyChain(context.Background(), db, &report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("verify found %+v", report)
+	}
+}
+
+// stored returns the calls left in rmscdr
+func stored(t *testing.T, db *sqlx.DB) []model.RMSCDR {
+	t.Helper()
+	rows, err := dbs.SelectCDRChunk(context.Background(), db, "1 = 1", nil, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// readArchive returns the unzipped content of an archive
+func readArchive(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestEraseDelete(t *testing.T) {
+	db, _ := chainedDB(t)
+	verify(t, db)
+
+	r, err := Erase(context.Background(), db, "082 123 4567", EraseOptions{Mode: EraseDelete})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Matched != 2 || r.Deleted != 2 || r.Anonymised != 0 {
+		t.Errorf("result %+v, want the 2 calls of the subject deleted", r)
+	}
+	rows := stored(t, db)
+	if len(rows) != 1 || rows[0].UID != "uid-2" {
+		t.Errorf("left %+v, want only the call of the other number", rows)
+	}
+	verify(t, db)
+}
+
+func TestEraseAnonymise(t *testing.T) {
+	db, _ := chainedDB(t)
+
+	r, err := Erase(context.Background(), db, subjectNumber, EraseOptions{Mode: EraseAnonymise, ChunkSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Matched != 2 || r.Anonymised != 2 || r.Deleted != 0 {
+		t.Errorf("result %+v, want the 2 calls of the subject anonymised", r)
+	}
+	rows := stored(t, db)
+	if len(rows) != 3 {
+		t.Fatalf("left %d calls, want all 3 kept", len(rows))
+	}
+	for _, cdr := range rows {
+		if cdr.Source == subjectNumber || cdr.Destination == subjectNumber {
+			t.Errorf("%s still holds the number: %+v", cdr.UID, cdr)
+		}
+	}
+	if rows[0].Source != privacy.Erased || rows[2].Destination != privacy.Erased || rows[2].Source != "2001" {
+		t.Errorf("the numbers are not replaced by %q: %+v", privacy.Erased, rows)
+	}
+	verify(t, db)
+}
+
+func TestEraseDryRunChangesNothing(t *testing.T) {
+	db, _ := chainedDB(t)
+
+	r, err := Erase(context.Background(), db, subjectNumber, EraseOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Matched != 2 || r.Deleted != 0 {
+		t.Errorf("result %+v, want the 2 calls counted only", r)
+	}
+	if rows := stored(t, db); len(rows) != 3 {
+		t.Errorf("a dry run left %d calls", len(rows))
+	}
+}
+
+func TestEraseArchives(t *testing.T) {
+	for _, format := range []string{"csv", "json"} {
+		for _, mode := range []string{EraseDelete, EraseAnonymise} {
+			t.Run(format+"/"+mode, func(t *testing.T) {
+				db, cdrs := chainedDB(t)
+				dir := t.TempDir()
+				arc, err := newArchive(dir, "old", format, time.Now())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := arc.Write(cdrs); err != nil {
+					t.Fatal(err)
+				}
+				if err := arc.Close(); err != nil {
+					t.Fatal(err)
+				}
+				r, err := Erase(context.Background(), db, subjectNumber, EraseOptions{Mode: mode, DryRun: true, ArchiveDir: dir})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.Archived != 2 || !strings.Contains(readArchive(t, arc.path), subjectNumber) {
+					t.Errorf("a dry run counted %d archived rows or changed the archive", r.Archived)
+				}
+
+				r, err = Erase(context.Background(), db, subjectNumber, EraseOptions{Mode: mode, ArchiveDir: dir})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.Archived != 2 {
+					t.Errorf("erased %d archived rows, want 2", r.Archived)
+				}
+				content := readArchive(t, arc.path)
+				if strings.Contains(content, subjectNumber) {
+					t.Errorf("the archive still holds the number:\n%s", content)
+				}
+				if !strings.Contains(content, "0839876543") {
+					t.Errorf("the call of the other number is gone:\n%s", content)
+				}
+				if got := strings.Contains(content, privacy.Erased); got != (mode == EraseAnonymise) {
+					t.Errorf("the archive holds %q: %v\n%s", privacy.Erased, got, content)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Package retention expires CDRs according to the configured rules, archiving them before they are deleted
+package retention
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/report"
+	"github.com/sirupsen/logrus"
+)
+
+// the default number of rows archived and deleted per transaction
+const defaultChunkSize = 1000
+
+// Options changes how the rules are applied
+type Options struct {
+	// only count the expiring rows
+	DryRun bool
+	// apply only the named rule
+	Rule string
+	// the reference time for the cutoffs, defaults to now
+	Now time.Time
+}
+
+// RuleResult is the outcome of applying one rule
+type RuleResult struct {
+	Rule    string    `json:"rule"`
+	Cutoff  time.Time `json:"cutoff"`
+	Matched int64     `json:"matched"`
+	Deleted int64     `json:"deleted"`
+	// time range of the expiring rows
+	First   time.Time `json:"first,omitempty"`
+	Last    time.Time `json:"last,omitempty"`
+	Archive string    `json:"archive,omitempty"`
+}
+
+// Validate checks the rules before anything is deleted
+func Validate(settings model.RetentionSettings) error {
+	names := make(map[string]bool)
+	for i, rule := range settings.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("retention rule %d has no name", i+1)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("retention rule %q is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+		where, _ := condition(rule)
+		if rule.Keep && where == "" {
+			return fmt.Errorf("keep rule %q matches every row, give it a filter", rule.Name)
+		}
+		if !rule.Keep && rule.MaxAgeDays <= 0 {
+			return fmt.Errorf("retention rule %q needs max_age_days above zero", rule.Name)
+		}
+	}
+	switch settings.ArchiveFormat {
+	case "", "csv", "json":
+	default:
+		return fmt.Errorf("unknown archive format %q, use csv or json", settings.ArchiveFormat)
+	}
+	return nil
+}
+
+// condition builds the where clause of the row filters of a rule, empty if the rule has none
+func condition(rule model.RetentionRule) (string, []interface{}) {
+	var parts []string
+	var args []interface{}
+	// a NULL flagged or direction is compared as unflagged or empty, so keep rules never hold on to it
+	if rule.Flagged != nil {
+		parts = append(parts, "COALESCE(flagged, FALSE) = ?")
+		args = append(args, *rule.Flagged)
+	}
+	if len(rule.Authentic) > 0 {
+		parts = append(parts, "COALESCE(authentic, '') IN ("+strings.TrimSuffix(strings.Repeat("?,", len(rule.Authentic)), ",")+")")
+		for _, value := range rule.Authentic {
+			args = append(args, value)
+		}
+	}
+	if rule.Direction != "" {
+		parts = append(parts, "COALESCE(direction, '') = ?")
+		args = append(args, rule.Direction)
+	}
+	return strings.Join(parts, " AND "), args
+}
+
+// expiring builds the where clause of the rows a purge rule expires, leaving out the rows of every keep rule
+func expiring(rule model.RetentionRule, cutoff time.Time, keep []model.RetentionRule) (string, []interface{}) {
+	parts := []string{"unix_timestamp < ?"}
+	args := []interface{}{cutoff.Unix()}
+	if where, whereArgs := condition(rule); where != "" {
+		parts = append(parts, where)
+		args = append(args, whereArgs...)
+	}
+	for _, k := range keep {
+		where, whereArgs := condition(k)
+		parts = append(parts, "NOT ("+where+")")
+		args = append(args, whereArgs...)
+	}
+	return strings.Join(parts, " AND "), args
+}
+
+// Run applies the retention rules in order. Expiring rows are written to a gzipped archive under archiveDir
+// and deleted in chunks, every purge gets an entry in the retention audit log.
+func Run(ctx context.Context, db *sqlx.DB, settings model.RetentionSettings, archiveDir string, opts Options) ([]RuleResult, error) {
+	CallFrom := "retention.Run "
+	if err := Validate(settings); err != nil {
+		return nil, err
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	chunkSize := settings.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	var keep []model.RetentionRule
+	for _, rule := range settings.Rules {
+		if rule.Keep {
+			keep = append(keep, rule)
+		}
+	}
+
+	var results []RuleResult
+	for _, rule := range settings.Rules {
+		if rule.Keep || (opts.Rule != "" && opts.Rule != rule.Name) {
+			continue
+		}
+		cutoff := now.AddDate(0, 0, -rule.MaxAgeDays)
+		where, args := expiring(rule, cutoff, keep)
+		matched, first, last, err := dbs.CountCDRsWhere(ctx, db, where, args)
+		if err != nil {
+			return results, fmt.Errorf("counting rows for rule %s: %w", rule.Name, err)
+		}
+		result := RuleResult{Rule: rule.Name, Cutoff: cutoff, Matched: matched}
+		if matched > 0 {
+			result.First, result.Last = time.Unix(first, 0), time.Unix(last, 0)
+		}
+		li.Logger.L.WithFields(logrus.Fields{
+			"CallFrom": CallFrom,
+			"rule":     rule.Name,
+			"cutoff":   cutoff,
+			"matched":  matched,
+			"dry_run":  opts.DryRun,
+		}).Info("retention rule evaluated")
+
+		audit := model.RetentionAudit{
+			RuleName:    rule.Name,
+			Cutoff:      cutoff,
+			DryRun:      opts.DryRun,
+			RowsMatched: matched,
+			StartedAt:   time.Now(),
+		}
+		if opts.DryRun || matched == 0 {
+			finished := time.Now()
+			audit.FinishedAt = &finished
+			if err := dbs.StartRetentionAudit(ctx, db, &audit); err != nil {
+				return results, err
+			}
+			results = append(results, result)
+			continue
+		}
+		if err := dbs.StartRetentionAudit(ctx, db, &audit); err != nil {
+			return results, err
+		}
+		days := make(map[time.Time]bool)
+		result.Deleted, result.Archive, err = purge(ctx, db, rule, where, args, audit.ID, settings.ArchiveFormat, archiveDir, chunkSize, now, days)
+		// the summaries of the purged days would still count the deleted calls, even after a purge that stopped
+		if refreshErr := refreshSummaries(context.WithoutCancel(ctx), db, days); refreshErr != nil && err == nil {
+			err = refreshErr
+		}
+		finished := time.Now()
+		audit.RowsDeleted, audit.ArchiveFile, audit.FinishedAt = result.Deleted, result.Archive, &finished
+		if auditErr := dbs.FinishRetentionAudit(ctx, db, &audit); auditErr != nil && err == nil {
+			err = auditErr
+		}
+		results = append(results, result)
+		if err != nil {
+			return results, fmt.Errorf("purging rows for rule %s: %w", rule.Name, err)
+		}
+		li.Logger.L.WithFields(logrus.Fields{
+			"CallFrom": CallFrom,
+			"rule":     rule.Name,
+			"deleted":  result.Deleted,
+			"archive":  result.Archive,
+		}).Info("retention purge complete")
+	}
+	return results, nil
+}
+
+// purge archives and deletes the expiring rows of a rule chunk by chunk, the call days of the deleted rows
+// are collected into days
+func purge(ctx context.Context, db *sqlx.DB, rule model.RetentionRule, where string, args []interface{}, auditID int64,
+	format string, archiveDir string, chunkSize int, now time.Time, days map[time.Time]bool) (int64, string, error) {
+	arc, err := newArchive(archiveDir, rule.Name, format, now)
+	if err != nil {
+		return 0, "", err
+	}
+	var deleted, afterID int64
+	for {
+		if err := ctx.Err(); err != nil {
+			arc.Close()
+			return deleted, arc.path, err
+		}
+		chunk, err := dbs.SelectCDRChunk(ctx, db, where, args, afterID, chunkSize)
+		if err != nil {
+			arc.Close()
+			return deleted, arc.path, err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		// the rows must be safely on disk before they are deleted
+		if err := arc.Write(chunk); err != nil {
+			arc.Close()
+			return deleted, arc.path, err
+		}
+		count, err := dbs.PurgeCDRs(ctx, db, auditID, chunk)
+		if err != nil {
+			arc.Close()
+			return deleted, arc.path, err
+		}
+		deleted += count
+		report.Days(chunk, days)
+		afterID = chunk[len(chunk)-1].ID
+	}
+	return deleted, arc.path, arc.Close()
+}
+
+// refreshSummaries recomputes the daily summaries of the days calls were deleted from, when the summaries are kept
+func refreshSummaries(ctx context.Context, db *sqlx.DB, days map[time.Time]bool) error {
+	if !model.Settings.Summary.Enabled || len(days) == 0 {
+		return nil
+	}
+	var touched []time.Time
+	for day := range days {
+		touched = append(touched, day)
+	}
+	if err := report.Refresh(ctx, dbs.NewSQLRepository(db), touched); err != nil {
+		return fmt.Errorf("refreshing daily summaries: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package retention
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/report"
+)
+
+// sqliteDB opens a new sqlite database holding the given calls
+func sqliteDB(t *testing.T, cdrs []model.RMSCDR) *sqlx.DB {
+	t.Helper()
+	ctx := context.Background()
+	store, err := dbs.Open(ctx, dbs.DriverSQLite, filepath.Join(t.TempDir(), "retention.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := store.DB()
+	t.Cleanup(func() { db.Close() })
+	if err := dbs.PrepareImport(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbs.InsertCDRsBatch(ctx, db, cdrs); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// call is an incoming call to extension 2001 from number at the given time
+func call(id string, number string, at time.Time) model.RMSCDR {
+	return model.RMSCDR{
+		UID:           "uid-" + id,
+		Direction:     "Incoming",
+		Time:          at,
+		UnixTimestamp: at.Unix(),
+		Source:        number,
+		Destination:   "2001",
+		Duration:      60,
+		FileName:      "in-" + id + ".wav",
+		SipCallID:     id + "@pbx",
+	}
+}
+
+// summarySettings keeps the daily summaries for one test
+func summarySettings(t *testing.T) {
+	t.Helper()
+	saved := model.Settings
+	t.Cleanup(func() { model.Settings = saved })
+	model.Settings.Summary = model.SummarySettings{Enabled: true, InboundDirections: []string{"Incoming"}}
+}
+
+func TestValidate(t *testing.T) {
+	flagged := true
+	tests := []struct {
+		name     string
+		settings model.RetentionSettings
+		valid    bool
+	}{
+		{"purge and keep", model.RetentionSettings{Rules: []model.RetentionRule{
+			{Name: "flagged", Keep: true, Flagged: &flagged},
+			{Name: "old", MaxAgeDays: 90},
+		}}, true},
+		{"json archive", model.RetentionSettings{ArchiveFormat: "json"}, true},
+		{"no name", model.RetentionSettings{Rules: []model.RetentionRule{{MaxAgeDays: 90}}}, false},
+		{"twice", model.RetentionSettings{Rules: []model.RetentionRule{{Name: "old", MaxAgeDays: 90}, {Name: "old", MaxAgeDays: 30}}}, false},
+		{"keep everything", model.RetentionSettings{Rules: []model.RetentionRule{{Name: "all", Keep: true}}}, false},
+		{"no age", model.RetentionSettings{Rules: []model.RetentionRule{{Name: "old"}}}, false},
+		{"unknown format", model.RetentionSettings{ArchiveFormat: "xml"}, false},
+	}
+	for _, tt := range tests {
+		if err := Validate(tt.settings); (err == nil) != tt.valid {
+			t.Errorf("%s: Validate = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+// retentionDB holds calls old enough to expire: unflagged, flagged, with a NULL flagged and with a NULL
+// direction, and one recent call
+func retentionDB(t *testing.T, now time.Time) *sqlx.DB {
+	t.Helper()
+	old := now.AddDate(0, 0, -100)
+	flagged := call("flagged", "0821234567", old.Add(time.Minute))
+	flagged.Flagged = true
+	db := sqliteDB(t, []model.RMSCDR{
+		call("old", "0821234567", old),
+		flagged,
+		call("null-flag", "0821234567", old.Add(2*time.Minute)),
+		call("null-direction", "0821234567", old.Add(3*time.Minute)),
+		call("new", "0821234567", now.AddDate(0, 0, -1)),
+	})
+	for _, stmt := range []string{
+		"UPDATE rmscdr SET flagged = NULL WHERE uid = 'uid-null-flag'",
+		"UPDATE rmscdr SET direction = NULL WHERE uid = 'uid-null-direction'",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// uids returns the uids of the calls left, in id order
+func uids(t *testing.T, db *sqlx.DB) []string {
+	t.Helper()
+	var left []string
+	if err := db.Select(&left, "SELECT uid FROM rmscdr ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	return left
+}
+
+func TestRunArchivesAndPurges(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	db := retentionDB(t, now)
+	flagged := true
+	settings := model.RetentionSettings{ChunkSize: 1, Rules: []model.RetentionRule{
+		{Name: "flagged", Keep: true, Flagged: &flagged},
+		{Name: "outgoing", Keep: true, Direction: "Outgoing"},
+		{Name: "old", MaxAgeDays: 90},
+	}}
+	dir := t.TempDir()
+
+	results, err := Run(context.Background(), db, settings, dir, Options{Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Matched != 3 || results[0].Deleted != 3 {
+		t.Fatalf("results %+v, want 3 old calls deleted", results)
+	}
+	// the calls with a NULL flagged or direction are not held by the keep rules
+	if left := uids(t, db); strings.Join(left, ",") != "uid-flagged,uid-new" {
+		t.Errorf("left %v, want the flagged and the new call", left)
+	}
+	content := readArchive(t, results[0].Archive)
+	if lines := strings.Split(strings.TrimSpace(content), "\n"); len(lines) != 4 || !strings.HasPrefix(lines[0], "id,uid,") {
+		t.Errorf("the archive holds %d lines, want the header and 3 calls:\n%s", len(lines), content)
+	}
+	for _, uid := range []string{"uid-old", "uid-null-flag", "uid-null-direction"} {
+		if !strings.Contains(content, uid) {
+			t.Errorf("%s is not archived", uid)
+		}
+	}
+	var purged, audits int
+	if err := db.Get(&purged, "SELECT COUNT(*) FROM retention_purged"); err != nil || purged != 3 {
+		t.Errorf("recorded %d purged uids, %v", purged, err)
+	}
+	if err := db.Get(&audits, "SELECT COUNT(*) FROM retention_audit WHERE rule_name = 'old' AND rows_deleted = 3 AND finished_at IS NOT NULL"); err != nil || audits != 1 {
+		t.Errorf("recorded %d finished audit entries, %v", audits, err)
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	db := retentionDB(t, now)
+	settings := model.RetentionSettings{Rules: []model.RetentionRule{{Name: "old", MaxAgeDays: 90}}}
+	dir := filepath.Join(t.TempDir(), "retention")
+
+	results, err := Run(context.Background(), db, settings, dir, Options{Now: now, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Matched != 4 || results[0].Deleted != 0 {
+		t.Errorf("results %+v, want 4 calls counted only", results)
+	}
+	if left := uids(t, db); len(left) != 5 {
+		t.Errorf("a dry run left %d calls", len(left))
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("a dry run wrote an archive folder: %v", err)
+	}
+}
+
+func TestRunOneRule(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	db := retentionDB(t, now)
+	settings := model.RetentionSettings{ArchiveFormat: "json", Rules: []model.RetentionRule{
+		{Name: "incoming", MaxAgeDays: 90, Direction: "Incoming"},
+		{Name: "everything", MaxAgeDays: 30},
+	}}
+
+	results, err := Run(context.Background(), db, settings, t.TempDir(), Options{Now: now, Rule: "incoming"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Rule != "incoming" || results[0].Deleted != 3 {
+		t.Fatalf("results %+v, want only the incoming rule", results)
+	}
+	if !strings.HasSuffix(results[0].Archive, ".jsonl.gz") || !strings.Contains(readArchive(t, results[0].Archive), `"uid":"uid-old"`) {
+		t.Errorf("the archive %s is not json lines", results[0].Archive)
+	}
+}
+
+func TestRunRefreshesPurgedDays(t *testing.T) {
+	summarySettings(t)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	old := time.Date(2024, 1, 10, 9, 0, 0, 0, time.UTC)
+	db := sqliteDB(t, []model.RMSCDR{
+		call("1", "0821234567", old),
+		call("2", "0821234567", old.Add(time.Hour)),
+		call("3", "0821234567", now.AddDate(0, 0, -1)),
+	})
+	ctx := context.Background()
+	if _, err := report.Rebuild(ctx, db, time.Time{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	settings := model.RetentionSettings{Rules: []model.RetentionRule{{Name: "old", MaxAgeDays: 90}}}
+
+	results, err := Run(ctx, db, settings, t.TempDir(), Options{Now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Deleted != 2 {
+		t.Fatalf("results %+v, want the 2 old calls deleted", results)
+	}
+	summaries, err := dbs.GetDailySummaries(ctx, db, old.AddDate(0, 0, -1), now.AddDate(0, 0, 1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int64
+	for _, s := range summaries {
+		if s.Day.Before(now.AddDate(0, 0, -90)) {
+			t.Errorf("the purged day %s is still summarised as %+v", s.Day.Format("2006-01-02"), s)
+		}
+		calls += s.Calls
+	}
+	if calls != 1 {
+		t.Errorf("the summaries count %d calls, want the 1 left", calls)
+	}
+}
@@ -0,0 +1,308 @@
+// Package schedule runs the import, the retention rules and the rebuild of the report summaries at the times
+// of cron expressions, while the loader runs as a server. Every job takes a lock in the database before it
+// starts, so two loaders never run the same job at once, and every execution is recorded in job_runs.
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/process"
+	"github.com/pienaahj/rmsloader/backend/report"
+	"github.com/pienaahj/rmsloader/backend/retention"
+	"github.com/pienaahj/rmsloader/backend/source"
+)
+
+// the kinds of job
+const (
+	KindImport    = "import"
+	KindRetention = "retention"
+	KindReport    = "report"
+)
+
+// the defaults of the schedule settings
+const (
+	defaultTimeZone    = "Africa/Johannesburg"
+	defaultLockMinutes = 120
+)
+
+// RunFunc runs one job
+type RunFunc func(ctx context.Context, db *sqlx.DB, job model.ScheduledJob) error
+
+// Planned is the next time a job runs
+type Planned struct {
+	Job  model.ScheduledJob
+	Next time.Time
+}
+
+// Scheduler runs the jobs of the schedule settings
+type Scheduler struct {
+	db       *sqlx.DB
+	settings model.ScheduleSettings
+	loc      *time.Location
+	jobs     []entry
+	// Run runs a job, the kinds of this package unless a test replaces it
+	Run RunFunc
+}
+
+// entry is a job with its parsed cron expression
+type entry struct {
+	job      model.ScheduledJob
+	schedule cron.Schedule
+}
+
+// New returns the scheduler of the settings, the jobs are checked first
+func New(db *sqlx.DB, settings model.ScheduleSettings) (*Scheduler, error) {
+	if err := Validate(settings); err != nil {
+		return nil, err
+	}
+	loc, _ := time.LoadLocation(timeZone(settings))
+	s := &Scheduler{
+		db:       db,
+		settings: settings,
+		loc:      loc,
+		Run:      RunJob,
+	}
+	for _, job := range settings.Jobs {
+		schedule, _ := cron.ParseStandard(job.Cron)
+		s.jobs = append(s.jobs, entry{job: job, schedule: schedule})
+	}
+	return s, nil
+}
+
+// Validate checks the time zone and the jobs of the schedule
+func Validate(settings model.ScheduleSettings) error {
+	invalid := func(msg string) error {
+		return apperr.New(apperr.ConfigInvalid, "schedule.Validate", msg)
+	}
+	if _, err := time.LoadLocation(timeZone(settings)); err != nil {
+		return invalid(fmt.Sprintf("unknown schedule time_zone %q", settings.TimeZone))
+	}
+	names := make(map[string]bool)
+	for _, job := range settings.Jobs {
+		if job.Name == "" {
+			return invalid("every scheduled job needs a name")
+		}
+		if names[job.Name] {
+			return invalid(fmt.Sprintf("the job name %q is used twice", job.Name))
+		}
+		names[job.Name] = true
+		switch job.Kind {
+		case KindImport, KindRetention, KindReport:
+		default:
+			return invalid(fmt.Sprintf("job %s: unknown kind %q, use import, retention or report", job.Name, job.Kind))
+		}
+		if _, err := cron.ParseStandard(job.Cron); err != nil {
+			return invalid(fmt.Sprintf("job %s: cron %q: %v", job.Name, job.Cron, err))
+		}
+	}
+	return nil
+}
+
+// Start runs every job at the times of its cron expression until ctx is done, then waits for the running
+// jobs to stop. A job still running at its next time skips that time.
+func (s *Scheduler) Start(ctx context.Context) error {
+	li.Logger.L.WithFields(logrus.Fields{
+		"jobs": len(s.jobs),
+	}).Info("scheduler started")
+	var wg sync.WaitGroup
+	for _, e := range s.jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.loop(ctx, e)
+		}()
+	}
+	wg.Wait()
+	li.Logger.L.Info("scheduler stopped")
+	return ctx.Err()
+}
+
+// loop waits for the next time of a job and runs it, until ctx is done
+func (s *Scheduler) loop(ctx context.Context, e entry) {
+	for {
+		next := e.schedule.Next(time.Now().In(s.loc))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		// the outcome is logged and recorded, the next time runs either way
+		s.Execute(ctx, e.job, next)
+	}
+}
+
+// Execute runs a job now under its lock and records the outcome. A job whose lock is held elsewhere is
+// recorded as skipped. The lock is renewed while the job runs, a job whose lock was taken over is stopped.
+func (s *Scheduler) Execute(ctx context.Context, job model.ScheduledJob, scheduledAt time.Time) (*model.JobRun, error) {
+	ctx = li.WithFields(ctx, logrus.Fields{"job": job.Name})
+	log := li.FromContext(ctx)
+	host, _ := os.Hostname()
+	run := &model.JobRun{
+		Job:         job.Name,
+		Kind:        job.Kind,
+		Host:        host,
+		Status:      model.JobRunning,
+		ScheduledAt: scheduledAt,
+		StartedAt:   time.Now(),
+	}
+	lock, err := dbs.AcquireTableLock(ctx, s.db, "schedule:"+job.Name, dbs.LockHolder(), s.lockTTL()/3)
+	if err != nil && !errors.Is(err, apperr.ErrDBLocked) {
+		log.WithFields(logrus.Fields{"err": err}).Error("could not take the lock of the scheduled job")
+		return nil, err
+	}
+	if err != nil {
+		run.Status = model.JobSkipped
+		run.Error = "the job is running elsewhere"
+		now := time.Now()
+		run.FinishedAt = &now
+		log.Warn("scheduled job skipped, it is running elsewhere")
+		return run, dbs.StartJobRun(ctx, s.db, run)
+	}
+	defer func() {
+		if err := lock.Release(context.WithoutCancel(ctx)); err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("could not release the lock of the scheduled job")
+		}
+	}()
+	locked, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-lock.Lost():
+			cancel(apperr.New(apperr.DBLockLost, "schedule.Execute", "the lock of job "+job.Name+" was lost, the job stopped"))
+		case <-locked.Done():
+		}
+	}()
+	if err := dbs.StartJobRun(ctx, s.db, run); err != nil {
+		return nil, err
+	}
+	log.WithFields(logrus.Fields{"kind": job.Kind, "scheduled_at": scheduledAt}).Info("scheduled job started")
+	runErr := s.Run(locked, s.db, job)
+	if cause := context.Cause(locked); runErr != nil && errors.Is(cause, apperr.ErrDBLockLost) {
+		runErr = cause
+	}
+	now := time.Now()
+	run.FinishedAt = &now
+	switch {
+	case runErr == nil:
+		run.Status = model.JobSucceeded
+	case errors.Is(runErr, process.ErrNoFiles):
+		// nothing was waiting to be imported, that is not a failure of a scheduled import
+		run.Status = model.JobSucceeded
+		run.Error = runErr.Error()
+	case errors.Is(runErr, apperr.ErrDBLocked):
+		// another loader is importing into the database under the import lock
+		run.Status = model.JobSkipped
+		run.Error = runErr.Error()
+	default:
+		run.Status = model.JobFailed
+		run.Error = runErr.Error()
+	}
+	if err := dbs.FinishJobRun(context.WithoutCancel(ctx), s.db, run); err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("could not record the finished job run")
+	}
+	entry := log.WithFields(logrus.Fields{
+		"status":  run.Status,
+		"seconds": now.Sub(run.StartedAt).Seconds(),
+	})
+	switch run.Status {
+	case model.JobFailed:
+		entry.WithFields(logrus.Fields{"err": runErr}).Error("scheduled job failed")
+	case model.JobSkipped:
+		entry.Warn("scheduled job skipped, another import is running")
+	default:
+		entry.Info("scheduled job finished")
+	}
+	return run, runErr
+}
+
+// Job returns the job of the schedule with the given name
+func (s *Scheduler) Job(name string) (model.ScheduledJob, bool) {
+	for _, e := range s.jobs {
+		if e.job.Name == name {
+			return e.job, true
+		}
+	}
+	return model.ScheduledJob{}, false
+}
+
+// Next returns the next time of every job after now, soonest first
+func (s *Scheduler) Next(now time.Time) []Planned {
+	planned := make([]Planned, 0, len(s.jobs))
+	for _, e := range s.jobs {
+		planned = append(planned, Planned{Job: e.job, Next: e.schedule.Next(now.In(s.loc))})
+	}
+	sort.SliceStable(planned, func(i, j int) bool { return planned[i].Next.Before(planned[j].Next) })
+	return planned
+}
+
+func (s *Scheduler) lockTTL() time.Duration {
+	if s.settings.LockMinutes > 0 {
+		return time.Duration(s.settings.LockMinutes) * time.Minute
+	}
+	return defaultLockMinutes * time.Minute
+}
+
+// RunJob runs a job of one of the kinds of this package
+func RunJob(ctx context.Context, db *sqlx.DB, job model.ScheduledJob) error {
+	switch job.Kind {
+	case KindImport:
+		return runImport(ctx, db)
+	case KindRetention:
+		// the purge does not start while an import holds the import lock, the job is then skipped
+		ctx, release, err := process.LockImport(ctx, dbs.NewSQLRepository(db))
+		if err != nil {
+			return err
+		}
+		defer release()
+		archiveDir := filepath.Join(model.PathVars.DestinationPath, "retention")
+		_, err = retention.Run(ctx, db, model.Settings.Retention, archiveDir, retention.Options{})
+		return err
+	case KindReport:
+		days := job.Days
+		if days <= 0 {
+			days = 1
+		}
+		today := time.Now()
+		_, err := report.Rebuild(ctx, db, today.AddDate(0, 0, 1-days), today.AddDate(0, 0, 1))
+		return err
+	}
+	return apperr.New(apperr.ConfigInvalid, "schedule.RunJob", fmt.Sprintf("unknown job kind %q", job.Kind))
+}
+
+// runImport imports from the configured source, a remote source is connected to for each run
+func runImport(ctx context.Context, db *sqlx.DB) error {
+	var opts process.Options
+	if source.IsRemote(model.Settings.Source) {
+		src, err := source.Open(ctx, model.Settings.Source)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		opts.Source = src
+	}
+	return process.Process(ctx, model.PathVars.CSVPath, dbs.NewSQLRepository(db), opts)
+}
+
+func timeZone(settings model.ScheduleSettings) string {
+	if settings.TimeZone != "" {
+		return settings.TimeZone
+	}
+	return defaultTimeZone
+}
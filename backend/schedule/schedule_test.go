@@ -0,0 +1,171 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	dbs "github.com/pienaahj/rmsloader/backend/db"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// sqliteDB opens a new sqlite database for one test
+func sqliteDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	store, err := dbs.Open(context.Background(), dbs.DriverSQLite, filepath.Join(t.TempDir(), "schedule.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DB().Close() })
+	return store.DB()
+}
+
+var importJob = model.ScheduledJob{Name: "import", Kind: KindImport, Cron: "*/15 * * * *"}
+
+func TestExecuteRecordsRuns(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	s, err := New(db, model.ScheduleSettings{Jobs: []model.ScheduledJob{importJob}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcomes := []error{nil, errors.New("disk full")}
+	s.Run = func(ctx context.Context, db *sqlx.DB, job model.ScheduledJob) error {
+		err := outcomes[0]
+		outcomes = outcomes[1:]
+		return err
+	}
+	for range 2 {
+		s.Execute(ctx, importJob, time.Now())
+	}
+	runs, err := dbs.ListJobRuns(ctx, db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("recorded %d runs, want 2", len(runs))
+	}
+	// newest first
+	if r := runs[0]; r.Status != model.JobFailed || r.Error != "disk full" || r.FinishedAt == nil || r.Job != "import" {
+		t.Errorf("failed run recorded as %+v", r)
+	}
+	if r := runs[1]; r.Status != model.JobSucceeded || r.Error != "" || r.FinishedAt == nil {
+		t.Errorf("succeeded run recorded as %+v", r)
+	}
+}
+
+func TestExecuteSkipsLockedJob(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	s, err := New(db, model.ScheduleSettings{Jobs: []model.ScheduledJob{importJob}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ran bool
+	s.Run = func(ctx context.Context, db *sqlx.DB, job model.ScheduledJob) error {
+		ran = true
+		return nil
+	}
+	if taken, err := dbs.TryLock(ctx, db, "schedule:import", "other:1", time.Hour); err != nil || !taken {
+		t.Fatalf("the other loader could not take the lock: %v", err)
+	}
+	run, err := s.Execute(ctx, importJob, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ran || run.Status != model.JobSkipped {
+		t.Errorf("a locked job ran %v with status %s, want skipped", ran, run.Status)
+	}
+	if err := dbs.Unlock(ctx, db, "schedule:import", "other:1"); err != nil {
+		t.Fatal(err)
+	}
+	if run, err := s.Execute(ctx, importJob, time.Now()); err != nil || !ran || run.Status != model.JobSucceeded {
+		t.Errorf("after the unlock the job ran %v with %+v, %v", ran, run, err)
+	}
+}
+
+func TestExecuteSkipsWhileAnotherImportRuns(t *testing.T) {
+	db := sqliteDB(t)
+	s, err := New(db, model.ScheduleSettings{Jobs: []model.ScheduledJob{importJob}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Run = func(ctx context.Context, db *sqlx.DB, job model.ScheduledJob) error {
+		return apperr.New(apperr.DBLocked, "test", "another import is running")
+	}
+	if run, _ := s.Execute(context.Background(), importJob, time.Now()); run.Status != model.JobSkipped {
+		t.Errorf("an import behind the import lock was recorded as %s, want skipped", run.Status)
+	}
+}
+
+func TestRetentionWaitsForImportLock(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	saved := model.Settings
+	t.Cleanup(func() { model.Settings = saved })
+	model.Settings.Lock = model.LockSettings{Enabled: true}
+	lock, err := dbs.AcquireImportLock(ctx, db, dbs.DefaultLockName, dbs.LockHolder(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release(ctx)
+	job := model.ScheduledJob{Name: "retention", Kind: KindRetention, Cron: "@daily"}
+	if err := RunJob(ctx, db, job); !errors.Is(err, apperr.ErrDBLocked) {
+		t.Errorf("a purge during an import gave %v, want DB_LOCKED", err)
+	}
+}
+
+func TestLockExpires(t *testing.T) {
+	db := sqliteDB(t)
+	ctx := context.Background()
+	if taken, err := dbs.TryLock(ctx, db, "schedule:import", "a:1", -time.Second); err != nil || !taken {
+		t.Fatalf("a could not take the lock: %v", err)
+	}
+	// the lock of a died loader has run out and is taken over
+	if taken, err := dbs.TryLock(ctx, db, "schedule:import", "b:2", time.Hour); err != nil || !taken {
+		t.Fatalf("b could not take the expired lock: %v", err)
+	}
+	if taken, err := dbs.TryLock(ctx, db, "schedule:import", "a:1", time.Hour); err != nil || taken {
+		t.Errorf("a took the lock b holds: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings model.ScheduleSettings
+		ok       bool
+	}{
+		{"jobs", model.ScheduleSettings{Jobs: []model.ScheduledJob{importJob, {Name: "report", Kind: KindReport, Cron: "@daily"}}}, true},
+		{"bad cron", model.ScheduleSettings{Jobs: []model.ScheduledJob{{Name: "import", Kind: KindImport, Cron: "every minute"}}}, false},
+		{"unknown kind", model.ScheduleSettings{Jobs: []model.ScheduledJob{{Name: "backup", Kind: "backup", Cron: "@daily"}}}, false},
+		{"twice", model.ScheduleSettings{Jobs: []model.ScheduledJob{importJob, importJob}}, false},
+		{"bad time zone", model.ScheduleSettings{TimeZone: "Mars/Olympus"}, false},
+	}
+	for _, tt := range tests {
+		if err := Validate(tt.settings); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	s, err := New(nil, model.ScheduleSettings{TimeZone: "UTC", Jobs: []model.ScheduledJob{
+		{Name: "retention", Kind: KindRetention, Cron: "30 2 * * *"},
+		importJob,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 10, 5, 0, 0, time.UTC)
+	planned := s.Next(now)
+	if len(planned) != 2 || planned[0].Job.Name != "import" || !planned[0].Next.Equal(time.Date(2024, 3, 1, 10, 15, 0, 0, time.UTC)) ||
+		!planned[1].Next.Equal(time.Date(2024, 3, 2, 2, 30, 0, 0, time.UTC)) {
+		t.Errorf("planned %+v", planned)
+	}
+}
@@ -0,0 +1,232 @@
+// Package secrets reads passwords and other credentials. A secret NAME is looked up, in order, in the file
+// named by NAME_FILE, in NAME, in the secret mounts of Docker and Kubernetes and in the encrypted secrets file.
+// Only the names of secrets and where they were found are ever logged, never their values.
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// the defaults of the secrets settings
+const (
+	defaultDir    = "/run/secrets"
+	defaultKeyEnv = "RMSLOADER_SECRETS_KEY"
+)
+
+// the sizes of the secretbox key and nonce
+const (
+	keySize   = 32
+	nonceSize = 24
+)
+
+// Get returns the secret name, it fails with CONFIG_INVALID when the secret is not set anywhere
+func Get(name string) (string, error) {
+	value, source, err := Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if source == "" {
+		return "", apperr.New(apperr.ConfigInvalid, "secrets.Get", "secret "+name+" is not set")
+	}
+	return value, nil
+}
+
+// GetOr returns the secret name, or def when it is not set anywhere
+func GetOr(name string, def string) (string, error) {
+	value, source, err := Lookup(name)
+	if err != nil || source == "" {
+		return def, err
+	}
+	return value, nil
+}
+
+// Lookup returns the secret name and where it was found, the source is empty when it is not set anywhere
+func Lookup(name string) (string, string, error) {
+	value, source, err := lookup(name)
+	if err != nil {
+		return "", "", apperr.Wrap(apperr.ConfigInvalid, "secrets.Lookup "+name, err)
+	}
+	if source != "" {
+		li.Logger.L.WithFields(logrus.Fields{
+			"secret": name,
+			"source": source,
+		}).Debug("secret read")
+	}
+	return value, source, nil
+}
+
+func lookup(name string) (string, string, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		value, err := readSecretFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("reading %s_FILE: %w", name, err)
+		}
+		return value, "file " + path, nil
+	}
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value, "env " + name, nil
+	}
+	for _, dir := range dirs() {
+		// docker secrets are usually named in lower case
+		for _, file := range []string{name, strings.ToLower(name)} {
+			path := filepath.Join(dir, file)
+			value, err := readSecretFile(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return "", "", err
+			}
+			return value, "file " + path, nil
+		}
+	}
+	if path := model.Settings.Secrets.File; path != "" {
+		values, err := readEncrypted(path)
+		if err != nil {
+			return "", "", err
+		}
+		if value, ok := values[name]; ok {
+			return value, "encrypted file " + path, nil
+		}
+	}
+	return "", "", nil
+}
+
+// readSecretFile reads a secret mounted as a file, without the trailing line break editors add
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// readEncrypted opens the encrypted secrets file with the key from the environment
+func readEncrypted(path string) (map[string]string, error) {
+	key, err := Key()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading the secrets file: %w", err)
+	}
+	plain, err := Open(key, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var values map[string]string
+	if err := json.Unmarshal(plain, &values); err != nil {
+		return nil, fmt.Errorf("%s does not hold a json object of secrets: %w", path, err)
+	}
+	return values, nil
+}
+
+func dirs() []string {
+	if len(model.Settings.Secrets.Dirs) > 0 {
+		return model.Settings.Secrets.Dirs
+	}
+	return []string{defaultDir}
+}
+
+// KeyEnv returns the environment variable holding the key of the secrets file
+func KeyEnv() string {
+	if name := model.Settings.Secrets.KeyEnv; name != "" {
+		return name
+	}
+	return defaultKeyEnv
+}
+
+// Key returns the key of the secrets file, the base64 encoding of 32 bytes in the key environment variable
+func Key() (*[keySize]byte, error) {
+	name := KeyEnv()
+	encoded := os.Getenv(name)
+	if encoded == "" {
+		return nil, fmt.Errorf("%s holds no key for the secrets file", name)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != keySize {
+		return nil, fmt.Errorf("%s must hold %d base64 encoded bytes", name, keySize)
+	}
+	var key [keySize]byte
+	copy(key[:], raw)
+	return &key, nil
+}
+
+// GenerateKey returns a new random key, base64 encoded for the key environment variable
+func GenerateKey() (string, error) {
+	var key [keySize]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key[:]), nil
+}
+
+// Seal encrypts plain with a NaCl secretbox, the random nonce is written in front of the box
+func Seal(key *[keySize]byte, plain []byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], plain, &nonce, key), nil
+}
+
+// Open decrypts a box written by Seal
+func Open(key *[keySize]byte, box []byte) ([]byte, error) {
+	if len(box) < nonceSize+secretbox.Overhead {
+		return nil, errors.New("the secrets file is too short")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], box[:nonceSize])
+	plain, ok := secretbox.Open(nil, box[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.New("cannot decrypt the secrets file, the key is wrong or the file was changed")
+	}
+	return plain, nil
+}
+
+// SealFile encrypts a json object of secrets with the key from the environment and writes it to out,
+// readable by the owner only. It returns the names of the secrets sealed.
+func SealFile(in string, out string) ([]string, error) {
+	key, err := Key()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.ConfigInvalid, "secrets.SealFile", err)
+	}
+	plain, err := os.ReadFile(in)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.IOOpen, "secrets.SealFile", err)
+	}
+	var values map[string]string
+	if err := json.Unmarshal(plain, &values); err != nil {
+		return nil, apperr.Wrap(apperr.ConfigInvalid, "secrets.SealFile", fmt.Errorf("%s does not hold a json object of secrets: %w", in, err))
+	}
+	box, err := Seal(key, plain)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(out, box, 0o600); err != nil {
+		return nil, apperr.Wrap(apperr.IOWrite, "secrets.SealFile", err)
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
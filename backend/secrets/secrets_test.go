@@ -0,0 +1,230 @@
+package secrets
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+const testKeyEnv = "RMSLOADER_TEST_SECRETS_KEY"
+
+// testSettings points the secrets settings at a new mount folder for one test and returns it.
+// The key of the encrypted file is set in the environment.
+func testSettings(t *testing.T) string {
+	t.Helper()
+	saved := model.Settings
+	t.Cleanup(func() { model.Settings = saved })
+	dir := t.TempDir()
+	mounts := filepath.Join(dir, "mounts")
+	if err := os.Mkdir(mounts, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	model.Settings.Secrets = model.SecretsSettings{
+		Dirs:   []string{mounts},
+		KeyEnv: testKeyEnv,
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(testKeyEnv, key)
+	return mounts
+}
+
+// writeFile writes a secret file
+func writeFile(t *testing.T, path string, value string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(value), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sealValues writes the encrypted secrets file holding a json object and sets it in the settings
+func sealValues(t *testing.T, json string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+	if _, err := SealFile(writeTemp(t, json), path); err != nil {
+		t.Fatal(err)
+	}
+	model.Settings.Secrets.File = path
+}
+
+func TestLookupOrder(t *testing.T) {
+	const name = "RMSLOADER_TEST_DB_PASSWORD"
+	tests := []struct {
+		name      string
+		file      bool
+		env       string
+		mount     string
+		lower     bool
+		encrypted bool
+		want      string
+		source    string
+	}{
+		{"nowhere", false, "", "", false, false, "", ""},
+		{"encrypted file", false, "", "", false, true, "from-encrypted", "encrypted file"},
+		{"mount before encrypted file", false, "", "from-mount", false, true, "from-mount", "file "},
+		{"lower case mount", false, "", "from-mount", true, false, "from-mount", "file "},
+		{"env before mount", false, "from-env", "from-mount", false, true, "from-env", "env " + name},
+		{"file before env", true, "from-env", "from-mount", false, true, "from-file", "file "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mounts := testSettings(t)
+			t.Setenv(name+"_FILE", "")
+			t.Setenv(name, tt.env)
+			if tt.file {
+				path := filepath.Join(t.TempDir(), "password")
+				writeFile(t, path, "from-file\n")
+				t.Setenv(name+"_FILE", path)
+			}
+			if tt.mount != "" {
+				file := name
+				if tt.lower {
+					file = strings.ToLower(name)
+				}
+				writeFile(t, filepath.Join(mounts, file), tt.mount+"\r\n")
+			}
+			if tt.encrypted {
+				sealValues(t, `{"`+name+`": "from-encrypted"}`)
+			}
+
+			value, source, err := Lookup(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != tt.want || !strings.HasPrefix(source, tt.source) || (tt.source == "") != (source == "") {
+				t.Errorf("Lookup = %q from %q, want %q from %q", value, source, tt.want, tt.source)
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	testSettings(t)
+	t.Setenv("RMSLOADER_TEST_TOKEN", "")
+	if _, err := Get("RMSLOADER_TEST_TOKEN"); apperr.CodeOf(err) != apperr.ConfigInvalid {
+		t.Errorf("Get of a missing secret failed with %v", err)
+	}
+	if value, err := GetOr("RMSLOADER_TEST_TOKEN", "default"); err != nil || value != "default" {
+		t.Errorf("GetOr of a missing secret = %q, %v", value, err)
+	}
+	t.Setenv("RMSLOADER_TEST_TOKEN", "set")
+	if value, err := Get("RMSLOADER_TEST_TOKEN"); err != nil || value != "set" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+}
+
+func TestLookupFailures(t *testing.T) {
+	const name = "RMSLOADER_TEST_API_TOKEN"
+	t.Run("missing _FILE", func(t *testing.T) {
+		testSettings(t)
+		t.Setenv(name+"_FILE", filepath.Join(t.TempDir(), "missing"))
+		if _, _, err := Lookup(name); apperr.CodeOf(err) != apperr.ConfigInvalid {
+			t.Errorf("a missing _FILE failed with %v", err)
+		}
+	})
+	t.Run("wrong key", func(t *testing.T) {
+		testSettings(t)
+		t.Setenv(name, "")
+		sealValues(t, `{"`+name+`": "sealed"}`)
+		key, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(testKeyEnv, key)
+		if _, _, err := Lookup(name); err == nil || !strings.Contains(err.Error(), "key is wrong") {
+			t.Errorf("a wrong key failed with %v", err)
+		}
+	})
+	t.Run("no key", func(t *testing.T) {
+		testSettings(t)
+		t.Setenv(name, "")
+		sealValues(t, `{}`)
+		t.Setenv(testKeyEnv, "")
+		if _, _, err := Lookup(name); apperr.CodeOf(err) != apperr.ConfigInvalid {
+			t.Errorf("a missing key failed with %v", err)
+		}
+	})
+	t.Run("missing encrypted file", func(t *testing.T) {
+		testSettings(t)
+		t.Setenv(name, "")
+		model.Settings.Secrets.File = filepath.Join(t.TempDir(), "missing.enc")
+		if _, _, err := Lookup(name); apperr.CodeOf(err) != apperr.ConfigInvalid {
+			t.Errorf("a missing encrypted file failed with %v", err)
+		}
+	})
+	t.Run("not json", func(t *testing.T) {
+		testSettings(t)
+		if _, err := SealFile(writeTemp(t, "name=value"), filepath.Join(t.TempDir(), "out")); apperr.CodeOf(err) != apperr.ConfigInvalid {
+			t.Errorf("sealing a file that is not json failed with %v", err)
+		}
+	})
+}
+
+// writeTemp writes content to a new file and returns its path
+func writeTemp(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "plain")
+	writeFile(t, path, content)
+	return path
+}
+
+func TestSealOpen(t *testing.T) {
+	testSettings(t)
+	key, err := Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte(`{"DB_PASSWORD": "s3cret"}`)
+	box, err := Seal(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(box, []byte("s3cret")) {
+		t.Fatal("the box holds the plain text")
+	}
+	again, err := Seal(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(box, again) {
+		t.Error("two boxes share the nonce")
+	}
+	got, err := Open(key, box)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+
+	var wrong [keySize]byte
+	copy(wrong[:], key[:])
+	wrong[0] ^= 1
+	if _, err := Open(&wrong, box); err == nil {
+		t.Error("a wrong key opened the box")
+	}
+	for _, i := range []int{0, nonceSize, len(box) - 1} {
+		tampered := bytes.Clone(box)
+		tampered[i] ^= 1
+		if _, err := Open(key, tampered); err == nil {
+			t.Errorf("the box opened with byte %d changed", i)
+		}
+	}
+	if _, err := Open(key, box[:nonceSize]); err == nil {
+		t.Error("a short box opened")
+	}
+}
+
+func TestKey(t *testing.T) {
+	testSettings(t)
+	for _, value := range []string{"", "not base64!", "c2hvcnQ="} {
+		t.Setenv(testKeyEnv, value)
+		if _, err := Key(); err == nil {
+			t.Errorf("the key %q was accepted", value)
+		}
+	}
+}
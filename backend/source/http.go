@@ -0,0 +1,323 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	li "github.com/pienaahj/rmsloader/backend/logwrapper"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/secrets"
+)
+
+// the ways the http source logs in to the recorder
+const (
+	AuthNone   = "none"
+	AuthBasic  = "basic"
+	AuthForm   = "form"
+	AuthBearer = "bearer"
+)
+
+// the defaults of the http source settings
+const (
+	defaultTimeLayout  = "2006-01-02 15:04:05"
+	defaultTimeZone    = "Africa/Johannesburg"
+	defaultMaxPages    = 1000
+	defaultInitialDays = 1
+)
+
+// Windowed is a source that serves the calls of a time window rather than a folder of exports,
+// the import sets the window before it lists the source
+type Windowed interface {
+	Source
+	SetWindow(from time.Time, to time.Time)
+}
+
+// httpSource requests the calls of a window from the web export of the RMS recorder, page by page. Each
+// page is a csv export of its own and is held until it is fetched.
+type httpSource struct {
+	client   *http.Client
+	settings model.HTTPSourceSettings
+	user     string
+	password string
+	token    string
+	from     time.Time
+	to       time.Time
+	pages    map[string][]byte
+}
+
+// dialHTTP returns the http source of the settings, a form login is posted before it is returned
+func dialHTTP(ctx context.Context, settings model.SourceSettings) (Source, error) {
+	op := "source.dialHTTP"
+	s := &httpSource{settings: settings.HTTP, pages: make(map[string][]byte)}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout(settings)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	s.client = &http.Client{Transport: transport, Jar: jar}
+	switch s.auth() {
+	case AuthBasic, AuthForm:
+		if s.user, err = secrets.GetOr("RMS_USERNAME", settings.User); err != nil {
+			return nil, err
+		}
+		if s.password, err = secrets.Get("RMS_PASSWORD"); err != nil {
+			return nil, apperr.Wrap(apperr.ConfigInvalid, op, err)
+		}
+	case AuthBearer:
+		if s.token, err = secrets.Get("RMS_TOKEN"); err != nil {
+			return nil, apperr.Wrap(apperr.ConfigInvalid, op, err)
+		}
+	}
+	if s.auth() == AuthForm {
+		ctx, cancel := context.WithTimeout(ctx, timeout(settings))
+		defer cancel()
+		if err := s.login(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// validateHTTP checks the settings of the http source
+func validateHTTP(settings model.SourceSettings) error {
+	h := settings.HTTP
+	if u, err := url.Parse(h.URL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("the http source needs the http or https url of the export")
+	}
+	switch h.Auth {
+	case "", AuthNone, AuthBasic, AuthBearer:
+	case AuthForm:
+		if h.LoginURL == "" {
+			return errors.New("form auth needs a login_url")
+		}
+	default:
+		return fmt.Errorf("unknown http auth %q, use none, basic, form or bearer", h.Auth)
+	}
+	if settings.AfterImport != "" && settings.AfterImport != AfterKeep {
+		return errors.New("the calls of the http source stay on the recorder, after_import must be keep")
+	}
+	if _, err := time.LoadLocation(orDefault(h.TimeZone, defaultTimeZone)); err != nil {
+		return fmt.Errorf("unknown http time_zone %q", h.TimeZone)
+	}
+	if h.PageSize < 0 || h.FirstPage < 0 || h.MaxPages < 0 || h.InitialDays < 0 {
+		return errors.New("the http page_size, first_page, max_pages and initial_days cannot be negative")
+	}
+	return nil
+}
+
+// login posts the login form, the session cookie it sets is sent with the export requests
+func (s *httpSource) login(ctx context.Context) error {
+	op := "source.httpSource.login"
+	form := url.Values{}
+	form.Set(orDefault(s.settings.UsernameField, "username"), s.user)
+	form.Set(orDefault(s.settings.PasswordField, "password"), s.password)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.settings.LoginURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return apperr.Wrap(apperr.ConfigInvalid, op, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return apperr.Wrap(apperr.IOOpen, op, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return checkStatus(op, resp)
+}
+
+// SetWindow sets the calls the source asks for, from is inclusive and to exclusive. A zero from asks for
+// the initial days before to.
+func (s *httpSource) SetWindow(from time.Time, to time.Time) {
+	if from.IsZero() {
+		days := s.settings.InitialDays
+		if days <= 0 {
+			days = defaultInitialDays
+		}
+		from = to.AddDate(0, 0, -days)
+	}
+	s.from, s.to = from, to
+}
+
+// List requests the pages of the window until one comes back short, every page with calls is a file
+func (s *httpSource) List(ctx context.Context) ([]File, error) {
+	op := "source.httpSource.List"
+	if s.to.IsZero() {
+		s.SetWindow(time.Time{}, time.Now())
+	}
+	maxPages := s.settings.MaxPages
+	if maxPages <= 0 {
+		maxPages = defaultMaxPages
+	}
+	var files []File
+	for n := 0; ; n++ {
+		if n == maxPages {
+			return nil, apperr.New(apperr.ConfigInvalid, op, fmt.Sprintf("the window %s needs more than %d pages, raise http.max_pages", s.window(), maxPages))
+		}
+		page := s.settings.FirstPage + n
+		body, err := s.page(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+		rows := countRows(body)
+		li.Logger.L.WithFields(logrus.Fields{
+			"CallFrom": op,
+			"window":   s.window(),
+			"page":     page,
+			"rows":     rows,
+		}).Debug("rms export page read")
+		if rows == 0 {
+			break
+		}
+		name := fmt.Sprintf("rms-%s-%s-p%04d.csv", s.from.UTC().Format("20060102T150405Z"), s.to.UTC().Format("20060102T150405Z"), n+1)
+		s.pages[name] = body
+		files = append(files, File{Name: name, Path: name, Size: int64(len(body)), ModTime: s.to})
+		if s.settings.PageSize <= 0 || rows < s.settings.PageSize {
+			break
+		}
+	}
+	return files, nil
+}
+
+// page requests one page of the window
+func (s *httpSource) page(ctx context.Context, page int) ([]byte, error) {
+	op := "source.httpSource.page"
+	u, err := url.Parse(s.settings.URL)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.ConfigInvalid, op, err)
+	}
+	loc, err := time.LoadLocation(orDefault(s.settings.TimeZone, defaultTimeZone))
+	if err != nil {
+		return nil, apperr.Wrap(apperr.ConfigInvalid, op, err)
+	}
+	layout := orDefault(s.settings.TimeLayout, defaultTimeLayout)
+	q := u.Query()
+	q.Set(orDefault(s.settings.FromParam, "from"), s.from.In(loc).Format(layout))
+	q.Set(orDefault(s.settings.ToParam, "to"), s.to.In(loc).Format(layout))
+	if s.settings.PageSize > 0 {
+		q.Set(orDefault(s.settings.PageParam, "page"), strconv.Itoa(page))
+		q.Set(orDefault(s.settings.PageSizeParam, "limit"), strconv.Itoa(s.settings.PageSize))
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.ConfigInvalid, op, err)
+	}
+	switch s.auth() {
+	case AuthBasic:
+		req.SetBasicAuth(s.user, s.password)
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.IOOpen, op, err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(op, resp); err != nil {
+		return nil, err
+	}
+	// an expired session is usually answered with the login page
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct == "text/html" {
+		return nil, apperr.New(apperr.IORead, op, "the recorder answered with a web page instead of a csv export, check http.url and the login")
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.IORead, op, err)
+	}
+	return body, nil
+}
+
+// Fetch writes the page into dir, it is then dropped from memory
+func (s *httpSource) Fetch(ctx context.Context, f File, dir string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	body, ok := s.pages[f.Name]
+	if !ok {
+		return "", apperr.New(apperr.IONotFound, "source.httpSource.Fetch", "page "+f.Name+" was not listed")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", apperr.Wrap(apperr.IOCreate, "source.httpSource.Fetch", err)
+	}
+	local := filepath.Join(dir, f.Name)
+	if err := os.WriteFile(local, body, 0o644); err != nil {
+		return "", apperr.Wrap(apperr.IOWrite, "source.httpSource.Fetch", err)
+	}
+	delete(s.pages, f.Name)
+	return local, nil
+}
+
+// Done does nothing, the calls stay on the recorder
+func (s *httpSource) Done(ctx context.Context, f File) error {
+	return nil
+}
+
+// Close drops the pages not fetched and the idle connections
+func (s *httpSource) Close() error {
+	s.pages = make(map[string][]byte)
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func (s *httpSource) String() string {
+	u, err := url.Parse(s.settings.URL)
+	if err != nil {
+		return "rms http export"
+	}
+	return "rms http export " + u.Redacted()
+}
+
+func (s *httpSource) auth() string {
+	return orDefault(s.settings.Auth, AuthNone)
+}
+
+func (s *httpSource) window() string {
+	return s.from.Format(time.RFC3339) + " to " + s.to.Format(time.RFC3339)
+}
+
+// checkStatus turns a failed response into an error, a refused login is a configuration error
+func checkStatus(op string, resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return apperr.New(apperr.ConfigInvalid, op, "the recorder refused the login: "+resp.Status)
+	case resp.StatusCode >= 300:
+		return apperr.New(apperr.IORead, op, "the recorder answered "+resp.Status)
+	}
+	return nil
+}
+
+// countRows counts the calls in a csv page, the header row is not a call
+func countRows(body []byte) int {
+	var rows int
+	for line := range bytes.SplitSeq(body, []byte("\n")) {
+		line = bytes.TrimSpace(bytes.TrimPrefix(line, []byte("\xef\xbb\xbf")))
+		if len(line) == 0 || (rows == 0 && bytes.Contains(line, []byte("Direction"))) {
+			continue
+		}
+		rows++
+	}
+	return rows
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,163 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+const exportHeader = "Direction;Time;Flagged;From;To;Duration;Size;Exists in DB;Local copy;Authentic;File name;SIP Call ID\n"
+
+// rmsStub stands in for the web export of the recorder, it serves rows a page at a time to a user signed in
+// with basic auth or the session cookie of its login form
+type rmsStub struct {
+	rows     []string
+	user     string
+	password string
+	// the query of every export request
+	queries []map[string]string
+}
+
+func (s *rmsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/login" {
+		r.ParseForm()
+		if r.PostForm.Get("user") != s.user || r.PostForm.Get("pass") != s.password {
+			http.Error(w, "wrong password", http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "ok"})
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if cookie, err := r.Cookie("session"); (!ok || user != s.user || password != s.password) && (err != nil || cookie.Value != "ok") {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>please log in</html>"))
+		return
+	}
+	q := map[string]string{}
+	for key := range r.URL.Query() {
+		q[key] = r.URL.Query().Get(key)
+	}
+	s.queries = append(s.queries, q)
+	page, _ := strconv.Atoi(q["page"])
+	limit, _ := strconv.Atoi(q["limit"])
+	start := min((page-1)*limit, len(s.rows))
+	end := min(start+limit, len(s.rows))
+	w.Header().Set("Content-Type", "text/csv")
+	w.Write([]byte(exportHeader + strings.Join(s.rows[start:end], "")))
+}
+
+func exportRows(n int) []string {
+	var rows []string
+	for i := range n {
+		rows = append(rows, "Incoming;2024-03-01 08:15:0"+strconv.Itoa(i)+";No;0821234567;2001;1 min 5 sec;512 KB;Yes;No;Yes;in.wav;call-"+strconv.Itoa(i)+"\n")
+	}
+	return rows
+}
+
+func httpSettings(url string) model.SourceSettings {
+	return model.SourceSettings{Type: TypeHTTP, HTTP: model.HTTPSourceSettings{
+		URL:       url + "/cdr/export?format=csv",
+		Auth:      AuthBasic,
+		PageSize:  2,
+		FirstPage: 1,
+	}}
+}
+
+func TestHTTPListPages(t *testing.T) {
+	stub := &rmsStub{rows: exportRows(5), user: "rms", password: "secret"}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	t.Setenv("RMS_USERNAME", "rms")
+	t.Setenv("RMS_PASSWORD", "secret")
+	ctx := context.Background()
+
+	src, err := Open(ctx, httpSettings(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	to := time.Date(2024, 3, 2, 6, 0, 0, 0, time.UTC)
+	src.(Windowed).SetWindow(time.Time{}, to)
+	files, err := src.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("listed %d pages, want 3", len(files))
+	}
+	q := stub.queries[0]
+	// the window is asked for in the time of the recorder, the initial day before to
+	if q["from"] != "2024-03-01 08:00:00" || q["to"] != "2024-03-02 08:00:00" || q["format"] != "csv" || q["limit"] != "2" {
+		t.Errorf("query %v", q)
+	}
+	dir := t.TempDir()
+	local, err := src.Fetch(ctx, files[2], dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := exportHeader + stub.rows[4]; string(data) != want {
+		t.Errorf("last page %q, want %q", data, want)
+	}
+}
+
+func TestHTTPFormLogin(t *testing.T) {
+	stub := &rmsStub{rows: exportRows(1), user: "rms", password: "secret"}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	settings := httpSettings(server.URL)
+	settings.HTTP.Auth = AuthForm
+	settings.HTTP.LoginURL = server.URL + "/login"
+	settings.HTTP.UsernameField = "user"
+	settings.HTTP.PasswordField = "pass"
+	t.Setenv("RMS_USERNAME", "rms")
+	ctx := context.Background()
+
+	t.Setenv("RMS_PASSWORD", "wrong")
+	if _, err := Open(ctx, settings); !errors.Is(err, apperr.ErrConfigInvalid) {
+		t.Errorf("a refused login gave %v, want CONFIG_INVALID", err)
+	}
+	t.Setenv("RMS_PASSWORD", "secret")
+	src, err := Open(ctx, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	files, err := src.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("listed %d pages, want 1", len(files))
+	}
+}
+
+func TestHTTPRejectsLoginPage(t *testing.T) {
+	stub := &rmsStub{rows: exportRows(1), user: "rms", password: "secret"}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	settings := httpSettings(server.URL)
+	settings.HTTP.Auth = AuthNone
+
+	src, err := Open(context.Background(), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if _, err := src.List(context.Background()); !errors.Is(err, apperr.ErrIORead) {
+		t.Errorf("a login page gave %v, want IO_READ", err)
+	}
+}
@@ -0,0 +1,76 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// ListFunc returns the paths of the exports in a folder
+type ListFunc func(dir string) ([]string, error)
+
+// Local reads the exports in a folder in place
+type Local struct {
+	dir      string
+	list     ListFunc
+	settings model.SourceSettings
+}
+
+// NewLocal returns the source of the exports in dir, listed by list. The after_import of the settings
+// applies to the exports in dir.
+func NewLocal(dir string, settings model.SourceSettings, list ListFunc) *Local {
+	return &Local{dir: dir, list: list, settings: settings}
+}
+
+// List returns the exports in the folder
+func (l *Local) List(ctx context.Context) ([]File, error) {
+	paths, err := l.list(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]File, 0, len(paths))
+	for _, p := range paths {
+		f := File{Name: filepath.Base(p), Path: p}
+		if info, err := os.Stat(p); err == nil {
+			f.Size, f.ModTime = info.Size(), info.ModTime()
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Fetch returns the path of the export, it is read where it is
+func (l *Local) Fetch(ctx context.Context, f File, dir string) (string, error) {
+	return f.Path, ctx.Err()
+}
+
+// Done keeps, deletes or moves the export
+func (l *Local) Done(ctx context.Context, f File) error {
+	switch l.settings.AfterImport {
+	case AfterDelete:
+		if err := os.Remove(f.Path); err != nil {
+			return apperr.Wrap(apperr.IOWrite, "source.Local.Done", err)
+		}
+	case AfterMove:
+		if err := os.MkdirAll(l.settings.MoveTo, 0o755); err != nil {
+			return apperr.Wrap(apperr.IOCreate, "source.Local.Done", err)
+		}
+		if err := os.Rename(f.Path, filepath.Join(l.settings.MoveTo, f.Name)); err != nil {
+			return apperr.Wrap(apperr.IOWrite, "source.Local.Done", err)
+		}
+	}
+	return nil
+}
+
+// Close does nothing for a folder
+func (l *Local) Close() error {
+	return nil
+}
+
+func (l *Local) String() string {
+	return fmt.Sprintf("local folder %s", l.dir)
+}
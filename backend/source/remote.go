@@ -0,0 +1,126 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// remoteFS is the part of an sftp client or an smb share the remote sources use, paths are separated by /
+type remoteFS interface {
+	ReadDir(dir string) ([]os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Remove(name string) error
+	Rename(oldname string, newname string) error
+	MkdirAll(dir string) error
+	Close() error
+}
+
+// remote is a source on a server, the exports are downloaded before they are imported
+type remote struct {
+	fs       remoteFS
+	name     string
+	settings model.SourceSettings
+}
+
+// List returns the csv exports in the remote folder, sub folders are not read
+func (r *remote) List(ctx context.Context) ([]File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries, err := r.fs.ReadDir(r.dir())
+	if err != nil {
+		return nil, apperr.Wrap(apperr.IOPath, "source.List "+r.name, err)
+	}
+	var files []File
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || !isExport(e.Name(), ".csv") {
+			continue
+		}
+		files = append(files, File{
+			Name:    e.Name(),
+			Path:    path.Join(r.dir(), e.Name()),
+			Size:    e.Size(),
+			ModTime: e.ModTime(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// Fetch downloads the export into dir. It is written under a temporary name first, so a broken
+// download is never taken for a complete export.
+func (r *remote) Fetch(ctx context.Context, f File, dir string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", apperr.Wrap(apperr.IOCreate, "source.Fetch", err)
+	}
+	src, err := r.fs.Open(f.Path)
+	if err != nil {
+		return "", apperr.Wrap(apperr.IOOpen, "source.Fetch "+f.Path, err)
+	}
+	defer src.Close()
+	local := filepath.Join(dir, f.Name)
+	tmp, err := os.CreateTemp(dir, f.Name+".part-*")
+	if err != nil {
+		return "", apperr.Wrap(apperr.IOCreate, "source.Fetch", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", apperr.Wrap(apperr.IORead, "source.Fetch "+f.Path, err)
+	}
+	if err := os.Rename(tmp.Name(), local); err != nil {
+		return "", apperr.Wrap(apperr.IOWrite, "source.Fetch", err)
+	}
+	return local, nil
+}
+
+// Done keeps, deletes or moves the remote export
+func (r *remote) Done(ctx context.Context, f File) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	switch r.settings.AfterImport {
+	case AfterDelete:
+		if err := r.fs.Remove(f.Path); err != nil {
+			return apperr.Wrap(apperr.IOWrite, "source.Done "+f.Path, err)
+		}
+	case AfterMove:
+		if err := r.fs.MkdirAll(r.settings.MoveTo); err != nil {
+			return apperr.Wrap(apperr.IOCreate, "source.Done "+r.settings.MoveTo, err)
+		}
+		if err := r.fs.Rename(f.Path, path.Join(r.settings.MoveTo, f.Name)); err != nil {
+			return apperr.Wrap(apperr.IOWrite, "source.Done "+f.Path, err)
+		}
+	}
+	return nil
+}
+
+// Close disconnects from the server
+func (r *remote) Close() error {
+	return r.fs.Close()
+}
+
+func (r *remote) String() string {
+	return fmt.Sprintf("%s %s", r.name, r.dir())
+}
+
+func (r *remote) dir() string {
+	if r.settings.Path == "" {
+		return "."
+	}
+	return r.settings.Path
+}
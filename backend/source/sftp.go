@@ -0,0 +1,153 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/secrets"
+)
+
+// sftpFS adapts an sftp client to the remote sources
+type sftpFS struct {
+	client *sftp.Client
+	// the ssh connection the client runs over, nil when the client was given a pipe
+	conn *ssh.Client
+}
+
+func (s *sftpFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return s.client.ReadDir(dir)
+}
+
+func (s *sftpFS) Open(name string) (io.ReadCloser, error) {
+	return s.client.Open(name)
+}
+
+func (s *sftpFS) Remove(name string) error {
+	return s.client.Remove(name)
+}
+
+// Rename replaces a file of the same name in the target folder, like a local move
+func (s *sftpFS) Rename(oldname string, newname string) error {
+	return s.client.PosixRename(oldname, newname)
+}
+
+func (s *sftpFS) MkdirAll(dir string) error {
+	return s.client.MkdirAll(dir)
+}
+
+func (s *sftpFS) Close() error {
+	err := s.client.Close()
+	if s.conn != nil {
+		if cerr := s.conn.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// newSFTP returns the source reading the exports over an sftp client
+func newSFTP(client *sftp.Client, conn *ssh.Client, name string, settings model.SourceSettings) Source {
+	return &remote{fs: &sftpFS{client: client, conn: conn}, name: name, settings: settings}
+}
+
+// dialSFTP connects to the sftp server of the settings. The user signs in with the SFTP_PASSWORD secret or
+// the key in key_file, and the host key must be listed in known_hosts.
+func dialSFTP(ctx context.Context, settings model.SourceSettings) (Source, error) {
+	op := "source.dialSFTP"
+	user, err := secrets.GetOr("SFTP_USERNAME", settings.User)
+	if err != nil {
+		return nil, err
+	}
+	var auth []ssh.AuthMethod
+	if settings.KeyFile != "" {
+		signer, err := loadKey(settings.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	password, err := secrets.GetOr("SFTP_PASSWORD", "")
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, apperr.New(apperr.ConfigInvalid, op, "the sftp source needs a key_file or the SFTP_PASSWORD secret")
+	}
+	hostsFile := settings.KnownHosts
+	if hostsFile == "" {
+		home, _ := os.UserHomeDir()
+		hostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(hostsFile)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.ConfigInvalid, op+" known_hosts", err)
+	}
+	addr := withPort(settings.Host, "22")
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         timeout(settings),
+	}
+	dialer := net.Dialer{Timeout: timeout(settings)}
+	tcp, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.IOOpen, op+" "+addr, err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(tcp, addr, config)
+	if err != nil {
+		tcp.Close()
+		return nil, apperr.Wrap(apperr.IOOpen, op+" "+addr, err)
+	}
+	conn := ssh.NewClient(sshConn, chans, reqs)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, apperr.Wrap(apperr.IOOpen, op+" "+addr, err)
+	}
+	return newSFTP(client, conn, fmt.Sprintf("sftp://%s@%s", user, addr), settings), nil
+}
+
+// loadKey reads the private key of the sftp user, an encrypted key is opened with the SFTP_KEY_PASSPHRASE secret
+func loadKey(file string) (ssh.Signer, error) {
+	op := "source.loadKey"
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.IOOpen, op, err)
+	}
+	passphrase, err := secrets.GetOr("SFTP_KEY_PASSPHRASE", "")
+	if err != nil {
+		return nil, err
+	}
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pem)
+	}
+	if err != nil {
+		return nil, apperr.Wrap(apperr.ConfigInvalid, op+" "+file, err)
+	}
+	return signer, nil
+}
+
+// withPort adds the default port to a host without one
+func withPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,131 @@
+package source
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// sftpStandIn serves root over sftp in memory and returns a source reading it, no ssh server is needed
+func sftpStandIn(t *testing.T, root string, settings model.SourceSettings) Source {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn, sftp.WithServerWorkingDirectory(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := newSFTP(client, nil, "sftp stand-in", settings)
+	t.Cleanup(func() {
+		src.Close()
+		server.Close()
+	})
+	return src
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSFTPListFetchMove(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, filepath.Join(root, "exports"), map[string]string{
+		"b.csv":       "second",
+		"a.CSV":       "first",
+		"notes.txt":   "not an export",
+		".hidden.csv": "hidden",
+	})
+	ctx := context.Background()
+	src := sftpStandIn(t, root, model.SourceSettings{Type: TypeSFTP, Path: "exports", AfterImport: AfterMove, MoveTo: "done"})
+
+	files, err := src.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "a.CSV" || files[1].Name != "b.csv" || files[0].Path != "exports/a.CSV" {
+		t.Fatalf("listed %+v, want a.CSV and b.csv", files)
+	}
+
+	dir := filepath.Join(t.TempDir(), "fetch")
+	local, err := src.Fetch(ctx, files[1], dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(local); string(got) != "second" || local != filepath.Join(dir, "b.csv") {
+		t.Errorf("fetched %q to %s", got, local)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("fetch left %d files in %s, want only the download", len(entries), dir)
+	}
+
+	if err := src.Done(ctx, files[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "done", "b.csv")); err != nil {
+		t.Errorf("b.csv was not moved: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "exports", "b.csv")); !os.IsNotExist(err) {
+		t.Errorf("b.csv is still in the exports folder: %v", err)
+	}
+}
+
+func TestSFTPDelete(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.csv": "first"})
+	ctx := context.Background()
+	src := sftpStandIn(t, root, model.SourceSettings{Type: TypeSFTP, AfterImport: AfterDelete})
+
+	files, err := src.List(ctx)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("listed %+v, %v", files, err)
+	}
+	if err := src.Done(ctx, files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.csv")); !os.IsNotExist(err) {
+		t.Errorf("a.csv was not deleted: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings model.SourceSettings
+		ok       bool
+	}{
+		{"local", model.SourceSettings{}, true},
+		{"sftp", model.SourceSettings{Type: TypeSFTP, Host: "rms"}, true},
+		{"sftp without host", model.SourceSettings{Type: TypeSFTP}, false},
+		{"smb without share", model.SourceSettings{Type: TypeSMB, Host: "rms"}, false},
+		{"unknown type", model.SourceSettings{Type: "ftp", Host: "rms"}, false},
+		{"move without folder", model.SourceSettings{AfterImport: AfterMove}, false},
+		{"unknown after import", model.SourceSettings{AfterImport: "archive"}, false},
+		{"http", model.SourceSettings{Type: TypeHTTP, HTTP: model.HTTPSourceSettings{URL: "https://rms/export"}}, true},
+		{"http without url", model.SourceSettings{Type: TypeHTTP}, false},
+		{"http form without login", model.SourceSettings{Type: TypeHTTP, HTTP: model.HTTPSourceSettings{URL: "https://rms/export", Auth: AuthForm}}, false},
+		{"http moving the calls", model.SourceSettings{Type: TypeHTTP, AfterImport: AfterDelete, HTTP: model.HTTPSourceSettings{URL: "https://rms/export"}}, false},
+	}
+	for _, tt := range tests {
+		if err := Validate(tt.settings); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
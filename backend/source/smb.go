@@ -0,0 +1,90 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/hirochachacha/go-smb2"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+	"github.com/pienaahj/rmsloader/backend/secrets"
+)
+
+// smbFS adapts a mounted smb share to the remote sources
+type smbFS struct {
+	share   *smb2.Share
+	session *smb2.Session
+	conn    net.Conn
+}
+
+func (s *smbFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return s.share.ReadDir(dir)
+}
+
+func (s *smbFS) Open(name string) (io.ReadCloser, error) {
+	return s.share.Open(name)
+}
+
+func (s *smbFS) Remove(name string) error {
+	return s.share.Remove(name)
+}
+
+func (s *smbFS) Rename(oldname string, newname string) error {
+	return s.share.Rename(oldname, newname)
+}
+
+func (s *smbFS) MkdirAll(dir string) error {
+	return s.share.MkdirAll(dir, 0o755)
+}
+
+func (s *smbFS) Close() error {
+	err := s.share.Umount()
+	if lerr := s.session.Logoff(); err == nil {
+		err = lerr
+	}
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// dialSMB mounts the smb share of the settings as the SMB_USERNAME user with the SMB_PASSWORD secret
+func dialSMB(ctx context.Context, settings model.SourceSettings) (Source, error) {
+	op := "source.dialSMB"
+	user, err := secrets.GetOr("SMB_USERNAME", settings.User)
+	if err != nil {
+		return nil, err
+	}
+	password, err := secrets.Get("SMB_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	addr := withPort(settings.Host, "445")
+	ctx, cancel := context.WithTimeout(ctx, timeout(settings))
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.IOOpen, op+" "+addr, err)
+	}
+	d := &smb2.Dialer{
+		Initiator: &smb2.NTLMInitiator{User: user, Password: password, Domain: settings.Domain},
+	}
+	session, err := d.DialContext(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, apperr.Wrap(apperr.IOOpen, op+" "+addr, err)
+	}
+	share, err := session.Mount(settings.Share)
+	if err != nil {
+		session.Logoff()
+		conn.Close()
+		return nil, apperr.Wrap(apperr.IOOpen, op+" "+settings.Share, err)
+	}
+	fs := &smbFS{share: share, session: session, conn: conn}
+	return &remote{fs: fs, name: fmt.Sprintf("smb://%s@%s/%s", user, addr, settings.Share), settings: settings}, nil
+}
@@ -0,0 +1,125 @@
+// Package source finds the RMS csv exports the import reads: in a local folder, on an SFTP server, on an
+// SMB share or in the web export of the recorder. Remote exports are downloaded to the temp storage first,
+// and after a successful import the exports in a folder can be kept, deleted or moved aside.
+package source
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pienaahj/rmsloader/backend/apperr"
+	"github.com/pienaahj/rmsloader/backend/model"
+)
+
+// the types of source
+const (
+	TypeLocal = "local"
+	TypeSFTP  = "sftp"
+	TypeSMB   = "smb"
+	TypeHTTP  = "http"
+)
+
+// what happens to an export once it is imported
+const (
+	AfterKeep   = "keep"
+	AfterDelete = "delete"
+	AfterMove   = "move"
+)
+
+// the longest file name RMS writes, longer names are not exports
+const maxNameLength = 100
+
+// defaultTimeout is the time allowed to connect to a remote source
+const defaultTimeout = 30 * time.Second
+
+// File is an export offered by a source
+type File struct {
+	// the base name of the file
+	Name string
+	// the path of the file in the source
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Source lists the exports and hands them to the import as local files
+type Source interface {
+	// List returns the csv exports waiting to be imported, in name order
+	List(ctx context.Context) ([]File, error)
+	// Fetch returns the path of a local copy of f, remote files are downloaded into dir
+	Fetch(ctx context.Context, f File, dir string) (string, error)
+	// Done keeps, deletes or moves f after it was imported
+	Done(ctx context.Context, f File) error
+	// Close disconnects from the source
+	Close() error
+	// String names the source in the logs, without credentials
+	String() string
+}
+
+// IsRemote reports whether the settings name a remote source, the local source reads csv_path
+func IsRemote(settings model.SourceSettings) bool {
+	return settings.Type != "" && settings.Type != TypeLocal
+}
+
+// Open connects to the remote source of the settings
+func Open(ctx context.Context, settings model.SourceSettings) (Source, error) {
+	if err := Validate(settings); err != nil {
+		return nil, err
+	}
+	switch settings.Type {
+	case TypeSFTP:
+		return dialSFTP(ctx, settings)
+	case TypeSMB:
+		return dialSMB(ctx, settings)
+	case TypeHTTP:
+		return dialHTTP(ctx, settings)
+	}
+	return nil, apperr.New(apperr.ConfigInvalid, "source.Open", fmt.Sprintf("source %q is not a remote source", settings.Type))
+}
+
+// Validate checks the source settings before anything is connected to
+func Validate(settings model.SourceSettings) error {
+	invalid := func(msg string) error {
+		return apperr.New(apperr.ConfigInvalid, "source.Validate", msg)
+	}
+	switch settings.Type {
+	case "", TypeLocal:
+	case TypeSFTP, TypeSMB:
+		if settings.Host == "" {
+			return invalid("the " + settings.Type + " source needs a host")
+		}
+		if settings.Type == TypeSMB && settings.Share == "" {
+			return invalid("the smb source needs a share")
+		}
+	case TypeHTTP:
+		if err := validateHTTP(settings); err != nil {
+			return invalid(err.Error())
+		}
+	default:
+		return invalid(fmt.Sprintf("unknown source type %q, use local, sftp, smb or http", settings.Type))
+	}
+	switch settings.AfterImport {
+	case "", AfterKeep, AfterDelete:
+	case AfterMove:
+		if settings.MoveTo == "" {
+			return invalid("after_import move needs a move_to folder")
+		}
+	default:
+		return invalid(fmt.Sprintf("unknown after_import %q, use keep, delete or move", settings.AfterImport))
+	}
+	return nil
+}
+
+// isExport reports whether a file name can be an RMS export with extension ext
+func isExport(name string, ext string) bool {
+	return name != "" && name[0] != '.' && len(name) <= maxNameLength && strings.HasSuffix(strings.ToLower(name), ext)
+}
+
+func timeout(settings model.SourceSettings) time.Duration {
+	if settings.TimeoutSeconds > 0 {
+		return time.Duration(settings.TimeoutSeconds) * time.Second
+	}
+	return defaultTimeout
+}
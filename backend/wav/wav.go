@@ -0,0 +1,212 @@
+// Package wav reads the RIFF/WAVE header of a recording without decoding the audio
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// wave format tags as found in the fmt chunk
+const (
+	FormatPCM        uint16 = 0x0001
+	FormatADPCM      uint16 = 0x0002
+	FormatIEEEFloat  uint16 = 0x0003
+	FormatALaw       uint16 = 0x0006
+	FormatMuLaw      uint16 = 0x0007
+	FormatIMAADPCM   uint16 = 0x0011
+	FormatG723ADPCM  uint16 = 0x0014
+	FormatGSM610     uint16 = 0x0031
+	FormatG721ADPCM  uint16 = 0x0040
+	FormatMPEG       uint16 = 0x0050
+	FormatMP3        uint16 = 0x0055
+	FormatG726ADPCM  uint16 = 0x0064
+	FormatG722ADPCM  uint16 = 0x0065
+	FormatExtensible uint16 = 0xFFFE
+)
+
+// codecNames maps the format tags to readable codec names
+var codecNames = map[uint16]string{
+	FormatPCM:       "pcm",
+	FormatADPCM:     "ms-adpcm",
+	FormatIEEEFloat: "ieee-float",
+	FormatALaw:      "g711-alaw",
+	FormatMuLaw:     "g711-ulaw",
+	FormatIMAADPCM:  "ima-adpcm",
+	FormatG723ADPCM: "g723-adpcm",
+	FormatGSM610:    "gsm610",
+	FormatG721ADPCM: "g721-adpcm",
+	FormatMPEG:      "mpeg",
+	FormatMP3:       "mp3",
+	FormatG726ADPCM: "g726-adpcm",
+	FormatG722ADPCM: "g722-adpcm",
+}
+
+// ErrNotWave is returned when the file is not a RIFF/WAVE file
+var ErrNotWave = errors.New("wav: not a RIFF/WAVE file")
+
+// ErrNoFormat is returned when the file has no fmt chunk before the data chunk
+var ErrNoFormat = errors.New("wav: missing fmt chunk")
+
+// ErrNoData is returned when the file ends before a data chunk
+var ErrNoData = errors.New("wav: missing data chunk")
+
+// maxFormatSize is the part of the fmt chunk read, the size of WAVEFORMATEXTENSIBLE. The chunk size comes
+// from the file and may be anything up to 4 GiB, the rest of a longer chunk is skipped.
+const maxFormatSize = 40
+
+// Info represents the header details of a wav recording
+type Info struct {
+	AudioFormat   uint16
+	Codec         string
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+	// the number of bytes of audio in the data chunk
+	DataSize int64
+	// the number of samples per channel from the fact chunk, zero if absent
+	Samples uint32
+	// the exact length of the audio
+	Duration time.Duration
+}
+
+// CodecName returns the readable name of a wave format tag
+func CodecName(format uint16) string {
+	if name, ok := codecNames[format]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", format)
+}
+
+// ReadFile reads the header of the wav file at path
+func ReadFile(path string) (Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Info{}, err
+	}
+	defer f.Close()
+	return ReadInfo(f)
+}
+
+// ReadInfo walks the RIFF chunks in r and returns the format details and audio length.
+// Only the chunk headers and the fmt and fact chunks are read, the audio data is skipped.
+// A file without a fmt chunk before its data chunk, or without a data chunk, is not a recording.
+func ReadInfo(r io.ReadSeeker) (Info, error) {
+	var info Info
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return info, fmt.Errorf("wav: reading riff header: %w", err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return info, ErrNotWave
+	}
+
+	var haveFormat, haveData bool
+	var offset int64 = 12
+	for !haveData {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return info, fmt.Errorf("wav: reading chunk header: %w", err)
+		}
+		offset += 8
+		id := string(header[0:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return info, fmt.Errorf("wav: fmt chunk too short: %d bytes", size)
+			}
+			chunk := make([]byte, min(size, maxFormatSize))
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return info, fmt.Errorf("wav: reading fmt chunk: %w", err)
+			}
+			if _, err := r.Seek(size-int64(len(chunk)), io.SeekCurrent); err != nil {
+				return info, err
+			}
+			info.AudioFormat = binary.LittleEndian.Uint16(chunk[0:2])
+			info.Channels = binary.LittleEndian.Uint16(chunk[2:4])
+			info.SampleRate = binary.LittleEndian.Uint32(chunk[4:8])
+			info.ByteRate = binary.LittleEndian.Uint32(chunk[8:12])
+			info.BlockAlign = binary.LittleEndian.Uint16(chunk[12:14])
+			info.BitsPerSample = binary.LittleEndian.Uint16(chunk[14:16])
+			// the extensible format carries the real format tag in the sub format guid
+			if info.AudioFormat == FormatExtensible && size >= 26 {
+				info.AudioFormat = binary.LittleEndian.Uint16(chunk[24:26])
+			}
+			info.Codec = CodecName(info.AudioFormat)
+			haveFormat = true
+			offset += size
+		case "fact":
+			if size >= 4 {
+				var samples [4]byte
+				if _, err := io.ReadFull(r, samples[:]); err != nil {
+					return info, fmt.Errorf("wav: reading fact chunk: %w", err)
+				}
+				info.Samples = binary.LittleEndian.Uint32(samples[:])
+				if _, err := r.Seek(size-4, io.SeekCurrent); err != nil {
+					return info, err
+				}
+			} else if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+				return info, err
+			}
+			offset += size
+		case "data":
+			info.DataSize = size
+			// streamed recordings leave the size unset, use what is in the file
+			if size == 0 || size == 0xFFFFFFFF {
+				end, err := r.Seek(0, io.SeekEnd)
+				if err != nil {
+					return info, err
+				}
+				info.DataSize = end - offset
+			}
+			haveData = true
+		default:
+			if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+				return info, err
+			}
+			offset += size
+		}
+		// chunks are word aligned
+		if !haveData && size%2 == 1 {
+			if _, err := r.Seek(1, io.SeekCurrent); err != nil {
+				return info, err
+			}
+			offset++
+		}
+	}
+	if !haveFormat {
+		return info, ErrNoFormat
+	}
+	if !haveData {
+		return info, ErrNoData
+	}
+	info.Duration = info.duration()
+	return info, nil
+}
+
+// duration works out the audio length, compressed formats prefer the fact chunk sample count
+func (i Info) duration() time.Duration {
+	switch i.AudioFormat {
+	case FormatPCM, FormatIEEEFloat, FormatALaw, FormatMuLaw:
+		if i.ByteRate > 0 {
+			return time.Duration(uint64(i.DataSize) * uint64(time.Second) / uint64(i.ByteRate))
+		}
+	}
+	if i.Samples > 0 && i.SampleRate > 0 {
+		return time.Duration(uint64(i.Samples) * uint64(time.Second) / uint64(i.SampleRate))
+	}
+	if i.ByteRate > 0 {
+		return time.Duration(uint64(i.DataSize) * uint64(time.Second) / uint64(i.ByteRate))
+	}
+	return 0
+}
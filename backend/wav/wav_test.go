@@ -0,0 +1,129 @@
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// chunk is a RIFF chunk with the size written in its header, which may differ from the body
+type chunk struct {
+	id   string
+	size uint32
+	body []byte
+}
+
+// riff builds a RIFF/WAVE file of the chunks, the bodies of odd sizes are padded
+func riff(chunks ...chunk) *bytes.Reader {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(0))
+	b.WriteString("WAVE")
+	for _, c := range chunks {
+		b.WriteString(c.id)
+		binary.Write(&b, binary.LittleEndian, c.size)
+		b.Write(c.body)
+		if len(c.body)%2 == 1 {
+			b.WriteByte(0)
+		}
+	}
+	return bytes.NewReader(b.Bytes())
+}
+
+// body returns a chunk with the size of its body
+func body(id string, data []byte) chunk {
+	return chunk{id: id, size: uint32(len(data)), body: data}
+}
+
+// format returns the body of a fmt chunk
+func format(tag uint16, channels uint16, rate uint32, bits uint16) []byte {
+	align := channels * bits / 8
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, tag)
+	binary.Write(&b, binary.LittleEndian, channels)
+	binary.Write(&b, binary.LittleEndian, rate)
+	binary.Write(&b, binary.LittleEndian, rate*uint32(align))
+	binary.Write(&b, binary.LittleEndian, align)
+	binary.Write(&b, binary.LittleEndian, bits)
+	return b.Bytes()
+}
+
+// ulaw is the fmt chunk of 8 kHz mono G.711 u-law, 8000 bytes a second
+var ulaw = body("fmt ", format(FormatMuLaw, 1, 8000, 8))
+
+func TestReadInfo(t *testing.T) {
+	extensible := append(format(FormatExtensible, 1, 8000, 16), make([]byte, 24)...)
+	binary.LittleEndian.PutUint16(extensible[16:], 22)
+	binary.LittleEndian.PutUint16(extensible[24:], FormatPCM)
+	fact := make([]byte, 4)
+	binary.LittleEndian.PutUint32(fact, 16000)
+
+	tests := []struct {
+		name     string
+		file     *bytes.Reader
+		codec    string
+		duration time.Duration
+	}{
+		{"pcm", riff(body("fmt ", format(FormatPCM, 2, 8000, 16)), body("data", make([]byte, 64000))),
+			"pcm", 2 * time.Second},
+		{"chunks before fmt and odd padding", riff(body("LIST", make([]byte, 7)), ulaw, body("data", make([]byte, 4000))),
+			"g711-ulaw", 500 * time.Millisecond},
+		{"long fmt chunk", riff(body("fmt ", append(format(FormatMuLaw, 1, 8000, 8), make([]byte, 1000)...)), body("data", make([]byte, 8000))),
+			"g711-ulaw", time.Second},
+		{"extensible", riff(body("fmt ", extensible), body("data", make([]byte, 16000))),
+			"pcm", time.Second},
+		{"fact samples", riff(body("fmt ", format(FormatGSM610, 1, 8000, 0)), body("fact", fact), body("data", make([]byte, 3250))),
+			"gsm610", 2 * time.Second},
+		{"streamed data size", riff(ulaw, chunk{id: "data", size: 0xFFFFFFFF, body: make([]byte, 12000)}),
+			"g711-ulaw", 1500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ReadInfo(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Codec != tt.codec || info.Duration != tt.duration {
+				t.Errorf("ReadInfo = %s for %s, want %s for %s", info.Codec, info.Duration, tt.codec, tt.duration)
+			}
+		})
+	}
+}
+
+func TestReadInfoInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file *bytes.Reader
+		want error
+	}{
+		{"not riff", bytes.NewReader([]byte("OggS\x00\x00\x00\x00WAVE")), ErrNotWave},
+		{"no data chunk", riff(ulaw), ErrNoData},
+		{"data size past the end", riff(ulaw, chunk{id: "LIST", size: 1 << 20}), ErrNoData},
+		{"data before fmt", riff(body("data", make([]byte, 8000)), ulaw), ErrNoFormat},
+		{"no chunks", riff(), ErrNoFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadInfo(tt.file); !errors.Is(err, tt.want) {
+				t.Errorf("ReadInfo failed with %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadInfoHugeFormatChunk(t *testing.T) {
+	// a fmt chunk claiming 4 GiB must not be read into memory
+	file := riff(chunk{id: "fmt ", size: 0xFFFFFFFE, body: format(FormatPCM, 1, 8000, 16)})
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := ReadInfo(file); err == nil {
+		t.Error("a truncated fmt chunk was read")
+	}
+	runtime.ReadMemStats(&after)
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20 {
+		t.Errorf("reading the header allocated %d bytes", grown)
+	}
+}